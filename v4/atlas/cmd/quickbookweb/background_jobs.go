@@ -0,0 +1,116 @@
+package main
+
+import (
+	"atlas"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// shutdownTimeout is how long Serve waits for the requests in flight when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+// BackgroundJobs holds what the jobs the server runs next to its handlers need. A job is only started when its
+// dependencies are set, and intervals left at 0 get their default.
+type BackgroundJobs struct {
+	// RunQBTokenRefresher
+	TokenDB       atlas.QBOrgTokenDB
+	OAuthConfig   *oauth2.Config
+	TokenInterval time.Duration
+	TokenWindow   time.Duration
+
+	// RunQBDepartmentSync and RunQBCDCPoller call Quickbooks with QBClients.
+	QBClients          QBClientSource
+	DepartmentDB       atlas.QBDepartmentSyncDB
+	DepartmentInterval time.Duration
+
+	// RunQBWebhookWorkers
+	WebhookQueue     *QBWebhookQueue
+	WebhookProcessor QBWebhookProcessor
+
+	// RunQBCDCPoller queues the changes it finds on WebhookQueue.
+	CDCDB       atlas.QBCDCDB
+	CDCInterval time.Duration
+
+	// RunQBCallbackDeliveries
+	CallbackSender *QBCallbackSender
+}
+
+// StartBackgroundJobs starts the background jobs, each in its own goroutine, and returns a function that stops
+// them and waits for them to return.
+func (a *App) StartBackgroundJobs(jobs BackgroundJobs) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	start := func(name string, run func(ctx context.Context)) {
+		a.Logr.Log("starting %s", name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx)
+		}()
+	}
+	orDefault := func(d, def time.Duration) time.Duration {
+		if d <= 0 {
+			return def
+		}
+		return d
+	}
+
+	if jobs.TokenDB != nil && jobs.OAuthConfig != nil {
+		interval, window := orDefault(jobs.TokenInterval, 5*time.Minute), orDefault(jobs.TokenWindow, 15*time.Minute)
+		start("quickbooks token refresher", func(ctx context.Context) {
+			a.RunQBTokenRefresher(ctx, jobs.TokenDB, jobs.OAuthConfig, interval, window)
+		})
+	}
+	if jobs.DepartmentDB != nil && jobs.QBClients != nil {
+		interval := orDefault(jobs.DepartmentInterval, time.Hour)
+		start("quickbooks department sync", func(ctx context.Context) {
+			a.RunQBDepartmentSync(ctx, jobs.DepartmentDB, jobs.QBClients, interval)
+		})
+	}
+	if jobs.WebhookQueue != nil && jobs.WebhookProcessor != nil {
+		start("quickbooks webhook workers", func(ctx context.Context) {
+			a.RunQBWebhookWorkers(ctx, jobs.WebhookQueue, jobs.WebhookProcessor)
+		})
+	}
+	if jobs.CDCDB != nil && jobs.QBClients != nil && jobs.WebhookQueue != nil {
+		interval := orDefault(jobs.CDCInterval, 15*time.Minute)
+		start("quickbooks change data capture poller", func(ctx context.Context) {
+			a.RunQBCDCPoller(ctx, jobs.CDCDB, jobs.QBClients, jobs.WebhookQueue, interval)
+		})
+	}
+	if jobs.CallbackSender != nil {
+		start("callback deliveries", func(ctx context.Context) {
+			a.RunQBCallbackDeliveries(ctx, jobs.CallbackSender)
+		})
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// Serve starts the background jobs and serves srv until ctx is done, then shuts srv down, giving the requests in
+// flight shutdownTimeout to finish, and stops the jobs.
+func (a *App) Serve(ctx context.Context, srv *http.Server, jobs BackgroundJobs) error {
+	stop := a.StartBackgroundJobs(jobs)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	a.Logr.Log("shutting down the server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
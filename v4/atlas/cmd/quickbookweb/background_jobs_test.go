@@ -0,0 +1,95 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+// listingQBOrgTokenDB tells when the token refresher lists the orgs.
+type listingQBOrgTokenDB struct {
+	MockQBOrgTokenDB
+	listed chan struct{}
+}
+
+func (db *listingQBOrgTokenDB) GetAllQBOrgs() ([]*atlas.QBOrg, error) {
+	select {
+	case db.listed <- struct{}{}:
+	default:
+	}
+	return db.MockQBOrgTokenDB.GetAllQBOrgs()
+}
+
+func TestStartBackgroundJobs(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	tokenDB := &listingQBOrgTokenDB{listed: make(chan struct{}, 1)}
+	q := main.NewQBWebhookQueue(&MockQBWebhookEventDB{})
+	_, err := q.Enqueue(org1.ID, org1.QBCompanyID, webhookPayload(org1.QBCompanyID))
+	ok(t, err)
+	processed := make(chan int, 1)
+
+	stop := app.StartBackgroundJobs(main.BackgroundJobs{
+		TokenDB:      tokenDB,
+		OAuthConfig:  newTestOAuth2Config("http://localhost/token"),
+		WebhookQueue: q,
+		WebhookProcessor: func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+			processed <- e.ID
+			return nil
+		},
+		CallbackSender: main.NewQBCallbackSender(&MockQBCallbackDB{}, newTestSecretBox(t)),
+	})
+	select {
+	case <-tokenDB.listed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the token refresher to run")
+	}
+	select {
+	case id := <-processed:
+		equals(t, 1, id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the webhook workers to run")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the background jobs to stop")
+	}
+}
+
+func TestServe(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	tokenDB := &listingQBOrgTokenDB{listed: make(chan struct{}, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: okHandler}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- app.Serve(ctx, srv, main.BackgroundJobs{
+			TokenDB:     tokenDB,
+			OAuthConfig: newTestOAuth2Config("http://localhost/token"),
+		})
+	}()
+	select {
+	case <-tokenDB.listed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the token refresher to run")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		ok(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the server to shut down")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+)
+
+const (
+	csrfTokenKeyName = "csrf_token"
+	csrfFormField    = "csrf_token"
+	csrfHeader       = "X-CSRF-Token"
+)
+
+// CSRFMiddleware gives every web session a CSRF token and rejects unsafe requests that do not send it back,
+// either in the csrf_token form field or the X-CSRF-Token header. Handlers read the token with CSRFToken
+// to put it in their localPresenter.
+func (a *App) CSRFMiddleware(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		// a session that fails to decode is replaced by a new one, which gets a new token below
+		session, _ := a.Store.Get(req, sessionName)
+		token, _ := session.Values[csrfTokenKeyName].(string)
+		if token == "" {
+			var err error
+			token, err = rotateCSRFToken(session.Values)
+			if err != nil {
+				a.Logr.Log("error generating csrf token: %s", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			err = session.Save(req, w)
+			if err != nil {
+				a.Logr.Log("error saving csrf token: %s", err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+		default:
+			sent := req.Header.Get(csrfHeader)
+			if sent == "" {
+				sent = req.PostFormValue(csrfFormField)
+			}
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				a.Logr.Log("csrf token mismatch for %s %s from %s", req.Method, req.URL.Path, remoteIP(req))
+				a.renderCSRFError(w, req, token)
+				return
+			}
+		}
+
+		ctx := context.WithValue(req.Context(), csrfTokenKeyName, token)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// CSRFToken returns the CSRF token CSRFMiddleware gave the request, to be rendered into forms.
+func CSRFToken(req *http.Request) string {
+	token, _ := req.Context().Value(csrfTokenKeyName).(string)
+	return token
+}
+
+// rotateCSRFToken puts a new CSRF token in the values of a session and returns it. The caller saves the
+// session.
+func rotateCSRFToken(values map[interface{}]interface{}) (string, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	values[csrfTokenKeyName] = token
+	return token, nil
+}
+
+// renderCSRFError renders the page shown when a form was posted without a valid CSRF token.
+func (a *App) renderCSRFError(w http.ResponseWriter, req *http.Request, token string) {
+	u, _ := getUser(req)
+	lp := &localPresenter{
+		PageTitle:       "Form expired",
+		PageURL:         req.URL.Path,
+		User:            u,
+		GlobalPresenter: a.Gp,
+		CSRFToken:       token,
+	}
+	a.Rndr.HTML(w, http.StatusForbidden, "csrf_error", lp)
+}
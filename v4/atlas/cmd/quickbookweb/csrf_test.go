@@ -0,0 +1,64 @@
+package main_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	h := app.CSRFMiddleware(okHandler)
+
+	test := GenerateHandleTester(t, h, true)
+	w := test("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	assert(t, len(w.HeaderMap["Set-Cookie"]) > 0, "expected session cookie holding the CSRF token to be set")
+
+	// no token
+	w = test("POST", url.Values{"name": {"x"}})
+	equals(t, http.StatusForbidden, w.Code)
+
+	// wrong token
+	w = test("POST", url.Values{"csrf_token": {"forged"}})
+	equals(t, http.StatusForbidden, w.Code)
+
+	test = GenerateHandleTesterWithCSRF(t, okHandler, true)
+	w = test("POST", url.Values{"name": {"x"}})
+	equals(t, http.StatusOK, w.Code)
+}
+
+func TestLogoutHandlerCSRF(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	lp := app.Wrap(app.LogoutHandler(&MockQBUserDB{}))
+
+	test := GenerateHandleTester(t, app.CSRFMiddleware(lp), true)
+	w := test("POST", url.Values{})
+	equals(t, http.StatusForbidden, w.Code)
+
+	test = GenerateHandleTesterWithCSRF(t, lp, true)
+	w = test("POST", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+}
+
+func TestLoginRotatesCSRFToken(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	var token string
+	capture := app.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = main.CSRFToken(req)
+	}))
+	w := GenerateHandleTester(t, capture, false)("GET", url.Values{})
+	before := token
+	assert(t, before != "", "expected CSRF token to be issued")
+
+	lp := app.CSRFMiddleware(app.Wrap(app.LoginPostHandler(&MockQBUserDB{}, newTestLoginGuard())))
+	test := GenerateHandleTesterWithHeaders(t, lp, false, nil, map[string]string{"Cookie": lastCookie(w)}, nil)
+	w = test("POST", url.Values{"email": {user1.Email}, "password": {user1.Password}, "csrf_token": {before}})
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+
+	test = GenerateHandleTesterWithHeaders(t, capture, false, nil, map[string]string{"Cookie": lastCookie(w)}, nil)
+	test("GET", url.Values{})
+	assert(t, token != "" && token != before, "expected login to give the session a new CSRF token")
+}
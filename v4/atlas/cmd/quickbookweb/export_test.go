@@ -0,0 +1,23 @@
+package main
+
+import (
+	"atlas"
+	"net/http"
+)
+
+// AllowPrivateAddresses turns the public address checks on or off, since test servers listen on the loopback
+// address.
+func AllowPrivateAddresses(allow bool) {
+	allowPrivateAddresses = allow
+}
+
+// Guard returns the handler of the route behind its access check, without the session and CSRF middleware.
+func (a *App) Guard(rt Route, sessions atlas.AtlasSessionDB, roles atlas.QBUserRoleDB) http.Handler {
+	return a.guard(rt, sessions, roles)
+}
+
+// SaveTOTPSecret and TOTPSecretFor keep the secret of an unfinished TOTP enrolment in session values.
+var (
+	SaveTOTPSecret = saveTOTPSecret
+	TOTPSecretFor  = totpSecretFor
+)
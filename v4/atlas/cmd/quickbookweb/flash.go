@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/gob"
+	"net/http"
+)
+
+// FlashKind is the kind of a flash message, which decides how it is displayed.
+type FlashKind string
+
+// Kinds of flash messages.
+const (
+	FlashSuccess FlashKind = "success"
+	FlashWarning FlashKind = "warning"
+	FlashError   FlashKind = "error"
+)
+
+const formStateKeyName = "form_state"
+
+// Flash is a message shown once on the next page the user sees.
+type Flash struct {
+	Kind    FlashKind
+	Message string
+}
+
+// AlertClass returns the bootstrap alert class for the flash.
+func (f Flash) AlertClass() string {
+	switch f.Kind {
+	case FlashSuccess:
+		return "alert-success"
+	case FlashError:
+		return "alert-danger"
+	}
+	return "alert-warning"
+}
+
+// String returns the message, so that templates printing a flash with {{ . }} show its text rather than the
+// struct.
+func (f Flash) String() string {
+	return f.Message
+}
+
+// FormState carries the submitted values and per-field errors of a form across the redirect back to it.
+type FormState struct {
+	Values map[string]string
+	Errors map[string]string
+}
+
+// Value returns the submitted value of a field.
+func (f FormState) Value(name string) string {
+	return f.Values[name]
+}
+
+// Error returns the validation error of a field, or "" if it is valid.
+func (f FormState) Error(name string) string {
+	return f.Errors[name]
+}
+
+// HasErrors reports whether any field is invalid.
+func (f FormState) HasErrors() bool {
+	return len(f.Errors) > 0
+}
+
+func init() {
+	gob.Register(Flash{})
+	gob.Register(FormState{})
+}
+
+func (a *App) getFlashes(w http.ResponseWriter, req *http.Request) []Flash {
+	session, _ := a.Store.Get(req, sessionName)
+	var fs []Flash
+	for _, f := range session.Flashes() {
+		if flash, ok := f.(Flash); ok {
+			fs = append(fs, flash)
+		}
+	}
+
+	session.Save(req, w)
+	return fs
+}
+
+func (a *App) saveFlash(w http.ResponseWriter, req *http.Request, kind FlashKind, msg string) error {
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return err
+	}
+	session.AddFlash(Flash{Kind: kind, Message: msg})
+	err = session.Save(req, w)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// getFormState returns the state of the form submitted before the redirect to this page, if any.
+func (a *App) getFormState(w http.ResponseWriter, req *http.Request) FormState {
+	session, _ := a.Store.Get(req, sessionName)
+	fs, ok := session.Values[formStateKeyName].(FormState)
+	if !ok {
+		return FormState{}
+	}
+	delete(session.Values, formStateKeyName)
+	session.Save(req, w)
+	return fs
+}
+
+// saveFormState keeps the state of a form for the page it is redirected back to.
+func (a *App) saveFormState(w http.ResponseWriter, req *http.Request, fs FormState) error {
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return err
+	}
+	session.Values[formStateKeyName] = fs
+	return session.Save(req, w)
+}
+
+// formError flashes an error and keeps the form state before redirecting back to the form at url.
+func (a *App) formError(w http.ResponseWriter, req *http.Request, fs FormState, url string) {
+	a.saveFlash(w, req, FlashError, "Please correct the errors below")
+	a.saveFormState(w, req, fs)
+	http.Redirect(w, req, url, http.StatusFound)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/asaskevich/govalidator"
+)
+
+// parseForm fills the struct pointed to by dst from the request form and validates it.
+//
+// Each field is read from the form value named by its `form` tag, trimmed, and converted to the field's
+// type (string, int or bool, where a checked checkbox is true). The `validate` tag lists comma separated
+// rules: required, email, min=N and max=N (length in characters), and eqfield=Other. Error messages use the
+// `label` tag, or the field name. A "secret" option on the form tag (`form:"password,secret"`) keeps the
+// value out of the returned FormState so it is never sent back to the browser.
+//
+// The returned FormState holds the submitted values and per-field errors, ready for saveFormState. An error is
+// returned when a `validate` tag names an unknown rule, which is a bug in the form struct.
+func parseForm(req *http.Request, dst interface{}) (FormState, bool, error) {
+	fs := FormState{Values: map[string]string{}, Errors: map[string]string{}}
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, secret := parseFormTag(sf.Tag.Get("form"))
+		if name == "" {
+			continue
+		}
+		raw := req.FormValue(name)
+		if sf.Type.Kind() != reflect.String || !secret {
+			raw = strings.TrimSpace(raw)
+		}
+		if !secret {
+			fs.Values[name] = raw
+		}
+
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(raw)
+		case reflect.Bool:
+			f.SetBool(raw == "on" || raw == "true" || raw == "1")
+		case reflect.Int:
+			if raw == "" {
+				continue
+			}
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				fs.Errors[name] = fmt.Sprintf("%s has to be a number", fieldLabel(sf))
+				continue
+			}
+			f.SetInt(int64(n))
+		}
+	}
+
+	errs, err := validateForm(dst)
+	if err != nil {
+		return fs, false, err
+	}
+	for name, msg := range errs {
+		if _, ok := fs.Errors[name]; !ok {
+			fs.Errors[name] = msg
+		}
+	}
+	return fs, len(fs.Errors) == 0, nil
+}
+
+// validateForm checks the `validate` tags of the struct pointed to by src and returns the first error of each
+// invalid field, keyed by its form name.
+func validateForm(src interface{}) (map[string]string, error) {
+	errs := map[string]string{}
+	v := reflect.ValueOf(src).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		rules := sf.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name, _ := parseFormTag(sf.Tag.Get("form"))
+		if name == "" {
+			name = sf.Name
+		}
+		msg, err := checkRules(v, v.Field(i), sf, rules)
+		if err != nil {
+			return nil, err
+		}
+		if msg != "" {
+			errs[name] = msg
+		}
+	}
+	return errs, nil
+}
+
+// checkRules returns the message of the first rule the field breaks, "" if it breaks none.
+func checkRules(parent, f reflect.Value, sf reflect.StructField, rules string) (string, error) {
+	label := fieldLabel(sf)
+	for _, rule := range strings.Split(rules, ",") {
+		rule, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			rule, arg = rule[:i], rule[i+1:]
+		}
+
+		switch rule {
+		case "required":
+			if isZero(f) {
+				return fmt.Sprintf("%s cannot be empty", label), nil
+			}
+		case "email":
+			if f.String() != "" && !govalidator.IsEmail(f.String()) {
+				return fmt.Sprintf("%s has to be a valid email address", label), nil
+			}
+		case "min":
+			n, _ := strconv.Atoi(arg)
+			if utf8.RuneCountInString(f.String()) < n {
+				return fmt.Sprintf("%s has to be at least %d characters long", label, n), nil
+			}
+		case "max":
+			n, _ := strconv.Atoi(arg)
+			if utf8.RuneCountInString(f.String()) > n {
+				return fmt.Sprintf("%s cannot be longer than %d characters", label, n), nil
+			}
+		case "eqfield":
+			other := parent.FieldByName(arg)
+			if !other.IsValid() || other.Interface() != f.Interface() {
+				return fmt.Sprintf("%s does not match", label), nil
+			}
+		default:
+			return "", fmt.Errorf("unknown validation rule %q on field %s", rule, sf.Name)
+		}
+	}
+	return "", nil
+}
+
+func parseFormTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	secret := false
+	for _, opt := range parts[1:] {
+		if opt == "secret" {
+			secret = true
+		}
+	}
+	return parts[0], secret
+}
+
+func fieldLabel(sf reflect.StructField) string {
+	if l := sf.Tag.Get("label"); l != "" {
+		return l
+	}
+	return sf.Name
+}
+
+func isZero(f reflect.Value) bool {
+	switch f.Kind() {
+	case reflect.String:
+		return f.String() == ""
+	case reflect.Int:
+		return f.Int() == 0
+	case reflect.Bool:
+		return !f.Bool()
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"atlas"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditActionLockout = "login_lockout"
+	auditActionUnlock  = "login_unlock"
+)
+
+// LoginGuard slows down and locks out repeated failed logins, per account and per IP address.
+// After FreeFailures failures every further attempt has to wait twice as long as the previous one, up to
+// MaxDelay, and after MaxAccountFailures (or MaxIPFailures) the account (or IP) is locked for LockDuration.
+// Wrong TOTP codes are counted apart, per user, and lock the second step after MaxTOTPFailures; a correct
+// password does not clear them.
+type LoginGuard struct {
+	store atlas.QBLoginAttemptDB
+	audit atlas.QBAuditDB
+
+	FreeFailures       int
+	MaxDelay           time.Duration
+	MaxAccountFailures int
+	MaxIPFailures      int
+	MaxTOTPFailures    int
+	LockDuration       time.Duration
+	Window             time.Duration
+}
+
+// NewLoginGuard returns a LoginGuard with the default limits. Use a MemoryLoginAttemptStore on a single node
+// and the database on a cluster.
+func NewLoginGuard(store atlas.QBLoginAttemptDB, audit atlas.QBAuditDB) *LoginGuard {
+	return &LoginGuard{
+		store:              store,
+		audit:              audit,
+		FreeFailures:       3,
+		MaxDelay:           30 * time.Second,
+		MaxAccountFailures: 10,
+		MaxIPFailures:      50,
+		MaxTOTPFailures:    5,
+		LockDuration:       15 * time.Minute,
+		Window:             time.Hour,
+	}
+}
+
+func accountAttemptKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+func totpAttemptKey(userID int) string {
+	return "totp:" + strconv.Itoa(userID)
+}
+
+// Wait returns how long the account and IP have to wait before they may try to log in again, 0 if they may now.
+func (g *LoginGuard) Wait(email, ip string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for _, key := range []string{accountAttemptKey(email), ipAttemptKey(ip)} {
+		at, err := g.store.GetQBLoginAttempt(key)
+		if err != nil {
+			return 0, err
+		}
+		if d := g.wait(at, now); d > wait {
+			wait = d
+		}
+	}
+	return wait, nil
+}
+
+func (g *LoginGuard) wait(at *atlas.QBLoginAttempt, now time.Time) time.Duration {
+	if now.Before(at.LockedUntil) {
+		return at.LockedUntil.Sub(now)
+	}
+	if at.Failures <= g.FreeFailures || now.Sub(at.LastFailure) > g.Window {
+		return 0
+	}
+	delay := g.MaxDelay
+	if n := uint(at.Failures - g.FreeFailures - 1); n < 16 {
+		if d := time.Second << n; d < delay {
+			delay = d
+		}
+	}
+	if d := at.LastFailure.Add(delay).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Fail records a failed login, locking the account or IP when it crosses its limit.
+func (g *LoginGuard) Fail(email, ip string, now time.Time) error {
+	err := g.recordFailure(accountAttemptKey(email), g.MaxAccountFailures, ip, now)
+	if err != nil {
+		return err
+	}
+	return g.recordFailure(ipAttemptKey(ip), g.MaxIPFailures, ip, now)
+}
+
+func (g *LoginGuard) recordFailure(key string, max int, ip string, now time.Time) error {
+	at, err := g.store.RecordQBLoginFailure(key, now, g.Window)
+	if err != nil {
+		return err
+	}
+	if at.Failures < max || now.Before(at.LockedUntil) {
+		return nil
+	}
+	err = g.store.LockQBLoginAttempt(key, now.Add(g.LockDuration))
+	if err != nil {
+		return err
+	}
+	return g.audit.CreateQBAuditEntry(atlas.QBAuditEntry{Action: auditActionLockout, Target: key, IP: ip, DateCreated: now})
+}
+
+// Succeed clears the failures of the account after a successful login.
+func (g *LoginGuard) Succeed(email string) error {
+	return g.store.DeleteQBLoginAttempt(accountAttemptKey(email))
+}
+
+// TOTPWait returns how long a user is locked out of the TOTP step, 0 if they may enter a code now.
+func (g *LoginGuard) TOTPWait(userID int, now time.Time) (time.Duration, error) {
+	at, err := g.store.GetQBLoginAttempt(totpAttemptKey(userID))
+	if err != nil {
+		return 0, err
+	}
+	if now.Before(at.LockedUntil) {
+		return at.LockedUntil.Sub(now), nil
+	}
+	return 0, nil
+}
+
+// FailTOTP records a wrong TOTP code, locking the TOTP step of the user when it crosses MaxTOTPFailures.
+func (g *LoginGuard) FailTOTP(userID int, ip string, now time.Time) error {
+	return g.recordFailure(totpAttemptKey(userID), g.MaxTOTPFailures, ip, now)
+}
+
+// SucceedTOTP clears the wrong TOTP codes of the user after a correct one.
+func (g *LoginGuard) SucceedTOTP(userID int) error {
+	return g.store.DeleteQBLoginAttempt(totpAttemptKey(userID))
+}
+
+// Unlock lifts the lockout of an account on behalf of an admin.
+func (g *LoginGuard) Unlock(email string, adminID int, ip string) error {
+	key := accountAttemptKey(email)
+	err := g.store.DeleteQBLoginAttempt(key)
+	if err != nil {
+		return err
+	}
+	return g.audit.CreateQBAuditEntry(atlas.QBAuditEntry{UserID: adminID, Action: auditActionUnlock, Target: key, IP: ip, DateCreated: time.Now()})
+}
+
+// MemoryLoginAttemptStore keeps login attempts in memory, for single node deployments and tests.
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]atlas.QBLoginAttempt
+}
+
+// NewMemoryLoginAttemptStore returns an empty MemoryLoginAttemptStore.
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{attempts: make(map[string]atlas.QBLoginAttempt)}
+}
+
+// GetQBLoginAttempt returns the attempts recorded for key.
+func (s *MemoryLoginAttemptStore) GetQBLoginAttempt(key string) (*atlas.QBLoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.attempts[key]
+	if !ok {
+		at = atlas.QBLoginAttempt{Key: key}
+	}
+	return &at, nil
+}
+
+// RecordQBLoginFailure counts a failure for key.
+func (s *MemoryLoginAttemptStore) RecordQBLoginFailure(key string, now time.Time, window time.Duration) (*atlas.QBLoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := s.attempts[key]
+	at.Key = key
+	if now.Sub(at.LastFailure) > window {
+		at.Failures = 0
+	}
+	at.Failures++
+	at.LastFailure = now
+	s.attempts[key] = at
+	return &at, nil
+}
+
+// LockQBLoginAttempt locks key until the given time.
+func (s *MemoryLoginAttemptStore) LockQBLoginAttempt(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at := s.attempts[key]
+	at.Key = key
+	at.LockedUntil = until
+	s.attempts[key] = at
+	return nil
+}
+
+// DeleteQBLoginAttempt forgets everything recorded for key.
+func (s *MemoryLoginAttemptStore) DeleteQBLoginAttempt(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
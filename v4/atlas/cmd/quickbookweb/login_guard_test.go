@@ -0,0 +1,115 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBAuditDB struct {
+	hasError bool
+	entries  []atlas.QBAuditEntry
+}
+
+func (db *MockQBAuditDB) CreateQBAuditEntry(e atlas.QBAuditEntry) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.entries = append(db.entries, e)
+	return nil
+}
+
+func newTestLoginGuard() *main.LoginGuard {
+	return main.NewLoginGuard(main.NewMemoryLoginAttemptStore(), &MockQBAuditDB{})
+}
+
+func TestLoginGuard(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	audit := &MockQBAuditDB{}
+	g := main.NewLoginGuard(main.NewMemoryLoginAttemptStore(), audit)
+	now := time.Now()
+	email, ip := "someone@floatingcube.com", "10.0.0.1"
+
+	for i := 0; i < g.FreeFailures; i++ {
+		ok(t, g.Fail(email, ip, now))
+	}
+	wait, err := g.Wait(email, ip, now)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	// delays double after the free failures
+	ok(t, g.Fail(email, ip, now))
+	wait, err = g.Wait(email, ip, now)
+	ok(t, err)
+	equals(t, time.Second, wait)
+	ok(t, g.Fail(email, ip, now))
+	wait, err = g.Wait(email, ip, now)
+	ok(t, err)
+	equals(t, 2*time.Second, wait)
+
+	// locked out after too many failures
+	for i := g.FreeFailures + 2; i < g.MaxAccountFailures; i++ {
+		ok(t, g.Fail(email, ip, now))
+	}
+	wait, err = g.Wait(email, ip, now)
+	ok(t, err)
+	equals(t, g.LockDuration, wait)
+	equals(t, 1, len(audit.entries))
+	equals(t, "account:"+email, audit.entries[0].Target)
+
+	// other accounts from another IP are not affected
+	wait, err = g.Wait("other@floatingcube.com", "10.0.0.2", now)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	ok(t, g.Unlock(email, user1.ID, "10.0.0.3"))
+	equals(t, 2, len(audit.entries))
+	equals(t, user1.ID, audit.entries[1].UserID)
+	wait, err = g.Wait(email, "10.0.0.2", now)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+}
+
+func TestLoginPostHandlerLockout(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	g := newTestLoginGuard()
+	g.FreeFailures = 100
+	g.MaxAccountFailures = 3
+	mockDB := &MockQBUserDB{}
+	test := GenerateHandleTester(t, app.Wrap(app.LoginPostHandler(mockDB, g)), false)
+
+	for i := 0; i < 3; i++ {
+		w := test("POST", url.Values{"email": {user3.Email}, "password": {"wrong"}})
+		equals(t, http.StatusFound, w.Code)
+	}
+	w := test("POST", url.Values{"email": {user1.Email}, "password": {user1.Password}})
+	equals(t, http.StatusFound, w.Code)
+	assert(t, len(w.HeaderMap["Set-Cookie"]) > 0, "expected other accounts to still log in.")
+
+	w = test("POST", url.Values{"email": {user3.Email}, "password": {user1.Password}})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, []int{user1.ID}, mockDB.sessionUserIDs)
+
+	// a cashier cannot unlock their shop manager
+	userParams := httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: "3"}}
+	unlock := GenerateHandleTesterAsUser(t, app.Wrap(app.UserUnlockPostHandler(&MockQBUserDB{}, g)), user4, userParams)
+	w = unlock("POST", url.Values{})
+	equals(t, http.StatusForbidden, w.Code)
+	wait, err := g.Wait(user3.Email, "", time.Now())
+	ok(t, err)
+	assert(t, wait > 0, "expected user to stay locked out")
+
+	unlock = GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserUnlockPostHandler(&MockQBUserDB{}, g)), true, userParams)
+	w = unlock("POST", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+	wait, err = g.Wait(user3.Email, "", time.Now())
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+// Mailer sends emails to users.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends plain text emails through an SMTP server.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer returns a Mailer for the SMTP server at host:port using PLAIN auth.
+func NewSMTPMailer(host string, port int, username, password, from string) *SMTPMailer {
+	return &SMTPMailer{
+		Addr: fmt.Sprintf("%s:%d", host, port),
+		From: from,
+		Auth: smtp.PlainAuth("", username, password, host),
+	}
+}
+
+// Send sends a plain text email.
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+	msg := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(msg))
+}
+
+// Mail is an email kept by MemoryMailer.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer keeps emails in memory instead of sending them, for tests and local development.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+// Send records the email.
+func (m *MemoryMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, Mail{To: to, Subject: subject, Body: body})
+	return nil
+}
+
+// Sent returns the emails sent so far.
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
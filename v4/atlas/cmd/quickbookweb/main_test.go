@@ -45,8 +45,9 @@ var org1 = atlas.QBOrg{
 	QBID:               123,
 	QBDepositAccountID: "321",
 	QBCompanyID:        "193514527926034",
-	QBCredToken:        "qyprdLazLx1P4ilJuXLKAyRKmWSK10Ol7d62xdPNfTefkbum",
-	QBCredSecret:       "RDFyX1zqZcelY3iCq5JFsD9Z1s2wB4iUvas3MiHi",
+	QBAccessToken:      "eyJlbmMiOiJBMTI4Q0JDLUhTMjU2IiwiYWxnIjoiZGlyIn0",
+	QBRefreshToken:     "AB11599412470qUbZIFTzw8XAH7xq2ZnoTvI1BVr5ZgGnQmWvS",
+	QBTokenExpiry:      time.Now().Add(time.Hour),
 	QBWebHookToken:     "4e4c499b-8854-46fc-a1df-f7519abcb745",
 }
 var shop1 = atlas.QBShop{
@@ -113,6 +114,72 @@ func GenerateHandleTesterWithURLParams(
 	}
 }
 
+// GenerateHandleTesterAsUser returns a HandleTester
+// that serves requests as the given user
+func GenerateHandleTesterAsUser(
+	t *testing.T,
+	handleFunc http.Handler,
+	user *atlas.QBUser,
+	httpRouterParams httprouter.Params,
+) HandleTester {
+	return func(method string, params url.Values) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "", strings.NewReader(params.Encode()))
+		ok(t, err)
+		req.Header.Set(
+			"Content-Type",
+			"application/x-www-form-urlencoded; param=value",
+		)
+		ctx := context.WithValue(req.Context(), server.Params, httpRouterParams)
+		ctx = context.WithValue(ctx, server.UserKeyName, user)
+		ctx = context.WithValue(ctx, server.SessionKeyName, "abcd1234")
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		handleFunc.ServeHTTP(w, req)
+		return w
+	}
+}
+
+// GenerateHandleTesterWithCSRF returns a HandleTester for a handler
+// behind CSRFMiddleware. It first does a GET to obtain a session and
+// its CSRF token, then sends both along with every request.
+func GenerateHandleTesterWithCSRF(
+	t *testing.T,
+	handleFunc http.Handler,
+	loggedIn bool,
+) HandleTester {
+	var token string
+	get := GenerateHandleTester(t, app.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = main.CSRFToken(req)
+	})), loggedIn)
+	cookie := get("GET", url.Values{}).HeaderMap.Get("Set-Cookie")
+	assert(t, token != "", "expected CSRF token to be issued")
+
+	return func(method string, params url.Values) *httptest.ResponseRecorder {
+		if params == nil {
+			params = url.Values{}
+		}
+		params.Set("csrf_token", token)
+		req, err := http.NewRequest(method, "", strings.NewReader(params.Encode()))
+		ok(t, err)
+		req.Header.Set(
+			"Content-Type",
+			"application/x-www-form-urlencoded; param=value",
+		)
+		req.Header.Set("Cookie", cookie)
+		ctx := context.WithValue(req.Context(), server.Params, httprouter.Params{})
+		if loggedIn {
+			ctx = context.WithValue(ctx, server.UserKeyName, user1)
+			ctx = context.WithValue(ctx, server.OrgKeyName, org1.ID)
+			ctx = context.WithValue(ctx, server.ShopKeyName, shop1.ID)
+			ctx = context.WithValue(ctx, server.SessionKeyName, "abcd1234")
+		}
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+		app.CSRFMiddleware(handleFunc).ServeHTTP(w, req)
+		return w
+	}
+}
+
 // GenerateHandleBodyTesterWithHeaders returns a HandleBodyTester
 // given header params
 func GenerateHandleBodyTesterWithHeaders(
@@ -268,9 +335,10 @@ func GenerateHandleTesterWithHeaders(
 		ctx := context.WithValue(req.Context(), server.Params, httpRouterParams)
 		w := httptest.NewRecorder()
 		if loggedIn {
-			ctx = context.WithValue(ctx, server.UserKeyName, user1.ID)
+			ctx = context.WithValue(ctx, server.UserKeyName, user1)
 			ctx = context.WithValue(ctx, server.OrgKeyName, org1.ID)
 			ctx = context.WithValue(ctx, server.ShopKeyName, shop1.ID)
+			ctx = context.WithValue(ctx, server.SessionKeyName, "abcd1234")
 		}
 		req = req.WithContext(ctx)
 		handleFunc.ServeHTTP(w, req)
@@ -332,6 +400,8 @@ func TestMain(m *testing.M) {
 	}
 	templatePath := path.Join(viper.GetString("path"), "templates")
 	app = main.SetupApp(r, ml, []byte("some-secret"), templatePath)
+	// the test servers listen on the loopback address
+	main.AllowPrivateAddresses(true)
 
 	retCode := m.Run()
 	os.Exit(retCode)
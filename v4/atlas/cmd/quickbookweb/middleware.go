@@ -13,11 +13,9 @@ import (
 )
 
 const (
-	tempCredName = "tempCredName-quickbook"
-	tempCredKey  = "tempCred-quickbook"
-	tokenCredKey = "tokenCred-quickbook"
-	companyKey   = "company"
-
+	tempCredName  = "tempCredName-quickbook"
+	oauthStateKey = "oauthState-quickbook"
+	companyKey    = "company"
 )
 
 // ifModifiedSinceMiddleware is middleware wrapper to protec tauthentication endpoint.
@@ -94,6 +92,13 @@ func (a *App) webUserAtlasMiddleware(db atlas.AtlasSessionDB) func(http http.Han
 				next.ServeHTTP(w, req)
 				return
 			}
+			// deactivated users are treated as logged out even if a session survived
+			if !u.IsActive {
+				delete(session.Values, sessionKeyName)
+				session.Save(req, w)
+				next.ServeHTTP(w, req)
+				return
+			}
 
 			ctx := context.WithValue(req.Context(), userKeyName, u)
 			ctx = context.WithValue(ctx, sessionKeyName, ssk)
@@ -105,8 +110,13 @@ func (a *App) webUserAtlasMiddleware(db atlas.AtlasSessionDB) func(http http.Han
 	}
 }
 
-// webHookAuthMiddleware verify the token from developer.intuit.com is correct
-func (a *App) webHookAuthMiddleware(db atlas.QBOrgWebHookDB) func(http http.Handler) http.Handler {
+// webHookAuthMiddleware verify the token from developer.intuit.com is correct.
+// A payload can hold notifications of several realms: it is split per realm, each realm is verified with the
+// token of its own org, and next is called once per verified realm with a payload of only its notifications and
+// with the org and realm ID in the request context. Unknown or unverified realms are skipped; if next fails for
+// any realm the request fails with the worst status it answered, so that Intuit sends the payload again after a
+// server error. Signatures are checked as v says, see verifyQBWebhook.
+func (a *App) webHookAuthMiddleware(db atlas.QBOrgWebHookDB, v *QBWebhookVerifier) func(http http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, req *http.Request) {
 			jsonBody, err := ioutil.ReadAll(req.Body)
@@ -115,51 +125,82 @@ func (a *App) webHookAuthMiddleware(db atlas.QBOrgWebHookDB) func(http http.Hand
 				http.Error(w, "webhook payload in bad form", 400)
 				return
 			}
-			rdr1 := ioutil.NopCloser(bytes.NewBuffer(jsonBody))
-			rdr2 := ioutil.NopCloser(bytes.NewBuffer(jsonBody))
 
-			var webPayload atlas.WebPayload
-			err = json.NewDecoder(rdr1).Decode(&webPayload)
+			var webPayload atlas.QBWebhookPayload
+			err = json.Unmarshal(jsonBody, &webPayload)
 			if err != nil {
 				a.Logr.Log("error reading webhook payload: %s", err)
 				http.Error(w, "webhook payload in bad form", 400)
 				return
 			}
-			if len(webPayload.EventNotification) < 1 {
+			if len(webPayload.EventNotifications) < 1 {
 				http.Error(w, "empty payload", 400)
 				return
 			}
-
-			companyID := webPayload.EventNotification[0].RealmID
-			qbOrg, err := db.GetQBOrgByCompanyID(companyID)
-			if err != nil {
-				a.Logr.Log("no company with id = %s exist", companyID)
-				http.Error(w, "company not found", 400)
-				return
+			var realms []string
+			byRealm := map[string][]atlas.QBEventNotification{}
+			for _, n := range webPayload.EventNotifications {
+				if _, ok := byRealm[n.RealmID]; !ok {
+					realms = append(realms, n.RealmID)
+				}
+				byRealm[n.RealmID] = append(byRealm[n.RealmID], n)
 			}
 
 			signedBody := req.Header.Get(intuitSignature)
-			if !CheckMAC(jsonBody, signedBody, qbOrg.QBWebHookToken) && a.IsProduction {
-				http.Error(w, "Not logged in.", 403)
-				return
+			known, verified, status := 0, 0, http.StatusOK
+			for _, companyID := range realms {
+				qbOrg, err := db.GetQBOrgByCompanyID(companyID)
+				if err != nil {
+					a.Logr.Log("no company with id = %s exist", companyID)
+					continue
+				}
+				known++
+				if !a.verifyQBWebhook(v, jsonBody, signedBody, qbOrg, companyID) {
+					continue
+				}
+				verified++
+
+				body, err := json.Marshal(atlas.QBWebhookPayload{EventNotifications: byRealm[companyID]})
+				if err != nil {
+					a.Logr.Log("error splitting webhook payload for realm %s: %s", companyID, err)
+					status = http.StatusInternalServerError
+					continue
+				}
+				ctx := context.WithValue(req.Context(), server.OrgKeyName, qbOrg.ID)
+				ctx = context.WithValue(ctx, companyKey, companyID)
+				r := req.WithContext(ctx)
+				r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				rw := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+				next.ServeHTTP(rw, r)
+				if rw.code < 200 || rw.code > 299 {
+					a.Logr.Log("webhook handler answered %d for realm %s: %s", rw.code, companyID, bytes.TrimSpace(rw.body.Bytes()))
+					if rw.code > status {
+						status = rw.code
+					}
+				}
 			}
 
-			req.Body = rdr2
-			ctx := context.WithValue(req.Context(), server.OrgKeyName, qbOrg.ID)
-			req = req.WithContext(ctx)
-			next.ServeHTTP(w, req)
-			return
+			switch {
+			case known == 0:
+				http.Error(w, "company not found", 400)
+			case verified == 0:
+				http.Error(w, "Not logged in.", 403)
+			case status != http.StatusOK:
+				http.Error(w, "webhook payload could not be processed", status)
+			default:
+				w.WriteHeader(http.StatusOK)
+			}
 		}
 		return http.HandlerFunc(fn)
 	}
 }
 
-// TODO: do permissions later la
-// webAuthMiddleware blocks access to the webpages from un-logged-in users
+// webAuthMiddleware blocks access to the webpages from un-logged-in users.
+// Routes that need more than a logged-in user add RequireRole after it.
 func (a *App) webAuthMiddleware(db atlas.AtlasSessionDB) func(http http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, req *http.Request) {
-			user, err := getUser(req)
+			_, err := getUser(req)
 			if err != nil {
 				if err != ErrNotLoggedIn {
 					a.Logr.Log("middleware error: %s", err)
@@ -168,12 +209,6 @@ func (a *App) webAuthMiddleware(db atlas.AtlasSessionDB) func(http http.Handler)
 				return
 			}
 
-			// Always serve if is superadmin
-			if user.IsSuperAdmin {
-				next.ServeHTTP(w, req)
-				return
-			}
-
 			next.ServeHTTP(w, req)
 		}
 		return http.HandlerFunc(fn)
@@ -194,27 +229,6 @@ func getUser(req *http.Request) (*atlas.QBUser, error) {
 	return u, nil
 }
 
-func (a *App) getFlashes(w http.ResponseWriter, req *http.Request) []interface{} {
-	session, _ := a.Store.Get(req, sessionName)
-	fs := session.Flashes()
-
-	session.Save(req, w)
-	return fs
-}
-
-func (a *App) saveFlash(w http.ResponseWriter, req *http.Request, msg string) error {
-	session, err := a.Store.Get(req, sessionName)
-	if err != nil {
-		return err
-	}
-	session.AddFlash(msg)
-	err = session.Save(req, w)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func getSessionKey(req *http.Request) (string, error) {
 	s := req.Context().Value(server.SessionKeyName)
 	if s == nil {
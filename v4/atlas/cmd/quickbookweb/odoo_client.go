@@ -0,0 +1,102 @@
+package main
+
+import (
+	"atlas"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kolo/xmlrpc"
+)
+
+// odooTimeout bounds every call to an Odoo server, which may be slow or not reachable at all.
+const odooTimeout = 15 * time.Second
+
+// ErrOdooAuthentication is returned when Odoo rejects the database, username or password.
+var ErrOdooAuthentication = errors.New("odoo rejected the credentials")
+
+// odooTransport only connects to public addresses, since the URL of the server is given by the user.
+var odooTransport = newPublicTransport(odooTimeout)
+
+// OdooClient calls the external XML-RPC API of an Odoo server.
+type OdooClient struct {
+	conn atlas.OdooConnection
+}
+
+// NewOdooClient returns a client for the server and credentials of conn, whose password has been opened.
+func NewOdooClient(conn atlas.OdooConnection) *OdooClient {
+	return &OdooClient{conn: conn}
+}
+
+// normalizeOdooURL checks that raw is an http(s) URL and strips its trailing slash.
+func normalizeOdooURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", raw)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+func (c *OdooClient) call(service, method string, args []interface{}, reply interface{}) error {
+	client, err := xmlrpc.NewClient(c.conn.URL+"/xmlrpc/2/"+service, odooTransport)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call(method, args, reply)
+}
+
+// Authenticate logs in to Odoo and returns the uid of the user.
+func (c *OdooClient) Authenticate() (int, error) {
+	var reply interface{}
+	err := c.call("common", "authenticate", []interface{}{c.conn.Database, c.conn.Username, c.conn.Password, map[string]interface{}{}}, &reply)
+	if err != nil {
+		return 0, err
+	}
+	// Odoo answers false instead of a uid when the credentials are wrong
+	uid, ok := reply.(int64)
+	if !ok || uid == 0 {
+		return 0, ErrOdooAuthentication
+	}
+	return int(uid), nil
+}
+
+// POSConfigs returns the active POS configs of the server. It needs the uid returned by Authenticate in
+// the connection.
+func (c *OdooClient) POSConfigs() ([]atlas.OdooPOSConfig, error) {
+	var reply interface{}
+	err := c.call("object", "execute_kw", []interface{}{
+		c.conn.Database, c.conn.OdooUID, c.conn.Password,
+		"pos.config", "search_read",
+		[]interface{}{[]interface{}{[]interface{}{"active", "=", true}}},
+		map[string]interface{}{"fields": []string{"name", "company_id"}},
+	}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	records, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected pos.config search_read answer %T", reply)
+	}
+
+	configs := make([]atlas.OdooPOSConfig, 0, len(records))
+	for _, r := range records {
+		rec, ok := r.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected pos.config record %T", r)
+		}
+		id, _ := rec["id"].(int64)
+		name, _ := rec["name"].(string)
+		cfg := atlas.OdooPOSConfig{ID: int(id), Name: name}
+		// many2one fields are [id, display name], or false when empty
+		if company, ok := rec["company_id"].([]interface{}); ok && len(company) == 2 {
+			companyID, _ := company[0].(int64)
+			cfg.CompanyID = int(companyID)
+			cfg.CompanyName, _ = company[1].(string)
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	onboardingKeyName   = "onboarding"
+	setupBackendKeyName = "setup_backend"
+)
+
+// OnboardingMiddleware routes the /start pages of the setup wizard to the step the user is at, on the pages
+// of the backend they chose.
+// Logged-out visitors can only see the first two steps, which create the account. Logged-in users can go
+// back to any step they have reached to edit it, but not skip ahead, and are sent to the app once the setup
+// is complete or if they never had to go through it.
+func (a *App) OnboardingMiddleware(db atlas.QBOnboardingDB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, req *http.Request) error {
+			step, backend := atlas.OnboardingStepForPath(req.URL.Path)
+			if step == 0 {
+				next.ServeHTTP(w, req)
+				return nil
+			}
+
+			u, err := getUser(req)
+			if err != nil {
+				if atlas.OnboardingSuperadmin.Before(step) {
+					http.Redirect(w, req, "/login", http.StatusFound)
+					return nil
+				}
+				next.ServeHTTP(w, req)
+				return nil
+			}
+
+			o, err := db.GetQBOnboarding(u.ID)
+			if err != nil {
+				return server.New500Error("error retrieving setup progress", err)
+			}
+			if o == nil || o.IsComplete() {
+				http.Redirect(w, req, atlas.OnboardingPath("", atlas.OnboardingComplete), http.StatusFound)
+				return nil
+			}
+			// the account exists, and with it the choice of backend
+			if step.Before(atlas.OnboardingOrg) || o.Step.Before(step) || backend != o.Backend {
+				http.Redirect(w, req, o.Path(), http.StatusFound)
+				return nil
+			}
+
+			ctx := context.WithValue(req.Context(), onboardingKeyName, o)
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return nil
+		}
+		return a.Wrap(fn)
+	}
+}
+
+// getOnboarding returns the setup progress of the logged-in user, from the request context if
+// OnboardingMiddleware put it there, or else from the database. It returns nil if nobody is logged in or
+// the user has none.
+func getOnboarding(req *http.Request, db atlas.QBOnboardingDB) (*atlas.QBOnboarding, error) {
+	if o, ok := req.Context().Value(onboardingKeyName).(*atlas.QBOnboarding); ok {
+		return o, nil
+	}
+	u, err := getUser(req)
+	if err == ErrNotLoggedIn {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return db.GetQBOnboarding(u.ID)
+}
+
+// advanceOnboarding moves the setup of the logged-in user on to step, if they are going through it.
+func advanceOnboarding(req *http.Request, db atlas.QBOnboardingDB, step atlas.OnboardingStep, update func(o *atlas.QBOnboarding)) error {
+	o, err := getOnboarding(req, db)
+	if err != nil {
+		return err
+	}
+	if o == nil || o.IsComplete() {
+		return nil
+	}
+	o.Advance(step)
+	if update != nil {
+		update(o)
+	}
+	_, err = db.SaveQBOnboarding(*o)
+	if err != nil {
+		return fmt.Errorf("error saving setup progress of user %d: %s", o.UserID, err)
+	}
+	return nil
+}
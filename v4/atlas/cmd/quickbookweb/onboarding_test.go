@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type MockQBOnboardingDB struct {
+	onboardingError bool
+	onboardings     map[int]*atlas.QBOnboarding
+}
+
+func (db *MockQBOnboardingDB) GetQBOnboarding(userID int) (*atlas.QBOnboarding, error) {
+	if db.onboardingError {
+		return nil, fmt.Errorf("some error")
+	}
+	o, ok := db.onboardings[userID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *o
+	return &copied, nil
+}
+
+func (db *MockQBOnboardingDB) SaveQBOnboarding(o atlas.QBOnboarding) (*atlas.QBOnboarding, error) {
+	if db.onboardingError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.onboardings == nil {
+		db.onboardings = map[int]*atlas.QBOnboarding{}
+	}
+	db.onboardings[o.UserID] = &o
+	return &o, nil
+}
+
+// withPath serves h as if the request was for path.
+func withPath(path string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Path = path
+		h.ServeHTTP(w, req)
+	})
+}
+
+func TestOnboardingMiddleware(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOnboardingDB{onboardings: map[int]*atlas.QBOnboarding{
+		user1.ID: {UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingConnect, OrgID: org1.ID},
+	}}
+	mw := app.OnboardingMiddleware(mockDB)
+
+	// a user half way through can go back, but not skip ahead
+	cases := []struct {
+		path     string
+		code     int
+		location string
+	}{
+		{"/start", http.StatusFound, "/start/4"},
+		{"/start/2", http.StatusFound, "/start/4"},
+		{"/start/3", http.StatusOK, ""},
+		{"/start/4", http.StatusOK, ""},
+		{"/start/5", http.StatusFound, "/start/4"},
+		{"/start/accounts", http.StatusFound, "/start/4"},
+		{"/w", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		test := GenerateHandleTesterAsUser(t, withPath(c.path, mw(okHandler)), user1, nil)
+		w := test("GET", url.Values{})
+		assert(t, w.Code == c.code, "%s: expected %d instead got %d", c.path, c.code, w.Code)
+		equals(t, c.location, w.HeaderMap.Get("Location"))
+	}
+
+	// an Odoo setup stays on the Odoo pages
+	mockDB.onboardings[user1.ID] = &atlas.QBOnboarding{UserID: user1.ID, Backend: atlas.BackendOdoo, Step: atlas.OnboardingConnect}
+	for _, c := range []struct {
+		path     string
+		location string
+	}{
+		{"/start/3", "/start/odoo/connect"},
+		{"/start/odoo/pos", "/start/odoo/connect"},
+		{"/start/odoo/connect", ""},
+	} {
+		test := GenerateHandleTesterAsUser(t, withPath(c.path, mw(okHandler)), user1, nil)
+		w := test("GET", url.Values{})
+		equals(t, c.location, w.HeaderMap.Get("Location"))
+	}
+	// the accounts step comes between connect and shop, although it was added last
+	mockDB.onboardings[user1.ID] = &atlas.QBOnboarding{UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingAccounts, OrgID: org1.ID}
+	for _, c := range []struct {
+		path     string
+		location string
+	}{
+		{"/start/4", ""},
+		{"/start/accounts", ""},
+		{"/start/5", "/start/accounts"},
+	} {
+		test := GenerateHandleTesterAsUser(t, withPath(c.path, mw(okHandler)), user1, nil)
+		w := test("GET", url.Values{})
+		equals(t, c.location, w.HeaderMap.Get("Location"))
+	}
+	mockDB.onboardings[user1.ID] = &atlas.QBOnboarding{UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingConnect, OrgID: org1.ID}
+
+	// logged out visitors can only create the superadmin
+	test := GenerateHandleTester(t, withPath("/start/2", mw(okHandler)), false)
+	w := test("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	test = GenerateHandleTester(t, withPath("/start/3", mw(okHandler)), false)
+	w = test("GET", url.Values{})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+
+	// users who finished or never started the setup go to the app
+	mockDB.onboardings[user1.ID].Complete(time.Now())
+	for _, u := range []*atlas.QBUser{user1, user2} {
+		test = GenerateHandleTesterAsUser(t, withPath("/start/3", mw(okHandler)), u, nil)
+		w = test("GET", url.Values{})
+		equals(t, "/w", w.HeaderMap.Get("Location"))
+	}
+
+	mockDB.onboardingError = true
+	test = GenerateHandleTesterAsUser(t, withPath("/start/3", mw(okHandler)), user1, nil)
+	w = test("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestWebStart3PostHandlerResume(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOrgDB{}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{
+		user1.ID: {UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingOrg},
+	}
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.WebStart3PostHandler(mockDB)), user1, nil)
+
+	w := test("POST", url.Values{"name": {"Floating Cube"}})
+	equals(t, "/start/4", w.HeaderMap.Get("Location"))
+	equals(t, atlas.OnboardingConnect, mockDB.onboardings[user1.ID].Step)
+	equals(t, org1.ID, mockDB.onboardings[user1.ID].OrgID)
+	assert(t, len(mockDB.methods) > 0, "expected payment methods to be set up for the new org")
+	// the user administers the org they created, and nothing else
+	equals(t, []atlas.QBUserRole{{ID: 1, UserID: user1.ID, OrgID: org1.ID, Role: atlas.RoleOrgAdmin}}, mockDB.granted)
+
+	// going back to the step renames the org instead of creating another one
+	mockDB.onboardings[user1.ID].Step = atlas.OnboardingShop
+	created := len(mockDB.methods)
+	w = test("POST", url.Values{"name": {"Floating Cube Pte Ltd"}})
+	equals(t, "/start/5", w.HeaderMap.Get("Location"))
+	equals(t, "Floating Cube Pte Ltd", mockDB.updatedOrg.Name)
+	equals(t, created, len(mockDB.methods))
+	equals(t, 1, len(mockDB.granted))
+	equals(t, atlas.OnboardingShop, mockDB.onboardings[user1.ID].Step)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RequireRole is the middleware routes use to declare the role needed to access them. The org and shop the
+// request is about are read from the "orgid" and "shopid" URL params, falling back to the form values, so a
+// role only grants access inside its own org (and shop, for shop scoped roles). Superadmins are always let through:
+// these hold RoleSuperAdmin, which only an operator grants. The IsSuperAdmin flag of a user grants nothing here.
+func (a *App) RequireRole(db atlas.QBUserRoleDB, role atlas.QBRole) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, req *http.Request) {
+			user, err := getUser(req)
+			if err != nil {
+				if err != ErrNotLoggedIn {
+					a.Logr.Log("middleware error: %s", err)
+				}
+				http.Redirect(w, req, "/login", http.StatusFound)
+				return
+			}
+			roles, err := db.GetQBUserRoles(user.ID)
+			if err != nil {
+				a.Logr.Log("error retrieving roles for user %d: %s", user.ID, err)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+				return
+			}
+			orgID, shopID := requestScope(req)
+			if !hasRole(roles, role, orgID, shopID) {
+				a.renderForbidden(w, req, user)
+				return
+			}
+			next.ServeHTTP(w, req)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// hasRole reports whether one of the roles grants at least the required role for the org and shop.
+// A request that names no org (orgID 0) is only granted to superadmins, and one that names no shop
+// (shopID 0) is about the whole org, so only org wide roles grant it.
+func hasRole(roles []*atlas.QBUserRole, required atlas.QBRole, orgID, shopID int) bool {
+	for _, r := range roles {
+		if r.Role == atlas.RoleSuperAdmin {
+			return true
+		}
+		if !r.Role.Includes(required) {
+			continue
+		}
+		if orgID == 0 || r.OrgID != orgID {
+			continue
+		}
+		if r.ShopID != 0 && r.ShopID != shopID {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// requestScope returns the org and shop ids a request is about, or 0 when it does not name one.
+func requestScope(req *http.Request) (int, int) {
+	var orgID, shopID int
+	if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+		orgID, _ = strconv.Atoi(ps.ByName("orgid"))
+		shopID, _ = strconv.Atoi(ps.ByName("shopid"))
+	}
+	if orgID == 0 {
+		orgID, _ = strconv.Atoi(req.FormValue("orgid"))
+	}
+	if shopID == 0 {
+		shopID, _ = strconv.Atoi(req.FormValue("shopid"))
+	}
+	return orgID, shopID
+}
+
+// renderForbidden renders the access denied page.
+func (a *App) renderForbidden(w http.ResponseWriter, req *http.Request, u *atlas.QBUser) {
+	lp := &localPresenter{
+		PageTitle:       "Access denied",
+		PageURL:         req.URL.Path,
+		User:            u,
+		GlobalPresenter: a.Gp,
+		CSRFToken:       CSRFToken(req),
+	}
+	a.Rndr.HTML(w, http.StatusForbidden, "forbidden", lp)
+}
@@ -0,0 +1,78 @@
+package main_test
+
+import (
+	"atlas"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestRequireRole(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	org1Params := httprouter.Params{{Key: "orgid", Value: strconv.Itoa(org1.ID)}}
+	shop1Params := httprouter.Params{org1Params[0], {Key: "shopid", Value: strconv.Itoa(shop1.ID)}}
+	otherShopParams := httprouter.Params{org1Params[0], {Key: "shopid", Value: "99"}}
+	otherOrgParams := httprouter.Params{{Key: "orgid", Value: "99"}}
+
+	cases := []struct {
+		name     string
+		role     atlas.QBRole
+		params   httprouter.Params
+		expected map[*atlas.QBUser]int
+	}{
+		{"manage org users", atlas.RoleOrgAdmin, org1Params, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 403, user4: 403}},
+		{"manage another org", atlas.RoleOrgAdmin, otherOrgParams, map[*atlas.QBUser]int{
+			user1: 200, user2: 403, user3: 403, user4: 403}},
+		{"manage shop", atlas.RoleShopManager, shop1Params, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 200, user4: 403}},
+		{"manage another shop", atlas.RoleShopManager, otherShopParams, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 403, user4: 403}},
+		{"view shop", atlas.RoleCashier, shop1Params, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 200, user4: 200}},
+		{"view another shop", atlas.RoleCashier, otherShopParams, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 403, user4: 403}},
+		{"superadmin page", atlas.RoleSuperAdmin, nil, map[*atlas.QBUser]int{
+			user1: 200, user2: 403, user3: 403, user4: 403}},
+		// a role only counts inside its own org, so a request naming no org needs a superadmin
+		{"no org given", atlas.RoleCashier, nil, map[*atlas.QBUser]int{
+			user1: 200, user2: 403, user3: 403, user4: 403}},
+		// a request naming no shop is about every shop of the org
+		{"every shop of org", atlas.RoleCashier, org1Params, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 403, user4: 403}},
+		{"manage every shop of org", atlas.RoleShopManager, org1Params, map[*atlas.QBUser]int{
+			user1: 200, user2: 200, user3: 403, user4: 403}},
+	}
+	for _, c := range cases {
+		h := app.RequireRole(&MockQBUserDB{}, c.role)(okHandler)
+		for u, code := range c.expected {
+			test := GenerateHandleTesterAsUser(t, h, u, c.params)
+			w := test("GET", url.Values{})
+			assert(t, w.Code == code, "%s: expected %s to get %d instead got %d", c.name, u.Email, code, w.Code)
+		}
+	}
+
+	// the IsSuperAdmin flag alone, as set on the accounts signed up before orgs got an admin role, grants nothing
+	flagged := &atlas.QBUser{ID: 5, Email: "signup@floatingcube.com", IsActive: true, IsSuperAdmin: true}
+	test := GenerateHandleTesterAsUser(t, app.RequireRole(&MockQBUserDB{}, atlas.RoleCashier)(okHandler), flagged, org1Params)
+	w := test("GET", url.Values{})
+	equals(t, http.StatusForbidden, w.Code)
+
+	// not logged in
+	test = GenerateHandleTester(t, app.RequireRole(&MockQBUserDB{}, atlas.RoleCashier)(okHandler), false)
+	w = test("GET", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+
+	// roles cannot be loaded
+	test = GenerateHandleTesterAsUser(t, app.RequireRole(&MockQBUserDB{hasError: true}, atlas.RoleCashier)(okHandler), user4, shop1Params)
+	w = test("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for dials to addresses the server must not call on behalf of users, such as
+// loopback, private and link-local addresses, which would reach the internal network.
+var ErrPrivateAddress = errors.New("address is not public")
+
+// allowPrivateAddresses turns the checks off, for tests calling servers on the loopback address.
+var allowPrivateAddresses = false
+
+// privateNets are the ranges of isPublicIP besides loopback, link-local, multicast and unspecified addresses.
+var privateNets = parseCIDRs(
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // RFC 1918
+	"100.64.0.0/10", // carrier-grade NAT
+	"fc00::/7",      // unique local
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// isPublicIP reports whether ip is an address users may make the server call.
+func isPublicIP(ip net.IP) bool {
+	if allowPrivateAddresses {
+		return true
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkPublicURL checks that raw is an absolute URL whose host only resolves to public addresses, and with
+// requireHTTPS that it is https. The host may resolve differently when it is called, so the transport has to
+// check again with publicDialControl.
+func checkPublicURL(ctx context.Context, raw string, requireHTTPS bool) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && (requireHTTPS || u.Scheme != "http") {
+		return fmt.Errorf("%q is not an https URL", raw)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%s resolves to %s, which %s", host, addr.IP, ErrPrivateAddress)
+		}
+	}
+	return nil
+}
+
+// publicDialControl is the Control of a net.Dialer refusing to connect to addresses that are not public. It
+// sees the address actually dialed, after DNS resolution, so a host cannot be made to point elsewhere after
+// checkPublicURL.
+func publicDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// newPublicTransport returns a transport that only connects to public addresses, for calling URLs given by
+// users. It does not use a proxy, which would hide the address of the server from the dialer.
+func newPublicTransport(timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: timeout, Control: publicDialControl}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+}
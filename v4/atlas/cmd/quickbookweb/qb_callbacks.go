@@ -0,0 +1,357 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Headers of the notifications posted to callbacks. The signature is the base64 HMAC-SHA256 of the body with
+// the secret of the callback, the way Intuit signs its own webhooks.
+const (
+	qbCallbackSignatureHeader = "X-Atlas-Signature"
+	qbCallbackDeliveryHeader  = "X-Atlas-Delivery"
+)
+
+// qbCallbackMinSecret is the shortest secret a callback can be registered with.
+const qbCallbackMinSecret = 16
+
+// QBCallbackNotification is the body posted to callbacks. EventID is the webhook event the changes came in;
+// a redelivery has the same EventID, so that shops can skip notifications they already handled.
+type QBCallbackNotification struct {
+	EventID int                    `json:"eventId"`
+	OrgID   int                    `json:"orgId"`
+	ShopID  int                    `json:"shopId"`
+	Changes []atlas.QBEntityChange `json:"changes"`
+}
+
+// QBCallbackSender posts the notifications queued for callbacks. Failed deliveries are retried after
+// BaseBackoff, doubling up to MaxBackoff, and are marked failed after MaxAttempts attempts.
+//
+// Callback URLs are given by shops, so the default Client only connects to public addresses and does not follow
+// redirects. The secrets of the callbacks are saved sealed with box.
+type QBCallbackSender struct {
+	db   atlas.QBCallbackDB
+	box  *SecretBox
+	wake chan struct{}
+
+	Client       *http.Client
+	Workers      int
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Lease        time.Duration
+	PollInterval time.Duration
+}
+
+// NewQBCallbackSender returns a QBCallbackSender with the default limits.
+func NewQBCallbackSender(db atlas.QBCallbackDB, box *SecretBox) *QBCallbackSender {
+	return &QBCallbackSender{
+		db:           db,
+		box:          box,
+		wake:         make(chan struct{}, 1),
+		Client:       newQBCallbackClient(10 * time.Second),
+		Workers:      4,
+		MaxAttempts:  8,
+		BaseBackoff:  30 * time.Second,
+		MaxBackoff:   time.Hour,
+		Lease:        time.Minute,
+		PollInterval: 30 * time.Second,
+	}
+}
+
+// Queue saves a notification of payload to callback c, to be posted by the workers.
+func (s *QBCallbackSender) Queue(c *atlas.QBCallback, payload []byte) (*atlas.QBCallbackDelivery, error) {
+	now := time.Now()
+	d, err := s.db.CreateQBCallbackDelivery(atlas.QBCallbackDelivery{
+		CallbackID:    c.ID,
+		OrgID:         c.OrgID,
+		URL:           c.URL,
+		Payload:       payload,
+		Status:        atlas.QBCallbackDeliveryPending,
+		NextAttemptAt: now,
+		DateCreated:   now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return d, nil
+}
+
+// newQBCallbackClient returns a client that only posts to public addresses and takes redirects as the answer,
+// so that a callback cannot send the server to the internal network.
+func newQBCallbackClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newPublicTransport(timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Backoff returns how long to wait before retrying a delivery that failed attempts times.
+func (s *QBCallbackSender) Backoff(attempts int) time.Duration {
+	return backoff(s.BaseBackoff, s.MaxBackoff, attempts)
+}
+
+// signQBCallback returns the signature of a notification body.
+func signQBCallback(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NotifyQBCallbacks returns a QBWebhookProcessor that processes events with next and then queues a notification
+// of their changes for every active callback of the org. If queueing fails the event is retried, with next
+// processing it again, so callbacks can be notified more than once of an event.
+func (a *App) NotifyQBCallbacks(s *QBCallbackSender, next QBWebhookProcessor) QBWebhookProcessor {
+	return func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+		if err := next(ctx, e); err != nil {
+			return err
+		}
+		var payload atlas.QBWebhookPayload
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return fmt.Errorf("error reading webhook event %d: %s", e.ID, err)
+		}
+		var changes []atlas.QBEntityChange
+		for _, n := range payload.EventNotifications {
+			if n.RealmID == e.RealmID {
+				changes = append(changes, n.DataChangeEvent.Entities...)
+			}
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		callbacks, err := s.db.GetQBCallbacks(e.OrgID)
+		if err != nil {
+			return fmt.Errorf("error retrieving callbacks of org %d: %s", e.OrgID, err)
+		}
+		for _, c := range callbacks {
+			if !c.IsActive {
+				continue
+			}
+			body, err := json.Marshal(QBCallbackNotification{EventID: e.ID, OrgID: e.OrgID, ShopID: c.ShopID, Changes: changes})
+			if err != nil {
+				return err
+			}
+			if _, err := s.Queue(c, body); err != nil {
+				return fmt.Errorf("error queueing notification of webhook event %d to callback %d: %s", e.ID, c.ID, err)
+			}
+		}
+		return nil
+	}
+}
+
+// RunQBCallbackDeliveries posts the queued notifications until ctx is done, as soon as they are queued on this
+// node and every PollInterval otherwise.
+func (a *App) RunQBCallbackDeliveries(ctx context.Context, s *QBCallbackSender) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := a.SendQBCallbacks(ctx, s, time.Now())
+			if err != nil {
+				a.Logr.Log("error sending callback notifications: %s", err)
+			}
+			if n == 0 || ctx.Err() != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// SendQBCallbacks claims the deliveries due at now, posts them with s.Workers workers and returns how many it
+// posted.
+func (a *App) SendQBCallbacks(ctx context.Context, s *QBCallbackSender, now time.Time) (int, error) {
+	deliveries, err := s.db.ClaimQBCallbackDeliveries(now, s.Lease, s.Workers*4)
+	if err != nil {
+		return 0, err
+	}
+	todo := make(chan *atlas.QBCallbackDelivery)
+	var wg sync.WaitGroup
+	for i := 0; i < s.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range todo {
+				a.sendQBCallback(ctx, s, d)
+			}
+		}()
+	}
+	for _, d := range deliveries {
+		todo <- d
+	}
+	close(todo)
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+func (a *App) sendQBCallback(ctx context.Context, s *QBCallbackSender, d *atlas.QBCallbackDelivery) {
+	code, err := postQBCallback(ctx, s, d)
+	now := time.Now()
+	d.Attempts++
+	d.ResponseCode = code
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.DeliveredAt = atlas.QBCallbackDeliveryDelivered, "", &now
+	case err == errQBCallbackRemoved || d.Attempts >= s.MaxAttempts:
+		a.Logr.Log("giving up on callback delivery %d of org %d after %d attempts: %s", d.ID, d.OrgID, d.Attempts, err)
+		d.Status, d.LastError = atlas.QBCallbackDeliveryFailed, qbCallbackFailure(code, err)
+	default:
+		a.Logr.Log("error posting callback delivery %d of org %d to %s, attempt %d: %s", d.ID, d.OrgID, d.URL, d.Attempts, err)
+		d.Status, d.LastError, d.NextAttemptAt = atlas.QBCallbackDeliveryPending, qbCallbackFailure(code, err), now.Add(s.Backoff(d.Attempts))
+	}
+	if err := s.db.UpdateQBCallbackDelivery(*d); err != nil {
+		a.Logr.Log("error saving callback delivery %d: %s", d.ID, err)
+	}
+}
+
+var (
+	// errQBCallbackRemoved fails a delivery whose callback was removed, without retrying it.
+	errQBCallbackRemoved = errors.New("callback was removed")
+	// errQBCallbackSecret is returned when the sealed secret of a callback cannot be opened.
+	errQBCallbackSecret = errors.New("callback secret cannot be opened")
+)
+
+// qbCallbackFailure returns the reason a delivery failed as shown to the org. The errors of the client name the
+// addresses the callback resolved to and why they were refused, which only go to the log.
+func qbCallbackFailure(code int, err error) string {
+	switch {
+	case err == errQBCallbackRemoved || err == errQBCallbackSecret:
+		return err.Error()
+	case code != 0:
+		return fmt.Sprintf("callback answered %d", code)
+	}
+	if uerr, ok := err.(*url.Error); ok && uerr.Timeout() {
+		return "callback did not answer in time"
+	}
+	return "callback could not be reached"
+}
+
+// postQBCallback posts a delivery to its callback, signed with the current secret of the callback, and returns
+// the status the callback answered. Answers other than 2xx are errors. The body of the answer is not read, so
+// that nothing the callback answers ends up in the delivery.
+func postQBCallback(ctx context.Context, s *QBCallbackSender, d *atlas.QBCallbackDelivery) (int, error) {
+	c, err := s.db.GetQBCallback(d.CallbackID)
+	if err != nil || !c.IsActive {
+		return 0, errQBCallbackRemoved
+	}
+	secret, err := s.box.Open(c.Secret)
+	if err != nil {
+		return 0, errQBCallbackSecret
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(qbCallbackSignatureHeader, signQBCallback(d.Payload, secret))
+	req.Header.Set(qbCallbackDeliveryHeader, strconv.Itoa(d.ID))
+	resp, err := s.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// RegisterQBCallbackAPIHandler registers the callback URL of the shop of the token with its shared secret,
+// taken from the "url" and "secret" form values. The URL has to be https and resolve to public addresses only.
+// The secret is saved sealed with box.
+func (a *App) RegisterQBCallbackAPIHandler(db atlas.QBCallbackDB, box *SecretBox) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, _ := req.Context().Value(server.OrgKeyName).(int)
+		shopID, _ := req.Context().Value(server.ShopKeyName).(int)
+		if orgID == 0 || shopID == 0 {
+			return server.NewAPIError(http.StatusForbidden, "Your token is not for a shop", fmt.Errorf("no org or shop in callback registration"))
+		}
+		callbackURL := strings.TrimSpace(req.FormValue("url"))
+		secret := req.FormValue("secret")
+		if err := checkPublicURL(req.Context(), callbackURL, true); err != nil {
+			return server.NewAPIError(http.StatusBadRequest, "Please give an https callback URL with a public address", err)
+		}
+		if len(secret) < qbCallbackMinSecret {
+			return server.NewAPIError(http.StatusBadRequest, fmt.Sprintf("The secret must be at least %d characters long", qbCallbackMinSecret), nil)
+		}
+
+		callbacks, err := db.GetQBCallbacks(orgID)
+		if err != nil {
+			return server.NewAPIError(http.StatusInternalServerError, "Error retrieving callbacks", err)
+		}
+		for _, c := range callbacks {
+			if c.ShopID == shopID && c.URL == callbackURL && c.IsActive {
+				return server.NewAPIError(http.StatusConflict, "This callback URL is already registered", nil)
+			}
+		}
+		sealed, err := box.Seal(secret)
+		if err != nil {
+			return server.NewAPIError(http.StatusInternalServerError, "Error saving callback", err)
+		}
+		c, err := db.CreateQBCallback(atlas.QBCallback{
+			OrgID:       orgID,
+			ShopID:      shopID,
+			URL:         callbackURL,
+			Secret:      sealed,
+			IsActive:    true,
+			DateCreated: time.Now(),
+		})
+		if err != nil {
+			return server.NewAPIError(http.StatusInternalServerError, "Error saving callback", err)
+		}
+		a.Logr.Log("shop %d of org %d registered callback %d to %s", shopID, orgID, c.ID, c.URL)
+		a.Rndr.JSON(w, http.StatusCreated, server.NewAPIResponse(http.StatusCreated, strconv.Itoa(c.ID)))
+		return nil
+	}
+}
+
+// DeleteQBCallbackAPIHandler removes the callback named by the "callbackid" URL param, if it is of the shop of
+// the token.
+func (a *App) DeleteQBCallbackAPIHandler(db atlas.QBCallbackDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, _ := req.Context().Value(server.OrgKeyName).(int)
+		shopID, _ := req.Context().Value(server.ShopKeyName).(int)
+		var callbackID int
+		if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+			callbackID, _ = strconv.Atoi(ps.ByName("callbackid"))
+		}
+		c, err := db.GetQBCallback(callbackID)
+		if err != nil || c.OrgID != orgID || c.ShopID != shopID || orgID == 0 {
+			return server.NewAPIError(http.StatusNotFound, "Callback not found", err)
+		}
+		if err = db.DeleteQBCallback(c.ID); err != nil {
+			return server.NewAPIError(http.StatusInternalServerError, "Error removing callback", err)
+		}
+		a.Logr.Log("shop %d of org %d removed callback %d", shopID, orgID, c.ID)
+		a.Rndr.JSON(w, http.StatusOK, server.NewAPIResponse(http.StatusOK, "Callback removed"))
+		return nil
+	}
+}
@@ -0,0 +1,416 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// MockQBCallbackDB keeps callbacks and their deliveries in memory.
+type MockQBCallbackDB struct {
+	MockQBOrgDB
+	hasError   bool
+	mu         sync.Mutex
+	callbacks  map[int]*atlas.QBCallback
+	deliveries map[int]*atlas.QBCallbackDelivery
+}
+
+func (db *MockQBCallbackDB) GetQBCallbacks(orgID int) ([]*atlas.QBCallback, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var callbacks []*atlas.QBCallback
+	for id := 1; id <= len(db.callbacks); id++ {
+		if c, ok := db.callbacks[id]; ok && c.OrgID == orgID {
+			copied := *c
+			callbacks = append(callbacks, &copied)
+		}
+	}
+	return callbacks, nil
+}
+
+func (db *MockQBCallbackDB) GetQBCallback(callbackID int) (*atlas.QBCallback, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c, ok := db.callbacks[callbackID]
+	if db.hasError || !ok {
+		return nil, fmt.Errorf("no callback %d", callbackID)
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (db *MockQBCallbackDB) CreateQBCallback(c atlas.QBCallback) (*atlas.QBCallback, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.callbacks == nil {
+		db.callbacks = map[int]*atlas.QBCallback{}
+	}
+	c.ID = len(db.callbacks) + 1
+	db.callbacks[c.ID] = &c
+	copied := c
+	return &copied, nil
+}
+
+func (db *MockQBCallbackDB) DeleteQBCallback(callbackID int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	// kept for the delivery log, like a soft delete
+	db.callbacks[callbackID].IsActive = false
+	return nil
+}
+
+func (db *MockQBCallbackDB) CreateQBCallbackDelivery(d atlas.QBCallbackDelivery) (*atlas.QBCallbackDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.deliveries == nil {
+		db.deliveries = map[int]*atlas.QBCallbackDelivery{}
+	}
+	d.ID = len(db.deliveries) + 1
+	db.deliveries[d.ID] = &d
+	copied := d
+	return &copied, nil
+}
+
+func (db *MockQBCallbackDB) GetQBCallbackDelivery(deliveryID int) (*atlas.QBCallbackDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	d, ok := db.deliveries[deliveryID]
+	if db.hasError || !ok {
+		return nil, fmt.Errorf("no callback delivery %d", deliveryID)
+	}
+	copied := *d
+	return &copied, nil
+}
+
+func (db *MockQBCallbackDB) GetRecentQBCallbackDeliveries(orgID int, limit int) ([]*atlas.QBCallbackDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var deliveries []*atlas.QBCallbackDelivery
+	for id := len(db.deliveries); id > 0 && len(deliveries) < limit; id-- {
+		if d := db.deliveries[id]; d.OrgID == orgID {
+			copied := *d
+			deliveries = append(deliveries, &copied)
+		}
+	}
+	return deliveries, nil
+}
+
+func (db *MockQBCallbackDB) ClaimQBCallbackDeliveries(now time.Time, lease time.Duration, limit int) ([]*atlas.QBCallbackDelivery, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var ids []int
+	for id, d := range db.deliveries {
+		due := d.Status == atlas.QBCallbackDeliveryPending || d.Status == atlas.QBCallbackDeliverySending
+		if due && !d.NextAttemptAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	claimed := make([]*atlas.QBCallbackDelivery, len(ids))
+	for i, id := range ids {
+		d := db.deliveries[id]
+		d.Status, d.NextAttemptAt = atlas.QBCallbackDeliverySending, now.Add(lease)
+		copied := *d
+		claimed[i] = &copied
+	}
+	return claimed, nil
+}
+
+func (db *MockQBCallbackDB) UpdateQBCallbackDelivery(d atlas.QBCallbackDelivery) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.deliveries[d.ID] = &d
+	return nil
+}
+
+func (db *MockQBCallbackDB) delivery(id int) atlas.QBCallbackDelivery {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return *db.deliveries[id]
+}
+
+const callbackSecret = "0123456789abcdef0123"
+
+// sealCallbackSecret returns callbackSecret sealed with box, the way callbacks are saved.
+func sealCallbackSecret(t *testing.T, box *main.SecretBox) string {
+	sealed, err := box.Seal(callbackSecret)
+	ok(t, err)
+	return sealed
+}
+
+func TestRegisterQBCallbackAPIHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBCallbackDB{}
+	box := newTestSecretBox(t)
+	test := GenerateHandleTester(t, app.Wrap(app.RegisterQBCallbackAPIHandler(mockDB, box)), true)
+
+	w := test("POST", url.Values{"url": {"https://203.0.113.10/hooks"}, "secret": {callbackSecret}})
+	equals(t, http.StatusCreated, w.Code)
+	c, err := mockDB.GetQBCallback(1)
+	ok(t, err)
+	equals(t, org1.ID, c.OrgID)
+	equals(t, shop1.ID, c.ShopID)
+	equals(t, "https://203.0.113.10/hooks", c.URL)
+	assert(t, !strings.Contains(c.Secret, callbackSecret), "expected the secret to be saved sealed")
+	secret, err := box.Open(c.Secret)
+	ok(t, err)
+	equals(t, callbackSecret, secret)
+	assert(t, c.IsActive, "expected the callback to be active")
+
+	for _, form := range []url.Values{
+		// registered already
+		{"url": {"https://203.0.113.10/hooks"}, "secret": {callbackSecret}},
+		{"url": {"ftp://203.0.113.10/hooks"}, "secret": {callbackSecret}},
+		{"url": {"http://203.0.113.10/other"}, "secret": {callbackSecret}},
+		{"url": {"203.0.113.10"}, "secret": {callbackSecret}},
+		{"url": {"https://203.0.113.10/other"}, "secret": {"short"}},
+	} {
+		w = test("POST", form)
+		assert(t, w.Code >= 400, "expected %v to be refused, got %d", form, w.Code)
+	}
+	equals(t, 1, len(mockDB.callbacks))
+
+	// a token without a shop cannot register
+	w = GenerateHandleTester(t, app.Wrap(app.RegisterQBCallbackAPIHandler(mockDB, box)), false)("POST", url.Values{"url": {"https://203.0.113.10/other"}, "secret": {callbackSecret}})
+	equals(t, http.StatusForbidden, w.Code)
+	equals(t, 1, len(mockDB.callbacks))
+
+	// callbacks cannot point at the internal network
+	main.AllowPrivateAddresses(false)
+	defer main.AllowPrivateAddresses(true)
+	for _, u := range []string{"https://127.0.0.1/hooks", "https://10.0.0.1/hooks", "https://169.254.169.254/latest/meta-data", "https://[::1]/hooks"} {
+		w = test("POST", url.Values{"url": {u}, "secret": {callbackSecret}})
+		equals(t, http.StatusBadRequest, w.Code)
+	}
+	equals(t, 1, len(mockDB.callbacks))
+}
+
+func TestDeleteQBCallbackAPIHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBCallbackDB{}
+	mine, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: "https://pos.example.com/hooks", Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	other, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: 2, URL: "https://pos.example.com/hooks", Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	remove := func(callbackID int) *httptest.ResponseRecorder {
+		params := httprouter.Params{{Key: "callbackid", Value: fmt.Sprint(callbackID)}}
+		return GenerateHandleTesterWithURLParams(t, app.Wrap(app.DeleteQBCallbackAPIHandler(mockDB)), true, params)("DELETE", url.Values{})
+	}
+
+	// only callbacks of the shop of the token can be removed
+	w := remove(other.ID)
+	equals(t, http.StatusNotFound, w.Code)
+	w = remove(mine.ID)
+	equals(t, http.StatusOK, w.Code)
+	c, err := mockDB.GetQBCallback(mine.ID)
+	ok(t, err)
+	assert(t, !c.IsActive, "expected the callback to be removed")
+	c, err = mockDB.GetQBCallback(other.ID)
+	ok(t, err)
+	assert(t, c.IsActive, "expected the callback of the other shop to be kept")
+}
+
+// callbackReceiver records the notifications posted to it, answering with the codes it is given in turn.
+type callbackReceiver struct {
+	mu         sync.Mutex
+	codes      []int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (r *callbackReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	body, _ := ioutil.ReadAll(req.Body)
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get("X-Atlas-Signature"))
+	code := http.StatusOK
+	if len(r.codes) > 0 {
+		code, r.codes = r.codes[0], r.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func TestNotifyQBCallbacks(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	receiver := &callbackReceiver{codes: []int{http.StatusServiceUnavailable}}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	mockDB := &MockQBCallbackDB{}
+	box := newTestSecretBox(t)
+	sealed := sealCallbackSecret(t, box)
+	c, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: ts.URL, Secret: sealed, IsActive: true})
+	ok(t, err)
+	_, err = mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: 2, URL: ts.URL, Secret: sealed})
+	ok(t, err)
+	_, err = mockDB.CreateQBCallback(atlas.QBCallback{OrgID: 42, ShopID: 3, URL: ts.URL, Secret: sealed, IsActive: true})
+	ok(t, err)
+	s := main.NewQBCallbackSender(mockDB, box)
+	s.MaxAttempts = 2
+
+	// nothing is sent for events that fail to process
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	e, err := q.Enqueue(org1.ID, org1.QBCompanyID, webhookPayload(org1.QBCompanyID))
+	ok(t, err)
+	fails := func(ctx context.Context, e *atlas.QBWebhookEvent) error { return fmt.Errorf("some error") }
+	err = app.NotifyQBCallbacks(s, fails)(context.Background(), e)
+	assert(t, err != nil, "expected the error of the processor")
+	equals(t, 0, len(mockDB.deliveries))
+
+	// only the active callbacks of the org are notified
+	succeeds := func(ctx context.Context, e *atlas.QBWebhookEvent) error { return nil }
+	ok(t, app.NotifyQBCallbacks(s, succeeds)(context.Background(), e))
+	equals(t, 1, len(mockDB.deliveries))
+	d := mockDB.delivery(1)
+	equals(t, c.ID, d.CallbackID)
+	equals(t, atlas.QBCallbackDeliveryPending, d.Status)
+	var n main.QBCallbackNotification
+	ok(t, json.Unmarshal(d.Payload, &n))
+	equals(t, e.ID, n.EventID)
+	equals(t, shop1.ID, n.ShopID)
+	equals(t, 1, len(n.Changes))
+	equals(t, "Customer", n.Changes[0].Name)
+
+	// the first attempt fails and is retried later
+	now := time.Now()
+	sent, err := app.SendQBCallbacks(context.Background(), s, now)
+	ok(t, err)
+	equals(t, 1, sent)
+	d = mockDB.delivery(1)
+	equals(t, atlas.QBCallbackDeliveryPending, d.Status)
+	equals(t, http.StatusServiceUnavailable, d.ResponseCode)
+	equals(t, 1, d.Attempts)
+	equals(t, "callback answered 503", d.LastError)
+	assert(t, d.NextAttemptAt.After(now), "expected the delivery to be retried later")
+	sent, err = app.SendQBCallbacks(context.Background(), s, now)
+	ok(t, err)
+	equals(t, 0, sent)
+
+	sent, err = app.SendQBCallbacks(context.Background(), s, time.Now().Add(s.MaxBackoff))
+	ok(t, err)
+	equals(t, 1, sent)
+	d = mockDB.delivery(1)
+	equals(t, atlas.QBCallbackDeliveryDelivered, d.Status)
+	equals(t, http.StatusOK, d.ResponseCode)
+	assert(t, d.DeliveredAt != nil, "expected the delivery time to be set")
+
+	// notifications are signed with the secret of the callback
+	equals(t, 2, len(receiver.bodies))
+	equals(t, d.Payload, receiver.bodies[1])
+	equals(t, signWebhook(d.Payload, callbackSecret), receiver.signatures[1])
+
+	// a callback that keeps failing is given up on after MaxAttempts
+	receiver.codes = []int{http.StatusInternalServerError, http.StatusInternalServerError}
+	ok(t, app.NotifyQBCallbacks(s, succeeds)(context.Background(), e))
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now())
+	ok(t, err)
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now().Add(s.MaxBackoff))
+	ok(t, err)
+	d = mockDB.delivery(2)
+	equals(t, atlas.QBCallbackDeliveryFailed, d.Status)
+	equals(t, 2, d.Attempts)
+
+	// deliveries to removed callbacks fail without being posted
+	ok(t, app.NotifyQBCallbacks(s, succeeds)(context.Background(), e))
+	ok(t, mockDB.DeleteQBCallback(c.ID))
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now())
+	ok(t, err)
+	d = mockDB.delivery(3)
+	equals(t, atlas.QBCallbackDeliveryFailed, d.Status)
+	equals(t, "callback was removed", d.LastError)
+	equals(t, 4, len(receiver.bodies))
+
+	// deliveries whose secret cannot be opened are not posted unsigned
+	unsealed, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: ts.URL, Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	_, err = s.Queue(unsealed, []byte(`{}`))
+	ok(t, err)
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now())
+	ok(t, err)
+	d = mockDB.delivery(4)
+	equals(t, atlas.QBCallbackDeliveryPending, d.Status)
+	equals(t, "callback secret cannot be opened", d.LastError)
+	equals(t, 4, len(receiver.bodies))
+}
+
+func TestSendQBCallbacksPublicOnly(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	internal := &callbackReceiver{}
+	its := httptest.NewServer(internal)
+	defer its.Close()
+	// answers with a redirect to the internal server and a body that is none of our business
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Location", its.URL)
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		w.Write([]byte("internal secrets"))
+	}))
+	defer ts.Close()
+
+	mockDB := &MockQBCallbackDB{}
+	box := newTestSecretBox(t)
+	c, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: ts.URL, Secret: sealCallbackSecret(t, box), IsActive: true})
+	ok(t, err)
+	s := main.NewQBCallbackSender(mockDB, box)
+	_, err = s.Queue(c, []byte(`{}`))
+	ok(t, err)
+
+	// redirects are not followed and answers are not kept
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now())
+	ok(t, err)
+	d := mockDB.delivery(1)
+	equals(t, atlas.QBCallbackDeliveryPending, d.Status)
+	equals(t, http.StatusTemporaryRedirect, d.ResponseCode)
+	equals(t, "callback answered 307", d.LastError)
+	equals(t, 0, len(internal.bodies))
+
+	// private addresses are refused when dialing, whatever the callback was registered with
+	main.AllowPrivateAddresses(false)
+	defer main.AllowPrivateAddresses(true)
+	_, err = app.SendQBCallbacks(context.Background(), s, time.Now().Add(s.MaxBackoff))
+	ok(t, err)
+	d = mockDB.delivery(1)
+	equals(t, 2, d.Attempts)
+	equals(t, 0, d.ResponseCode)
+	// the org is not told which addresses the callback resolved to
+	equals(t, "callback could not be reached", d.LastError)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"atlas"
+	"context"
+	"time"
+)
+
+// RunQBCDCPoller polls Quickbooks for changes of every org every interval until ctx is done, so that changes are
+// picked up even when the webhook is down.
+func (a *App) RunQBCDCPoller(ctx context.Context, db atlas.QBCDCDB, qb QBClientSource, q *QBWebhookQueue, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.PollQBChanges(ctx, db, qb, q); err != nil {
+			a.Logr.Log("error polling quickbooks for changes: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollQBChanges asks Quickbooks for the changes of every connected org since its checkpoint and queues them
+// like webhook payloads, so that they are processed the same way. Changes the webhook already queued are
+// dropped as duplicates, but polled changes are taken however old they are, since they come from Quickbooks
+// itself rather than from a payload that could be replayed. Orgs that are not connected are skipped, and errors for one org are logged without
+// stopping the others; its checkpoint is then kept so that the next poll asks again.
+func (a *App) PollQBChanges(ctx context.Context, db atlas.QBCDCDB, qb QBClientSource, q *QBWebhookQueue) error {
+	orgs, err := db.GetAllQBOrgs()
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		if org.QBCompanyID == "" || org.QBNeedsReconnect {
+			continue
+		}
+		if err := a.pollOrgChanges(db, qb(ctx, org), q, org); err != nil {
+			a.Logr.Log("error polling quickbooks for changes of org %d (%s): %s", org.ID, org.Name, err)
+		}
+	}
+	return nil
+}
+
+// maxQBCDCPages is how many pages of changes are asked for an org in one poll. The next poll goes on from
+// where it stopped.
+const maxQBCDCPages = 10
+
+// qbCDCRetention is how long Quickbooks keeps the changes it returns from CDC queries.
+const qbCDCRetention = 30 * 24 * time.Hour
+
+// pollOrgChanges queues the changes of an org since its checkpoint and moves the checkpoint on. Quickbooks
+// returns at most qbCDCPageSize changes per entity, so when an entity fills its page the checkpoint is set to
+// the time of its last change instead, and Quickbooks is asked again from there.
+//
+// Changes Quickbooks no longer keeps, or a full page of changes made at the same time, cannot be polled; the
+// org is then marked for a full resync.
+func (a *App) pollOrgChanges(db atlas.QBCDCDB, qb *QBClient, q *QBWebhookQueue, org *atlas.QBOrg) error {
+	now := time.Now()
+	since, err := db.GetQBCDCCheckpoint(org.ID)
+	if err != nil {
+		return err
+	}
+	if oldest := now.Add(-qbCDCRetention); since.Before(oldest) {
+		// nothing was polled before the first poll, but a checkpoint this old has missed changes
+		if !since.IsZero() {
+			a.Logr.Log("changes of org %d since %s are no longer kept by quickbooks, marking it for a full resync", org.ID, since)
+			if err = db.MarkQBOrgForFullResync(org.ID); err != nil {
+				return err
+			}
+		}
+		since = oldest
+	}
+	for page := 1; ; page++ {
+		changes, asOf, err := qb.ChangesSince(atlas.QBChangeEntities, since)
+		if err != nil {
+			return err
+		}
+		if asOf.IsZero() {
+			asOf = now
+		}
+
+		if len(changes) > 0 {
+			var n atlas.QBEventNotification
+			n.RealmID = org.QBCompanyID
+			n.DataChangeEvent.Entities = changes
+			e, err := a.queueQBChanges(q, org.ID, org.QBCompanyID, &atlas.QBWebhookPayload{EventNotifications: []atlas.QBEventNotification{n}}, 0)
+			if err != nil {
+				return err
+			}
+			if e != nil {
+				a.Logr.Log("queued changes of org %d missed by the webhook as event %d", org.ID, e.ID)
+			}
+		}
+
+		checkpoint, full := qbCDCPageEnd(changes, asOf)
+		if full && !checkpoint.After(since) {
+			// a whole page changed at the same time, asking again would return the same page
+			a.Logr.Log("more than %d changes of an entity of org %d at %s, marking it for a full resync", qbCDCPageSize, org.ID, checkpoint)
+			if err = db.MarkQBOrgForFullResync(org.ID); err != nil {
+				return err
+			}
+			checkpoint, full = asOf, false
+		}
+		if err = db.SaveQBCDCCheckpoint(org.ID, checkpoint); err != nil {
+			return err
+		}
+		if !full || page >= maxQBCDCPages {
+			return nil
+		}
+		since = checkpoint
+	}
+}
+
+// qbCDCPageEnd returns the time the changes Quickbooks returned are complete up to, and whether an entity filled
+// its page so that there may be more changes. That is asOf unless a page is full, and otherwise the time of
+// the last change of the full page that ends first.
+func qbCDCPageEnd(changes []atlas.QBEntityChange, asOf time.Time) (time.Time, bool) {
+	counts := map[string]int{}
+	last := map[string]time.Time{}
+	for _, c := range changes {
+		counts[c.Name]++
+		if at, err := c.LastUpdatedTime(); err == nil && at.After(last[c.Name]) {
+			last[c.Name] = at
+		}
+	}
+	end, full := asOf, false
+	for name, n := range counts {
+		if n >= qbCDCPageSize && (!full || last[name].Before(end)) {
+			end, full = last[name], true
+		}
+	}
+	return end, full
+}
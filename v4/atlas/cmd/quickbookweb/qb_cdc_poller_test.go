@@ -0,0 +1,199 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+type MockQBCDCDB struct {
+	hasError    bool
+	orgs        []*atlas.QBOrg
+	checkpoints map[int]time.Time
+	resyncs     []int
+}
+
+func (db *MockQBCDCDB) GetAllQBOrgs() ([]*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.orgs, nil
+}
+
+func (db *MockQBCDCDB) GetQBCDCCheckpoint(orgID int) (time.Time, error) {
+	if db.hasError {
+		return time.Time{}, fmt.Errorf("some error")
+	}
+	return db.checkpoints[orgID], nil
+}
+
+func (db *MockQBCDCDB) SaveQBCDCCheckpoint(orgID int, checkpoint time.Time) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	if db.checkpoints == nil {
+		db.checkpoints = map[int]time.Time{}
+	}
+	db.checkpoints[orgID] = checkpoint
+	return nil
+}
+
+func (db *MockQBCDCDB) MarkQBOrgForFullResync(orgID int) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.resyncs = append(db.resyncs, orgID)
+	return nil
+}
+
+// qbMetaData returns the MetaData of an entity created and last updated at the given times.
+func qbMetaData(created, updated time.Time) map[string]interface{} {
+	return map[string]interface{}{"CreateTime": created.Format(time.RFC3339), "LastUpdatedTime": updated.Format(time.RFC3339)}
+}
+
+func TestPollQBChanges(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	now := time.Now().Truncate(time.Second)
+	api := newMockQBAPI(org1.QBCompanyID)
+	api.add("Customer", map[string]interface{}{"Id": "1", "DisplayName": "Ho", "MetaData": qbMetaData(now.Add(-2*time.Hour), now.Add(-time.Hour))})
+	api.add("Item", map[string]interface{}{"Id": "2", "Name": "Coffee", "MetaData": qbMetaData(now.Add(-10*time.Minute), now.Add(-10*time.Minute))})
+	api.add("Invoice", map[string]interface{}{"Id": "3", "status": "Deleted", "MetaData": qbMetaData(now.Add(-time.Hour), now.Add(-5*time.Minute))})
+	// older than the changes webhooks are taken for, but polled changes come from Quickbooks itself
+	api.add("Customer", map[string]interface{}{"Id": "4", "DisplayName": "Old", "MetaData": qbMetaData(now.Add(-72*time.Hour), now.Add(-48*time.Hour))})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	notConnected := org1
+	notConnected.ID, notConnected.QBCompanyID = 2, ""
+	mockDB := &MockQBCDCDB{orgs: []*atlas.QBOrg{connectedOrg1(), &notConnected}}
+
+	// the webhook got the new item before, in its own time format
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1}}, enforceWebhooks, q)
+	item := atlas.QBEntityChange{Name: "Item", ID: "2", Operation: "Create", LastUpdated: now.Add(-10 * time.Minute).Format("2006-01-02T15:04:05.000-0700")}
+	w := postWebhook(h, webhookChangesPayload(webhookChange{org1.QBCompanyID, item}))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 1, len(store.events))
+
+	err := app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, 2, len(store.events))
+	e := store.event(2)
+	equals(t, org1.ID, e.OrgID)
+	equals(t, org1.QBCompanyID, e.RealmID)
+	var p atlas.QBWebhookPayload
+	ok(t, json.Unmarshal(e.Payload, &p))
+	equals(t, 1, len(p.EventNotifications))
+	var got []string
+	for _, c := range p.EventNotifications[0].DataChangeEvent.Entities {
+		got = append(got, c.Operation+" "+c.Name+" "+c.ID)
+	}
+	equals(t, []string{"Update Customer 1", "Update Customer 4", "Delete Invoice 3"}, got)
+	checkpoint := mockDB.checkpoints[org1.ID]
+	assert(t, !checkpoint.Before(now), "expected the checkpoint to move to the time of the poll, got %s", checkpoint)
+	_, polled := mockDB.checkpoints[notConnected.ID]
+	assert(t, !polled, "expected orgs that are not connected to be skipped")
+	equals(t, 0, len(mockDB.resyncs))
+
+	// the polled changes go through the same processing as webhook payloads
+	var handled []string
+	handlers := map[string]main.QBEntityChangeHandler{}
+	for _, name := range atlas.QBChangeEntities {
+		handlers[name] = func(ctx context.Context, orgID int, c atlas.QBEntityChange) error {
+			handled = append(handled, c.Operation+" "+c.Name+" "+c.ID)
+			return nil
+		}
+	}
+	ok(t, app.QBWebhookDispatcher(handlers)(context.Background(), &e))
+	equals(t, got, handled)
+
+	// nothing changed since the checkpoint
+	err = app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, 2, len(store.events))
+
+	// a checkpoint older than Quickbooks keeps changes for has missed some
+	mockDB.checkpoints[org1.ID] = now.Add(-40 * 24 * time.Hour)
+	err = app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, []int{org1.ID}, mockDB.resyncs)
+	assert(t, !mockDB.checkpoints[org1.ID].Before(now), "expected the checkpoint to move on, got %s", mockDB.checkpoints[org1.ID])
+	equals(t, 2, len(store.events))
+
+	// the checkpoint is kept while Quickbooks cannot be reached
+	mockDB.checkpoints[org1.ID] = now.Add(-time.Hour)
+	ts.Close()
+	err = app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, now.Add(-time.Hour), mockDB.checkpoints[org1.ID])
+	equals(t, 2, len(store.events))
+
+	mockDB.hasError = true
+	err = app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	assert(t, err != nil, "expected an error when orgs cannot be listed")
+}
+
+func TestPollQBChangesPages(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	now := time.Now().Truncate(time.Second)
+	api := newMockQBAPI(org1.QBCompanyID)
+	// more changes than Quickbooks returns at once
+	for i := 0; i < 1500; i++ {
+		updated := now.Add(time.Duration(i-1500) * time.Second)
+		api.add("Customer", map[string]interface{}{"Id": fmt.Sprint(i + 1), "DisplayName": "Ho", "MetaData": qbMetaData(updated.Add(-time.Hour), updated)})
+	}
+	api.add("Item", map[string]interface{}{"Id": "1", "Name": "Coffee", "MetaData": qbMetaData(now.Add(-time.Hour), now.Add(-time.Minute))})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	mockDB := &MockQBCDCDB{orgs: []*atlas.QBOrg{connectedOrg1()}}
+
+	err := app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, 2, len(store.events))
+	customers := map[string]bool{}
+	for id := 1; id <= 2; id++ {
+		var p atlas.QBWebhookPayload
+		ok(t, json.Unmarshal(store.event(id).Payload, &p))
+		for _, c := range p.EventNotifications[0].DataChangeEvent.Entities {
+			if c.Name == "Customer" {
+				customers[c.ID] = true
+			}
+		}
+	}
+	equals(t, 1500, len(customers))
+	checkpoint := mockDB.checkpoints[org1.ID]
+	assert(t, !checkpoint.Before(now), "expected the checkpoint to move to the time of the last poll, got %s", checkpoint)
+}
+
+func TestPollQBChangesStuckPage(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	now := time.Now().Truncate(time.Second)
+	api := newMockQBAPI(org1.QBCompanyID)
+	// more changes made at the same time than Quickbooks returns at once
+	for i := 0; i < 1200; i++ {
+		api.add("Customer", map[string]interface{}{"Id": fmt.Sprint(i + 1), "DisplayName": "Ho", "MetaData": qbMetaData(now.Add(-2*time.Hour), now.Add(-time.Hour))})
+	}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	mockDB := &MockQBCDCDB{orgs: []*atlas.QBOrg{connectedOrg1()}}
+
+	err := app.PollQBChanges(context.Background(), mockDB, newTestQBClientSource(ts), q)
+	ok(t, err)
+	equals(t, []int{org1.ID}, mockDB.resyncs)
+	checkpoint := mockDB.checkpoints[org1.ID]
+	assert(t, !checkpoint.Before(now), "expected the checkpoint to move on to the time of the poll, got %s", checkpoint)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OrgChangeStream streams the changes of orgs to V4 devices as Server-Sent Events. Changes are kept in the
+// database, so that a device can resume from the last event it got and streams on other nodes see them within
+// PollInterval; streams on the node a change is published on get it right away.
+//
+// Like ThrottleBacklog it holds a token for every open stream, and refuses new streams once all tokens, or
+// MaxPerOrg streams of an org, are taken. Streams are long-lived, so they are refused at once instead of
+// waiting in a backlog.
+type OrgChangeStream struct {
+	db     atlas.QBOrgChangeDB
+	tokens chan token
+
+	mu          sync.Mutex
+	subscribers map[int]map[chan struct{}]bool
+
+	MaxPerOrg    int
+	BatchSize    int
+	PollInterval time.Duration
+	Heartbeat    time.Duration
+	Retry        time.Duration
+}
+
+// NewOrgChangeStream returns an OrgChangeStream allowing limit open streams, at most perOrg of them for an org.
+func NewOrgChangeStream(db atlas.QBOrgChangeDB, limit int, perOrg int) *OrgChangeStream {
+	s := &OrgChangeStream{
+		db:           db,
+		tokens:       make(chan token, limit),
+		subscribers:  map[int]map[chan struct{}]bool{},
+		MaxPerOrg:    perOrg,
+		BatchSize:    100,
+		PollInterval: 10 * time.Second,
+		Heartbeat:    30 * time.Second,
+		Retry:        5 * time.Second,
+	}
+	for i := 0; i < limit; i++ {
+		s.tokens <- token{}
+	}
+	return s
+}
+
+// Publish saves changes, all of them or none, and wakes the streams of their orgs on this node.
+func (s *OrgChangeStream) Publish(changes ...atlas.QBOrgChange) ([]*atlas.QBOrgChange, error) {
+	now := time.Now()
+	for i := range changes {
+		if changes[i].DateCreated.IsZero() {
+			changes[i].DateCreated = now
+		}
+	}
+	saved, err := s.db.CreateQBOrgChanges(changes)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range changes {
+		for wake := range s.subscribers[c.OrgID] {
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return saved, nil
+}
+
+// subscribe takes a token for a stream of an org and returns the channel the stream is woken on, or false if
+// there are too many streams.
+func (s *OrgChangeStream) subscribe(orgID int) (chan struct{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subscribers[orgID]) >= s.MaxPerOrg {
+		return nil, false
+	}
+	select {
+	case <-s.tokens:
+	default:
+		return nil, false
+	}
+	if s.subscribers[orgID] == nil {
+		s.subscribers[orgID] = map[chan struct{}]bool{}
+	}
+	wake := make(chan struct{}, 1)
+	s.subscribers[orgID][wake] = true
+	return wake, true
+}
+
+func (s *OrgChangeStream) unsubscribe(orgID int, wake chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers[orgID], wake)
+	if len(s.subscribers[orgID]) == 0 {
+		delete(s.subscribers, orgID)
+	}
+	s.tokens <- token{}
+}
+
+// orgChangeEvent is the data of a change event.
+type orgChangeEvent struct {
+	ID          int       `json:"id"`
+	ShopID      int       `json:"shopId"`
+	Kind        string    `json:"kind"`
+	EntityID    string    `json:"entityId"`
+	Operation   string    `json:"operation"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+// OrgChangeStreamHandler streams the changes of the org of the token, and of its shop, as Server-Sent Events
+// named after their kind, such as item or customer. A device resumes with the Last-Event-ID header, or the
+// lastEventId query param where it cannot set headers, and otherwise only gets the changes from now on.
+func (a *App) OrgChangeStreamHandler(s *OrgChangeStream) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		orgID, _ := ctx.Value(server.OrgKeyName).(int)
+		shopID, _ := ctx.Value(server.ShopKeyName).(int)
+		if orgID == 0 {
+			a.Rndr.JSON(w, http.StatusForbidden, server.NewAPIResponse(http.StatusForbidden, "Your token is not for an organisation"))
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			a.Logr.Log("error streaming changes of org %d: response writer cannot flush", orgID)
+			a.Rndr.JSON(w, http.StatusInternalServerError, server.NewAPIResponse(http.StatusInternalServerError, "Streaming is not supported"))
+			return
+		}
+		lastID, err := lastEventID(req)
+		if err != nil {
+			a.Rndr.JSON(w, http.StatusBadRequest, server.NewAPIResponse(http.StatusBadRequest, "Last-Event-ID must be an event ID"))
+			return
+		}
+		if lastID < 0 {
+			lastID, err = s.db.GetLatestQBOrgChangeID(orgID)
+			if err != nil {
+				a.Logr.Log("error retrieving latest change of org %d: %s", orgID, err)
+				a.Rndr.JSON(w, http.StatusInternalServerError, server.NewAPIResponse(http.StatusInternalServerError, "Error retrieving changes"))
+				return
+			}
+		}
+
+		wake, ok := s.subscribe(orgID)
+		if !ok {
+			a.Logr.Log("refusing change stream of shop %d of org %d: too many streams", shopID, orgID)
+			a.Rndr.JSON(w, http.StatusLocked, server.NewAPIResponse(http.StatusLocked, errCapacityExceeded))
+			return
+		}
+		defer s.unsubscribe(orgID, wake)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", s.Retry/time.Millisecond)
+		flusher.Flush()
+
+		poll := time.NewTicker(s.PollInterval)
+		defer poll.Stop()
+		heartbeat := time.NewTicker(s.Heartbeat)
+		defer heartbeat.Stop()
+		for {
+			lastID, err = s.writeChanges(ctx, w, orgID, shopID, lastID)
+			if err != nil {
+				a.Logr.Log("error streaming changes of org %d: %s", orgID, err)
+				return
+			}
+			flusher.Flush()
+			select {
+			case <-ctx.Done():
+				return
+			case <-wake:
+			case <-poll.C:
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+				flusher.Flush()
+			}
+		}
+	})
+}
+
+// writeChanges writes the changes of an org after lastID that are for the shop, and returns the ID of the last
+// change it went through.
+func (s *OrgChangeStream) writeChanges(ctx context.Context, w http.ResponseWriter, orgID int, shopID int, lastID int) (int, error) {
+	for ctx.Err() == nil {
+		changes, err := s.db.GetQBOrgChangesSince(orgID, lastID, s.BatchSize)
+		if err != nil {
+			return lastID, err
+		}
+		for _, c := range changes {
+			lastID = c.ID
+			if c.ShopID != 0 && c.ShopID != shopID {
+				continue
+			}
+			data, err := json.Marshal(orgChangeEvent{c.ID, c.ShopID, c.Kind, c.EntityID, c.Operation, c.DateCreated})
+			if err != nil {
+				return lastID, err
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.ID, c.Kind, data); err != nil {
+				return lastID, err
+			}
+		}
+		if len(changes) < s.BatchSize {
+			break
+		}
+	}
+	return lastID, nil
+}
+
+// lastEventID returns the ID of the last event a device got, -1 if it is not resuming.
+func lastEventID(req *http.Request) (int, error) {
+	v := req.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = req.URL.Query().Get("lastEventId")
+	}
+	if v == "" {
+		return -1, nil
+	}
+	id, err := strconv.Atoi(v)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid last event id %q", v)
+	}
+	return id, nil
+}
+
+// OrgChangeHandlers returns the handlers publishing the Quickbooks changes that V4 devices are told about, to be
+// given to QBWebhookDispatcher.
+//
+// Prices are the unit prices of items, and Quickbooks does not say which fields of an item changed, so every
+// item that is created or updated is published as a price change as well. The changes of an entity are published
+// together, so that a retried event does not publish some of them twice.
+func (a *App) OrgChangeHandlers(s *OrgChangeStream) map[string]QBEntityChangeHandler {
+	publish := func(kinds ...string) QBEntityChangeHandler {
+		return func(ctx context.Context, orgID int, c atlas.QBEntityChange) error {
+			var changes []atlas.QBOrgChange
+			for _, kind := range kinds {
+				if kind == atlas.OrgChangePrice && c.Operation != "Create" && c.Operation != "Update" {
+					continue
+				}
+				changes = append(changes, atlas.QBOrgChange{OrgID: orgID, Kind: kind, EntityID: c.ID, Operation: c.Operation})
+			}
+			_, err := s.Publish(changes...)
+			return err
+		}
+	}
+	return map[string]QBEntityChangeHandler{
+		atlas.QBEntityItem:     publish(atlas.OrgChangeItem, atlas.OrgChangePrice),
+		atlas.QBEntityCustomer: publish(atlas.OrgChangeCustomer),
+	}
+}
@@ -0,0 +1,242 @@
+package main_test
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+type MockQBOrgChangeDB struct {
+	hasError bool
+	// failKind fails saving changes of this kind, and the changes saved with them
+	failKind string
+	mu       sync.Mutex
+	changes  []atlas.QBOrgChange
+}
+
+func (db *MockQBOrgChangeDB) CreateQBOrgChanges(changes []atlas.QBOrgChange) ([]*atlas.QBOrgChange, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	for _, c := range changes {
+		if c.Kind == db.failKind {
+			return nil, fmt.Errorf("some error")
+		}
+	}
+	var saved []*atlas.QBOrgChange
+	for _, c := range changes {
+		c.ID = len(db.changes) + 1
+		db.changes = append(db.changes, c)
+		copied := c
+		saved = append(saved, &copied)
+	}
+	return saved, nil
+}
+
+func (db *MockQBOrgChangeDB) GetQBOrgChangesSince(orgID int, afterID int, limit int) ([]*atlas.QBOrgChange, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var changes []*atlas.QBOrgChange
+	for i := range db.changes {
+		c := db.changes[i]
+		if c.OrgID == orgID && c.ID > afterID && len(changes) < limit {
+			changes = append(changes, &c)
+		}
+	}
+	return changes, nil
+}
+
+func (db *MockQBOrgChangeDB) GetLatestQBOrgChangeID(orgID int) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return 0, fmt.Errorf("some error")
+	}
+	latest := 0
+	for _, c := range db.changes {
+		if c.OrgID == orgID {
+			latest = c.ID
+		}
+	}
+	return latest, nil
+}
+
+// newChangeStreamServer serves the change stream to shop1 of org1, as authAtlasMiddleware would.
+func newChangeStreamServer(s *main.OrgChangeStream) *httptest.Server {
+	h := app.OrgChangeStreamHandler(s)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "" {
+			ctx := context.WithValue(req.Context(), server.OrgKeyName, org1.ID)
+			req = req.WithContext(context.WithValue(ctx, server.ShopKeyName, shop1.ID))
+		}
+		h.ServeHTTP(w, req)
+	}))
+}
+
+func openChangeStream(t *testing.T, ts *httptest.Server, lastEventID string) (*http.Response, *bufio.Reader) {
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	ok(t, err)
+	req.Header.Set("Authorization", "some-token")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	ok(t, err)
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// readChangeEvent returns the id and name of the next event of a stream, skipping comments and the retry field.
+func readChangeEvent(t *testing.T, r *bufio.Reader) (string, string) {
+	type event struct{ id, name string }
+	events := make(chan event, 1)
+	go func() {
+		var e event
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(events)
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case line == "" && e.id != "":
+				events <- e
+				return
+			}
+		}
+	}()
+	select {
+	case e, open := <-events:
+		assert(t, open, "expected an event before the stream closed")
+		return e.id, e.name
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a change event")
+	}
+	return "", ""
+}
+
+func TestOrgChangeStreamHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOrgChangeDB{}
+	for _, c := range []atlas.QBOrgChange{
+		{OrgID: org1.ID, Kind: atlas.OrgChangeItem, EntityID: "2", Operation: "Update"},
+		{OrgID: org1.ID, ShopID: 2, Kind: atlas.OrgChangePrice, EntityID: "2", Operation: "Update"},
+		{OrgID: 42, Kind: atlas.OrgChangeCustomer, EntityID: "7", Operation: "Create"},
+		{OrgID: org1.ID, ShopID: shop1.ID, Kind: atlas.OrgChangePaymentMethod, EntityID: "3", Operation: "Update"},
+	} {
+		_, err := mockDB.CreateQBOrgChanges([]atlas.QBOrgChange{c})
+		ok(t, err)
+	}
+	s := main.NewOrgChangeStream(mockDB, 10, 2)
+	ts := newChangeStreamServer(s)
+	defer ts.Close()
+
+	// resuming gets the missed changes of the org and of its shop
+	resp, r := openChangeStream(t, ts, "0")
+	defer resp.Body.Close()
+	equals(t, http.StatusOK, resp.StatusCode)
+	equals(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	id, name := readChangeEvent(t, r)
+	equals(t, "1", id)
+	equals(t, "item", name)
+	id, name = readChangeEvent(t, r)
+	equals(t, "4", id)
+	equals(t, "payment_method", name)
+
+	// a new stream only gets the changes from now on, and open streams get them right away
+	fresh, freshR := openChangeStream(t, ts, "")
+	defer fresh.Body.Close()
+	equals(t, http.StatusOK, fresh.StatusCode)
+	handlers := app.OrgChangeHandlers(s)
+	err := handlers[atlas.QBEntityCustomer](context.Background(), org1.ID, atlas.QBEntityChange{Name: "Customer", ID: "9", Operation: "Create"})
+	ok(t, err)
+	id, name = readChangeEvent(t, r)
+	equals(t, "5", id)
+	equals(t, "customer", name)
+	id, name = readChangeEvent(t, freshR)
+	equals(t, "5", id)
+	equals(t, "customer", name)
+	_, hasPaymentHandler := handlers[atlas.QBEntityPayment]
+	assert(t, !hasPaymentHandler, "expected only items and customers to be published")
+
+	// items hold the prices, so a changed item may have a new price, a deleted one has none
+	err = handlers[atlas.QBEntityItem](context.Background(), org1.ID, atlas.QBEntityChange{Name: "Item", ID: "2", Operation: "Update"})
+	ok(t, err)
+	err = handlers[atlas.QBEntityItem](context.Background(), org1.ID, atlas.QBEntityChange{Name: "Item", ID: "3", Operation: "Delete"})
+	ok(t, err)
+	for _, want := range [][2]string{{"6", "item"}, {"7", "price"}, {"8", "item"}} {
+		id, name = readChangeEvent(t, r)
+		equals(t, want[0], id)
+		equals(t, want[1], name)
+	}
+
+	// an item is published with its price or not at all, so that retrying the event does not publish it twice
+	mockDB.failKind = atlas.OrgChangePrice
+	err = handlers[atlas.QBEntityItem](context.Background(), org1.ID, atlas.QBEntityChange{Name: "Item", ID: "4", Operation: "Create"})
+	assert(t, err != nil, "expected the error of saving the price")
+	mockDB.failKind = ""
+	err = handlers[atlas.QBEntityItem](context.Background(), org1.ID, atlas.QBEntityChange{Name: "Item", ID: "4", Operation: "Create"})
+	ok(t, err)
+	for _, want := range [][2]string{{"9", "item"}, {"10", "price"}} {
+		id, name = readChangeEvent(t, r)
+		equals(t, want[0], id)
+		equals(t, want[1], name)
+	}
+	equals(t, 10, len(mockDB.changes))
+
+	// an org can only have so many streams
+	third, _ := openChangeStream(t, ts, "")
+	third.Body.Close()
+	equals(t, http.StatusLocked, third.StatusCode)
+
+	// and a stream is given back once the device goes away
+	fresh.Body.Close()
+	code := 0
+	for i := 0; i < 20 && code != http.StatusOK; i++ {
+		time.Sleep(50 * time.Millisecond)
+		again, _ := openChangeStream(t, ts, "")
+		code = again.StatusCode
+		again.Body.Close()
+	}
+	equals(t, http.StatusOK, code)
+}
+
+func TestOrgChangeStreamHandlerErrors(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOrgChangeDB{}
+	ts := newChangeStreamServer(main.NewOrgChangeStream(mockDB, 1, 1))
+	defer ts.Close()
+
+	resp, _ := openChangeStream(t, ts, "nope")
+	resp.Body.Close()
+	equals(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err := http.Get(ts.URL)
+	ok(t, err)
+	resp.Body.Close()
+	equals(t, http.StatusForbidden, resp.StatusCode)
+
+	mockDB.hasError = true
+	resp, _ = openChangeStream(t, ts, "")
+	resp.Body.Close()
+	equals(t, http.StatusInternalServerError, resp.StatusCode)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"atlas"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// QBAPIBaseURL and QBSandboxAPIBaseURL are the Quickbooks Online accounting API hosts.
+	QBAPIBaseURL        = "https://quickbooks.api.intuit.com"
+	QBSandboxAPIBaseURL = "https://sandbox-quickbooks.api.intuit.com"
+
+	qbMinorVersion = "65"
+)
+
+// QBAPIError is an error answered by the Quickbooks API, with the messages of its fault.
+type QBAPIError struct {
+	StatusCode int
+	Messages   []string
+}
+
+func (e *QBAPIError) Error() string {
+	return fmt.Sprintf("quickbooks api error %d: %s", e.StatusCode, strings.Join(e.Messages, "; "))
+}
+
+// QBClient calls the Quickbooks accounting API for one company.
+type QBClient struct {
+	baseURL string
+	realmID string
+	http    *http.Client
+}
+
+// QBClientSource returns an API client authorised with the Quickbooks credentials of an org.
+type QBClientSource func(ctx context.Context, org *atlas.QBOrg) *QBClient
+
+// NewQBClientSource returns a QBClientSource for the API at baseURL, usually QBAPIBaseURL. An expired
+// access token is refreshed on the fly and saved with db at once, since Intuit may rotate the refresh token
+// and the old one stops working.
+func NewQBClientSource(conf *oauth2.Config, baseURL string, db atlas.QBOrgTokenSaver) QBClientSource {
+	return func(ctx context.Context, org *atlas.QBOrg) *QBClient {
+		src := &savingQBTokenSource{src: conf.TokenSource(ctx, qbOrgToken(org)), db: db, org: org}
+		return &QBClient{
+			baseURL: strings.TrimSuffix(baseURL, "/"),
+			realmID: org.QBCompanyID,
+			http:    oauth2.NewClient(ctx, src),
+		}
+	}
+}
+
+// savingQBTokenSource saves the tokens of an org whenever its token source refreshes them. The org is updated
+// as well, so that callers saving it later do not put the old tokens back.
+type savingQBTokenSource struct {
+	src oauth2.TokenSource
+	db  atlas.QBOrgTokenSaver
+
+	mu  sync.Mutex
+	org *atlas.QBOrg
+}
+
+// Token returns the token of the org, saving it first if it was refreshed. When saving fails the error is
+// returned, and saving is tried again on the next call.
+func (s *savingQBTokenSource) Token() (*oauth2.Token, error) {
+	tok, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok.AccessToken == s.org.QBAccessToken {
+		return tok, nil
+	}
+	refreshed := *s.org
+	setQBOrgToken(&refreshed, tok)
+	if _, err = s.db.UpdateQBOrg(refreshed); err != nil {
+		return nil, fmt.Errorf("error saving refreshed token of org %d: %s", s.org.ID, err)
+	}
+	*s.org = refreshed
+	return tok, nil
+}
+
+type qbFault struct {
+	Fault struct {
+		Error []struct {
+			Message string
+			Detail  string
+		}
+	}
+}
+
+func (c *QBClient) do(method, path string, query url.Values, body, reply interface{}) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("minorversion", qbMinorVersion)
+	u := fmt.Sprintf("%s/v3/company/%s/%s?%s", c.baseURL, url.PathEscape(c.realmID), path, query.Encode())
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &QBAPIError{StatusCode: resp.StatusCode}
+		var f qbFault
+		if json.Unmarshal(b, &f) == nil {
+			for _, e := range f.Fault.Error {
+				apiErr.Messages = append(apiErr.Messages, strings.TrimSpace(e.Message+" "+e.Detail))
+			}
+		}
+		return apiErr
+	}
+	return json.Unmarshal(b, reply)
+}
+
+// query runs a Quickbooks query and decodes its QueryResponse into reply.
+func (c *QBClient) query(q string, reply interface{}) error {
+	var resp struct {
+		QueryResponse json.RawMessage
+	}
+	err := c.do(http.MethodGet, "query", url.Values{"query": {q}}, nil, &resp)
+	if err != nil {
+		return err
+	}
+	if len(resp.QueryResponse) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.QueryResponse, reply)
+}
+
+type qbPaymentMethod struct {
+	ID     string `json:"Id,omitempty"`
+	Name   string
+	Type   string
+	Active bool
+}
+
+func (pm qbPaymentMethod) remote() atlas.QBRemotePaymentMethod {
+	return atlas.QBRemotePaymentMethod{QBID: pm.ID, Name: pm.Name, Type: pm.Type, Active: pm.Active}
+}
+
+// PaymentMethods returns every payment method of the company, inactive ones included.
+func (c *QBClient) PaymentMethods() ([]atlas.QBRemotePaymentMethod, error) {
+	var reply struct {
+		PaymentMethod []qbPaymentMethod
+	}
+	err := c.query("select * from PaymentMethod where Active in (true, false) maxresults 1000", &reply)
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]atlas.QBRemotePaymentMethod, len(reply.PaymentMethod))
+	for i, pm := range reply.PaymentMethod {
+		methods[i] = pm.remote()
+	}
+	return methods, nil
+}
+
+// CreatePaymentMethod adds an active payment method to the company.
+func (c *QBClient) CreatePaymentMethod(name, typ string) (*atlas.QBRemotePaymentMethod, error) {
+	var reply struct {
+		PaymentMethod qbPaymentMethod
+	}
+	err := c.do(http.MethodPost, "paymentmethod", nil, qbPaymentMethod{Name: name, Type: typ, Active: true}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	pm := reply.PaymentMethod.remote()
+	return &pm, nil
+}
+
+type qbDepartment struct {
+	ID     string `json:"Id"`
+	Name   string
+	Active bool
+}
+
+// Departments returns every department of the company, inactive ones included.
+func (c *QBClient) Departments() ([]atlas.QBRemoteDepartment, error) {
+	var reply struct {
+		Department []qbDepartment
+	}
+	err := c.query("select * from Department where Active in (true, false) maxresults 1000", &reply)
+	if err != nil {
+		return nil, err
+	}
+	departments := make([]atlas.QBRemoteDepartment, len(reply.Department))
+	for i, d := range reply.Department {
+		id, err := strconv.Atoi(d.ID)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected department id %q: %s", d.ID, err)
+		}
+		departments[i] = atlas.QBRemoteDepartment{QBID: id, Name: d.Name, Active: d.Active}
+	}
+	return departments, nil
+}
+
+type qbAccount struct {
+	ID                 string `json:"Id"`
+	Name               string
+	FullyQualifiedName string
+	AccountType        string
+	AccountSubType     string
+	Active             bool
+}
+
+// Accounts returns the active accounts of the chart of accounts of the company.
+func (c *QBClient) Accounts() ([]atlas.QBRemoteAccount, error) {
+	var reply struct {
+		Account []qbAccount
+	}
+	err := c.query("select * from Account maxresults 1000", &reply)
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]atlas.QBRemoteAccount, len(reply.Account))
+	for i, a := range reply.Account {
+		accounts[i] = atlas.QBRemoteAccount{
+			QBID:               a.ID,
+			Name:               a.Name,
+			FullyQualifiedName: a.FullyQualifiedName,
+			AccountType:        a.AccountType,
+			AccountSubType:     a.AccountSubType,
+			Active:             a.Active,
+		}
+	}
+	return accounts, nil
+}
+
+type qbRef struct {
+	Value string `json:"value"`
+	Name  string `json:"name,omitempty"`
+}
+
+type qbTaxCode struct {
+	ID               string `json:"Id"`
+	Name             string
+	Active           bool
+	Taxable          bool
+	SalesTaxRateList struct {
+		TaxRateDetail []struct {
+			TaxRateRef qbRef
+		}
+	}
+}
+
+// TaxCodes returns the active tax codes of the company.
+func (c *QBClient) TaxCodes() ([]atlas.QBRemoteTaxCode, error) {
+	var reply struct {
+		TaxCode []qbTaxCode
+	}
+	err := c.query("select * from TaxCode maxresults 1000", &reply)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]atlas.QBRemoteTaxCode, len(reply.TaxCode))
+	for i, tc := range reply.TaxCode {
+		codes[i] = atlas.QBRemoteTaxCode{QBID: tc.ID, Name: tc.Name, Active: tc.Active, Taxable: tc.Taxable}
+		for _, d := range tc.SalesTaxRateList.TaxRateDetail {
+			codes[i].SalesTaxRateIDs = append(codes[i].SalesTaxRateIDs, d.TaxRateRef.Value)
+		}
+	}
+	return codes, nil
+}
+
+type qbTaxRate struct {
+	ID        string `json:"Id"`
+	Name      string
+	RateValue float64
+	Active    bool
+}
+
+// TaxRates returns the active tax rates of the company.
+func (c *QBClient) TaxRates() ([]atlas.QBRemoteTaxRate, error) {
+	var reply struct {
+		TaxRate []qbTaxRate
+	}
+	err := c.query("select * from TaxRate maxresults 1000", &reply)
+	if err != nil {
+		return nil, err
+	}
+	rates := make([]atlas.QBRemoteTaxRate, len(reply.TaxRate))
+	for i, tr := range reply.TaxRate {
+		rates[i] = atlas.QBRemoteTaxRate{QBID: tr.ID, Name: tr.Name, RateValue: tr.RateValue, Active: tr.Active}
+	}
+	return rates, nil
+}
+
+type qbCDCEntity struct {
+	ID       string `json:"Id"`
+	Status   string `json:"status"`
+	MetaData struct {
+		CreateTime      string
+		LastUpdatedTime string
+	}
+}
+
+func (e qbCDCEntity) change(name string) atlas.QBEntityChange {
+	c := atlas.QBEntityChange{Name: name, ID: e.ID, Operation: "Update", LastUpdated: e.MetaData.LastUpdatedTime}
+	switch {
+	case e.Status == "Deleted":
+		c.Operation = "Delete"
+	case e.MetaData.CreateTime != "" && e.MetaData.CreateTime == e.MetaData.LastUpdatedTime:
+		c.Operation = "Create"
+	}
+	return c
+}
+
+// qbCDCPageSize is the most changes of an entity Quickbooks returns for one CDC query.
+const qbCDCPageSize = 1000
+
+// ChangesSince returns the changes of the entities since the given time, at most qbCDCPageSize per entity,
+// with the time of the company they are current as of. Quickbooks keeps changes for 30 days.
+func (c *QBClient) ChangesSince(entities []string, since time.Time) ([]atlas.QBEntityChange, time.Time, error) {
+	var reply struct {
+		CDCResponse []struct {
+			QueryResponse []map[string]json.RawMessage
+		}
+		Time time.Time `json:"time"`
+	}
+	query := url.Values{"entities": {strings.Join(entities, ",")}, "changedSince": {since.Format(time.RFC3339)}}
+	err := c.do(http.MethodGet, "cdc", query, nil, &reply)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var changes []atlas.QBEntityChange
+	for _, r := range reply.CDCResponse {
+		for _, qr := range r.QueryResponse {
+			for _, name := range entities {
+				raw, ok := qr[name]
+				if !ok {
+					continue
+				}
+				var changed []qbCDCEntity
+				if err = json.Unmarshal(raw, &changed); err != nil {
+					return nil, time.Time{}, fmt.Errorf("unexpected changes of %s: %s", name, err)
+				}
+				for _, e := range changed {
+					changes = append(changes, e.change(name))
+				}
+			}
+		}
+	}
+	return changes, reply.Time, nil
+}
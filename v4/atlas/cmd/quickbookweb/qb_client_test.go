@@ -0,0 +1,215 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+// MockQBAPI stands in for the Quickbooks accounting API of one company. Entities are kept as the JSON
+// objects the API answers with, keyed by entity name.
+type MockQBAPI struct {
+	mu       sync.Mutex
+	realmID  string
+	entities map[string][]map[string]interface{}
+	created  map[string]int
+	// failCreate makes every create answer with a validation fault.
+	failCreate bool
+}
+
+func newMockQBAPI(realmID string) *MockQBAPI {
+	return &MockQBAPI{realmID: realmID, entities: map[string][]map[string]interface{}{}, created: map[string]int{}}
+}
+
+func (api *MockQBAPI) add(entity string, fields map[string]interface{}) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if _, ok := fields["Id"]; !ok {
+		fields["Id"] = fmt.Sprint(100 + len(api.entities[entity]))
+	}
+	api.entities[entity] = append(api.entities[entity], fields)
+}
+
+var qbQueryEntityRe = regexp.MustCompile(`(?i)^select \* from (\w+)`)
+
+func (api *MockQBAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	fault := func(code int, msg string) {
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Fault": map[string]interface{}{"Error": []map[string]string{{"Message": msg}}, "type": "ValidationFault"},
+		})
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		fault(http.StatusUnauthorized, "AuthenticationFailed")
+		return
+	}
+	prefix := "/v3/company/" + api.realmID + "/"
+	if !strings.HasPrefix(req.URL.Path, prefix) {
+		fault(http.StatusNotFound, "unknown company")
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, prefix)
+
+	if req.Method == http.MethodGet && path == "query" {
+		m := qbQueryEntityRe.FindStringSubmatch(req.URL.Query().Get("query"))
+		if m == nil {
+			fault(http.StatusBadRequest, "QueryParserError")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"QueryResponse": map[string]interface{}{m[1]: api.entities[m[1]]},
+			"time":          time.Now(),
+		})
+		return
+	}
+
+	if req.Method == http.MethodGet && path == "cdc" {
+		since, err := time.Parse(time.RFC3339, req.URL.Query().Get("changedSince"))
+		if err != nil {
+			fault(http.StatusBadRequest, "invalid changedSince")
+			return
+		}
+		var responses []map[string]interface{}
+		for _, entity := range strings.Split(req.URL.Query().Get("entities"), ",") {
+			// changed since, that time included, oldest first, a page at most
+			var changed []map[string]interface{}
+			for _, fields := range api.entities[entity] {
+				if !qbLastUpdated(fields).Before(since) {
+					changed = append(changed, fields)
+				}
+			}
+			sort.Slice(changed, func(i, j int) bool { return qbLastUpdated(changed[i]).Before(qbLastUpdated(changed[j])) })
+			if len(changed) > 1000 {
+				changed = changed[:1000]
+			}
+			responses = append(responses, map[string]interface{}{entity: changed, "startPosition": 1, "maxResults": len(changed)})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"CDCResponse": []map[string]interface{}{{"QueryResponse": responses}},
+			"time":        time.Now(),
+		})
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		if api.failCreate {
+			fault(http.StatusBadRequest, "Duplicate Name Exists Error")
+			return
+		}
+		for entity := range api.entities {
+			if strings.ToLower(entity) == path {
+				var fields map[string]interface{}
+				json.NewDecoder(req.Body).Decode(&fields)
+				fields["Id"] = fmt.Sprint(100 + len(api.entities[entity]))
+				api.entities[entity] = append(api.entities[entity], fields)
+				api.created[entity]++
+				json.NewEncoder(w).Encode(map[string]interface{}{entity: fields})
+				return
+			}
+		}
+	}
+	fault(http.StatusBadRequest, "unsupported operation")
+}
+
+// newTestQBClientSource returns a QBClientSource for a MockQBAPI served by ts.
+func newTestQBClientSource(ts *httptest.Server) main.QBClientSource {
+	return main.NewQBClientSource(newTestOAuth2Config(ts.URL+"/token"), ts.URL, &MockQBOrgTokenDB{})
+}
+
+// connectedOrg1 is org1 with a fresh Quickbooks access token.
+func connectedOrg1() *atlas.QBOrg {
+	o := org1
+	o.QBAccessToken = "access"
+	o.QBRefreshToken = "refresh"
+	o.QBTokenExpiry = time.Now().Add(time.Hour)
+	return &o
+}
+
+func TestQBClientPaymentMethods(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	api := newMockQBAPI(org1.QBCompanyID)
+	api.add("PaymentMethod", map[string]interface{}{"Id": "1", "Name": "Cash", "Type": "NON_CREDIT_CARD", "Active": true})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	qb := newTestQBClientSource(ts)(context.Background(), connectedOrg1())
+
+	methods, err := qb.PaymentMethods()
+	ok(t, err)
+	equals(t, []atlas.QBRemotePaymentMethod{{QBID: "1", Name: "Cash", Type: "NON_CREDIT_CARD", Active: true}}, methods)
+
+	created, err := qb.CreatePaymentMethod("Visa", atlas.PaymentMethodCreditCard)
+	ok(t, err)
+	equals(t, "Visa", created.Name)
+	assert(t, created.QBID != "", "expected the created payment method to have an id")
+
+	api.failCreate = true
+	_, err = qb.CreatePaymentMethod("Visa", atlas.PaymentMethodCreditCard)
+	apiErr, isAPIErr := err.(*main.QBAPIError)
+	assert(t, isAPIErr, "expected a QBAPIError instead got %v", err)
+	equals(t, http.StatusBadRequest, apiErr.StatusCode)
+	equals(t, []string{"Duplicate Name Exists Error"}, apiErr.Messages)
+
+	// another company
+	other := connectedOrg1()
+	other.QBCompanyID = "999"
+	_, err = newTestQBClientSource(ts)(context.Background(), other).PaymentMethods()
+	assert(t, err != nil, "expected an error for an unknown company")
+}
+
+func TestQBClientSourceSavesRefreshedToken(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	tokenServer := newMockIntuitTokenServer(t)
+	defer tokenServer.Close()
+	ts := httptest.NewServer(newMockQBAPI(org1.QBCompanyID))
+	defer ts.Close()
+	mockDB := &MockQBOrgTokenDB{}
+	qb := main.NewQBClientSource(newTestOAuth2Config(tokenServer.URL), ts.URL, mockDB)
+
+	org := connectedOrg1()
+	_, err := qb(context.Background(), org).PaymentMethods()
+	ok(t, err)
+	equals(t, 0, len(mockDB.updated))
+
+	org.QBRefreshToken = "good-refresh"
+	org.QBTokenExpiry = time.Now().Add(-time.Minute)
+	_, err = qb(context.Background(), org).PaymentMethods()
+	ok(t, err)
+	equals(t, 1, len(mockDB.updated))
+	equals(t, "new-access", mockDB.updated[org.ID].QBAccessToken)
+	equals(t, "new-refresh", mockDB.updated[org.ID].QBRefreshToken)
+	equals(t, "new-access", org.QBAccessToken)
+
+	// the refreshed token is saved again when saving failed
+	org.QBAccessToken = "old-access"
+	org.QBRefreshToken = "good-refresh"
+	org.QBTokenExpiry = time.Now().Add(-time.Minute)
+	mockDB.hasError = true
+	client := qb(context.Background(), org)
+	_, err = client.PaymentMethods()
+	assert(t, err != nil, "expected an error when the refreshed token cannot be saved")
+	mockDB.hasError = false
+	_, err = client.PaymentMethods()
+	ok(t, err)
+	equals(t, "new-access", org.QBAccessToken)
+}
+
+// qbLastUpdated returns the LastUpdatedTime of the MetaData of an entity.
+func qbLastUpdated(fields map[string]interface{}) time.Time {
+	meta, _ := fields["MetaData"].(map[string]interface{})
+	updated, _ := time.Parse(time.RFC3339, fmt.Sprint(meta["LastUpdatedTime"]))
+	return updated
+}
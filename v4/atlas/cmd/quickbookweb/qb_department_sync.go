@@ -0,0 +1,80 @@
+package main
+
+import (
+	"atlas"
+	"context"
+	"time"
+)
+
+// RunQBDepartmentSync renames the shops mapped to Quickbooks departments every interval until ctx is done,
+// so that renaming a department in Quickbooks renames its shop.
+func (a *App) RunQBDepartmentSync(ctx context.Context, db atlas.QBDepartmentSyncDB, qb QBClientSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.SyncQBDepartmentNames(ctx, db, qb); err != nil {
+			a.Logr.Log("error syncing quickbooks department names: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SyncQBDepartmentNames gives every shop mapped to a Quickbooks department the current name of the department.
+// Orgs that are not connected are skipped, and errors for one org are logged without stopping the others.
+func (a *App) SyncQBDepartmentNames(ctx context.Context, db atlas.QBDepartmentSyncDB, qb QBClientSource) error {
+	orgs, err := db.GetAllQBOrgs()
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		if org.QBCompanyID == "" || org.QBNeedsReconnect {
+			continue
+		}
+		if err := a.syncOrgDepartmentNames(db, qb(ctx, org), org); err != nil {
+			a.Logr.Log("error syncing quickbooks department names of org %d (%s): %s", org.ID, org.Name, err)
+		}
+	}
+	return nil
+}
+
+func (a *App) syncOrgDepartmentNames(db atlas.QBShopDepartmentDB, qb *QBClient, org *atlas.QBOrg) error {
+	shops, err := db.GetAllQBShopsForOrg(org.ID)
+	if err != nil {
+		return err
+	}
+	mapped := false
+	for _, s := range shops {
+		if s.QBDepartmentID != 0 {
+			mapped = true
+			break
+		}
+	}
+	if !mapped {
+		return nil
+	}
+
+	departments, err := qb.Departments()
+	if err != nil {
+		return err
+	}
+	names := map[int]string{}
+	for _, d := range departments {
+		names[d.QBID] = d.Name
+	}
+	for _, s := range shops {
+		name, ok := names[s.QBDepartmentID]
+		if s.QBDepartmentID == 0 || !ok || name == "" || name == s.Name {
+			continue
+		}
+		a.Logr.Log("renaming shop %d of org %d from %q to %q after its quickbooks department", s.ID, org.ID, s.Name, name)
+		s.Name = name
+		if _, err = db.UpdateQBShop(*s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+)
+
+type MockQBShopDB struct {
+	MockQBOrgDB
+	orgs     []*atlas.QBOrg
+	shops    map[int]*atlas.QBShop
+	sessions []atlas.AtlasSession
+}
+
+func (db *MockQBShopDB) GetAllQBOrgs() ([]*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.orgs, nil
+}
+
+func (db *MockQBShopDB) GetAllQBShopsForOrg(orgID int) ([]*atlas.QBShop, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var shops []*atlas.QBShop
+	for _, s := range db.shops {
+		if s.OrgID == orgID {
+			copied := *s
+			shops = append(shops, &copied)
+		}
+	}
+	sort.Slice(shops, func(i, j int) bool { return shops[i].ID < shops[j].ID })
+	return shops, nil
+}
+
+func (db *MockQBShopDB) CreateQBShop(s atlas.QBShop) (*atlas.QBShop, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.shops == nil {
+		db.shops = map[int]*atlas.QBShop{}
+	}
+	s.ID = len(db.shops) + 1
+	db.shops[s.ID] = &s
+	return &s, nil
+}
+
+func (db *MockQBShopDB) UpdateQBShop(s atlas.QBShop) (*atlas.QBShop, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.shops[s.ID] = &s
+	return &s, nil
+}
+
+func (db *MockQBShopDB) CreateAtlasSession(s atlas.AtlasSession) (*atlas.AtlasSession, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.sessions = append(db.sessions, s)
+	return &s, nil
+}
+
+func newDepartmentsQBAPI() *MockQBAPI {
+	api := newMockQBAPI(org1.QBCompanyID)
+	api.add("Department", map[string]interface{}{"Id": "1", "Name": "Orchard", "Active": true})
+	api.add("Department", map[string]interface{}{"Id": "2", "Name": "Bugis", "Active": true})
+	api.add("Department", map[string]interface{}{"Id": "3", "Name": "Closed Down", "Active": false})
+	return api
+}
+
+func TestWebStart5PostHandlerDepartments(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := httptest.NewServer(newDepartmentsQBAPI())
+	defer ts.Close()
+	mockDB := &MockQBShopDB{MockQBOrgDB: MockQBOrgDB{org: connectedOrg1()}}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{
+		user1.ID: {UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingShop, OrgID: org1.ID},
+	}
+	// Orchard already has a shop
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Orchard", OrgID: org1.ID, QBDepartmentID: 1})
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.WebStart5PostHandler(mockDB, newTestQBClientSource(ts))), user1, nil)
+
+	// already mapped, inactive or unknown departments are not offered
+	orgID := fmt.Sprint(org1.ID)
+	w := test("POST", url.Values{"orgid": {orgID}, "department": {"1", "3", "42"}})
+	equals(t, "/start/5", w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.shops))
+
+	// the shops go to the org being set up, whatever org the form names
+	w = test("POST", url.Values{"orgid": {"42"}, "department": {"2"}})
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+	equals(t, atlas.QBShop{ID: 2, Name: "Bugis", OrgID: org1.ID, QBDepartmentID: 2}, *mockDB.shops[2])
+	equals(t, 1, len(mockDB.sessions))
+	equals(t, "Bugis", mockDB.sessions[0].ShopName)
+	assert(t, mockDB.onboardings[user1.ID].IsComplete(), "expected the setup to be complete")
+
+	// naming a shop by hand still works
+	w = test("POST", url.Values{"orgid": {orgID}, "name": {"Pop-up"}})
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+	equals(t, 0, mockDB.shops[3].QBDepartmentID)
+
+	// but not in an org of someone else
+	w = test("POST", url.Values{"orgid": {"42"}, "name": {"Pop-up"}})
+	equals(t, http.StatusForbidden, w.Code)
+	equals(t, 3, len(mockDB.shops))
+}
+
+func TestSyncQBDepartmentNames(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	api := newDepartmentsQBAPI()
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	disconnected := *connectedOrg1()
+	disconnected.ID = 2
+	disconnected.QBNeedsReconnect = true
+	mockDB := &MockQBShopDB{orgs: []*atlas.QBOrg{connectedOrg1(), &disconnected}}
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Orchard", OrgID: org1.ID, QBDepartmentID: 1})
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Old Bugis", OrgID: org1.ID, QBDepartmentID: 2})
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Pop-up", OrgID: org1.ID})
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Old Bugis", OrgID: disconnected.ID, QBDepartmentID: 2})
+
+	err := app.SyncQBDepartmentNames(context.Background(), mockDB, newTestQBClientSource(ts))
+	ok(t, err)
+	equals(t, "Orchard", mockDB.shops[1].Name)
+	equals(t, "Bugis", mockDB.shops[2].Name)
+	equals(t, "Pop-up", mockDB.shops[3].Name)
+	equals(t, "Old Bugis", mockDB.shops[4].Name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"atlas"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	intuitAuthURL         = "https://appcenter.intuit.com/connect/oauth2"
+	intuitTokenURL        = "https://oauth.platform.intuit.com/oauth2/v1/tokens/bearer"
+	intuitAccountingScope = "com.intuit.quickbooks.accounting"
+
+	// intuitRefreshExpiryKey is the extra field Intuit returns with the lifetime of the refresh token in seconds.
+	intuitRefreshExpiryKey = "x_refresh_token_expires_in"
+)
+
+// NewQuickbooksOAuth2Config returns the oauth2 configuration for the Intuit authorization-code flow.
+func NewQuickbooksOAuth2Config(clientID, clientSecret, redirectURL string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{intuitAccountingScope},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   intuitAuthURL,
+			TokenURL:  intuitTokenURL,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+	}
+}
+
+// setQBOrgToken copies the credentials of an oauth2 token onto the org.
+func setQBOrgToken(org *atlas.QBOrg, tok *oauth2.Token) {
+	org.QBAccessToken = tok.AccessToken
+	org.QBTokenExpiry = tok.Expiry
+	org.QBNeedsReconnect = false
+	// Intuit may rotate the refresh token on every refresh, so only overwrite it when we get a new one.
+	if tok.RefreshToken != "" {
+		org.QBRefreshToken = tok.RefreshToken
+	}
+	if secs := tokenExtraSeconds(tok, intuitRefreshExpiryKey); secs > 0 {
+		org.QBRefreshTokenExpiry = time.Now().Add(time.Duration(secs) * time.Second)
+	}
+}
+
+// qbOrgToken rebuilds the oauth2 token stored on the org.
+func qbOrgToken(org *atlas.QBOrg) *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  org.QBAccessToken,
+		RefreshToken: org.QBRefreshToken,
+		TokenType:    "Bearer",
+		Expiry:       org.QBTokenExpiry,
+	}
+}
+
+// tokenExtraSeconds reads a numeric extra field from the token response, returning 0 if it is absent.
+func tokenExtraSeconds(tok *oauth2.Token, key string) int64 {
+	switch v := tok.Extra(key).(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"atlas"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SyncQBPaymentMethods reconciles the payment methods of an org with the PaymentMethod list of its Quickbooks
+// company, and saves the outcome for the review page.
+//
+// Payment methods not linked yet are matched to Quickbooks ones by name, ignoring case, and get their QBID.
+// Enabled ones without a match are created in Quickbooks; disabled ones are left alone. Active Quickbooks
+// payment methods nobody matched are imported, disabled, so that an admin can decide whether the POS offers
+// them. Type mismatches, and links to payment methods made inactive or deleted in Quickbooks, are only
+// reported as conflicts.
+//
+// The sync can be run again at any time: links are saved as they are made, so a sync cut short by an API
+// error picks up where it stopped.
+func (a *App) SyncQBPaymentMethods(db atlas.QBPaymentMethodSyncDB, qb *QBClient, org *atlas.QBOrg) (*atlas.QBPaymentMethodSync, error) {
+	local, err := db.GetAllQBPaymentMethodsForOrg(org.ID)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := qb.PaymentMethods()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := map[string]atlas.QBRemotePaymentMethod{}
+	byName := map[string]atlas.QBRemotePaymentMethod{}
+	for _, r := range remote {
+		byID[r.QBID] = r
+		byName[paymentMethodNameKey(r.Name)] = r
+	}
+	used := map[string]bool{}
+	for _, pm := range local {
+		if pm.QBID != "" {
+			used[pm.QBID] = true
+		}
+	}
+
+	s := atlas.QBPaymentMethodSync{OrgID: org.ID, RanAt: time.Now()}
+	conflict := func(pm *atlas.QBPaymentMethod, r atlas.QBRemotePaymentMethod, kind string) {
+		s.Conflicts = append(s.Conflicts, atlas.QBPaymentMethodConflict{
+			PaymentMethodID: pm.ID,
+			Name:            pm.Name,
+			QBID:            r.QBID,
+			Kind:            kind,
+			Type:            pm.Type,
+			QBType:          r.Type,
+		})
+	}
+
+	for _, pm := range local {
+		if pm.QBID != "" {
+			r, ok := byID[pm.QBID]
+			switch {
+			case !ok:
+				conflict(pm, atlas.QBRemotePaymentMethod{QBID: pm.QBID}, atlas.ConflictDeletedInQB)
+			case r.Type != pm.Type:
+				conflict(pm, r, atlas.ConflictTypeMismatch)
+			case !r.Active && !pm.IsDisabled:
+				conflict(pm, r, atlas.ConflictInactiveInQB)
+			}
+			continue
+		}
+
+		r, ok := byName[paymentMethodNameKey(pm.Name)]
+		if ok && !used[r.QBID] {
+			if r.Type != pm.Type {
+				conflict(pm, r, atlas.ConflictTypeMismatch)
+				used[r.QBID] = true
+				continue
+			}
+			if !r.Active && !pm.IsDisabled {
+				conflict(pm, r, atlas.ConflictInactiveInQB)
+			}
+			used[r.QBID] = true
+			pm.QBID = r.QBID
+			if _, err = db.UpdateQBPaymentMethod(*pm); err != nil {
+				return nil, err
+			}
+			s.Linked++
+			continue
+		}
+		if pm.IsDisabled {
+			continue
+		}
+
+		created, err := qb.CreatePaymentMethod(pm.Name, pm.Type)
+		if err != nil {
+			return nil, fmt.Errorf("error creating payment method %q in quickbooks: %s", pm.Name, err)
+		}
+		used[created.QBID] = true
+		pm.QBID = created.QBID
+		if _, err = db.UpdateQBPaymentMethod(*pm); err != nil {
+			return nil, err
+		}
+		s.Created++
+	}
+
+	codes := map[string]bool{}
+	for _, pm := range local {
+		codes[strings.ToLower(pm.Code)] = true
+	}
+	for _, r := range remote {
+		if used[r.QBID] || !r.Active {
+			continue
+		}
+		pm := atlas.QBPaymentMethod{
+			OrgID:       org.ID,
+			Name:        r.Name,
+			DisplayName: r.Name,
+			Code:        uniquePaymentMethodCode(r.Name, codes),
+			Type:        r.Type,
+			QBID:        r.QBID,
+			IsDisabled:  true,
+			Position:    len(local) + s.Imported + 1,
+		}
+		if _, err = db.CreateQBPaymentMethod(pm); err != nil {
+			return nil, err
+		}
+		codes[pm.Code] = true
+		s.Imported++
+	}
+
+	saved, err := db.SaveQBPaymentMethodSync(s)
+	if err != nil {
+		return nil, err
+	}
+	a.Logr.Log("synced payment methods of org %d (%s) with quickbooks: %d linked, %d created, %d imported, %d conflicts",
+		org.ID, org.Name, s.Linked, s.Created, s.Imported, len(s.Conflicts))
+	return saved, nil
+}
+
+func paymentMethodNameKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+var nonCodeRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// uniquePaymentMethodCode derives a valid code from a payment method name that is not one of taken.
+func uniquePaymentMethodCode(name string, taken map[string]bool) string {
+	base := strings.Trim(nonCodeRe.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if base == "" {
+		base = "qb"
+	}
+	if len(base) > 20 {
+		base = base[:20]
+	}
+	code := base
+	for i := 2; taken[code]; i++ {
+		suffix := fmt.Sprintf("_%d", i)
+		if len(base)+len(suffix) > 20 {
+			code = base[:20-len(suffix)] + suffix
+		} else {
+			code = base + suffix
+		}
+	}
+	return code
+}
@@ -0,0 +1,110 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSyncQBPaymentMethods(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	api := newMockQBAPI(org1.QBCompanyID)
+	api.add("PaymentMethod", map[string]interface{}{"Id": "1", "Name": "cash (sgd)", "Type": "NON_CREDIT_CARD", "Active": true})
+	api.add("PaymentMethod", map[string]interface{}{"Id": "2", "Name": "Nets", "Type": "CREDIT_CARD", "Active": true})
+	api.add("PaymentMethod", map[string]interface{}{"Id": "3", "Name": "Visa", "Type": "CREDIT_CARD", "Active": false})
+	api.add("PaymentMethod", map[string]interface{}{"Id": "4", "Name": "Diners Club", "Type": "CREDIT_CARD", "Active": true})
+	api.add("PaymentMethod", map[string]interface{}{"Id": "5", "Name": "Cheque", "Type": "NON_CREDIT_CARD", "Active": false})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	org := connectedOrg1()
+	qb := newTestQBClientSource(ts)(context.Background(), org)
+
+	mockDB := newMockQBPaymentMethodDB()
+	mockDB.methods[6].IsDisabled = true // Voucher
+	s, err := app.SyncQBPaymentMethods(mockDB, qb, org)
+	ok(t, err)
+
+	// Cash (SGD) and Visa matched by name, Nets has the wrong type
+	equals(t, 2, s.Linked)
+	equals(t, "1", mockDB.methods[1].QBID)
+	equals(t, "3", mockDB.methods[7].QBID)
+	equals(t, "", mockDB.methods[5].QBID)
+	equals(t, []atlas.QBPaymentMethodConflict{
+		{PaymentMethodID: 5, Name: "Nets", QBID: "2", Kind: atlas.ConflictTypeMismatch, Type: "NON_CREDIT_CARD", QBType: "CREDIT_CARD"},
+		{PaymentMethodID: 7, Name: "Visa", QBID: "3", Kind: atlas.ConflictInactiveInQB, Type: "CREDIT_CARD", QBType: "CREDIT_CARD"},
+	}, s.Conflicts)
+	// the other enabled ones are created in Quickbooks, the disabled Voucher is not
+	equals(t, 5, s.Created)
+	equals(t, 5, api.created["PaymentMethod"])
+	equals(t, "", mockDB.methods[6].QBID)
+	// Diners Club is imported disabled, the inactive Cheque is not
+	equals(t, 1, s.Imported)
+	diners := mockDB.methods[10]
+	equals(t, "Diners Club", diners.Name)
+	equals(t, "diners_club", diners.Code)
+	equals(t, "4", diners.QBID)
+	assert(t, diners.IsDisabled, "expected imported payment method to be disabled")
+	equals(t, 1, len(mockDB.syncs))
+
+	// a second sync finds nothing new
+	s, err = app.SyncQBPaymentMethods(mockDB, qb, org)
+	ok(t, err)
+	equals(t, 0, s.Linked+s.Created+s.Imported)
+	equals(t, 2, len(s.Conflicts))
+
+	// Diners Club is deleted in Quickbooks
+	pms := api.entities["PaymentMethod"]
+	api.entities["PaymentMethod"] = append(pms[:3], pms[4:]...)
+	s, err = app.SyncQBPaymentMethods(mockDB, qb, org)
+	ok(t, err)
+	equals(t, 3, len(s.Conflicts))
+	equals(t, atlas.QBPaymentMethodConflict{PaymentMethodID: 10, Name: "Diners Club", QBID: "4", Kind: atlas.ConflictDeletedInQB}, s.Conflicts[2])
+}
+
+func TestQBPaymentMethodSyncPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	api := newMockQBAPI(org1.QBCompanyID)
+	api.add("PaymentMethod", map[string]interface{}{"Id": "1", "Name": "Cash (SGD)", "Type": "NON_CREDIT_CARD", "Active": true})
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	mockDB := &MockQBOrgDB{MockQBPaymentMethodDB: *newMockQBPaymentMethodDB(), org: connectedOrg1()}
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBPaymentMethodSyncPostHandler(mockDB, newTestQBClientSource(ts))), true, params)
+	reviewURL := fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", org1.ID)
+
+	w := test("POST", url.Values{})
+	equals(t, reviewURL, w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.syncs))
+	equals(t, 8, api.created["PaymentMethod"])
+
+	// a failed sync is retried later rather than failing the request
+	api.failCreate = true
+	mockDB.CreateQBPaymentMethod(atlas.QBPaymentMethod{OrgID: org1.ID, Name: "PayNow", Code: "paynow", Type: atlas.PaymentMethodNonCreditCard})
+	w = test("POST", url.Values{})
+	equals(t, reviewURL, w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.syncs))
+
+	// orgs that need to reconnect are not synced
+	mockDB.org.QBNeedsReconnect = true
+	api.failCreate = false
+	w = test("POST", url.Values{})
+	equals(t, reviewURL, w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.syncs))
+	// and are offered to reconnect on the review page
+	page := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBPaymentMethodReviewPageHandler(mockDB)), true, params)
+	w = page("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	assert(t, strings.Contains(w.Body.String(), fmt.Sprintf("/orgs/%d/quickbooks/connect", org1.ID)), "expected a reconnect form on the review page")
+
+	mockDB.org = nil
+	mockDB.MockQBPaymentMethodDB.hasError = true
+	w = page("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
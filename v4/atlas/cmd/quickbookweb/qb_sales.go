@@ -0,0 +1,22 @@
+package main
+
+import (
+	"atlas"
+	"context"
+)
+
+// QBSalesPoster posts the sales the POS of an org recorded to Quickbooks.
+type QBSalesPoster func(ctx context.Context, orgID int) error
+
+// RequireQBTaxMappings returns a QBSalesPoster that posts the sales of an org with post only while every active
+// POS tax rate of the org has a Quickbooks tax code. Until then it returns the *atlas.UnmappedTaxRatesError of
+// atlas.CheckQBTaxMappings and posts nothing, since sales posted without their tax code would be booked
+// without GST.
+func RequireQBTaxMappings(db atlas.QBTaxMappingDB, post QBSalesPoster) QBSalesPoster {
+	return func(ctx context.Context, orgID int) error {
+		if err := atlas.CheckQBTaxMappings(db, orgID); err != nil {
+			return err
+		}
+		return post(ctx, orgID)
+	}
+}
@@ -0,0 +1,34 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+func TestRequireQBTaxMappings(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	taxDB := newMockQBTaxDB()
+	var posted []int
+	post := main.RequireQBTaxMappings(taxDB, func(ctx context.Context, orgID int) error {
+		posted = append(posted, orgID)
+		return nil
+	})
+
+	err := post(context.Background(), org1.ID)
+	_, isUnmapped := err.(*atlas.UnmappedTaxRatesError)
+	assert(t, isUnmapped, "expected an UnmappedTaxRatesError, got %v", err)
+	equals(t, 0, len(posted))
+
+	taxDB.mappings = append(taxDB.mappings,
+		atlas.QBTaxMapping{OrgID: org1.ID, POSTaxRateID: 1, QBTaxCodeID: "2", QBTaxRateID: "3"},
+		atlas.QBTaxMapping{OrgID: org1.ID, POSTaxRateID: 2, QBTaxCodeID: "4"})
+	ok(t, post(context.Background(), org1.ID))
+	equals(t, []int{org1.ID}, posted)
+
+	taxDB.hasError = true
+	assert(t, post(context.Background(), org1.ID) != nil, "expected an error when the tax rates cannot be read")
+	equals(t, 1, len(posted))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"atlas"
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// RunQBTokenRefresher refreshes the Quickbooks access tokens of every org every interval until ctx is done.
+// Tokens expiring within window are refreshed.
+func (a *App) RunQBTokenRefresher(ctx context.Context, db atlas.QBOrgTokenDB, conf *oauth2.Config, interval, window time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.RefreshQBOrgTokens(ctx, db, conf, window); err != nil {
+			a.Logr.Log("error refreshing quickbooks tokens: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RefreshQBOrgTokens refreshes the access token of every org expiring within window and saves it.
+// Orgs whose refresh token is expired or rejected by Intuit are flagged with QBNeedsReconnect so that the
+// admin is asked to connect again; transient errors are only logged and retried on the next run.
+func (a *App) RefreshQBOrgTokens(ctx context.Context, db atlas.QBOrgTokenDB, conf *oauth2.Config, window time.Duration) error {
+	orgs, err := db.GetAllQBOrgs()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, org := range orgs {
+		if org.QBRefreshToken == "" || org.QBNeedsReconnect {
+			continue
+		}
+		if org.QBTokenExpiry.Sub(now) > window {
+			continue
+		}
+
+		if !org.QBRefreshTokenExpiry.IsZero() && org.QBRefreshTokenExpiry.Before(now) {
+			a.Logr.Log("refresh token for org %d (%s) has expired", org.ID, org.Name)
+			a.flagQBOrgReconnect(db, org)
+			continue
+		}
+
+		// without an access token the token source is forced to use the refresh token
+		tok, err := conf.TokenSource(ctx, &oauth2.Token{RefreshToken: org.QBRefreshToken}).Token()
+		if err != nil {
+			a.Logr.Log("error refreshing token for org %d (%s): %s", org.ID, org.Name, err)
+			if isRejectedRefresh(err) {
+				a.flagQBOrgReconnect(db, org)
+			}
+			continue
+		}
+
+		setQBOrgToken(org, tok)
+		if _, err = db.UpdateQBOrg(*org); err != nil {
+			a.Logr.Log("error saving refreshed token for org %d (%s): %s", org.ID, org.Name, err)
+		}
+	}
+	return nil
+}
+
+func (a *App) flagQBOrgReconnect(db atlas.QBOrgTokenDB, org *atlas.QBOrg) {
+	org.QBNeedsReconnect = true
+	if _, err := db.UpdateQBOrg(*org); err != nil {
+		a.Logr.Log("error flagging org %d (%s) for reconnect: %s", org.ID, org.Name, err)
+	}
+}
+
+// isRejectedRefresh reports whether Intuit refused the refresh token itself, as opposed to a network or server error.
+func isRejectedRefresh(err error) bool {
+	re, ok := err.(*oauth2.RetrieveError)
+	if !ok || re.Response == nil {
+		return false
+	}
+	return re.Response.StatusCode == http.StatusBadRequest || re.Response.StatusCode == http.StatusUnauthorized
+}
@@ -0,0 +1,69 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type MockQBOrgTokenDB struct {
+	hasError bool
+	orgs     []*atlas.QBOrg
+	updated  map[int]atlas.QBOrg
+}
+
+func (db *MockQBOrgTokenDB) GetAllQBOrgs() ([]*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.orgs, nil
+}
+
+func (db *MockQBOrgTokenDB) UpdateQBOrg(o atlas.QBOrg) (*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.updated == nil {
+		db.updated = map[int]atlas.QBOrg{}
+	}
+	db.updated[o.ID] = o
+	return &o, nil
+}
+
+func TestRefreshQBOrgTokens(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := newMockIntuitTokenServer(t)
+	defer ts.Close()
+	conf := newTestOAuth2Config(ts.URL)
+	now := time.Now()
+
+	mockDB := &MockQBOrgTokenDB{orgs: []*atlas.QBOrg{
+		// expiring soon
+		{ID: 1, QBRefreshToken: "good-refresh", QBTokenExpiry: now.Add(5 * time.Minute)},
+		// still fresh
+		{ID: 2, QBRefreshToken: "good-refresh", QBTokenExpiry: now.Add(time.Hour)},
+		// revoked by Intuit
+		{ID: 3, QBRefreshToken: "revoked", QBTokenExpiry: now.Add(-time.Minute)},
+		// refresh token lapsed
+		{ID: 4, QBRefreshToken: "good-refresh", QBTokenExpiry: now, QBRefreshTokenExpiry: now.Add(-time.Hour)},
+		// never connected
+		{ID: 5},
+	}}
+	err := app.RefreshQBOrgTokens(context.Background(), mockDB, conf, 10*time.Minute)
+	ok(t, err)
+
+	equals(t, 3, len(mockDB.updated))
+	refreshed := mockDB.updated[1]
+	equals(t, "new-access", refreshed.QBAccessToken)
+	equals(t, "new-refresh", refreshed.QBRefreshToken)
+	assert(t, refreshed.QBTokenExpiry.After(now.Add(30*time.Minute)), "expected new expiry instead got %s", refreshed.QBTokenExpiry)
+	assert(t, !refreshed.QBNeedsReconnect, "expected refreshed org not to need a reconnect")
+	assert(t, mockDB.updated[3].QBNeedsReconnect, "expected revoked org to be flagged for reconnect")
+	assert(t, mockDB.updated[4].QBNeedsReconnect, "expected lapsed org to be flagged for reconnect")
+
+	mockDB = &MockQBOrgTokenDB{hasError: true}
+	err = app.RefreshQBOrgTokens(context.Background(), mockDB, conf, 10*time.Minute)
+	assert(t, err != nil, "expected error when orgs cannot be listed")
+}
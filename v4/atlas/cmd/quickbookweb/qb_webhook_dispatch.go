@@ -0,0 +1,53 @@
+package main
+
+import (
+	"atlas"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// QBEntityChangeHandler handles a change of an entity of the Quickbooks company of an org. A change is handled
+// again when the event holding it is retried, so handlers have to be idempotent.
+type QBEntityChangeHandler func(ctx context.Context, orgID int, c atlas.QBEntityChange) error
+
+// QBWebhookDispatcher returns a QBWebhookProcessor that fans the entity changes of an event out to the handler
+// of their entity, one of atlas.QBChangeEntities. Changes of entities without a handler are skipped, and the
+// event fails if any handler fails. If the only failures are handlers held up by unmapped tax rates, their
+// *atlas.UnmappedTaxRatesError is returned as is, so that the queue parks the event rather than using up its
+// attempts.
+func (a *App) QBWebhookDispatcher(handlers map[string]QBEntityChangeHandler) QBWebhookProcessor {
+	return func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+		var payload atlas.QBWebhookPayload
+		if err := json.Unmarshal(e.Payload, &payload); err != nil {
+			return fmt.Errorf("error reading webhook event %d: %s", e.ID, err)
+		}
+		var failures []string
+		var unmapped error
+		for _, n := range payload.EventNotifications {
+			if n.RealmID != e.RealmID {
+				a.Logr.Log("skipping notification for realm %s in webhook event %d of realm %s", n.RealmID, e.ID, e.RealmID)
+				continue
+			}
+			for _, c := range n.DataChangeEvent.Entities {
+				h, ok := handlers[c.Name]
+				if !ok {
+					continue
+				}
+				err := h(ctx, e.OrgID, c)
+				if _, ok := err.(*atlas.UnmappedTaxRatesError); ok {
+					unmapped = err
+					continue
+				}
+				if err != nil {
+					failures = append(failures, fmt.Sprintf("%s %s %s: %s", c.Operation, c.Name, c.ID, err))
+				}
+			}
+		}
+		if len(failures) > 0 {
+			return fmt.Errorf("%s", strings.Join(failures, "; "))
+		}
+		return unmapped
+	}
+}
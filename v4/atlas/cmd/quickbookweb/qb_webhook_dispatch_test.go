@@ -0,0 +1,90 @@
+package main_test
+
+import (
+	"atlas"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+func TestQBWebhookDispatcher(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	var handled []string
+	handler := func(ctx context.Context, orgID int, c atlas.QBEntityChange) error {
+		equals(t, org1.ID, orgID)
+		handled = append(handled, c.Operation+" "+c.Name+" "+c.ID)
+		if c.ID == "13" {
+			return fmt.Errorf("some error")
+		}
+		return nil
+	}
+	handlers := map[string]main.QBEntityChangeHandler{}
+	for _, name := range atlas.QBChangeEntities {
+		handlers[name] = handler
+	}
+	process := app.QBWebhookDispatcher(handlers)
+
+	payload := []byte(`{"eventNotifications":[{"realmId":"` + org1.QBCompanyID + `","dataChangeEvent":{"entities":[
+		{"name":"Customer","id":"1","operation":"Create","lastUpdated":"2017-03-01T10:00:00-0700"},
+		{"name":"Item","id":"2","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Vendor","id":"3","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Invoice","id":"4","operation":"Void","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Payment","id":"5","operation":"Delete","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"SalesReceipt","id":"6","operation":"Create","lastUpdated":"2017-03-01T10:00:00.000Z"}
+	]}},{"realmId":"42","dataChangeEvent":{"entities":[
+		{"name":"Customer","id":"7","operation":"Create","lastUpdated":"2017-03-01T10:00:00.000Z"}
+	]}}]}`)
+	err := process(context.Background(), &atlas.QBWebhookEvent{ID: 1, OrgID: org1.ID, RealmID: org1.QBCompanyID, Payload: payload})
+	ok(t, err)
+	// vendors have no handler and other realms are not this org's business
+	equals(t, []string{"Create Customer 1", "Update Item 2", "Void Invoice 4", "Delete Payment 5", "Create SalesReceipt 6"}, handled)
+
+	handled = nil
+	payload = []byte(`{"eventNotifications":[{"realmId":"` + org1.QBCompanyID + `","dataChangeEvent":{"entities":[
+		{"name":"Customer","id":"13","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Item","id":"14","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"}
+	]}}]}`)
+	err = process(context.Background(), &atlas.QBWebhookEvent{ID: 2, OrgID: org1.ID, RealmID: org1.QBCompanyID, Payload: payload})
+	assert(t, err != nil && strings.Contains(err.Error(), "Customer 13"), "expected the failing change in the error, got %v", err)
+	equals(t, 2, len(handled))
+
+	err = process(context.Background(), &atlas.QBWebhookEvent{ID: 3, OrgID: org1.ID, RealmID: org1.QBCompanyID, Payload: []byte("{")})
+	assert(t, err != nil, "expected an error for a broken payload")
+
+	// sales held up by unmapped tax rates are parked rather than failed, unless another change failed
+	handled = nil
+	unmapped := &atlas.UnmappedTaxRatesError{OrgID: org1.ID}
+	handlers[atlas.QBEntitySalesReceipt] = func(ctx context.Context, orgID int, c atlas.QBEntityChange) error {
+		return unmapped
+	}
+	process = app.QBWebhookDispatcher(handlers)
+	payload = []byte(`{"eventNotifications":[{"realmId":"` + org1.QBCompanyID + `","dataChangeEvent":{"entities":[
+		{"name":"SalesReceipt","id":"21","operation":"Create","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Customer","id":"22","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"}
+	]}}]}`)
+	err = process(context.Background(), &atlas.QBWebhookEvent{ID: 4, OrgID: org1.ID, RealmID: org1.QBCompanyID, Payload: payload})
+	assert(t, err == unmapped, "expected the unmapped tax rates error, got %v", err)
+	equals(t, []string{"Update Customer 22"}, handled)
+
+	payload = []byte(`{"eventNotifications":[{"realmId":"` + org1.QBCompanyID + `","dataChangeEvent":{"entities":[
+		{"name":"SalesReceipt","id":"21","operation":"Create","lastUpdated":"2017-03-01T10:00:00.000Z"},
+		{"name":"Customer","id":"13","operation":"Update","lastUpdated":"2017-03-01T10:00:00.000Z"}
+	]}}]}`)
+	err = process(context.Background(), &atlas.QBWebhookEvent{ID: 5, OrgID: org1.ID, RealmID: org1.QBCompanyID, Payload: payload})
+	_, parked := err.(*atlas.UnmappedTaxRatesError)
+	assert(t, err != nil && !parked && strings.Contains(err.Error(), "Customer 13"), "expected the failing change in the error, got %v", err)
+}
+
+func TestQBEntityChangeLastUpdatedTime(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	for _, s := range []string{"2017-03-01T17:00:00-0000", "2017-03-01T10:00:00-0700", "2017-03-01T17:00:00.000Z", "2017-03-01T10:00:00.000-0700"} {
+		at, err := atlas.QBEntityChange{LastUpdated: s}.LastUpdatedTime()
+		ok(t, err)
+		equals(t, "2017-03-01T17:00:00Z", at.UTC().Format("2006-01-02T15:04:05Z07:00"))
+	}
+	_, err := atlas.QBEntityChange{LastUpdated: "yesterday"}.LastUpdatedTime()
+	assert(t, err != nil, "expected an error for an unknown format")
+}
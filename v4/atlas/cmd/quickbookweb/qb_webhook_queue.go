@@ -0,0 +1,361 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// QBWebhookProcessor processes one queued webhook event. Returning an error retries the event later.
+type QBWebhookProcessor func(ctx context.Context, e *atlas.QBWebhookEvent) error
+
+// QBWebhookQueue keeps verified webhook payloads in the database so that Intuit gets its answer right away and
+// no event is lost if processing is slow or fails. Failed events are retried after BaseBackoff, doubling up to
+// MaxBackoff, and are marked dead after MaxAttempts attempts. Events held up by unmapped tax rates (see
+// atlas.CheckQBTaxMappings) are parked instead: they are retried every ParkInterval without using up attempts,
+// since only picking the tax codes can get them through.
+//
+// Changes that were queued before are dropped when Intuit sends them again, and so are webhook changes older
+// than MaxEventAge, so that old payloads cannot be replayed, and changes without a valid time.
+type QBWebhookQueue struct {
+	store atlas.QBWebhookQueueDB
+	wake  chan struct{}
+
+	Workers      int
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Lease        time.Duration
+	PollInterval time.Duration
+	MaxEventAge  time.Duration
+	ParkInterval time.Duration
+}
+
+// NewQBWebhookQueue returns a QBWebhookQueue with the default limits.
+func NewQBWebhookQueue(store atlas.QBWebhookQueueDB) *QBWebhookQueue {
+	return &QBWebhookQueue{
+		store:        store,
+		wake:         make(chan struct{}, 1),
+		Workers:      4,
+		MaxAttempts:  8,
+		BaseBackoff:  30 * time.Second,
+		MaxBackoff:   time.Hour,
+		Lease:        5 * time.Minute,
+		PollInterval: 30 * time.Second,
+		MaxEventAge:  24 * time.Hour,
+		ParkInterval: 15 * time.Minute,
+	}
+}
+
+// Enqueue saves a payload of an org to be processed by the workers.
+func (q *QBWebhookQueue) Enqueue(orgID int, realmID string, payload []byte) (*atlas.QBWebhookEvent, error) {
+	now := time.Now()
+	e, err := q.store.CreateQBWebhookEvent(atlas.QBWebhookEvent{
+		OrgID:         orgID,
+		RealmID:       realmID,
+		Payload:       payload,
+		Status:        atlas.QBWebhookEventPending,
+		NextAttemptAt: now,
+		DateCreated:   now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return e, nil
+}
+
+// Backoff returns how long to wait before retrying an event that failed attempts times.
+func (q *QBWebhookQueue) Backoff(attempts int) time.Duration {
+	return backoff(q.BaseBackoff, q.MaxBackoff, attempts)
+}
+
+// backoff returns base doubled for every attempt after the first, up to max.
+func backoff(base, max time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// admit drops the changes of p that are older than maxAge at now, unless maxAge is 0, or have no valid time, and
+// returns the fingerprints of the others along with why each dropped change was dropped.
+func admit(realmID string, p *atlas.QBWebhookPayload, now time.Time, maxAge time.Duration) ([]string, []string) {
+	var fingerprints, dropped []string
+	var notifications []atlas.QBEventNotification
+	for _, n := range p.EventNotifications {
+		var fresh []atlas.QBEntityChange
+		for _, c := range n.DataChangeEvent.Entities {
+			at, err := c.LastUpdatedTime()
+			if err != nil {
+				dropped = append(dropped, err.Error())
+				continue
+			}
+			if maxAge > 0 && at.Before(now.Add(-maxAge)) {
+				dropped = append(dropped, fmt.Sprintf("%s %s %s of %s is older than %s", c.Operation, c.Name, c.ID, c.LastUpdated, maxAge))
+				continue
+			}
+			fresh = append(fresh, c)
+			fingerprints = append(fingerprints, c.Fingerprint(realmID))
+		}
+		if len(fresh) > 0 {
+			n.DataChangeEvent.Entities = fresh
+			notifications = append(notifications, n)
+		}
+	}
+	p.EventNotifications = notifications
+	return fingerprints, dropped
+}
+
+// keepQBChanges drops the changes of p whose fingerprint is not in fingerprints, and any change repeated in p.
+func keepQBChanges(realmID string, p *atlas.QBWebhookPayload, fingerprints []string) {
+	keep := map[string]bool{}
+	for _, fp := range fingerprints {
+		keep[fp] = true
+	}
+	var notifications []atlas.QBEventNotification
+	for _, n := range p.EventNotifications {
+		var kept []atlas.QBEntityChange
+		for _, c := range n.DataChangeEvent.Entities {
+			fp := c.Fingerprint(realmID)
+			if !keep[fp] {
+				continue
+			}
+			delete(keep, fp)
+			kept = append(kept, c)
+		}
+		if len(kept) > 0 {
+			n.DataChangeEvent.Entities = kept
+			notifications = append(notifications, n)
+		}
+	}
+	p.EventNotifications = notifications
+}
+
+// QBWebhookHandler verifies webhook payloads of Intuit with webHookAuthMiddleware and queues their new changes,
+// answering as soon as they are saved. It answers 500 when saving fails so that Intuit sends the payload again.
+func (a *App) QBWebhookHandler(db atlas.QBOrgWebHookDB, v *QBWebhookVerifier, q *QBWebhookQueue) http.Handler {
+	return a.webHookAuthMiddleware(db, v)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var payload atlas.QBWebhookPayload
+		err := json.NewDecoder(req.Body).Decode(&payload)
+		if err != nil {
+			a.Logr.Log("error reading webhook payload: %s", err)
+			http.Error(w, "webhook payload in bad form", http.StatusBadRequest)
+			return
+		}
+		orgID, _ := req.Context().Value(server.OrgKeyName).(int)
+		realmID, _ := req.Context().Value(companyKey).(string)
+
+		e, err := a.queueQBChanges(q, orgID, realmID, &payload, q.MaxEventAge)
+		if err != nil {
+			a.Logr.Log("error queueing webhook payload of org %d: %s", orgID, err)
+			http.Error(w, "could not save webhook payload", http.StatusInternalServerError)
+			return
+		}
+		if e == nil {
+			a.Logr.Log("skipping webhook payload of org %d, every change was queued before or dropped", orgID)
+		} else {
+			a.Logr.Log("queued webhook event %d of org %d", e.ID, orgID)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// queueQBChanges queues the changes of p that were not queued before, and are not older than maxAge unless it
+// is 0, as an event of the org, and returns it. It returns a nil event if there is no new change.
+//
+// The fingerprints of the changes are recorded first, and only the changes whose fingerprint got recorded by
+// this call are queued, so that a payload Intuit sends twice at once is queued once.
+func (a *App) queueQBChanges(q *QBWebhookQueue, orgID int, realmID string, p *atlas.QBWebhookPayload, maxAge time.Duration) (*atlas.QBWebhookEvent, error) {
+	now := time.Now()
+	fingerprints, dropped := admit(realmID, p, now, maxAge)
+	for _, reason := range dropped {
+		a.Logr.Log("dropping a change of org %d for realm %s: %s", orgID, realmID, reason)
+	}
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+	recorded, err := q.store.RecordQBWebhookFingerprints(fingerprints, now)
+	if err != nil || len(recorded) == 0 {
+		return nil, err
+	}
+	keepQBChanges(realmID, p, recorded)
+	body, err := json.Marshal(p)
+	if err == nil {
+		var e *atlas.QBWebhookEvent
+		e, err = q.Enqueue(orgID, realmID, body)
+		if err == nil {
+			return e, nil
+		}
+	}
+	// forgotten again, so that the changes are taken when Intuit sends them again
+	if ferr := q.store.DeleteQBWebhookFingerprints(recorded); ferr != nil {
+		a.Logr.Log("error forgetting the changes of org %d that could not be queued: %s", orgID, ferr)
+	}
+	return nil, err
+}
+
+// QBWebhookReplayPostHandler queues a stored webhook event of an org again, whatever its status, so that it is
+// processed once more.
+func (a *App) QBWebhookReplayPostHandler(q *QBWebhookQueue) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, _ := requestScope(req)
+		var eventID int
+		if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+			eventID, _ = strconv.Atoi(ps.ByName("eventid"))
+		}
+		e, err := q.store.GetQBWebhookEvent(eventID)
+		if err != nil || e.OrgID != orgID || orgID == 0 {
+			if err == nil {
+				err = fmt.Errorf("webhook event %d is not in org %d", eventID, orgID)
+			}
+			return server.NewError(http.StatusNotFound, "webhook event not found", err)
+		}
+
+		replay, err := q.Enqueue(e.OrgID, e.RealmID, e.Payload)
+		if err != nil {
+			return server.New500Error("error queueing webhook event", err)
+		}
+		msg := fmt.Sprintf("webhook event %d queued again as event %d", e.ID, replay.ID)
+		a.Logr.Log("%s for org %d", msg, orgID)
+		a.Rndr.JSON(w, http.StatusAccepted, server.NewAPIResponse(http.StatusAccepted, msg))
+		return nil
+	}
+}
+
+// RunQBWebhookWorkers processes the queued webhook events until ctx is done, as soon as they are queued on
+// this node and every PollInterval otherwise.
+func (a *App) RunQBWebhookWorkers(ctx context.Context, q *QBWebhookQueue, process QBWebhookProcessor) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n, err := a.ProcessQBWebhookEvents(ctx, q, process, time.Now())
+			if err != nil {
+				a.Logr.Log("error processing webhook events: %s", err)
+			}
+			if n == 0 || ctx.Err() != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// older changes are refused anyway, so their fingerprints are not needed anymore
+			if err := q.store.DeleteQBWebhookFingerprintsBefore(time.Now().Add(-q.MaxEventAge)); err != nil {
+				a.Logr.Log("error deleting old webhook fingerprints: %s", err)
+			}
+		case <-q.wake:
+		}
+	}
+}
+
+// ProcessQBWebhookEvents claims the events due at now, processes them with q.Workers workers and returns how
+// many it processed. Events that fail are scheduled for a retry, or marked dead once they used up their attempts,
+// and events held up by unmapped tax rates are parked.
+func (a *App) ProcessQBWebhookEvents(ctx context.Context, q *QBWebhookQueue, process QBWebhookProcessor, now time.Time) (int, error) {
+	events, err := q.store.ClaimQBWebhookEvents(now, q.Lease, q.Workers*4)
+	if err != nil {
+		return 0, err
+	}
+	todo := make(chan *atlas.QBWebhookEvent)
+	var wg sync.WaitGroup
+	for i := 0; i < q.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range todo {
+				a.processQBWebhookEvent(ctx, q, process, e)
+			}
+		}()
+	}
+	for _, e := range events {
+		todo <- e
+	}
+	close(todo)
+	wg.Wait()
+	return len(events), nil
+}
+
+func (a *App) processQBWebhookEvent(ctx context.Context, q *QBWebhookQueue, process QBWebhookProcessor, e *atlas.QBWebhookEvent) {
+	err := process(ctx, e)
+	now := time.Now()
+	if unmapped, ok := err.(*atlas.UnmappedTaxRatesError); ok {
+		a.Logr.Log("parking webhook event %d of org %d: %s", e.ID, e.OrgID, unmapped)
+		e.Status, e.LastError, e.NextAttemptAt = atlas.QBWebhookEventPending, unmapped.Error(), now.Add(q.ParkInterval)
+		if err := q.store.UpdateQBWebhookEvent(*e); err != nil {
+			a.Logr.Log("error saving webhook event %d: %s", e.ID, err)
+		}
+		return
+	}
+	e.Attempts++
+	switch {
+	case err == nil:
+		e.Status, e.LastError, e.ProcessedAt = atlas.QBWebhookEventDone, "", &now
+	case e.Attempts >= q.MaxAttempts:
+		a.Logr.Log("giving up on webhook event %d of org %d after %d attempts: %s", e.ID, e.OrgID, e.Attempts, err)
+		e.Status, e.LastError = atlas.QBWebhookEventDead, err.Error()
+	default:
+		a.Logr.Log("error processing webhook event %d of org %d, attempt %d: %s", e.ID, e.OrgID, e.Attempts, err)
+		e.Status, e.LastError, e.NextAttemptAt = atlas.QBWebhookEventPending, err.Error(), now.Add(q.Backoff(e.Attempts))
+	}
+	if err := q.store.UpdateQBWebhookEvent(*e); err != nil {
+		a.Logr.Log("error saving webhook event %d: %s", e.ID, err)
+	}
+}
+
+// QBWebhookHandlerProcessor processes events by sending their payload to h as if it came straight from
+// webHookAuthMiddleware. Answers other than 2xx are errors.
+func QBWebhookHandlerProcessor(h http.Handler) QBWebhookProcessor {
+	return func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+		req, err := http.NewRequest(http.MethodPost, "/", bytes.NewReader(e.Payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		ctx = context.WithValue(ctx, server.OrgKeyName, e.OrgID)
+		ctx = context.WithValue(ctx, companyKey, e.RealmID)
+		w := &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK}
+		h.ServeHTTP(w, req.WithContext(ctx))
+		if w.code < 200 || w.code > 299 {
+			return fmt.Errorf("webhook handler answered %d: %s", w.code, bytes.TrimSpace(w.body.Bytes()))
+		}
+		return nil
+	}
+}
+
+// bufferedResponseWriter keeps the answer of a handler instead of sending it.
+type bufferedResponseWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
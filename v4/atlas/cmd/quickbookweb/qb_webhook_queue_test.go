@@ -0,0 +1,497 @@
+package main_test
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// MockQBWebhookEventDB is an in-memory webhook event queue.
+type MockQBWebhookEventDB struct {
+	hasError bool
+
+	mu           sync.Mutex
+	events       map[int]*atlas.QBWebhookEvent
+	fingerprints map[string]time.Time
+}
+
+func (db *MockQBWebhookEventDB) CreateQBWebhookEvent(e atlas.QBWebhookEvent) (*atlas.QBWebhookEvent, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.events == nil {
+		db.events = map[int]*atlas.QBWebhookEvent{}
+	}
+	e.ID = len(db.events) + 1
+	db.events[e.ID] = &e
+	copied := e
+	return &copied, nil
+}
+
+func (db *MockQBWebhookEventDB) ClaimQBWebhookEvents(now time.Time, lease time.Duration, limit int) ([]*atlas.QBWebhookEvent, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var ids []int
+	for id, e := range db.events {
+		due := e.Status == atlas.QBWebhookEventPending || e.Status == atlas.QBWebhookEventProcessing
+		if due && !e.NextAttemptAt.After(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	claimed := make([]*atlas.QBWebhookEvent, len(ids))
+	for i, id := range ids {
+		e := db.events[id]
+		e.Status, e.NextAttemptAt = atlas.QBWebhookEventProcessing, now.Add(lease)
+		copied := *e
+		claimed[i] = &copied
+	}
+	return claimed, nil
+}
+
+func (db *MockQBWebhookEventDB) UpdateQBWebhookEvent(e atlas.QBWebhookEvent) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.events[e.ID] = &e
+	return nil
+}
+
+func (db *MockQBWebhookEventDB) GetQBWebhookEvent(eventID int) (*atlas.QBWebhookEvent, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	e, ok := db.events[eventID]
+	if db.hasError || !ok {
+		return nil, fmt.Errorf("some error")
+	}
+	copied := *e
+	return &copied, nil
+}
+
+func (db *MockQBWebhookEventDB) RecordQBWebhookFingerprints(fingerprints []string, at time.Time) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.fingerprints == nil {
+		db.fingerprints = map[string]time.Time{}
+	}
+	var recorded []string
+	for _, fp := range fingerprints {
+		if _, ok := db.fingerprints[fp]; ok {
+			continue
+		}
+		db.fingerprints[fp] = at
+		recorded = append(recorded, fp)
+	}
+	return recorded, nil
+}
+
+func (db *MockQBWebhookEventDB) DeleteQBWebhookFingerprints(fingerprints []string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	for _, fp := range fingerprints {
+		delete(db.fingerprints, fp)
+	}
+	return nil
+}
+
+func (db *MockQBWebhookEventDB) DeleteQBWebhookFingerprintsBefore(t time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	for fp, at := range db.fingerprints {
+		if at.Before(t) {
+			delete(db.fingerprints, fp)
+		}
+	}
+	return nil
+}
+
+func (db *MockQBWebhookEventDB) event(id int) atlas.QBWebhookEvent {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return *db.events[id]
+}
+
+type MockQBOrgWebHookDB struct {
+	orgs []*atlas.QBOrg
+}
+
+func (db *MockQBOrgWebHookDB) GetQBOrgByCompanyID(companyID string) (*atlas.QBOrg, error) {
+	for _, o := range db.orgs {
+		if o.QBCompanyID == companyID {
+			return o, nil
+		}
+	}
+	return nil, fmt.Errorf("no org for company %s", companyID)
+}
+
+// webhookPayload returns a payload with a change of a customer, which just got updated, for every realm.
+func webhookPayload(realmIDs ...string) []byte {
+	var changes []webhookChange
+	for i, realmID := range realmIDs {
+		changes = append(changes, webhookChange{realmID, atlas.QBEntityChange{Name: "Customer", ID: fmt.Sprint(i + 1), Operation: "Update"}})
+	}
+	return webhookChangesPayload(changes...)
+}
+
+type webhookChange struct {
+	realmID string
+	change  atlas.QBEntityChange
+}
+
+// webhookChangesPayload returns a payload with a notification for every change, dated now if it has no time.
+func webhookChangesPayload(changes ...webhookChange) []byte {
+	var p atlas.QBWebhookPayload
+	for _, c := range changes {
+		if c.change.LastUpdated == "" {
+			c.change.LastUpdated = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		var n atlas.QBEventNotification
+		n.RealmID = c.realmID
+		n.DataChangeEvent.Entities = []atlas.QBEntityChange{c.change}
+		p.EventNotifications = append(p.EventNotifications, n)
+	}
+	b, _ := json.Marshal(p)
+	return b
+}
+
+// postWebhook posts the payload signed with the webhook token of org1, which the other test orgs share.
+func postWebhook(h http.Handler, payload []byte) *httptest.ResponseRecorder {
+	return postSignedWebhook(h, payload, signWebhook(payload, org1.QBWebHookToken))
+}
+
+func postSignedWebhook(h http.Handler, payload []byte, signature string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set("intuit-signature", signature)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestQBWebhookHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	store := &MockQBWebhookEventDB{}
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1}}, enforceWebhooks, main.NewQBWebhookQueue(store))
+
+	payload := webhookPayload(org1.QBCompanyID)
+	w := postWebhook(h, payload)
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 1, len(store.events))
+	e := store.event(1)
+	equals(t, org1.ID, e.OrgID)
+	equals(t, org1.QBCompanyID, e.RealmID)
+	equals(t, []string{org1.QBCompanyID}, payloadRealms(t, e.Payload))
+	equals(t, atlas.QBWebhookEventPending, e.Status)
+
+	// unknown companies and bad payloads are refused
+	w = postWebhook(h, webhookPayload("42"))
+	equals(t, http.StatusBadRequest, w.Code)
+	w = postWebhook(h, []byte("{"))
+	equals(t, http.StatusBadRequest, w.Code)
+	equals(t, 1, len(store.events))
+
+	// Intuit has to send it again if it cannot be saved
+	store.hasError = true
+	w = postWebhook(h, payload)
+	equals(t, http.StatusInternalServerError, w.Code)
+}
+
+// payloadRealms returns the realm of every notification in a webhook payload.
+func payloadRealms(t *testing.T, payload []byte) []string {
+	var p atlas.QBWebhookPayload
+	ok(t, json.Unmarshal(payload, &p))
+	var realms []string
+	for _, n := range p.EventNotifications {
+		realms = append(realms, n.RealmID)
+	}
+	return realms
+}
+
+func TestQBWebhookHandlerMultipleRealms(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	org2 := org1
+	org2.ID, org2.QBCompanyID = 2, "123145678901234"
+	store := &MockQBWebhookEventDB{}
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1, &org2}}, enforceWebhooks, main.NewQBWebhookQueue(store))
+
+	// every realm gets its own event, unknown realms are skipped
+	w := postWebhook(h, webhookPayload(org1.QBCompanyID, "42", org2.QBCompanyID, org1.QBCompanyID))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 2, len(store.events))
+	equals(t, org1.ID, store.event(1).OrgID)
+	equals(t, []string{org1.QBCompanyID, org1.QBCompanyID}, payloadRealms(t, store.event(1).Payload))
+	equals(t, org2.ID, store.event(2).OrgID)
+	equals(t, org2.QBCompanyID, store.event(2).RealmID)
+	equals(t, []string{org2.QBCompanyID}, payloadRealms(t, store.event(2).Payload))
+
+	w = postWebhook(h, webhookPayload("42", "43"))
+	equals(t, http.StatusBadRequest, w.Code)
+	equals(t, 2, len(store.events))
+}
+
+func TestProcessQBWebhookEvents(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	q.MaxAttempts = 3
+	q.BaseBackoff = time.Minute
+	q.MaxBackoff = 90 * time.Second
+
+	equals(t, time.Minute, q.Backoff(1))
+	equals(t, 90*time.Second, q.Backoff(2))
+	equals(t, 90*time.Second, q.Backoff(10))
+
+	for _, payload := range []string{"ok", "broken", "flaky"} {
+		_, err := q.Enqueue(org1.ID, org1.QBCompanyID, []byte(payload))
+		ok(t, err)
+	}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	process := func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[string(e.Payload)]++
+		if string(e.Payload) == "broken" || (string(e.Payload) == "flaky" && calls["flaky"] == 1) {
+			return fmt.Errorf("%s failed", e.Payload)
+		}
+		return nil
+	}
+
+	now := time.Now()
+	n, err := app.ProcessQBWebhookEvents(context.Background(), q, process, now)
+	ok(t, err)
+	equals(t, 3, n)
+	equals(t, atlas.QBWebhookEventDone, store.event(1).Status)
+	assert(t, store.event(1).ProcessedAt != nil, "expected the processing time to be saved")
+	broken := store.event(2)
+	equals(t, atlas.QBWebhookEventPending, broken.Status)
+	equals(t, 1, broken.Attempts)
+	equals(t, "broken failed", broken.LastError)
+	assert(t, broken.NextAttemptAt.After(now.Add(59*time.Second)), "expected a retry after a minute, got %s", broken.NextAttemptAt)
+
+	// nothing is due before the backoff
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, now.Add(time.Second))
+	ok(t, err)
+	equals(t, 0, n)
+
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, now.Add(2*time.Minute))
+	ok(t, err)
+	equals(t, 2, n)
+	equals(t, atlas.QBWebhookEventDone, store.event(3).Status)
+	equals(t, 2, store.event(2).Attempts)
+
+	// the last attempt dead-letters the event
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, now.Add(time.Hour))
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, atlas.QBWebhookEventDead, store.event(2).Status)
+	equals(t, 3, store.event(2).Attempts)
+	equals(t, map[string]int{"ok": 1, "broken": 3, "flaky": 2}, calls)
+
+	// an event whose worker died is processed again once its lease runs out
+	_, err = q.Enqueue(org1.ID, org1.QBCompanyID, []byte("ok"))
+	ok(t, err)
+	claimed, err := store.ClaimQBWebhookEvents(time.Now(), q.Lease, 10)
+	ok(t, err)
+	equals(t, 1, len(claimed))
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, time.Now())
+	ok(t, err)
+	equals(t, 0, n)
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, time.Now().Add(q.Lease+time.Second))
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, atlas.QBWebhookEventDone, store.event(4).Status)
+
+	// an event held up by unmapped tax rates is parked without using up its attempts
+	_, err = q.Enqueue(org1.ID, org1.QBCompanyID, []byte("sales"))
+	ok(t, err)
+	parking := func(ctx context.Context, e *atlas.QBWebhookEvent) error {
+		return &atlas.UnmappedTaxRatesError{OrgID: e.OrgID}
+	}
+	for i := 0; i < q.MaxAttempts+1; i++ {
+		at := time.Now().Add(time.Duration(i) * (q.ParkInterval + time.Second))
+		n, err = app.ProcessQBWebhookEvents(context.Background(), q, parking, at)
+		ok(t, err)
+		equals(t, 1, n)
+	}
+	parked := store.event(5)
+	equals(t, atlas.QBWebhookEventPending, parked.Status)
+	equals(t, 0, parked.Attempts)
+	assert(t, strings.Contains(parked.LastError, "tax code"), "expected the unmapped tax rates as the last error, got %q", parked.LastError)
+	n, err = app.ProcessQBWebhookEvents(context.Background(), q, process, parked.NextAttemptAt)
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, atlas.QBWebhookEventDone, store.event(5).Status)
+
+	store.hasError = true
+	_, err = app.ProcessQBWebhookEvents(context.Background(), q, process, time.Now())
+	assert(t, err != nil, "expected an error when events cannot be claimed")
+}
+
+func TestQBWebhookHandlerProcessor(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	var gotOrgID int
+	var gotBody []byte
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotOrgID, _ = req.Context().Value(server.OrgKeyName).(int)
+		gotBody, _ = ioutil.ReadAll(req.Body)
+		if string(gotBody) == "fail" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+		}
+	})
+	process := main.QBWebhookHandlerProcessor(h)
+
+	err := process(context.Background(), &atlas.QBWebhookEvent{OrgID: org1.ID, Payload: []byte("hello")})
+	ok(t, err)
+	equals(t, org1.ID, gotOrgID)
+	equals(t, "hello", string(gotBody))
+
+	err = process(context.Background(), &atlas.QBWebhookEvent{OrgID: org1.ID, Payload: []byte("fail")})
+	assert(t, err != nil, "expected an error when the handler fails")
+}
+
+func TestQBWebhookHandlerDuplicates(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1}}, enforceWebhooks, q)
+	customer := webhookChange{org1.QBCompanyID, atlas.QBEntityChange{Name: "Customer", ID: "1", Operation: "Update"}}
+	item := webhookChange{org1.QBCompanyID, atlas.QBEntityChange{Name: "Item", ID: "2", Operation: "Create", LastUpdated: time.Now().UTC().Format(time.RFC3339Nano)}}
+
+	payload := webhookChangesPayload(customer)
+	w := postWebhook(h, payload)
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 1, len(store.events))
+
+	// Intuit sending it again changes nothing
+	w = postWebhook(h, payload)
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 1, len(store.events))
+
+	// only the new change of a payload is queued
+	var p atlas.QBWebhookPayload
+	ok(t, json.Unmarshal(payload, &p))
+	customer.change.LastUpdated = p.EventNotifications[0].DataChangeEvent.Entities[0].LastUpdated
+	w = postWebhook(h, webhookChangesPayload(customer, item))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 2, len(store.events))
+	ok(t, json.Unmarshal(store.event(2).Payload, &p))
+	equals(t, 1, len(p.EventNotifications))
+	equals(t, []atlas.QBEntityChange{item.change}, p.EventNotifications[0].DataChangeEvent.Entities)
+
+	// a later update of the same customer is a new change
+	customer.change.LastUpdated = time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano)
+	w = postWebhook(h, webhookChangesPayload(customer))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 3, len(store.events))
+
+	// old changes are dropped, the others of the payload are still queued
+	customer.change.LastUpdated = time.Now().Add(-q.MaxEventAge - time.Minute).Format("2006-01-02T15:04:05-0700")
+	w = postWebhook(h, webhookChangesPayload(customer))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 3, len(store.events))
+	item.change.ID = "3"
+	w = postWebhook(h, webhookChangesPayload(customer, item))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 4, len(store.events))
+	ok(t, json.Unmarshal(store.event(4).Payload, &p))
+	equals(t, 1, len(p.EventNotifications))
+	equals(t, []atlas.QBEntityChange{item.change}, p.EventNotifications[0].DataChangeEvent.Entities)
+
+	// so are undated changes
+	customer.change.LastUpdated = "yesterday"
+	item.change.ID = "4"
+	w = postWebhook(h, webhookChangesPayload(customer, item))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 5, len(store.events))
+	ok(t, json.Unmarshal(store.event(5).Payload, &p))
+	equals(t, []atlas.QBEntityChange{item.change}, p.EventNotifications[0].DataChangeEvent.Entities)
+}
+
+func TestQBWebhookHandlerConcurrentDuplicates(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	store := &MockQBWebhookEventDB{}
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1}}, enforceWebhooks, main.NewQBWebhookQueue(store))
+
+	// Intuit sending a payload again before the first one is queued still queues it once
+	payload := webhookPayload(org1.QBCompanyID)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postWebhook(h, payload)
+		}()
+	}
+	wg.Wait()
+	equals(t, 1, len(store.events))
+}
+
+func TestQBWebhookReplayPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	store := &MockQBWebhookEventDB{}
+	q := main.NewQBWebhookQueue(store)
+	e, err := q.Enqueue(org1.ID, org1.QBCompanyID, webhookPayload(org1.QBCompanyID))
+	ok(t, err)
+	e.Status = atlas.QBWebhookEventDead
+	ok(t, store.UpdateQBWebhookEvent(*e))
+	other, err := q.Enqueue(42, "42", webhookPayload("42"))
+	ok(t, err)
+
+	replay := func(eventID int) *httptest.ResponseRecorder {
+		params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}, {Key: "eventid", Value: fmt.Sprint(eventID)}}
+		return GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBWebhookReplayPostHandler(q)), true, params)("POST", url.Values{})
+	}
+
+	w := replay(e.ID)
+	equals(t, http.StatusAccepted, w.Code)
+	equals(t, 3, len(store.events))
+	replayed := store.event(3)
+	equals(t, atlas.QBWebhookEventPending, replayed.Status)
+	equals(t, org1.ID, replayed.OrgID)
+	equals(t, e.Payload, replayed.Payload)
+
+	// events of other orgs and unknown events cannot be replayed
+	w = replay(other.ID)
+	equals(t, http.StatusNotFound, w.Code)
+	w = replay(99)
+	equals(t, http.StatusNotFound, w.Code)
+	equals(t, 3, len(store.events))
+}
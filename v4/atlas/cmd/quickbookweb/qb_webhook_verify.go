@@ -0,0 +1,80 @@
+package main
+
+import (
+	"atlas"
+	"expvar"
+	"fmt"
+)
+
+// QBWebhookVerifyMode is how the signatures of Intuit webhook payloads are checked. It is set per environment
+// in the config, under qb_webhook_verification.
+type QBWebhookVerifyMode string
+
+// Webhook verification modes. Enforce rejects payloads that are not signed with the webhook token of their
+// org, log-only logs them and accepts them anyway, and disabled does not check signatures at all.
+const (
+	QBWebhookVerifyEnforce  QBWebhookVerifyMode = "enforce"
+	QBWebhookVerifyLogOnly  QBWebhookVerifyMode = "log-only"
+	QBWebhookVerifyDisabled QBWebhookVerifyMode = "disabled"
+)
+
+// Reasons a webhook signature check fails.
+const (
+	qbWebhookMissingSignature = "missing_signature"
+	qbWebhookMissingToken     = "missing_token"
+	qbWebhookBadSignature     = "bad_signature"
+)
+
+// QBWebhookRejected counts the webhook payloads rejected in enforce mode, by reason. It is published with the
+// other expvar variables on /debug/vars.
+var QBWebhookRejected = expvar.NewMap("qb_webhook_rejected")
+
+// QBWebhookVerifier checks the signatures of webhook payloads according to Mode.
+type QBWebhookVerifier struct {
+	Mode QBWebhookVerifyMode
+}
+
+// NewQBWebhookVerifier returns a QBWebhookVerifier for the mode set in the config. An empty mode enforces
+// signatures, so that an environment has to opt out of checking them.
+func NewQBWebhookVerifier(mode string) (*QBWebhookVerifier, error) {
+	switch m := QBWebhookVerifyMode(mode); m {
+	case "":
+		return &QBWebhookVerifier{Mode: QBWebhookVerifyEnforce}, nil
+	case QBWebhookVerifyEnforce, QBWebhookVerifyLogOnly, QBWebhookVerifyDisabled:
+		return &QBWebhookVerifier{Mode: m}, nil
+	default:
+		return nil, fmt.Errorf("unknown webhook verification mode %q", mode)
+	}
+}
+
+// verifyQBWebhook reports whether the payload body of realmID, signed with signature, is accepted for org.
+// Every failed check is logged with the realm and the reason, whatever the mode.
+func (a *App) verifyQBWebhook(v *QBWebhookVerifier, body []byte, signature string, org *atlas.QBOrg, realmID string) bool {
+	mode := QBWebhookVerifyEnforce
+	if v != nil {
+		mode = v.Mode
+	}
+	if mode == QBWebhookVerifyDisabled {
+		return true
+	}
+
+	var reason string
+	switch {
+	case signature == "":
+		reason = qbWebhookMissingSignature
+	case org.QBWebHookToken == "":
+		reason = qbWebhookMissingToken
+	case !CheckMAC(body, signature, org.QBWebHookToken):
+		reason = qbWebhookBadSignature
+	default:
+		return true
+	}
+
+	if mode == QBWebhookVerifyLogOnly {
+		a.Logr.Log("webhook signature check failed: mode=%s realm=%s org=%d reason=%s action=accepted", mode, realmID, org.ID, reason)
+		return true
+	}
+	QBWebhookRejected.Add(reason, 1)
+	a.Logr.Log("webhook signature check failed: mode=%s realm=%s org=%d reason=%s action=rejected", mode, realmID, org.ID, reason)
+	return false
+}
@@ -0,0 +1,106 @@
+package main_test
+
+import (
+	"atlas"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"net/http"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+var enforceWebhooks = &main.QBWebhookVerifier{Mode: main.QBWebhookVerifyEnforce}
+
+// signWebhook signs the payload the way Intuit does, with the webhook token of an org.
+func signWebhook(payload []byte, token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(payload)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func rejectedWebhooks(reason string) int64 {
+	n, _ := main.QBWebhookRejected.Get(reason).(*expvar.Int)
+	if n == nil {
+		return 0
+	}
+	return n.Value()
+}
+
+func TestNewQBWebhookVerifier(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	v, err := main.NewQBWebhookVerifier("")
+	ok(t, err)
+	equals(t, main.QBWebhookVerifyEnforce, v.Mode)
+	v, err = main.NewQBWebhookVerifier("log-only")
+	ok(t, err)
+	equals(t, main.QBWebhookVerifyLogOnly, v.Mode)
+	_, err = main.NewQBWebhookVerifier("off")
+	assert(t, err != nil, "expected an error for an unknown mode")
+}
+
+func TestQBWebhookVerifyModes(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	noToken := org1
+	noToken.ID, noToken.QBCompanyID, noToken.QBWebHookToken = 2, "123145678901234", ""
+	db := &MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1, &noToken}}
+
+	tests := []struct {
+		mode     main.QBWebhookVerifyMode
+		realm    string
+		sign     func(payload []byte) string
+		code     int
+		reason   string
+		rejected bool
+	}{
+		{main.QBWebhookVerifyEnforce, org1.QBCompanyID, func(p []byte) string { return signWebhook(p, org1.QBWebHookToken) }, http.StatusOK, "", false},
+		{main.QBWebhookVerifyEnforce, org1.QBCompanyID, func(p []byte) string { return signWebhook(p, "some-other-token") }, http.StatusForbidden, "bad_signature", true},
+		{main.QBWebhookVerifyEnforce, org1.QBCompanyID, func(p []byte) string { return "" }, http.StatusForbidden, "missing_signature", true},
+		{main.QBWebhookVerifyEnforce, noToken.QBCompanyID, func(p []byte) string { return signWebhook(p, "") }, http.StatusForbidden, "missing_token", true},
+		{main.QBWebhookVerifyLogOnly, org1.QBCompanyID, func(p []byte) string { return signWebhook(p, "some-other-token") }, http.StatusOK, "bad_signature", false},
+		{main.QBWebhookVerifyLogOnly, org1.QBCompanyID, func(p []byte) string { return "" }, http.StatusOK, "missing_signature", false},
+		{main.QBWebhookVerifyDisabled, org1.QBCompanyID, func(p []byte) string { return signWebhook(p, "some-other-token") }, http.StatusOK, "bad_signature", false},
+		{main.QBWebhookVerifyDisabled, org1.QBCompanyID, func(p []byte) string { return "" }, http.StatusOK, "missing_signature", false},
+	}
+	for _, tt := range tests {
+		store := &MockQBWebhookEventDB{}
+		h := app.QBWebhookHandler(db, &main.QBWebhookVerifier{Mode: tt.mode}, main.NewQBWebhookQueue(store))
+		payload := webhookPayload(tt.realm)
+		before := rejectedWebhooks(tt.reason)
+
+		w := postSignedWebhook(h, payload, tt.sign(payload))
+		equals(t, tt.code, w.Code)
+		queued := 0
+		if tt.code == http.StatusOK {
+			queued = 1
+		}
+		equals(t, queued, len(store.events))
+		if tt.reason == "" {
+			continue
+		}
+		counted := int64(0)
+		if tt.rejected {
+			counted = 1
+		}
+		equals(t, counted, rejectedWebhooks(tt.reason)-before)
+	}
+
+	// a realm failing the check is skipped while the others of the payload are queued
+	org2 := org1
+	org2.ID, org2.QBCompanyID, org2.QBWebHookToken = 3, "123145678909999", "some-other-token"
+	store := &MockQBWebhookEventDB{}
+	h := app.QBWebhookHandler(&MockQBOrgWebHookDB{orgs: []*atlas.QBOrg{&org1, &org2}}, enforceWebhooks, main.NewQBWebhookQueue(store))
+	before := rejectedWebhooks("bad_signature")
+	w := postWebhook(h, webhookPayload(org1.QBCompanyID, org2.QBCompanyID))
+	equals(t, http.StatusOK, w.Code)
+	equals(t, 1, len(store.events))
+	equals(t, org1.ID, store.event(1).OrgID)
+	equals(t, int64(1), rejectedWebhooks("bad_signature")-before)
+
+	// without a verifier signatures are enforced
+	h = app.QBWebhookHandler(db, nil, main.NewQBWebhookQueue(&MockQBWebhookEventDB{}))
+	w = postSignedWebhook(h, webhookPayload(org1.QBCompanyID), "")
+	equals(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows at most max events per key within a sliding window.
+type RateLimiter struct {
+	max    int
+	window time.Duration
+
+	mu     sync.Mutex
+	events map[string][]time.Time
+	swept  time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing max events per key every window.
+func NewRateLimiter(max int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		max:    max,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the limit.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-l.window)
+	if now.Sub(l.swept) >= l.window {
+		l.sweep(cutoff)
+		l.swept = now
+	}
+	recent := l.events[key][:0]
+	for _, t := range l.events[key] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= l.max {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+	return true
+}
+
+// sweep forgets the keys whose events are all older than cutoff, so that the limiter does not keep every key
+// it has ever seen. Events are recorded in order, so the last one of a key is its newest.
+func (l *RateLimiter) sweep(cutoff time.Time) {
+	for key, events := range l.events {
+		if len(events) == 0 || !events[len(events)-1].After(cutoff) {
+			delete(l.events, key)
+		}
+	}
+}
+
+// Len returns how many keys the limiter keeps events for.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.events)
+}
+
+// remoteIP returns the IP address of the client making the request.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
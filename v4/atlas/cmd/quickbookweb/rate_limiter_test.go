@@ -0,0 +1,27 @@
+package main_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+func TestRateLimiter(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	l := main.NewRateLimiter(2, 50*time.Millisecond)
+	assert(t, l.Allow("ip:1"), "expected the first event to be allowed")
+	assert(t, l.Allow("ip:1"), "expected the second event to be allowed")
+	assert(t, !l.Allow("ip:1"), "expected the third event to be refused")
+	assert(t, l.Allow("ip:2"), "expected other keys to have their own limit")
+
+	// keys whose events all expired are forgotten
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprintf("email:%d", i))
+	}
+	equals(t, 102, l.Len())
+	time.Sleep(60 * time.Millisecond)
+	assert(t, l.Allow("ip:1"), "expected events to be allowed again once the window passed")
+	equals(t, 1, l.Len())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"context"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/oauth2"
+)
+
+// Access is who may call a route.
+type Access int
+
+const (
+	// AccessPublic routes are open to everyone. The pages of the setup wizard are public, OnboardingMiddleware
+	// sends each visitor to the step they may see.
+	AccessPublic Access = iota
+	// AccessLoggedIn routes need a logged-in user.
+	AccessLoggedIn
+	// AccessRole routes need a logged-in user holding Route.Role in the org, and shop, the request names.
+	AccessRole
+	// AccessDevice routes are called by V4 devices with the token of an Atlas session.
+	AccessDevice
+	// AccessWebhook routes are called by Intuit, whose signature the handler checks.
+	AccessWebhook
+)
+
+// Route is an entry of the route table: who may call Method Path, and the handler serving it.
+type Route struct {
+	Method  string
+	Path    string
+	Access  Access
+	Role    atlas.QBRole
+	Handler http.Handler
+}
+
+// AppDB is the database the routes are served from.
+type AppDB interface {
+	atlas.AtlasSessionDB
+	atlas.QBLoginDB
+	atlas.QBUserDB
+	atlas.QBUserManagementDB
+	atlas.QBInviteDB
+	atlas.QBPasswordResetDB
+	atlas.QBSetupUserDB
+	atlas.QBSetupOrgDB
+	atlas.QBSetupConnectDB
+	atlas.QBSetupDepartmentDB
+	atlas.OdooSetupDB
+	atlas.QBOrgTOTPSettingDB
+	atlas.QBPaymentMethodDB
+	atlas.QBPaymentMethodReviewDB
+	atlas.QBAccountMappingPageDB
+	atlas.QBTaxMappingPageDB
+	atlas.POSTaxRateDB
+	atlas.QBOrgWebHookDB
+	atlas.QBCallbackPageDB
+}
+
+// RouteDeps holds what the handlers of the route table are built with.
+type RouteDeps struct {
+	DB           AppDB
+	LoginGuard   *LoginGuard
+	Mailer       Mailer
+	Signer       *TokenSigner
+	ResetLimiter *RateLimiter
+	// BaseURL is the configured public URL of the site, which emailed links point to.
+	BaseURL     string
+	OAuthConfig *oauth2.Config
+	QBClients   QBClientSource
+	Box         *SecretBox
+	// Changes tells the devices of an org about the changes made on its pages.
+	Changes         *OrgChangeStream
+	WebhookVerifier *QBWebhookVerifier
+	Webhooks        *QBWebhookQueue
+	Callbacks       *QBCallbackSender
+}
+
+// Routes returns the route table of the web pages and of the device API.
+func (a *App) Routes(d RouteDeps) []Route {
+	onboarding := a.OnboardingMiddleware(d.DB)
+	start := func(h server.HandlerWithError) http.Handler {
+		return onboarding(a.Wrap(h))
+	}
+
+	return []Route{
+		{"GET", "/login", AccessPublic, "", a.Wrap(a.LoginPageHandler())},
+		{"POST", "/login", AccessPublic, "", a.Wrap(a.LoginPostHandler(d.DB, d.LoginGuard))},
+		{"POST", "/logout", AccessLoggedIn, "", a.Wrap(a.LogoutHandler(d.DB))},
+		{"GET", "/login/2fa", AccessPublic, "", a.Wrap(a.TOTPLoginPageHandler(d.DB))},
+		{"POST", "/login/2fa", AccessPublic, "", a.Wrap(a.TOTPLoginPostHandler(d.DB, d.LoginGuard))},
+		{"GET", "/login/2fa/setup", AccessPublic, "", a.Wrap(a.TOTPSetupPageHandler(d.DB))},
+		{"POST", "/login/2fa/setup", AccessPublic, "", a.Wrap(a.TOTPSetupPostHandler(d.DB))},
+		{"GET", "/account/2fa", AccessLoggedIn, "", a.Wrap(a.TOTPSetupPageHandler(d.DB))},
+		{"POST", "/account/2fa", AccessLoggedIn, "", a.Wrap(a.TOTPSetupPostHandler(d.DB))},
+		{"POST", "/account/2fa/disable", AccessLoggedIn, "", a.Wrap(a.TOTPDisablePostHandler(d.DB))},
+		{"GET", "/password/reset", AccessPublic, "", a.Wrap(a.PasswordResetRequestPageHandler())},
+		{"POST", "/password/reset", AccessPublic, "", a.Wrap(a.PasswordResetRequestPostHandler(d.DB, d.Mailer, d.ResetLimiter, d.BaseURL))},
+		{"GET", "/password/reset/:token", AccessPublic, "", a.Wrap(a.PasswordResetPageHandler(d.DB))},
+		{"POST", "/password/reset/:token", AccessPublic, "", a.Wrap(a.PasswordResetPostHandler(d.DB))},
+		{"GET", "/invite/:token", AccessPublic, "", a.Wrap(a.InviteAcceptPageHandler(d.DB, d.Signer))},
+		{"POST", "/invite/:token", AccessPublic, "", a.Wrap(a.InviteAcceptPostHandler(d.DB, d.Signer))},
+
+		{"GET", "/start", AccessPublic, "", start(a.WebStartPageHandler())},
+		{"GET", "/start/2", AccessPublic, "", start(a.WebStart2PageHandler())},
+		{"POST", "/start/2", AccessPublic, "", start(a.WebStart2PostHandler(d.DB))},
+		{"GET", "/start/3", AccessPublic, "", start(a.WebStart3PageHandler(d.DB))},
+		{"POST", "/start/3", AccessPublic, "", start(a.WebStart3PostHandler(d.DB))},
+		{"GET", "/start/4", AccessPublic, "", start(a.WebStart4PageHandler(d.DB))},
+		{"POST", "/start/4", AccessPublic, "", start(a.QuickbooksConnectHandler(d.DB, d.OAuthConfig))},
+		{"GET", "/start/5", AccessPublic, "", start(a.WebStart5PageHandler(d.DB, d.QBClients))},
+		{"GET", "/start/accounts", AccessPublic, "", start(a.QBAccountsPageHandler(d.DB, d.QBClients))},
+		{"POST", "/start/accounts", AccessPublic, "", start(a.QBAccountsPostHandler(d.DB, d.QBClients))},
+		{"POST", "/start/5", AccessPublic, "", start(a.WebStart5PostHandler(d.DB, d.QBClients))},
+		{"GET", "/start/odoo/connect", AccessPublic, "", start(a.OdooConnectPageHandler(d.DB))},
+		{"POST", "/start/odoo/connect", AccessPublic, "", start(a.OdooConnectPostHandler(d.DB, d.Box))},
+		{"GET", "/start/odoo/pos", AccessPublic, "", start(a.OdooPOSPageHandler(d.DB, d.Box))},
+		{"POST", "/start/odoo/pos", AccessPublic, "", start(a.OdooPOSPostHandler(d.DB, d.Box))},
+		{"GET", "/quickbooks/callback", AccessLoggedIn, "", a.Wrap(a.QuickbooksCallback(d.DB, d.OAuthConfig, d.QBClients))},
+
+		{"GET", "/orgs/:orgid/users", AccessRole, atlas.RoleShopManager, a.Wrap(a.UserIndexManagementHandler(d.DB))},
+		{"GET", "/orgs/:orgid/users/:userid", AccessRole, atlas.RoleShopManager, a.Wrap(a.UserInfoEditPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/users/:userid", AccessRole, atlas.RoleShopManager, a.Wrap(a.UserInfoEditPostHandler(d.DB))},
+		{"POST", "/orgs/:orgid/users/:userid/unlock", AccessRole, atlas.RoleShopManager, a.Wrap(a.UserUnlockPostHandler(d.DB, d.LoginGuard))},
+		{"GET", "/orgs/:orgid/invites", AccessRole, atlas.RoleShopManager, a.Wrap(a.InvitePageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/invites", AccessRole, atlas.RoleShopManager, a.Wrap(a.InvitePostHandler(d.DB, d.Mailer, d.Signer, d.BaseURL))},
+		{"POST", "/orgs/:orgid/quickbooks/connect", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QuickbooksReconnectHandler(d.OAuthConfig))},
+		{"GET", "/orgs/:orgid/2fa", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.OrgTOTPPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/2fa", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.OrgTOTPPostHandler(d.DB))},
+		{"GET", "/orgs/:orgid/payment-methods", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.PaymentMethodsPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/payment-methods", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.PaymentMethodCreatePostHandler(d.DB, d.Changes))},
+		{"GET", "/orgs/:orgid/payment-methods/:pmid", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.PaymentMethodEditPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/payment-methods/:pmid", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.PaymentMethodEditPostHandler(d.DB, d.Changes))},
+		{"POST", "/orgs/:orgid/payment-methods/:pmid/move", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.PaymentMethodMovePostHandler(d.DB, d.Changes))},
+		{"GET", "/orgs/:orgid/quickbooks/payment-methods", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBPaymentMethodReviewPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/quickbooks/payment-methods", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBPaymentMethodSyncPostHandler(d.DB, d.QBClients))},
+		{"GET", "/orgs/:orgid/quickbooks/accounts", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBAccountsPageHandler(d.DB, d.QBClients))},
+		{"POST", "/orgs/:orgid/quickbooks/accounts", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBAccountsPostHandler(d.DB, d.QBClients))},
+		{"GET", "/orgs/:orgid/quickbooks/tax-codes", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBTaxCodesPageHandler(d.DB, d.QBClients))},
+		{"POST", "/orgs/:orgid/quickbooks/tax-codes", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBTaxCodesPostHandler(d.DB, d.QBClients))},
+		{"GET", "/orgs/:orgid/tax-rates", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.POSTaxRatesPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/tax-rates", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.POSTaxRateCreatePostHandler(d.DB))},
+		{"POST", "/orgs/:orgid/tax-rates/:rateid/active", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.POSTaxRateActivePostHandler(d.DB))},
+		{"POST", "/orgs/:orgid/quickbooks/webhook-events/:eventid/replay", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBWebhookReplayPostHandler(d.Webhooks))},
+		{"GET", "/orgs/:orgid/quickbooks/callbacks", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBCallbacksPageHandler(d.DB))},
+		{"POST", "/orgs/:orgid/quickbooks/callbacks/deliveries/:deliveryid/redeliver", AccessRole, atlas.RoleOrgAdmin, a.Wrap(a.QBCallbackRedeliverPostHandler(d.DB, d.Callbacks))},
+
+		{"GET", "/api/auth", AccessDevice, "", a.Wrap(a.GetAuthAPIHandler())},
+		{"HEAD", "/api/auth", AccessPublic, "", a.Wrap(a.HeadAuthAPIHandler(d.DB))},
+		{"GET", "/api/changes", AccessDevice, "", a.OrgChangeStreamHandler(d.Changes)},
+		{"POST", "/api/quickbooks/callbacks", AccessDevice, "", a.Wrap(a.RegisterQBCallbackAPIHandler(d.DB, d.Box))},
+		{"DELETE", "/api/quickbooks/callbacks/:callbackid", AccessDevice, "", a.Wrap(a.DeleteQBCallbackAPIHandler(d.DB))},
+
+		{"POST", "/quickbooks/webhook", AccessWebhook, "", a.QBWebhookHandler(d.DB, d.WebhookVerifier, d.Webhooks)},
+	}
+}
+
+// RegisterRoutes adds the routes to r, each behind the checks its access needs. Web routes also get the user
+// of the session and a CSRF token; device routes are authenticated with the token of an Atlas session instead,
+// and webhook routes with the signature of Intuit.
+func (a *App) RegisterRoutes(r *httprouter.Router, routes []Route, db AppDB) {
+	for _, rt := range routes {
+		h := a.guard(rt, db, db)
+		if rt.Access != AccessDevice && rt.Access != AccessWebhook {
+			h = a.webUserAtlasMiddleware(db)(a.CSRFMiddleware(h))
+		}
+		r.Handle(rt.Method, rt.Path, withParams(h))
+	}
+}
+
+// guard puts the access check of the route in front of its handler.
+func (a *App) guard(rt Route, sessions atlas.AtlasSessionDB, roles atlas.QBUserRoleDB) http.Handler {
+	switch rt.Access {
+	case AccessLoggedIn:
+		return a.webAuthMiddleware(sessions)(rt.Handler)
+	case AccessRole:
+		return a.RequireRole(roles, rt.Role)(rt.Handler)
+	case AccessDevice:
+		return a.authAtlasMiddleware(sessions)(rt.Handler)
+	}
+	return rt.Handler
+}
+
+// withParams passes the URL params httprouter matched to h in the request context, where the handlers read
+// them from.
+func withParams(h http.Handler) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), server.Params, ps)))
+	}
+}
@@ -0,0 +1,161 @@
+package main_test
+
+import (
+	"atlas"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// accessMatrix is the status each user gets from the access check of a route, nil being a logged-out visitor.
+type accessMatrix map[*atlas.QBUser]int
+
+// signupUser carries the IsSuperAdmin flag that signing up used to set, without any role.
+var signupUser = &atlas.QBUser{ID: 5, Email: "signup@floatingcube.com", IsActive: true, IsSuperAdmin: true}
+
+var (
+	everyone     = accessMatrix{nil: 200, signupUser: 200, user1: 200, user2: 200, user3: 200, user4: 200}
+	loggedIn     = accessMatrix{nil: 302, signupUser: 200, user1: 200, user2: 200, user3: 200, user4: 200}
+	orgAdmins    = accessMatrix{nil: 302, signupUser: 403, user1: 200, user2: 200, user3: 403, user4: 403}
+	shopManagers = accessMatrix{nil: 302, signupUser: 403, user1: 200, user2: 200, user3: 403, user4: 403}
+	devices      = accessMatrix{nil: 403, signupUser: 403, user1: 403, user2: 403, user3: 403, user4: 403}
+)
+
+// routeAccess is who may call each route, checked with the URL params naming org1 and shop1. Routes about a
+// whole org name no shop, so shop managers need an org wide role for them.
+var routeAccess = map[string]accessMatrix{
+	"GET /login":                             everyone,
+	"POST /login":                            everyone,
+	"POST /logout":                           loggedIn,
+	"GET /login/2fa":                         everyone,
+	"POST /login/2fa":                        everyone,
+	"GET /login/2fa/setup":                   everyone,
+	"POST /login/2fa/setup":                  everyone,
+	"GET /account/2fa":                       loggedIn,
+	"POST /account/2fa":                      loggedIn,
+	"POST /account/2fa/disable":              loggedIn,
+	"GET /password/reset":                    everyone,
+	"POST /password/reset":                   everyone,
+	"GET /password/reset/:token":             everyone,
+	"POST /password/reset/:token":            everyone,
+	"GET /invite/:token":                     everyone,
+	"POST /invite/:token":                    everyone,
+	"GET /start":                             everyone,
+	"GET /start/2":                           everyone,
+	"POST /start/2":                          everyone,
+	"GET /start/3":                           everyone,
+	"POST /start/3":                          everyone,
+	"GET /start/4":                           everyone,
+	"POST /start/4":                          everyone,
+	"GET /start/5":                           everyone,
+	"GET /start/accounts":                    everyone,
+	"POST /start/accounts":                   everyone,
+	"POST /start/5":                          everyone,
+	"GET /start/odoo/connect":                everyone,
+	"POST /start/odoo/connect":               everyone,
+	"GET /start/odoo/pos":                    everyone,
+	"POST /start/odoo/pos":                   everyone,
+	"GET /quickbooks/callback":               loggedIn,
+	"GET /orgs/:orgid/users":                 shopManagers,
+	"GET /orgs/:orgid/users/:userid":         shopManagers,
+	"POST /orgs/:orgid/users/:userid":        shopManagers,
+	"POST /orgs/:orgid/users/:userid/unlock": shopManagers,
+	"GET /orgs/:orgid/invites":               shopManagers,
+	"POST /orgs/:orgid/invites":              shopManagers,
+	"POST /orgs/:orgid/quickbooks/connect":   orgAdmins,
+	"GET /orgs/:orgid/2fa":                   orgAdmins,
+	"POST /orgs/:orgid/2fa":                  orgAdmins,
+
+	"GET /orgs/:orgid/payment-methods":             orgAdmins,
+	"POST /orgs/:orgid/payment-methods":            orgAdmins,
+	"GET /orgs/:orgid/payment-methods/:pmid":       orgAdmins,
+	"POST /orgs/:orgid/payment-methods/:pmid":      orgAdmins,
+	"POST /orgs/:orgid/payment-methods/:pmid/move": orgAdmins,
+	"GET /orgs/:orgid/quickbooks/payment-methods":  orgAdmins,
+	"POST /orgs/:orgid/quickbooks/payment-methods": orgAdmins,
+	"GET /orgs/:orgid/quickbooks/accounts":         orgAdmins,
+	"POST /orgs/:orgid/quickbooks/accounts":        orgAdmins,
+	"GET /orgs/:orgid/quickbooks/tax-codes":        orgAdmins,
+	"POST /orgs/:orgid/quickbooks/tax-codes":       orgAdmins,
+	"GET /orgs/:orgid/tax-rates":                   orgAdmins,
+	"POST /orgs/:orgid/tax-rates":                  orgAdmins,
+	"POST /orgs/:orgid/tax-rates/:rateid/active":   orgAdmins,
+
+	"POST /orgs/:orgid/quickbooks/webhook-events/:eventid/replay": orgAdmins,
+
+	"GET /orgs/:orgid/quickbooks/callbacks":                                   orgAdmins,
+	"POST /orgs/:orgid/quickbooks/callbacks/deliveries/:deliveryid/redeliver": orgAdmins,
+
+	"GET /api/auth":  devices,
+	"HEAD /api/auth": everyone,
+
+	"GET /api/changes": devices,
+
+	"POST /api/quickbooks/callbacks":               devices,
+	"DELETE /api/quickbooks/callbacks/:callbackid": devices,
+
+	// the webhook handler checks the signature of Intuit itself
+	"POST /quickbooks/webhook": everyone,
+}
+
+// routeParams names org1 and shop1, and the first of anything else, for the params of path.
+func routeParams(path string) httprouter.Params {
+	var ps httprouter.Params
+	for _, part := range strings.Split(path, "/") {
+		if !strings.HasPrefix(part, ":") {
+			continue
+		}
+		p := httprouter.Param{Key: part[1:], Value: "1"}
+		switch p.Key {
+		case "orgid":
+			p.Value = strconv.Itoa(org1.ID)
+		case "shopid":
+			p.Value = strconv.Itoa(shop1.ID)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+func TestRoutes(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	routes := app.Routes(main.RouteDeps{})
+	seen := map[string]bool{}
+	for _, rt := range routes {
+		name := rt.Method + " " + rt.Path
+		assert(t, !seen[name], "%s is routed twice", name)
+		seen[name] = true
+		expected, declared := routeAccess[name]
+		assert(t, declared, "%s has no access declared in routeAccess", name)
+
+		rt.Handler = okHandler
+		h := app.Guard(rt, nil, &MockQBUserDB{})
+		for u, code := range expected {
+			var test HandleTester
+			who := "logged-out visitor"
+			if u == nil {
+				test = GenerateHandleTesterWithURLParams(t, h, false, routeParams(rt.Path))
+			} else {
+				test = GenerateHandleTesterAsUser(t, h, u, routeParams(rt.Path))
+				who = u.Email
+			}
+			w := test(rt.Method, url.Values{})
+			assert(t, w.Code == code, "%s: expected %s to get %d instead got %d", name, who, code, w.Code)
+		}
+	}
+	for name := range routeAccess {
+		assert(t, seen[name], "%s is declared in routeAccess but not routed", name)
+	}
+
+	// a route behind a role names the role
+	for _, rt := range routes {
+		if rt.Access == main.AccessRole {
+			assert(t, rt.Role.IsValid(), "%s %s needs a role", rt.Method, rt.Path)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// ErrSealedValue is returned for values that were not sealed with the key of the SecretBox.
+var ErrSealedValue = fmt.Errorf("invalid sealed value")
+
+// SecretBox encrypts the credentials the server keeps to call other systems, such as the passwords of Odoo
+// connections, so that they are not readable from the database alone.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox returns a SecretBox encrypting with AES-GCM under key, which has to be 16, 24 or 32 bytes long.
+func NewSecretBox(key []byte) (*SecretBox, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal encrypts plaintext and returns it with its nonce, base64 encoded.
+func (b *SecretBox) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value returned by Seal.
+func (b *SecretBox) Open(sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", ErrSealedValue
+	}
+	n := b.aead.NonceSize()
+	plaintext, err := b.aead.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", ErrSealedValue
+	}
+	return string(plaintext), nil
+}
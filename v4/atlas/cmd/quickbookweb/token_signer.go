@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed or were not signed by us.
+	ErrInvalidToken = fmt.Errorf("invalid token")
+	// ErrExpiredToken is returned for correctly signed tokens past their expiry.
+	ErrExpiredToken = fmt.Errorf("token has expired")
+)
+
+// TokenSigner creates and verifies signed, expiring tokens to be put in links.
+type TokenSigner struct {
+	key []byte
+}
+
+// NewTokenSigner returns a TokenSigner using key for the HMAC signature.
+func NewTokenSigner(key []byte) *TokenSigner {
+	return &TokenSigner{key: key}
+}
+
+// Sign returns a url safe token carrying payload that expires at expires.
+func (s *TokenSigner) Sign(payload string, expires time.Time) string {
+	msg := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return msg + "." + s.mac(msg)
+}
+
+// Verify checks the signature and expiry of token and returns its payload.
+func (s *TokenSigner) Verify(token string) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", ErrInvalidToken
+	}
+	msg, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(s.mac(msg))) {
+		return "", ErrInvalidToken
+	}
+
+	parts := strings.Split(msg, ".")
+	if len(parts) != 2 {
+		return "", ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() > expires {
+		return "", ErrExpiredToken
+	}
+	return string(payload), nil
+}
+
+func (s *TokenSigner) mac(msg string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// newRandomToken returns a url safe random string, for oauth states and single-use links.
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash stored in place of a single-use token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -5,15 +5,28 @@ import (
 	"atlas/cmd/server"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/asaskevich/govalidator"
+	"github.com/julienschmidt/httprouter"
 )
 
 const sessionName = "session"
 const userKeyName = "user"
 const sessionKeyName = "session_key"
 
+type loginForm struct {
+	Email    string `form:"email" label:"Email" validate:"required,email"`
+	Password string `form:"password,secret" label:"Password" validate:"required"`
+}
+
+type userEditForm struct {
+	Name     string `form:"name" label:"Name" validate:"required,max=100"`
+	Email    string `form:"email" label:"Email" validate:"required,email"`
+	IsActive bool   `form:"active"`
+}
+
 // LoginPageHandler is the handler for displaying the login page.
 func (a *App) LoginPageHandler() server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
@@ -27,6 +40,9 @@ func (a *App) LoginPageHandler() server.HandlerWithError {
 			PageTitle:       "Login",
 			PageURL:         "/login",
 			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
+			Flashes:         a.getFlashes(w, req),
+			Form:            a.getFormState(w, req),
 		}
 		a.Rndr.HTML(w, http.StatusOK, "login", lp)
 		return nil
@@ -34,7 +50,8 @@ func (a *App) LoginPageHandler() server.HandlerWithError {
 }
 
 // LoginPostHandler is the handler for dealing with user login input.
-func (a *App) LoginPostHandler(db atlas.QBUserDB) server.HandlerWithError {
+// Failed attempts are counted by the guard, which delays and then locks out accounts and IPs.
+func (a *App) LoginPostHandler(db atlas.QBLoginDB, guard *LoginGuard) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		u, _ := getUser(req)
 		// user is logged in already
@@ -42,43 +59,101 @@ func (a *App) LoginPostHandler(db atlas.QBUserDB) server.HandlerWithError {
 			http.Redirect(w, req, "/", http.StatusFound)
 			return nil
 		}
-		email, pass := strings.TrimSpace(req.FormValue("email")), req.FormValue("password")
-		// TODO: add proper flashes and validation
-		if email == "" || pass == "" {
+		var form loginForm
+		fs, valid, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if !valid {
+			a.formError(w, req, fs, "/login")
+			return nil
+		}
+		email, pass := form.Email, form.Password
+		ip := remoteIP(req)
+		wait, err := guard.Wait(email, ip, time.Now())
+		if err != nil {
 			http.Redirect(w, req, "/login", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "validation error: email or password cannot be empty", fmt.Errorf("email or password cannot be empty"))
+			return server.New500Error("internal server error: unable to check login attempts", err)
 		}
-		if !govalidator.IsEmail(email) {
+		if wait > 0 {
+			a.saveFlash(w, req, FlashError, fmt.Sprintf("Too many failed logins, please try again in %s", wait.Round(time.Second)))
 			http.Redirect(w, req, "/login", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "email has to be a valid email address", fmt.Errorf("email has to be a valid email address"))
-
+			return server.NewError(http.StatusTooManyRequests, fmt.Sprintf("too many failed logins, please try again in %s", wait.Round(time.Second)), fmt.Errorf("login for %s from %s throttled", email, ip))
 		}
-		u, err := db.GetQBUserByEmail(email)
-		if err != nil {
+		u, err = db.GetQBUserByEmail(email)
+		if err != nil || !u.IsCorrectPassword(pass, db) {
+			if ferr := guard.Fail(email, ip, time.Now()); ferr != nil {
+				a.Logr.Log("error recording failed login for %s: %s", email, ferr)
+			}
+			if err == nil {
+				err = fmt.Errorf("wrong password for %s", email)
+			}
+			a.saveFlash(w, req, FlashError, "Incorrect email or password")
+			a.saveFormState(w, req, FormState{Values: map[string]string{"email": email}})
 			http.Redirect(w, req, "/login", http.StatusFound)
-			return server.New500Error("internal server error: unable to retrieve user by email", err)
+			return server.NewError(http.StatusUnauthorized, "incorrect email or password", err)
+		}
+		if err = guard.Succeed(email); err != nil {
+			a.Logr.Log("error clearing failed logins for %s: %s", email, err)
 		}
-		if !u.IsCorrectPassword(pass, db) {
+		if !u.IsActive {
+			a.saveFlash(w, req, FlashError, "This account has been deactivated")
 			http.Redirect(w, req, "/login", http.StatusFound)
+			return server.NewError(http.StatusForbidden, "this account has been deactivated", fmt.Errorf("login attempt by deactivated user %d", u.ID))
 		}
 
-		sess, err := db.CreateAtlasWebSession(u.ID)
+		needsTOTP, err := needsSecondFactor(db, u.ID)
 		if err != nil {
 			http.Redirect(w, req, "/login", http.StatusFound)
-			return server.New500Error("internal server error: error during create web session", err)
+			return server.New500Error("internal server error: error checking second factor", err)
+		}
+		if needsTOTP {
+			err = a.startPendingLogin(w, req, u.ID)
+			if err != nil {
+				return server.New500Error("internal server error: error during saving of session", err)
+			}
+			http.Redirect(w, req, "/login/2fa", http.StatusFound)
+			return nil
 		}
 
-		session, err := a.Store.Get(req, sessionName)
+		err = a.createLoginSession(w, req, db, u.ID)
 		if err != nil {
-			return server.New500Error("internal server error: error during getting of session", err)
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return err
 		}
-		session.Values[sessionKeyName] = sess.SessionKey
-		session.Save(req, w)
 		http.Redirect(w, req, "/w", http.StatusFound)
 		return nil
 	}
 }
 
+// webSessionDB is the part of the databases creating web sessions, which every way of logging in has.
+type webSessionDB interface {
+	CreateAtlasWebSession(userID int) (*atlas.WebSession, error)
+}
+
+// createLoginSession creates a web session for the user and saves its key in the session cookie. The CSRF
+// token is replaced, so that a token planted before login is of no use after it, and an unfinished TOTP
+// enrolment is dropped.
+func (a *App) createLoginSession(w http.ResponseWriter, req *http.Request, db webSessionDB, userID int) error {
+	sess, err := db.CreateAtlasWebSession(userID)
+	if err != nil {
+		return server.New500Error("internal server error: error during create web session", err)
+	}
+
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return server.New500Error("internal server error: error during getting of session", err)
+	}
+	session.Values[sessionKeyName] = sess.SessionKey
+	clearTOTPSecret(session.Values)
+	_, err = rotateCSRFToken(session.Values)
+	if err != nil {
+		return server.New500Error("internal server error: error generating csrf token", err)
+	}
+	session.Save(req, w)
+	return nil
+}
+
 // LogoutHandler is the handler for logging out.
 // TODO: set the flashes properly when redirecting.
 func (a *App) LogoutHandler(db atlas.QBUserDB) server.HandlerWithError {
@@ -99,29 +174,264 @@ func (a *App) LogoutHandler(db atlas.QBUserDB) server.HandlerWithError {
 			return server.New500Error("internal server error: error during getting of session", err)
 		}
 		delete(session.Values, sessionKeyName)
+		clearTOTPSecret(session.Values)
 		session.Save(req, w)
 		http.Redirect(w, req, "/", http.StatusFound)
 		return nil
 	}
 }
 
+// usersPerPage is the number of users listed on one page of the users management page.
+const usersPerPage = 20
+
 // UserIndexManagementHandler displays the users management page.
-func (a *App) UserIndexManagementHandler() server.HandlerWithError {
+func (a *App) UserIndexManagementHandler(db atlas.QBUserManagementDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, _ := requestScope(req)
+		if orgID == 0 {
+			return server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for users management page"))
+		}
+		query := strings.TrimSpace(req.FormValue("q"))
+		page, err := strconv.Atoi(req.FormValue("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+
+		users, total, err := db.SearchQBUsersForOrg(orgID, query, usersPerPage, (page-1)*usersPerPage)
+		if err != nil {
+			return server.New500Error("error retrieving users for organisation", err)
+		}
+		totalPages := (total + usersPerPage - 1) / usersPerPage
+
+		p := struct {
+			Users      []*atlas.QBUser
+			OrgID      int
+			Query      string
+			Page       int
+			TotalPages int
+			PrevPage   int
+			NextPage   int
+			*localPresenter
+		}{
+			Users:      users,
+			OrgID:      orgID,
+			Query:      query,
+			Page:       page,
+			TotalPages: totalPages,
+			localPresenter: &localPresenter{
+				PageTitle:       "Users",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+			},
+		}
+		if page > 1 {
+			p.PrevPage = page - 1
+		}
+		if page < totalPages {
+			p.NextPage = page + 1
+		}
+		a.Rndr.HTML(w, http.StatusOK, "users", p)
 		return nil
 	}
 }
 
 // UserInfoEditPageHandler is the handler for displaying the edit form for one user.
-func (a *App) UserInfoEditPageHandler() server.HandlerWithError {
+func (a *App) UserInfoEditPageHandler(db atlas.QBUserManagementDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, editUser, err := getOrgUser(req, db)
+		if err != nil {
+			return err
+		}
+
+		form := a.getFormState(w, req)
+		if form.Values == nil {
+			form.Values = map[string]string{"name": editUser.Name, "email": editUser.Email}
+			if editUser.IsActive {
+				form.Values["active"] = "on"
+			}
+		}
+
+		p := struct {
+			EditUser *atlas.QBUser
+			OrgID    int
+			*localPresenter
+		}{
+			EditUser: editUser,
+			OrgID:    orgID,
+			localPresenter: &localPresenter{
+				PageTitle:       "Edit user",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "user_edit", p)
 		return nil
 	}
 }
 
 // UserInfoEditPostHandler is the handler for handling the Post user data.
-func (a *App) UserInfoEditPostHandler() server.HandlerWithError {
+// Deactivating a user also logs them out of every web session. Superadmin rights are not edited here, only an
+// operator grants RoleSuperAdmin.
+func (a *App) UserInfoEditPostHandler(db atlas.QBUserManagementDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, editUser, err := getOrgUser(req, db)
+		if err != nil {
+			return err
+		}
+		editURL := fmt.Sprintf("/orgs/%d/users/%d", orgID, editUser.ID)
+		allowed, err := canEditUser(db, u, editUser, orgID)
+		if err != nil {
+			return server.New500Error("error retrieving roles for user", err)
+		}
+		if !allowed {
+			return server.NewError(http.StatusForbidden, "you cannot edit this user", fmt.Errorf("user %d outranks user %d in org %d", editUser.ID, u.ID, orgID))
+		}
+
+		var form userEditForm
+		fs, _, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if _, invalid := fs.Errors["email"]; !invalid {
+			if existing, err := db.GetQBUserByEmail(form.Email); err == nil && existing.ID != editUser.ID {
+				fs.Errors["email"] = "Another user already uses this email address"
+			}
+		}
+		if editUser.ID == u.ID && !form.IsActive {
+			fs.Errors["active"] = "You cannot deactivate yourself"
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, editURL)
+			return nil
+		}
+
+		wasActive := editUser.IsActive
+		editUser.Name = form.Name
+		editUser.Email = form.Email
+		editUser.IsActive = form.IsActive
+		_, err = db.UpdateQBUser(*editUser)
+		if err != nil {
+			return server.New500Error("error saving user", err)
+		}
+		if wasActive && !form.IsActive {
+			err = db.DeleteAllAtlasWebSessionsForUser(editUser.ID)
+			if err != nil {
+				return server.New500Error("error logging out deactivated user", err)
+			}
+		}
+
+		a.saveFlash(w, req, FlashSuccess, "User saved")
+		http.Redirect(w, req, fmt.Sprintf("/orgs/%d/users", orgID), http.StatusFound)
 		return nil
 	}
 }
+
+// UserUnlockPostHandler lifts the login lockout of a user. Only users who may edit the locked user may unlock
+// them.
+func (a *App) UserUnlockPostHandler(db atlas.QBUserManagementDB, guard *LoginGuard) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, editUser, err := getOrgUser(req, db)
+		if err != nil {
+			return err
+		}
+		allowed, err := canEditUser(db, u, editUser, orgID)
+		if err != nil {
+			return server.New500Error("error retrieving roles for user", err)
+		}
+		if !allowed {
+			return server.NewError(http.StatusForbidden, "you cannot unlock this user", fmt.Errorf("user %d outranks user %d in org %d", editUser.ID, u.ID, orgID))
+		}
+		err = guard.Unlock(editUser.Email, u.ID, remoteIP(req))
+		if err != nil {
+			return server.New500Error("error unlocking user", err)
+		}
+		a.saveFlash(w, req, FlashSuccess, editUser.Email+" can log in again")
+		http.Redirect(w, req, fmt.Sprintf("/orgs/%d/users/%d", orgID, editUser.ID), http.StatusFound)
+		return nil
+	}
+}
+
+// canEditUser reports whether actor may edit target within the org. Superadmins may edit anyone; other users
+// may not edit a superadmin, and need at least each role target holds in the org over the same shop, since
+// changing the email of a user is enough to take the account over with a password reset.
+func canEditUser(db atlas.QBUserRoleDB, actor, target *atlas.QBUser, orgID int) (bool, error) {
+	actorRoles, err := db.GetQBUserRoles(actor.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range actorRoles {
+		if r.Role == atlas.RoleSuperAdmin {
+			return true, nil
+		}
+	}
+	targetRoles, err := db.GetQBUserRoles(target.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, r := range targetRoles {
+		if r.Role == atlas.RoleSuperAdmin {
+			return false, nil
+		}
+		if r.OrgID == orgID && !hasRole(actorRoles, r.Role, orgID, r.ShopID) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getOrgUser returns the org and the user named by the "orgid" and "userid" URL params,
+// making sure the user belongs to the org.
+func getOrgUser(req *http.Request, db atlas.QBUserManagementDB) (int, *atlas.QBUser, error) {
+	orgID, _ := requestScope(req)
+	var userID int
+	if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+		userID, _ = strconv.Atoi(ps.ByName("userid"))
+	}
+	if orgID == 0 || userID == 0 {
+		return 0, nil, server.NewError(http.StatusBadRequest, "no organisation or user given", fmt.Errorf("missing orgid or userid"))
+	}
+
+	roles, err := db.GetQBUserRoles(userID)
+	if err != nil {
+		return 0, nil, server.New500Error("error retrieving roles for user", err)
+	}
+	inOrg := false
+	for _, r := range roles {
+		if r.OrgID == orgID {
+			inOrg = true
+			break
+		}
+	}
+	if !inOrg {
+		return 0, nil, server.NewError(http.StatusNotFound, "user not found", fmt.Errorf("user %d has no role in org %d", userID, orgID))
+	}
+
+	u, err := db.GetQBUserByID(userID)
+	if err != nil {
+		return 0, nil, server.NewError(http.StatusNotFound, "user not found", err)
+	}
+	return orgID, u, nil
+}
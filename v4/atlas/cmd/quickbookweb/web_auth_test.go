@@ -6,13 +6,23 @@ import (
 		"fmt"
 		"net/url"
 		"net/http"
+		"strings"
 
+		"github.com/julienschmidt/httprouter"
 		"golang.org/x/crypto/bcrypt"
 )
 type MockQBUserDB struct {
+	MockQBOnboardingDB
 	hasError		bool
 	mockhashedPassword	[]byte
 	mockTx			*atlas.Tx
+	updatedUser		*atlas.QBUser
+	loggedOutUserIDs	[]int
+	totps			map[int]*atlas.QBUserTOTP
+	totpRequired		bool
+	sessionUserIDs		[]int
+	roles			map[int][]*atlas.QBUserRole
+	setupUser		*atlas.QBUser
 }
 
 func (db *MockQBUserDB) Begin() (*atlas.Tx, error) {
@@ -41,7 +51,12 @@ func (db *MockQBUserDB) GetQBUserByEmail(email string) (*atlas.QBUser, error) {
 	if db.hasError {
 		return nil, fmt.Errorf("some error")
 	}
-	return user1, nil
+	for _, u := range []*atlas.QBUser{user1, user2, user3, user4} {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("no user with email %s", email)
 }
 
 func (db *MockQBUserDB) GetPassword(userID int) ([]byte, error) {
@@ -59,6 +74,12 @@ func (db *MockQBUserDB) GetQBUserByID(userID int) (*atlas.QBUser, error) {
 	if db.hasError {
 		return nil, fmt.Errorf("some error")
 	}
+	for _, u := range []*atlas.QBUser{user2, user3, user4} {
+		if u.ID == userID {
+			copied := *u
+			return &copied, nil
+		}
+	}
 	return user1, nil
 }
 
@@ -73,6 +94,7 @@ func (db *MockQBUserDB) CreateAtlasWebSession(userID int) (*atlas.WebSession, er
 	if db.hasError {
 		return nil, fmt.Errorf("some error")
 	}
+	db.sessionUserIDs = append(db.sessionUserIDs, userID)
 	aws := &atlas.WebSession{
 		UserID:     userID,
 		SessionKey: "w1232445",
@@ -80,6 +102,97 @@ func (db *MockQBUserDB) CreateAtlasWebSession(userID int) (*atlas.WebSession, er
 	return aws, nil
 }
 
+// Role fixtures: user2 administers org1, user3 manages shop1 and user4 is a cashier at shop1.
+var user2 = &atlas.QBUser{ID: 2, Email: "orgadmin@floatingcube.com", Name: "Org Admin", IsActive: true}
+var user3 = &atlas.QBUser{ID: 3, Email: "manager@floatingcube.com", Name: "Shop Manager", IsActive: true}
+var user4 = &atlas.QBUser{ID: 4, Email: "cashier@floatingcube.com", Name: "Cashier", IsActive: true}
+
+var mockRoles = map[int][]*atlas.QBUserRole{
+	user1.ID: {{ID: 4, UserID: user1.ID, Role: atlas.RoleSuperAdmin}},
+	user2.ID: {{ID: 1, UserID: user2.ID, OrgID: org1.ID, Role: atlas.RoleOrgAdmin}},
+	user3.ID: {{ID: 2, UserID: user3.ID, OrgID: org1.ID, ShopID: shop1.ID, Role: atlas.RoleShopManager}},
+	user4.ID: {{ID: 3, UserID: user4.ID, OrgID: org1.ID, ShopID: shop1.ID, Role: atlas.RoleCashier}},
+}
+
+func (db *MockQBUserDB) GetQBUserRoles(userID int) ([]*atlas.QBUserRole, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if roles, ok := db.roles[userID]; ok {
+		return roles, nil
+	}
+	return mockRoles[userID], nil
+}
+
+func (db *MockQBUserDB) SearchQBUsersForOrg(orgID int, query string, limit, offset int) ([]*atlas.QBUser, int, error) {
+	if db.hasError {
+		return nil, 0, fmt.Errorf("some error")
+	}
+	var users []*atlas.QBUser
+	for _, u := range []*atlas.QBUser{user2, user3, user4} {
+		if strings.Contains(u.Name, query) || strings.Contains(u.Email, query) {
+			users = append(users, u)
+		}
+	}
+	total := len(users)
+	if offset >= total {
+		return nil, total, nil
+	}
+	if offset+limit < total {
+		users = users[:offset+limit]
+	}
+	return users[offset:], total, nil
+}
+
+func (db *MockQBUserDB) UpdateQBUser(u atlas.QBUser) (*atlas.QBUser, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.updatedUser = &u
+	return &u, nil
+}
+
+func (db *MockQBUserDB) DeleteAllAtlasWebSessionsForUser(userID int) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.loggedOutUserIDs = append(db.loggedOutUserIDs, userID)
+	return nil
+}
+
+func (db *MockQBUserDB) GetQBUserTOTP(userID int) (*atlas.QBUserTOTP, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.totps[userID], nil
+}
+
+func (db *MockQBUserDB) SaveQBUserTOTP(t atlas.QBUserTOTP) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	if db.totps == nil {
+		db.totps = map[int]*atlas.QBUserTOTP{}
+	}
+	db.totps[t.UserID] = &t
+	return nil
+}
+
+func (db *MockQBUserDB) DeleteQBUserTOTP(userID int) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	delete(db.totps, userID)
+	return nil
+}
+
+func (db *MockQBUserDB) IsTOTPRequiredForUser(userID int) (bool, error) {
+	if db.hasError {
+		return false, fmt.Errorf("some error")
+	}
+	return db.totpRequired, nil
+}
+
 func TestLoginPageHandler(t *testing.T) {
 	skip(t, skipProjectFlag, "quickbook")
 	lp := app.LoginPageHandler()
@@ -98,7 +211,7 @@ func TestLoginPostHandler(t *testing.T) {
 	mockDB := &MockQBUserDB{
 		hasError:			false,
 	}
-	lp := app.LoginPostHandler(mockDB)
+	lp := app.LoginPostHandler(mockDB, newTestLoginGuard())
 
 	test := GenerateHandleTester(t, app.Wrap(lp), false)
 	//correct password
@@ -109,6 +222,13 @@ func TestLoginPostHandler(t *testing.T) {
 	// Wrong password
 	w = test("POST", url.Values{"email": {"hochiminh@communist.com"}, "password": {"tranisme"}})
 	assert(t, w.Code == http.StatusFound, "expected successful login with proper POST inputs to redirect 302 instead got %d", w.Code)
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.sessionUserIDs))
+
+	// invalid input is sent back to the form without checking the password
+	w = test("POST", url.Values{"email": {"notanemail"}, "password": {""}})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, 1, len(mockDB.sessionUserIDs))
 }
 
 func TestLogoutHandler(t *testing.T) {
@@ -128,27 +248,127 @@ func TestLogoutHandler(t *testing.T) {
 
 func TestUserIndexManagementHandler(t *testing.T) {
 	skip(t, skipProjectFlag, "quickbook")
-	lp := app.UserIndexManagementHandler()
-	
-	test := GenerateHandleTester(t, app.Wrap(lp), false)
+	lp := app.UserIndexManagementHandler(&MockQBUserDB{})
+	orgParams := httprouter.Params{{Key: "orgid", Value: "1"}}
+
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(lp), true, orgParams)
 	w := test("GET", url.Values{})
 	assert(t, w.Code == http.StatusOK, "expected page to return 200 instead got %d", w.Code)
+	assert(t, strings.Contains(w.Body.String(), user3.Email), "expected users of the org to be listed")
+
+	// search
+	w = test("GET", url.Values{"q": {"Cashier"}})
+	assert(t, w.Code == http.StatusOK, "expected page to return 200 instead got %d", w.Code)
+	assert(t, !strings.Contains(w.Body.String(), user3.Email), "expected search to filter out %s", user3.Email)
+
+	// no org given
+	test = GenerateHandleTester(t, app.Wrap(lp), true)
+	w = test("GET", url.Values{})
+	equals(t, http.StatusBadRequest, w.Code)
+
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserIndexManagementHandler(&MockQBUserDB{hasError: true})), true, orgParams)
+	w = test("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
 }
 
 func TestUserInfoEditPageHandler(t *testing.T) {
 	skip(t, skipProjectFlag, "quickbook")
-	lp := app.UserInfoEditPageHandler()
-	
-	test := GenerateHandleTester(t, app.Wrap(lp), false)
+	lp := app.UserInfoEditPageHandler(&MockQBUserDB{})
+
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(lp), true, httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: "3"}})
 	w := test("GET", url.Values{})
 	assert(t, w.Code == http.StatusOK, "expected page to return 200 instead got %d", w.Code)
+	assert(t, strings.Contains(w.Body.String(), user3.Email), "expected edit form to be filled in with the user")
+
+	// user is not part of the org
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(lp), true, httprouter.Params{{Key: "orgid", Value: "99"}, {Key: "userid", Value: "3"}})
+	w = test("GET", url.Values{})
+	equals(t, http.StatusNotFound, w.Code)
 }
 
 func TestUserInfoEditPostHandler(t *testing.T) {
 	skip(t, skipProjectFlag, "quickbook")
-	lp := app.UserInfoEditPostHandler()
-	
-	test := GenerateHandleTester(t, app.Wrap(lp), false)
-	w := test("GET", url.Values{})
-	assert(t, w.Code == http.StatusOK, "expected page to return 200 instead got %d", w.Code)
+	params := httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: "3"}}
+
+	mockDB := &MockQBUserDB{}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), true, params)
+	w := test("POST", url.Values{"name": {"New Name"}, "email": {"new@floatingcube.com"}, "active": {"on"}})
+	assert(t, w.Code == http.StatusFound, "expected successful edit to redirect 302 instead got %d", w.Code)
+	equals(t, "/orgs/1/users", w.HeaderMap.Get("Location"))
+	equals(t, "New Name", mockDB.updatedUser.Name)
+	equals(t, "new@floatingcube.com", mockDB.updatedUser.Email)
+	equals(t, 0, len(mockDB.loggedOutUserIDs))
+
+	// deactivation logs the user out
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), true, params)
+	w = test("POST", url.Values{"name": {user3.Name}, "email": {user3.Email}})
+	assert(t, w.Code == http.StatusFound, "expected successful edit to redirect 302 instead got %d", w.Code)
+	assert(t, !mockDB.updatedUser.IsActive, "expected user to be deactivated")
+	equals(t, []int{user3.ID}, mockDB.loggedOutUserIDs)
+
+	// validation errors send the admin back to the form
+	for _, form := range []url.Values{
+		{"name": {""}, "email": {user3.Email}, "active": {"on"}},
+		{"name": {user3.Name}, "email": {"notanemail"}, "active": {"on"}},
+		{"name": {user3.Name}, "email": {user2.Email}, "active": {"on"}},
+	} {
+		mockDB = &MockQBUserDB{}
+		test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), true, params)
+		w = test("POST", form)
+		assert(t, w.Code == http.StatusFound, "expected invalid edit to redirect 302 instead got %d", w.Code)
+		equals(t, "/orgs/1/users/3", w.HeaderMap.Get("Location"))
+		assert(t, mockDB.updatedUser == nil, "expected invalid edit %v not to be saved", form)
+	}
+
+	// users who outrank the admin cannot be edited, so that their account cannot be taken over
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), user3, httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: "2"}})
+	w = test("POST", url.Values{"name": {user2.Name}, "email": {"attacker@evil.com"}, "active": {"on"}})
+	equals(t, http.StatusForbidden, w.Code)
+	assert(t, mockDB.updatedUser == nil, "expected the edit of a higher ranked user not to be saved")
+
+	mockDB = &MockQBUserDB{roles: map[int][]*atlas.QBUserRole{
+		user1.ID: {
+			{ID: 4, UserID: user1.ID, Role: atlas.RoleSuperAdmin},
+			{ID: 5, UserID: user1.ID, OrgID: org1.ID, Role: atlas.RoleOrgAdmin},
+		},
+	}}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), user2, httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: fmt.Sprint(user1.ID)}})
+	w = test("POST", url.Values{"name": {user1.Name}, "email": {"attacker@evil.com"}})
+	equals(t, http.StatusForbidden, w.Code)
+	assert(t, mockDB.updatedUser == nil, "expected the edit of a superadmin not to be saved")
+
+	// a shop manager only manages the cashiers of their own shop
+	cashierParams := httprouter.Params{{Key: "orgid", Value: "1"}, {Key: "userid", Value: fmt.Sprint(user4.ID)}}
+	mockDB = &MockQBUserDB{roles: map[int][]*atlas.QBUserRole{
+		user4.ID: {{ID: 3, UserID: user4.ID, OrgID: org1.ID, ShopID: 99, Role: atlas.RoleCashier}},
+	}}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), user3, cashierParams)
+	w = test("POST", url.Values{"name": {user4.Name}, "email": {"attacker@evil.com"}, "active": {"on"}})
+	equals(t, http.StatusForbidden, w.Code)
+	assert(t, mockDB.updatedUser == nil, "expected the edit of a cashier of another shop not to be saved")
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), user3, cashierParams)
+	w = test("POST", url.Values{"name": {user4.Name}, "email": {user4.Email}, "active": {"on"}})
+	equals(t, "/orgs/1/users", w.HeaderMap.Get("Location"))
+
+	// the IsSuperAdmin flag grants nothing, and the form cannot set it
+	flagged := *user4
+	flagged.IsSuperAdmin = true
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), &flagged, params)
+	w = test("POST", url.Values{"name": {user3.Name}, "email": {"attacker@evil.com"}, "active": {"on"}})
+	equals(t, http.StatusForbidden, w.Code)
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), true, params)
+	w = test("POST", url.Values{"name": {user3.Name}, "email": {user3.Email}, "active": {"on"}, "superadmin": {"on"}})
+	assert(t, !mockDB.updatedUser.IsSuperAdmin, "expected the superadmin flag not to be set")
+
+	// admins can edit their peers and the users below them
+	mockDB = &MockQBUserDB{}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.UserInfoEditPostHandler(mockDB)), user2, params)
+	w = test("POST", url.Values{"name": {user3.Name}, "email": {user3.Email}, "active": {"on"}})
+	equals(t, "/orgs/1/users", w.HeaderMap.Get("Location"))
+	assert(t, mockDB.updatedUser != nil, "expected the edit to be saved")
 }
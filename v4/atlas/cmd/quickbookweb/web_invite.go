@@ -0,0 +1,259 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// inviteTTL is how long an invitation link stays valid.
+const inviteTTL = 72 * time.Hour
+
+type inviteForm struct {
+	Email string `form:"email" label:"Email" validate:"required,email"`
+	Role  string `form:"role" label:"Role" validate:"required"`
+}
+
+type inviteAcceptForm struct {
+	Name     string `form:"name" label:"Name" validate:"required,max=100"`
+	Password string `form:"password,secret" label:"Password" validate:"required,min=8"`
+	Confirm  string `form:"confirm,secret" label:"Password confirmation" validate:"eqfield=Password"`
+}
+
+// InvitePageHandler displays the form for inviting someone to an org.
+func (a *App) InvitePageHandler(db atlas.QBInviteDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, _ := requestScope(req)
+		if orgID == 0 {
+			return server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for invite page"))
+		}
+		shops, err := db.GetAllShopsForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving shops for organisation", err)
+		}
+
+		p := struct {
+			OrgID int
+			Shops []*atlas.QBShop
+			Roles []atlas.QBRole
+			*localPresenter
+		}{
+			OrgID: orgID,
+			Shops: shops,
+			Roles: []atlas.QBRole{atlas.RoleOrgAdmin, atlas.RoleShopManager, atlas.RoleCashier},
+			localPresenter: &localPresenter{
+				PageTitle:       "Invite a user",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "invite", p)
+		return nil
+	}
+}
+
+// InvitePostHandler creates an invitation and emails the signup link to the invitee.
+// Users can only invite others with a role they hold themselves for that org or shop.
+// The link is built from baseURL, the configured public URL of the site, so that it cannot be pointed at
+// another host through the request headers.
+func (a *App) InvitePostHandler(db atlas.QBInviteDB, mailer Mailer, signer *TokenSigner, baseURL string) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, shopID := requestScope(req)
+		if orgID == 0 {
+			return server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for invite"))
+		}
+		inviteURL := fmt.Sprintf("/orgs/%d/invites", orgID)
+		var form inviteForm
+		fs, _, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		email, role := form.Email, atlas.QBRole(form.Role)
+
+		if _, invalid := fs.Errors["role"]; !invalid && (!role.IsValid() || role == atlas.RoleSuperAdmin) {
+			fs.Errors["role"] = "Please pick a role"
+		}
+		if role != atlas.RoleOrgAdmin && shopID == 0 {
+			fs.Errors["shopid"] = "Please pick the shop this user works at"
+		}
+		if _, invalid := fs.Errors["email"]; !invalid {
+			if _, err := db.GetQBUserByEmail(email); err == nil {
+				fs.Errors["email"] = "A user with this email address already exists"
+			}
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, inviteURL)
+			return nil
+		}
+		if role == atlas.RoleOrgAdmin {
+			shopID = 0
+		}
+
+		if shopID != 0 {
+			shops, err := db.GetAllShopsForOrg(orgID)
+			if err != nil {
+				return server.New500Error("error retrieving shops for organisation", err)
+			}
+			found := false
+			for _, s := range shops {
+				if s.ID == shopID {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return server.NewError(http.StatusBadRequest, "shop does not belong to the organisation", fmt.Errorf("shop %d is not in org %d", shopID, orgID))
+			}
+		}
+		roles, err := db.GetQBUserRoles(u.ID)
+		if err != nil {
+			return server.New500Error("error retrieving roles for user", err)
+		}
+		if !hasRole(roles, role, orgID, shopID) {
+			return server.NewError(http.StatusForbidden, "you cannot invite users with this role", fmt.Errorf("user %d cannot grant %s in org %d shop %d", u.ID, role, orgID, shopID))
+		}
+
+		expires := time.Now().Add(inviteTTL)
+		inv, err := db.CreateQBInvite(atlas.QBInvite{
+			Email:       email,
+			OrgID:       orgID,
+			ShopID:      shopID,
+			Role:        role,
+			InvitedByID: u.ID,
+			ExpiresAt:   expires,
+		})
+		if err != nil {
+			return server.New500Error("error creating invitation", err)
+		}
+
+		link := publicURL(baseURL, "/invite/"+signer.Sign(strconv.Itoa(inv.ID), expires))
+		body := fmt.Sprintf("Hi,\n\n%s has invited you to join them on Atlas.\n\nFollow this link to set your password, it is valid for %d hours:\n\n%s\n",
+			inviterName(u), int(inviteTTL.Hours()), link)
+		err = mailer.Send(email, "You have been invited to Atlas", body)
+		if err != nil {
+			return server.New500Error("error sending invitation email", err)
+		}
+
+		a.saveFlash(w, req, FlashSuccess, "Invitation sent to "+email)
+		http.Redirect(w, req, inviteURL, http.StatusFound)
+		return nil
+	}
+}
+
+// InviteAcceptPageHandler displays the set-password page an invitation link lands on.
+func (a *App) InviteAcceptPageHandler(db atlas.QBInviteDB, signer *TokenSigner) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		token, inv, err := getInvite(req, db, signer)
+		if err != nil {
+			return err
+		}
+		p := struct {
+			Token string
+			Email string
+			*localPresenter
+		}{
+			Token: token,
+			Email: inv.Email,
+			localPresenter: &localPresenter{
+				PageTitle:       "Set your password",
+				PageURL:         "/invite",
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "invite_accept", p)
+		return nil
+	}
+}
+
+// InviteAcceptPostHandler creates the invited user and logs them in.
+func (a *App) InviteAcceptPostHandler(db atlas.QBInviteDB, signer *TokenSigner) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		token, inv, err := getInvite(req, db, signer)
+		if err != nil {
+			return err
+		}
+		var form inviteAcceptForm
+		fs, valid, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if !valid {
+			a.formError(w, req, fs, "/invite/"+token)
+			return nil
+		}
+
+		user, err := db.AcceptQBInvite(inv.ID, atlas.QBUser{Email: inv.Email, Name: form.Name, Password: form.Password, IsActive: true})
+		if err != nil {
+			return server.New500Error("internal server error: something went wrong when creating user", err)
+		}
+		err = a.createLoginSession(w, req, db, user.ID)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, req, "/w", http.StatusFound)
+		return nil
+	}
+}
+
+// getInvite verifies the invitation token in the "token" URL param and returns it with its pending invite.
+func getInvite(req *http.Request, db atlas.QBInviteDB, signer *TokenSigner) (string, *atlas.QBInvite, error) {
+	var token string
+	if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+		token = ps.ByName("token")
+	}
+	payload, err := signer.Verify(token)
+	if err == ErrExpiredToken {
+		return "", nil, server.NewError(http.StatusGone, "this invitation has expired, please ask for a new one", err)
+	}
+	if err != nil {
+		return "", nil, server.NewError(http.StatusNotFound, "invitation not found", err)
+	}
+	inviteID, err := strconv.Atoi(payload)
+	if err != nil {
+		return "", nil, server.NewError(http.StatusNotFound, "invitation not found", err)
+	}
+	inv, err := db.GetQBInvite(inviteID)
+	if err != nil {
+		return "", nil, server.NewError(http.StatusNotFound, "invitation not found", err)
+	}
+	if inv.AcceptedAt != nil {
+		return "", nil, server.NewError(http.StatusGone, "this invitation has already been used", fmt.Errorf("invite %d already accepted", inv.ID))
+	}
+	if time.Now().After(inv.ExpiresAt) {
+		return "", nil, server.NewError(http.StatusGone, "this invitation has expired, please ask for a new one", ErrExpiredToken)
+	}
+	return token, inv, nil
+}
+
+// publicURL returns the absolute link to path on the site at baseURL, the configured public URL of the site.
+func publicURL(baseURL, path string) string {
+	return strings.TrimSuffix(baseURL, "/") + path
+}
+
+func inviterName(u *atlas.QBUser) string {
+	if u.Name != "" {
+		return u.Name
+	}
+	return u.Email
+}
@@ -0,0 +1,161 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBInviteDB struct {
+	MockQBUserDB
+	invites     []*atlas.QBInvite
+	createdUser *atlas.QBUser
+}
+
+func (db *MockQBInviteDB) GetAllShopsForOrg(orgID int) ([]*atlas.QBShop, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	s := shop1
+	return []*atlas.QBShop{&s}, nil
+}
+
+func (db *MockQBInviteDB) CreateQBInvite(inv atlas.QBInvite) (*atlas.QBInvite, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	inv.ID = len(db.invites) + 1
+	db.invites = append(db.invites, &inv)
+	return &inv, nil
+}
+
+func (db *MockQBInviteDB) GetQBInvite(inviteID int) (*atlas.QBInvite, error) {
+	if db.hasError || inviteID < 1 || inviteID > len(db.invites) {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.invites[inviteID-1], nil
+}
+
+func (db *MockQBInviteDB) AcceptQBInvite(inviteID int, u atlas.QBUser) (*atlas.QBUser, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	now := time.Now()
+	db.invites[inviteID-1].AcceptedAt = &now
+	u.ID = 10
+	db.createdUser = &u
+	return &u, nil
+}
+
+// testBaseURL is the public URL of the site that emailed links are built from.
+const testBaseURL = "https://atlas.example.com"
+
+var inviteLinkRe = regexp.MustCompile(`/invite/(\S+)`)
+
+func TestInvitePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	signer := main.NewTokenSigner([]byte("invite-secret"))
+	orgParams := httprouter.Params{{Key: "orgid", Value: strconv.Itoa(org1.ID)}}
+
+	mockDB := &MockQBInviteDB{}
+	mailer := &main.MemoryMailer{}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.InvitePostHandler(mockDB, mailer, signer, testBaseURL)), true, orgParams)
+	w := test("POST", url.Values{"email": {"newbie@floatingcube.com"}, "role": {"cashier"}, "shopid": {"1"}})
+	assert(t, w.Code == http.StatusFound, "expected successful invite to redirect 302 instead got %d", w.Code)
+	equals(t, 1, len(mockDB.invites))
+	equals(t, atlas.RoleCashier, mockDB.invites[0].Role)
+	equals(t, shop1.ID, mockDB.invites[0].ShopID)
+	sent := mailer.Sent()
+	equals(t, 1, len(sent))
+	equals(t, "newbie@floatingcube.com", sent[0].To)
+	assert(t, inviteLinkRe.MatchString(sent[0].Body), "expected invite link in email body %q", sent[0].Body)
+	assert(t, strings.Contains(sent[0].Body, testBaseURL+"/invite/"), "expected the invite link on the configured site in %q", sent[0].Body)
+
+	// the link ignores where the request claims to come from
+	mailer = &main.MemoryMailer{}
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.InvitePostHandler(&MockQBInviteDB{}, mailer, signer, testBaseURL)), true, orgParams,
+		map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"}, nil)
+	test("POST", url.Values{"email": {"newbie@floatingcube.com"}, "role": {"cashier"}, "shopid": {"1"}})
+	equals(t, 1, len(mailer.Sent()))
+	assert(t, strings.Contains(mailer.Sent()[0].Body, testBaseURL+"/invite/"), "expected the invite link on the configured site in %q", mailer.Sent()[0].Body)
+
+	// invalid input is not invited
+	for _, form := range []url.Values{
+		{"email": {"notanemail"}, "role": {"cashier"}, "shopid": {"1"}},
+		{"email": {"newbie@floatingcube.com"}, "role": {"superadmin"}},
+		{"email": {"newbie@floatingcube.com"}, "role": {"cashier"}},
+		{"email": {user3.Email}, "role": {"cashier"}, "shopid": {"1"}},
+	} {
+		mockDB = &MockQBInviteDB{}
+		mailer = &main.MemoryMailer{}
+		test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.InvitePostHandler(mockDB, mailer, signer, testBaseURL)), true, orgParams)
+		w = test("POST", form)
+		assert(t, w.Code == http.StatusFound, "expected invalid invite to redirect 302 instead got %d", w.Code)
+		assert(t, len(mockDB.invites) == 0 && len(mailer.Sent()) == 0, "expected invalid invite %v not to be sent", form)
+	}
+
+	// a cashier cannot invite a shop manager
+	mockDB = &MockQBInviteDB{}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.InvitePostHandler(mockDB, &main.MemoryMailer{}, signer, testBaseURL)), user4, orgParams)
+	w = test("POST", url.Values{"email": {"newbie@floatingcube.com"}, "role": {"shopmanager"}, "shopid": {"1"}})
+	equals(t, http.StatusForbidden, w.Code)
+	equals(t, 0, len(mockDB.invites))
+
+	// nor does the IsSuperAdmin flag let them
+	flagged := *user4
+	flagged.IsSuperAdmin = true
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.InvitePostHandler(mockDB, &main.MemoryMailer{}, signer, testBaseURL)), &flagged, orgParams)
+	w = test("POST", url.Values{"email": {"newbie@floatingcube.com"}, "role": {"orgadmin"}})
+	equals(t, http.StatusForbidden, w.Code)
+	equals(t, 0, len(mockDB.invites))
+}
+
+func TestInviteAccept(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	signer := main.NewTokenSigner([]byte("invite-secret"))
+	mockDB := &MockQBInviteDB{invites: []*atlas.QBInvite{
+		{ID: 1, Email: "newbie@floatingcube.com", OrgID: org1.ID, ShopID: shop1.ID, Role: atlas.RoleCashier, ExpiresAt: time.Now().Add(time.Hour)},
+	}}
+	token := signer.Sign("1", time.Now().Add(time.Hour))
+	tokenParams := httprouter.Params{{Key: "token", Value: token}}
+
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.InviteAcceptPageHandler(mockDB, signer)), false, tokenParams)
+	w := test("GET", url.Values{})
+	assert(t, w.Code == http.StatusOK, "expected set password page to return 200 instead got %d", w.Code)
+
+	// passwords not matching
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.InviteAcceptPostHandler(mockDB, signer)), false, tokenParams)
+	w = test("POST", url.Values{"name": {"Newbie"}, "password": {"longenough"}, "confirm": {"different"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/invite/"+token, w.HeaderMap.Get("Location"))
+	assert(t, mockDB.createdUser == nil, "expected no user to be created")
+
+	w = test("POST", url.Values{"name": {"Newbie"}, "password": {"longenough"}, "confirm": {"longenough"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+	assert(t, len(w.HeaderMap["Set-Cookie"]) > 0, "expected session cookie to be set after signup.")
+	equals(t, "newbie@floatingcube.com", mockDB.createdUser.Email)
+	equals(t, []int{mockDB.createdUser.ID}, mockDB.sessionUserIDs)
+	assert(t, !mockDB.createdUser.IsSuperAdmin, "expected invited user not to be a superadmin")
+
+	// the link only works once
+	w = test("POST", url.Values{"name": {"Newbie"}, "password": {"longenough"}, "confirm": {"longenough"}})
+	equals(t, http.StatusGone, w.Code)
+
+	// tampered and expired links
+	for _, tok := range []string{token + "x", signer.Sign("1", time.Now().Add(-time.Minute)), main.NewTokenSigner([]byte("other")).Sign("1", time.Now().Add(time.Hour))} {
+		test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.InviteAcceptPageHandler(mockDB, signer)), false, httprouter.Params{{Key: "token", Value: tok}})
+		w = test("GET", url.Values{})
+		assert(t, w.Code == http.StatusNotFound || w.Code == http.StatusGone, "expected bad token %s to be refused instead got %d", tok, w.Code)
+	}
+}
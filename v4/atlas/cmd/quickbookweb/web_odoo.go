@@ -0,0 +1,270 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type odooConnectForm struct {
+	URL      string `form:"url" label:"Odoo URL" validate:"required,max=255"`
+	Database string `form:"database" label:"Database" validate:"required,max=100"`
+	Username string `form:"username" label:"Username" validate:"required,max=100"`
+	Password string `form:"password,secret" label:"Password" validate:"required"`
+}
+
+var (
+	odooConnectPath = atlas.OnboardingPath(atlas.BackendOdoo, atlas.OnboardingConnect)
+	odooPOSPath     = atlas.OnboardingPath(atlas.BackendOdoo, atlas.OnboardingShop)
+)
+
+// OdooConnectPageHandler displays the form for the address and credentials of the Odoo server.
+func (a *App) OdooConnectPageHandler(db atlas.OdooSetupDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return server.New500Error("error retrieving setup progress", err)
+		}
+		form := a.getFormState(w, req)
+		if form.Values == nil && o != nil && o.OdooConnectionID != 0 {
+			conn, err := db.GetOdooConnection(o.OdooConnectionID)
+			if err != nil {
+				return server.New500Error("error retrieving Odoo connection", err)
+			}
+			form.Values = map[string]string{"url": conn.URL, "database": conn.Database, "username": conn.Username}
+		}
+
+		lp := &localPresenter{
+			PageTitle:       "Connect to Odoo",
+			PageURL:         odooConnectPath,
+			User:            u,
+			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
+			Flashes:         a.getFlashes(w, req),
+			Form:            form,
+		}
+		a.Rndr.HTML(w, http.StatusOK, "odoo_connect", lp)
+		return nil
+	}
+}
+
+// OdooConnectPostHandler logs in to the Odoo server over XML-RPC and saves the credentials if they work, with
+// the password sealed by box. The server has to be on a public address.
+func (a *App) OdooConnectPostHandler(db atlas.OdooSetupDB, box *SecretBox) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		var form odooConnectForm
+		fs, _, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if _, invalid := fs.Errors["url"]; !invalid {
+			form.URL, err = normalizeOdooURL(form.URL)
+			if err != nil {
+				fs.Errors["url"] = "Odoo URL has to start with http:// or https://"
+			} else if err = checkPublicURL(req.Context(), form.URL, false); err != nil {
+				a.Logr.Log("refusing Odoo URL %s: %s", form.URL, err)
+				fs.Errors["url"] = "Odoo URL has to be a public address"
+			}
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, odooConnectPath)
+			return nil
+		}
+
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return server.New500Error("error retrieving setup progress", err)
+		}
+		conn := atlas.OdooConnection{
+			UserID:   u.ID,
+			URL:      form.URL,
+			Database: form.Database,
+			Username: form.Username,
+			Password: form.Password,
+		}
+		if o != nil {
+			conn.ID = o.OdooConnectionID
+		}
+
+		conn.OdooUID, err = NewOdooClient(conn).Authenticate()
+		if err == ErrOdooAuthentication {
+			fs.Errors["password"] = "Odoo did not accept this database, username and password"
+			a.formError(w, req, fs, odooConnectPath)
+			return nil
+		}
+		if err != nil {
+			a.Logr.Log("error connecting to Odoo at %s: %s", conn.URL, err)
+			fs.Errors["url"] = "Could not reach Odoo at this URL"
+			a.formError(w, req, fs, odooConnectPath)
+			return nil
+		}
+
+		conn.Password, err = box.Seal(form.Password)
+		if err != nil {
+			return server.New500Error("error sealing Odoo password", err)
+		}
+		saved, err := db.SaveOdooConnection(conn)
+		if err != nil {
+			return server.New500Error("error saving Odoo connection", err)
+		}
+		err = advanceOnboarding(req, db, atlas.OnboardingShop, func(o *atlas.QBOnboarding) {
+			o.OdooConnectionID = saved.ID
+		})
+		if err != nil {
+			return server.New500Error("error saving setup progress", err)
+		}
+		http.Redirect(w, req, odooPOSPath, http.StatusFound)
+		return nil
+	}
+}
+
+// OdooPOSPageHandler lists the POS configs of the Odoo server, for picking the ones to link.
+func (a *App) OdooPOSPageHandler(db atlas.OdooSetupDB, box *SecretBox) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		conn, configs, err := a.getOdooPOSConfigs(w, req, db, box)
+		if err != nil || conn == nil {
+			return err
+		}
+
+		p := struct {
+			Connection *atlas.OdooConnection
+			Configs    []atlas.OdooPOSConfig
+			*localPresenter
+		}{
+			Connection: conn,
+			Configs:    configs,
+			localPresenter: &localPresenter{
+				PageTitle:       "Pick your points of sale",
+				PageURL:         odooPOSPath,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "odoo_pos", p)
+		return nil
+	}
+}
+
+// OdooPOSPostHandler creates an org per Odoo company and a shop per picked POS config, and completes the setup.
+func (a *App) OdooPOSPostHandler(db atlas.OdooSetupDB, box *SecretBox) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		conn, configs, err := a.getOdooPOSConfigs(w, req, db, box)
+		if err != nil || conn == nil {
+			return err
+		}
+
+		err = req.ParseForm()
+		if err != nil {
+			return server.NewError(http.StatusBadRequest, "error parsing form", err)
+		}
+		picked := map[int]bool{}
+		for _, v := range req.Form["config"] {
+			id, err := strconv.Atoi(v)
+			if err == nil {
+				picked[id] = true
+			}
+		}
+		// only link configs the server actually has, never what the form claims they are called
+		var selected []atlas.OdooPOSConfig
+		for _, cfg := range configs {
+			if picked[cfg.ID] {
+				selected = append(selected, cfg)
+			}
+		}
+		if len(selected) == 0 {
+			a.formError(w, req, FormState{Errors: map[string]string{"config": "Please pick at least one point of sale"}}, odooPOSPath)
+			return nil
+		}
+
+		shops, err := db.ImportOdooPOSConfigs(conn.ID, selected)
+		if err != nil {
+			return server.New500Error("error creating organisations and shops from Odoo", err)
+		}
+		if len(shops) == 0 {
+			a.formError(w, req, FormState{Errors: map[string]string{"config": "No shop could be created from these points of sale"}}, odooPOSPath)
+			return nil
+		}
+		_, err = db.CreateAtlasSession(atlas.AtlasSession{
+			UserID:   u.ID,
+			UserName: u.Name,
+			OrgID:    shops[0].OrgID,
+			OrgName:  selected[0].CompanyName,
+			ShopID:   shops[0].ID,
+			ShopName: shops[0].Name,
+		})
+		if err != nil {
+			return server.New500Error("error creating new atlas session", err)
+		}
+		err = advanceOnboarding(req, db, atlas.OnboardingComplete, func(o *atlas.QBOnboarding) {
+			o.Complete(time.Now())
+		})
+		if err != nil {
+			return server.New500Error("error saving setup progress", err)
+		}
+
+		a.saveFlash(w, req, FlashSuccess, fmt.Sprintf("Linked %d points of sale from Odoo", len(shops)))
+		http.Redirect(w, req, "/w", http.StatusFound)
+		return nil
+	}
+}
+
+// getOdooPOSConfigs returns the Odoo connection of the setup, with its password opened, and its POS configs.
+// When there is no connection yet, its password cannot be opened, or the server cannot be reached, it sends
+// the user back to the connect page and returns a nil connection.
+func (a *App) getOdooPOSConfigs(w http.ResponseWriter, req *http.Request, db atlas.OdooSetupDB, box *SecretBox) (*atlas.OdooConnection, []atlas.OdooPOSConfig, error) {
+	o, err := getOnboarding(req, db)
+	if err != nil {
+		return nil, nil, server.New500Error("error retrieving setup progress", err)
+	}
+	if o == nil || o.OdooConnectionID == 0 {
+		http.Redirect(w, req, odooConnectPath, http.StatusFound)
+		return nil, nil, nil
+	}
+	conn, err := db.GetOdooConnection(o.OdooConnectionID)
+	if err != nil {
+		return nil, nil, server.New500Error("error retrieving Odoo connection", err)
+	}
+	conn.Password, err = box.Open(conn.Password)
+	if err != nil {
+		a.Logr.Log("error opening password of Odoo connection %d: %s", conn.ID, err)
+		a.saveFlash(w, req, FlashError, "Please enter your Odoo password again")
+		http.Redirect(w, req, odooConnectPath, http.StatusFound)
+		return nil, nil, nil
+	}
+
+	configs, err := NewOdooClient(*conn).POSConfigs()
+	if err != nil {
+		a.Logr.Log("error listing POS configs of Odoo at %s: %s", conn.URL, err)
+		a.saveFlash(w, req, FlashError, "Could not list the points of sale of your Odoo server, please check the connection")
+		http.Redirect(w, req, odooConnectPath, http.StatusFound)
+		return nil, nil, nil
+	}
+	for i := range configs {
+		if configs[i].CompanyName == "" {
+			configs[i].CompanyName = conn.Database
+		}
+	}
+	return conn, configs, nil
+}
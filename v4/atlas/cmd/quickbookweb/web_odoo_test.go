@@ -0,0 +1,251 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+)
+
+const (
+	testOdooDatabase = "epos"
+	testOdooPassword = "odoo-secret"
+	testOdooUID      = 7
+)
+
+func newTestSecretBox(t *testing.T) *main.SecretBox {
+	box, err := main.NewSecretBox([]byte("0123456789abcdef0123456789abcdef"))
+	ok(t, err)
+	return box
+}
+
+func TestSecretBox(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	box := newTestSecretBox(t)
+	sealed, err := box.Seal(testOdooPassword)
+	ok(t, err)
+	assert(t, !strings.Contains(sealed, testOdooPassword), "expected the password to be encrypted")
+	opened, err := box.Open(sealed)
+	ok(t, err)
+	equals(t, testOdooPassword, opened)
+
+	_, err = box.Open(testOdooPassword)
+	equals(t, main.ErrSealedValue, err)
+	other, err := main.NewSecretBox([]byte("fedcba9876543210fedcba9876543210"))
+	ok(t, err)
+	_, err = other.Open(sealed)
+	equals(t, main.ErrSealedValue, err)
+}
+
+type MockOdooSetupDB struct {
+	MockQBOnboardingDB
+	hasError    bool
+	connections map[int]*atlas.OdooConnection
+	imported    []atlas.OdooPOSConfig
+	sessions    []atlas.AtlasSession
+}
+
+func (db *MockOdooSetupDB) GetOdooConnection(id int) (*atlas.OdooConnection, error) {
+	c, ok := db.connections[id]
+	if db.hasError || !ok {
+		return nil, fmt.Errorf("some error")
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (db *MockOdooSetupDB) SaveOdooConnection(c atlas.OdooConnection) (*atlas.OdooConnection, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.connections == nil {
+		db.connections = map[int]*atlas.OdooConnection{}
+	}
+	if c.ID == 0 {
+		c.ID = len(db.connections) + 1
+	}
+	db.connections[c.ID] = &c
+	return &c, nil
+}
+
+func (db *MockOdooSetupDB) ImportOdooPOSConfigs(connectionID int, configs []atlas.OdooPOSConfig) ([]*atlas.QBShop, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.imported = append(db.imported, configs...)
+	shops := make([]*atlas.QBShop, len(configs))
+	for i, cfg := range configs {
+		shops[i] = &atlas.QBShop{ID: cfg.ID, OrgID: cfg.CompanyID, Name: cfg.Name}
+	}
+	return shops, nil
+}
+
+func (db *MockOdooSetupDB) CreateAtlasSession(s atlas.AtlasSession) (*atlas.AtlasSession, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.sessions = append(db.sessions, s)
+	return &s, nil
+}
+
+// newMockOdooServer stands in for the XML-RPC API of an Odoo server with three points of sale.
+func newMockOdooServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, err := ioutil.ReadAll(req.Body)
+		ok(t, err)
+		body := string(b)
+		goodPassword := strings.Contains(body, "<string>"+testOdooPassword+"</string>")
+
+		var value string
+		switch {
+		case req.URL.Path == "/xmlrpc/2/common" && strings.Contains(body, "<methodName>authenticate</methodName>"):
+			value = "<boolean>0</boolean>"
+			if goodPassword && strings.Contains(body, "<string>"+testOdooDatabase+"</string>") {
+				value = fmt.Sprintf("<int>%d</int>", testOdooUID)
+			}
+		case req.URL.Path == "/xmlrpc/2/object" && strings.Contains(body, "<string>pos.config</string>") && goodPassword:
+			value = "<array><data>" +
+				odooPOSConfigXML(1, "Orchard", "<array><data><value><int>1</int></value><value><string>Floating Cube SG</string></value></data></array>") +
+				odooPOSConfigXML(2, "Bugis", "<array><data><value><int>1</int></value><value><string>Floating Cube SG</string></value></data></array>") +
+				odooPOSConfigXML(3, "Kuala Lumpur", "<boolean>0</boolean>") +
+				"</data></array>"
+		default:
+			w.Header().Set("Content-Type", "text/xml")
+			fmt.Fprint(w, `<?xml version="1.0"?><methodResponse><fault><value><struct><member><name>faultCode</name><value><int>1</int></value></member><member><name>faultString</name><value><string>Access Denied</string></value></member></struct></value></fault></methodResponse>`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprintf(w, `<?xml version="1.0"?><methodResponse><params><param><value>%s</value></param></params></methodResponse>`, value)
+	}))
+}
+
+func odooPOSConfigXML(id int, name, company string) string {
+	return fmt.Sprintf("<value><struct>"+
+		"<member><name>id</name><value><int>%d</int></value></member>"+
+		"<member><name>name</name><value><string>%s</string></value></member>"+
+		"<member><name>company_id</name><value>%s</value></member>"+
+		"</struct></value>", id, name, company)
+}
+
+func TestOdooClient(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := newMockOdooServer(t)
+	defer ts.Close()
+	conn := atlas.OdooConnection{URL: ts.URL, Database: testOdooDatabase, Username: "admin", Password: testOdooPassword}
+
+	uid, err := main.NewOdooClient(conn).Authenticate()
+	ok(t, err)
+	equals(t, testOdooUID, uid)
+
+	conn.OdooUID = uid
+	configs, err := main.NewOdooClient(conn).POSConfigs()
+	ok(t, err)
+	equals(t, []atlas.OdooPOSConfig{
+		{ID: 1, Name: "Orchard", CompanyID: 1, CompanyName: "Floating Cube SG"},
+		{ID: 2, Name: "Bugis", CompanyID: 1, CompanyName: "Floating Cube SG"},
+		{ID: 3, Name: "Kuala Lumpur"},
+	}, configs)
+
+	wrong := conn
+	wrong.Password = "wrong"
+	_, err = main.NewOdooClient(wrong).Authenticate()
+	equals(t, main.ErrOdooAuthentication, err)
+	_, err = main.NewOdooClient(wrong).POSConfigs()
+	assert(t, err != nil, "expected an XML-RPC fault with the wrong password")
+
+	ts.Close()
+	_, err = main.NewOdooClient(conn).Authenticate()
+	assert(t, err != nil && err != main.ErrOdooAuthentication, "expected a connection error when Odoo is down instead got %v", err)
+}
+
+func TestOdooConnectPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := newMockOdooServer(t)
+	defer ts.Close()
+	mockDB := &MockOdooSetupDB{}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{user1.ID: {UserID: user1.ID, Backend: atlas.BackendOdoo, Step: atlas.OnboardingConnect}}
+	box := newTestSecretBox(t)
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.OdooConnectPostHandler(mockDB, box)), user1, nil)
+
+	for _, form := range []url.Values{
+		{"url": {ts.URL}, "database": {testOdooDatabase}, "username": {"admin"}, "password": {"wrong"}},
+		{"url": {"ftp://" + strings.TrimPrefix(ts.URL, "http://")}, "database": {testOdooDatabase}, "username": {"admin"}, "password": {testOdooPassword}},
+		{"url": {ts.URL}, "database": {""}, "username": {"admin"}, "password": {testOdooPassword}},
+	} {
+		w := test("POST", form)
+		equals(t, "/start/odoo/connect", w.HeaderMap.Get("Location"))
+		equals(t, 0, len(mockDB.connections))
+	}
+
+	w := test("POST", url.Values{"url": {ts.URL + "/"}, "database": {testOdooDatabase}, "username": {"admin"}, "password": {testOdooPassword}})
+	equals(t, "/start/odoo/pos", w.HeaderMap.Get("Location"))
+	conn := mockDB.connections[1]
+	equals(t, ts.URL, conn.URL)
+	equals(t, testOdooUID, conn.OdooUID)
+	assert(t, conn.Password != testOdooPassword, "expected the password to be saved sealed")
+	password, err := box.Open(conn.Password)
+	ok(t, err)
+	equals(t, testOdooPassword, password)
+	equals(t, atlas.OnboardingShop, mockDB.onboardings[user1.ID].Step)
+	equals(t, conn.ID, mockDB.onboardings[user1.ID].OdooConnectionID)
+
+	// the server is not called on private addresses
+	main.AllowPrivateAddresses(false)
+	defer main.AllowPrivateAddresses(true)
+	mockDB = &MockOdooSetupDB{}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{user1.ID: {UserID: user1.ID, Backend: atlas.BackendOdoo, Step: atlas.OnboardingConnect}}
+	test = GenerateHandleTesterAsUser(t, app.Wrap(app.OdooConnectPostHandler(mockDB, box)), user1, nil)
+	for _, u := range []string{ts.URL, "http://localhost:8069", "http://169.254.169.254", "http://10.0.0.1:8069"} {
+		w = test("POST", url.Values{"url": {u}, "database": {testOdooDatabase}, "username": {"admin"}, "password": {testOdooPassword}})
+		equals(t, "/start/odoo/connect", w.HeaderMap.Get("Location"))
+		equals(t, 0, len(mockDB.connections))
+	}
+}
+
+func TestOdooPOSPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := newMockOdooServer(t)
+	defer ts.Close()
+	box := newTestSecretBox(t)
+	sealed, err := box.Seal(testOdooPassword)
+	ok(t, err)
+	mockDB := &MockOdooSetupDB{connections: map[int]*atlas.OdooConnection{
+		1: {ID: 1, URL: ts.URL, Database: testOdooDatabase, Username: "admin", Password: sealed, OdooUID: testOdooUID},
+	}}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{user1.ID: {UserID: user1.ID, Backend: atlas.BackendOdoo, Step: atlas.OnboardingShop, OdooConnectionID: 1}}
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.OdooPOSPostHandler(mockDB, box)), user1, nil)
+
+	// nothing picked, or only configs the server does not have
+	w := test("POST", url.Values{"config": {"42"}})
+	equals(t, "/start/odoo/pos", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.imported))
+
+	w = test("POST", url.Values{"config": {"1", "3"}})
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+	equals(t, []atlas.OdooPOSConfig{
+		{ID: 1, Name: "Orchard", CompanyID: 1, CompanyName: "Floating Cube SG"},
+		{ID: 3, Name: "Kuala Lumpur", CompanyName: testOdooDatabase},
+	}, mockDB.imported)
+	equals(t, 1, len(mockDB.sessions))
+	equals(t, "Orchard", mockDB.sessions[0].ShopName)
+	assert(t, mockDB.onboardings[user1.ID].IsComplete(), "expected the setup to be complete")
+
+	// a password saved before it was sealed has to be entered again
+	mockDB.connections[1].Password = testOdooPassword
+	mockDB.onboardings[user1.ID].Step = atlas.OnboardingShop
+	w = test("POST", url.Values{"config": {"1"}})
+	equals(t, "/start/odoo/connect", w.HeaderMap.Get("Location"))
+	mockDB.connections[1].Password = sealed
+
+	// Odoo cannot be reached any more
+	ts.Close()
+	mockDB.onboardings[user1.ID].Step = atlas.OnboardingShop
+	w = test("POST", url.Values{"config": {"1"}})
+	equals(t, "/start/odoo/connect", w.HeaderMap.Get("Location"))
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// passwordResetTTL is how long a password reset link stays valid.
+const passwordResetTTL = time.Hour
+
+type passwordResetRequestForm struct {
+	Email string `form:"email" label:"Email" validate:"required,email"`
+}
+
+type passwordResetForm struct {
+	Password string `form:"password,secret" label:"Password" validate:"required,min=8"`
+	Confirm  string `form:"confirm,secret" label:"Password confirmation" validate:"eqfield=Password"`
+}
+
+// PasswordResetRequestPageHandler displays the form for requesting a password reset email.
+func (a *App) PasswordResetRequestPageHandler() server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		p := &localPresenter{
+			PageTitle:       "Forgot password",
+			PageURL:         "/password/reset",
+			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
+			Flashes:         a.getFlashes(w, req),
+			Form:            a.getFormState(w, req),
+		}
+		a.Rndr.HTML(w, http.StatusOK, "password_reset_request", p)
+		return nil
+	}
+}
+
+// PasswordResetRequestPostHandler emails a password reset link to the user. It answers the same whether or not
+// the email belongs to a user so that it cannot be used to find out who has an account.
+// Requests are rate limited per email and per IP address. The link is built from baseURL, the configured public
+// URL of the site, and never from the request headers, so that a reset asked for by someone else cannot send
+// the token to their host.
+func (a *App) PasswordResetRequestPostHandler(db atlas.QBPasswordResetDB, mailer Mailer, limiter *RateLimiter, baseURL string) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		var form passwordResetRequestForm
+		fs, valid, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if !valid {
+			a.formError(w, req, fs, "/password/reset")
+			return nil
+		}
+		email := form.Email
+		if !limiter.Allow("ip:"+remoteIP(req)) || !limiter.Allow("email:"+strings.ToLower(email)) {
+			a.saveFlash(w, req, FlashError, "Too many password reset requests, please try again later")
+			http.Redirect(w, req, "/password/reset", http.StatusFound)
+			return nil
+		}
+
+		u, err := db.GetQBUserByEmail(email)
+		if err == nil && u.IsActive {
+			token, err := newRandomToken()
+			if err != nil {
+				return server.New500Error("error generating password reset token", err)
+			}
+			_, err = db.CreateQBPasswordReset(atlas.QBPasswordReset{
+				UserID:    u.ID,
+				TokenHash: hashToken(token),
+				ExpiresAt: time.Now().Add(passwordResetTTL),
+			})
+			if err != nil {
+				return server.New500Error("error creating password reset", err)
+			}
+
+			link := publicURL(baseURL, "/password/reset/"+token)
+			body := fmt.Sprintf("Hi,\n\nSomeone asked to reset the password of your Atlas account. If it was you, follow this link within the next hour:\n\n%s\n\nIf you did not ask for it you can ignore this email.\n", link)
+			err = mailer.Send(u.Email, "Reset your Atlas password", body)
+			if err != nil {
+				return server.New500Error("error sending password reset email", err)
+			}
+		}
+
+		a.saveFlash(w, req, FlashSuccess, "If an account exists for "+email+", we have sent it a link to reset the password")
+		http.Redirect(w, req, "/password/reset", http.StatusFound)
+		return nil
+	}
+}
+
+// PasswordResetPageHandler displays the form for choosing a new password.
+func (a *App) PasswordResetPageHandler(db atlas.QBPasswordResetDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		token, _, err := getPasswordReset(req, db)
+		if err != nil {
+			return err
+		}
+		p := struct {
+			Token string
+			*localPresenter
+		}{
+			Token: token,
+			localPresenter: &localPresenter{
+				PageTitle:       "Choose a new password",
+				PageURL:         "/password/reset",
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "password_reset", p)
+		return nil
+	}
+}
+
+// PasswordResetPostHandler sets the new password and logs the user out everywhere.
+func (a *App) PasswordResetPostHandler(db atlas.QBPasswordResetDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		token, reset, err := getPasswordReset(req, db)
+		if err != nil {
+			return err
+		}
+		var form passwordResetForm
+		fs, valid, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if !valid {
+			a.formError(w, req, fs, "/password/reset/"+token)
+			return nil
+		}
+
+		err = db.ResetQBUserPassword(reset.ID, reset.UserID, form.Password)
+		if err != nil {
+			return server.New500Error("error resetting password", err)
+		}
+		http.Redirect(w, req, "/login", http.StatusFound)
+		return nil
+	}
+}
+
+// getPasswordReset looks up the unused, unexpired password reset for the token in the "token" URL param.
+func getPasswordReset(req *http.Request, db atlas.QBPasswordResetDB) (string, *atlas.QBPasswordReset, error) {
+	var token string
+	if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+		token = ps.ByName("token")
+	}
+	if token == "" {
+		return "", nil, server.NewError(http.StatusNotFound, "password reset link not found", fmt.Errorf("missing password reset token"))
+	}
+	reset, err := db.GetQBPasswordResetByTokenHash(hashToken(token))
+	if err != nil {
+		return "", nil, server.NewError(http.StatusNotFound, "password reset link not found", err)
+	}
+	if reset.UsedAt != nil {
+		return "", nil, server.NewError(http.StatusGone, "this password reset link has already been used", fmt.Errorf("password reset %d already used", reset.ID))
+	}
+	if time.Now().After(reset.ExpiresAt) {
+		return "", nil, server.NewError(http.StatusGone, "this password reset link has expired, please ask for a new one", fmt.Errorf("password reset %d expired", reset.ID))
+	}
+	return token, reset, nil
+}
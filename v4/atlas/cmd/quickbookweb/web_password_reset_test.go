@@ -0,0 +1,128 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBPasswordResetDB struct {
+	MockQBUserDB
+	resets        map[string]*atlas.QBPasswordReset
+	resetUserIDs  []int
+	resetPassword string
+}
+
+func (db *MockQBPasswordResetDB) CreateQBPasswordReset(r atlas.QBPasswordReset) (*atlas.QBPasswordReset, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	if db.resets == nil {
+		db.resets = map[string]*atlas.QBPasswordReset{}
+	}
+	r.ID = len(db.resets) + 1
+	db.resets[r.TokenHash] = &r
+	return &r, nil
+}
+
+func (db *MockQBPasswordResetDB) GetQBPasswordResetByTokenHash(tokenHash string) (*atlas.QBPasswordReset, error) {
+	r, ok := db.resets[tokenHash]
+	if db.hasError || !ok {
+		return nil, fmt.Errorf("some error")
+	}
+	return r, nil
+}
+
+func (db *MockQBPasswordResetDB) ResetQBUserPassword(resetID int, userID int, password string) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	now := time.Now()
+	for _, r := range db.resets {
+		if r.ID == resetID {
+			r.UsedAt = &now
+		}
+	}
+	db.resetUserIDs = append(db.resetUserIDs, userID)
+	db.resetPassword = password
+	return nil
+}
+
+var resetLinkRe = regexp.MustCompile(`/password/reset/(\S+)`)
+
+func TestPasswordReset(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBPasswordResetDB{}
+	mailer := &main.MemoryMailer{}
+	test := GenerateHandleTester(t, app.Wrap(app.PasswordResetRequestPostHandler(mockDB, mailer, main.NewRateLimiter(5, time.Hour), testBaseURL)), false)
+
+	w := test("POST", url.Values{"email": {user3.Email}})
+	equals(t, http.StatusFound, w.Code)
+	sent := mailer.Sent()
+	equals(t, 1, len(sent))
+	equals(t, user3.Email, sent[0].To)
+	m := resetLinkRe.FindStringSubmatch(sent[0].Body)
+	assert(t, m != nil, "expected reset link in email body %q", sent[0].Body)
+	assert(t, strings.Contains(sent[0].Body, testBaseURL+"/password/reset/"), "expected the reset link on the configured site in %q", sent[0].Body)
+	token := m[1]
+
+	// the link ignores where the request claims to come from
+	poisoned := &main.MemoryMailer{}
+	GenerateHandleTesterWithHeaders(t, app.Wrap(app.PasswordResetRequestPostHandler(&MockQBPasswordResetDB{}, poisoned, main.NewRateLimiter(5, time.Hour), testBaseURL)), false, nil,
+		map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "evil.example.com"}, nil)("POST", url.Values{"email": {user3.Email}})
+	equals(t, 1, len(poisoned.Sent()))
+	assert(t, strings.Contains(poisoned.Sent()[0].Body, testBaseURL+"/password/reset/"), "expected the reset link on the configured site in %q", poisoned.Sent()[0].Body)
+
+	// unknown emails get the same answer but no email
+	w = test("POST", url.Values{"email": {"nobody@floatingcube.com"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, 1, len(mailer.Sent()))
+
+	tokenParams := httprouter.Params{{Key: "token", Value: token}}
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.PasswordResetPageHandler(mockDB)), false, tokenParams)
+	w = test("GET", url.Values{})
+	assert(t, w.Code == http.StatusOK, "expected reset page to return 200 instead got %d", w.Code)
+
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.PasswordResetPostHandler(mockDB)), false, tokenParams)
+	w = test("POST", url.Values{"password": {"short"}, "confirm": {"short"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/password/reset/"+token, w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.resetUserIDs))
+
+	w = test("POST", url.Values{"password": {"brandnewpass"}, "confirm": {"brandnewpass"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, []int{user3.ID}, mockDB.resetUserIDs)
+	equals(t, "brandnewpass", mockDB.resetPassword)
+
+	// single use
+	w = test("POST", url.Values{"password": {"anotherpass"}, "confirm": {"anotherpass"}})
+	equals(t, http.StatusGone, w.Code)
+
+	// unknown token
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.PasswordResetPageHandler(mockDB)), false, httprouter.Params{{Key: "token", Value: "made-up"}})
+	w = test("GET", url.Values{})
+	equals(t, http.StatusNotFound, w.Code)
+}
+
+func TestPasswordResetRateLimit(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBPasswordResetDB{}
+	mailer := &main.MemoryMailer{}
+	test := GenerateHandleTester(t, app.Wrap(app.PasswordResetRequestPostHandler(mockDB, mailer, main.NewRateLimiter(2, time.Hour), testBaseURL)), false)
+
+	for i := 0; i < 4; i++ {
+		w := test("POST", url.Values{"email": {user3.Email}})
+		equals(t, http.StatusFound, w.Code)
+	}
+	equals(t, 2, len(mailer.Sent()))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type paymentMethodForm struct {
+	Name        string `form:"name" label:"Name" validate:"required,max=100"`
+	DisplayName string `form:"display_name" label:"Display name" validate:"max=100"`
+	Code        string `form:"code" label:"Code" validate:"required"`
+	Type        string `form:"type" label:"Type" validate:"required"`
+	IsDisabled  bool   `form:"disabled"`
+}
+
+// PaymentMethodsPageHandler lists the payment methods of an org in the order the POS shows them, with a form
+// to add one.
+func (a *App) PaymentMethodsPageHandler(db atlas.QBPaymentMethodDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, err := paymentMethodsOrg(req)
+		if err != nil {
+			return err
+		}
+		methods, err := db.GetAllQBPaymentMethodsForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving payment methods for organisation", err)
+		}
+		form := a.getFormState(w, req)
+		if form.Values == nil {
+			form.Values = map[string]string{"type": atlas.PaymentMethodNonCreditCard}
+		}
+
+		p := struct {
+			PaymentMethods []*atlas.QBPaymentMethod
+			OrgID          int
+			*localPresenter
+		}{
+			PaymentMethods: methods,
+			OrgID:          orgID,
+			localPresenter: &localPresenter{
+				PageTitle:       "Payment methods",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "payment_methods", p)
+		return nil
+	}
+}
+
+// PaymentMethodCreatePostHandler adds a payment method at the end of the list of an org.
+func (a *App) PaymentMethodCreatePostHandler(db atlas.QBPaymentMethodDB, s *OrgChangeStream) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, err := paymentMethodsOrg(req)
+		if err != nil {
+			return err
+		}
+		listURL := fmt.Sprintf("/orgs/%d/payment-methods", orgID)
+		methods, err := db.GetAllQBPaymentMethodsForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving payment methods for organisation", err)
+		}
+
+		var form paymentMethodForm
+		fs, err := parsePaymentMethodForm(req, &form, methods, 0)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, listURL)
+			return nil
+		}
+
+		pm := atlas.QBPaymentMethod{OrgID: orgID, Position: len(methods) + 1}
+		form.apply(&pm)
+		created, err := db.CreateQBPaymentMethod(pm)
+		if err == atlas.ErrQBPaymentMethodCodeTaken {
+			fs.Errors["code"] = "Another payment method already uses this code"
+			a.formError(w, req, fs, listURL)
+			return nil
+		}
+		if err != nil {
+			return server.New500Error("error creating payment method", err)
+		}
+		a.publishPaymentMethodChange(s, orgID, created.ID, "Create")
+
+		a.saveFlash(w, req, FlashSuccess, pm.Name+" added")
+		http.Redirect(w, req, listURL, http.StatusFound)
+		return nil
+	}
+}
+
+// PaymentMethodEditPageHandler displays the form to rename, recode or disable a payment method.
+func (a *App) PaymentMethodEditPageHandler(db atlas.QBPaymentMethodDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, pm, _, err := getOrgPaymentMethod(req, db)
+		if err != nil {
+			return err
+		}
+
+		form := a.getFormState(w, req)
+		if form.Values == nil {
+			form.Values = map[string]string{
+				"name":         pm.Name,
+				"display_name": pm.DisplayName,
+				"code":         pm.Code,
+				"type":         pm.Type,
+			}
+			if pm.IsDisabled {
+				form.Values["disabled"] = "on"
+			}
+		}
+
+		p := struct {
+			PaymentMethod *atlas.QBPaymentMethod
+			OrgID         int
+			*localPresenter
+		}{
+			PaymentMethod: pm,
+			OrgID:         orgID,
+			localPresenter: &localPresenter{
+				PageTitle:       "Edit payment method",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "payment_method_edit", p)
+		return nil
+	}
+}
+
+// PaymentMethodEditPostHandler saves a payment method. Disabled payment methods are kept, so that past
+// payments still refer to them, but the POS no longer offers them.
+func (a *App) PaymentMethodEditPostHandler(db atlas.QBPaymentMethodDB, s *OrgChangeStream) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, pm, methods, err := getOrgPaymentMethod(req, db)
+		if err != nil {
+			return err
+		}
+		editURL := fmt.Sprintf("/orgs/%d/payment-methods/%d", orgID, pm.ID)
+
+		var form paymentMethodForm
+		fs, err := parsePaymentMethodForm(req, &form, methods, pm.ID)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, editURL)
+			return nil
+		}
+
+		form.apply(pm)
+		_, err = db.UpdateQBPaymentMethod(*pm)
+		if err == atlas.ErrQBPaymentMethodCodeTaken {
+			fs.Errors["code"] = "Another payment method already uses this code"
+			a.formError(w, req, fs, editURL)
+			return nil
+		}
+		if err != nil {
+			return server.New500Error("error saving payment method", err)
+		}
+		a.publishPaymentMethodChange(s, orgID, pm.ID, "Update")
+
+		a.saveFlash(w, req, FlashSuccess, pm.Name+" saved")
+		http.Redirect(w, req, fmt.Sprintf("/orgs/%d/payment-methods", orgID), http.StatusFound)
+		return nil
+	}
+}
+
+// PaymentMethodMovePostHandler moves a payment method one place up or down the list, as given by the
+// "direction" form value.
+func (a *App) PaymentMethodMovePostHandler(db atlas.QBPaymentMethodDB, s *OrgChangeStream) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, pm, methods, err := getOrgPaymentMethod(req, db)
+		if err != nil {
+			return err
+		}
+		listURL := fmt.Sprintf("/orgs/%d/payment-methods", orgID)
+
+		ids := make([]int, len(methods))
+		from := 0
+		for i, m := range methods {
+			ids[i] = m.ID
+			if m.ID == pm.ID {
+				from = i
+			}
+		}
+		to := from
+		switch req.FormValue("direction") {
+		case "up":
+			to = from - 1
+		case "down":
+			to = from + 1
+		default:
+			return server.NewError(http.StatusBadRequest, "unknown direction", fmt.Errorf("direction %q is not up or down", req.FormValue("direction")))
+		}
+		if to < 0 || to >= len(ids) {
+			http.Redirect(w, req, listURL, http.StatusFound)
+			return nil
+		}
+
+		ids[from], ids[to] = ids[to], ids[from]
+		err = db.ReorderQBPaymentMethods(orgID, ids)
+		if err != nil {
+			return server.New500Error("error reordering payment methods", err)
+		}
+		// both payment methods changed position
+		a.publishPaymentMethodChange(s, orgID, ids[from], "Update")
+		a.publishPaymentMethodChange(s, orgID, ids[to], "Update")
+		http.Redirect(w, req, listURL, http.StatusFound)
+		return nil
+	}
+}
+
+// publishPaymentMethodChange tells the devices of an org that a payment method changed. The payment method is
+// saved already, so a change that cannot be published is only logged; devices get it at their next full sync.
+func (a *App) publishPaymentMethodChange(s *OrgChangeStream, orgID, pmID int, operation string) {
+	_, err := s.Publish(atlas.QBOrgChange{OrgID: orgID, Kind: atlas.OrgChangePaymentMethod, EntityID: strconv.Itoa(pmID), Operation: operation})
+	if err != nil {
+		a.Logr.Log("error publishing the change of payment method %d of org %d: %s", pmID, orgID, err)
+	}
+}
+
+// parsePaymentMethodForm parses and validates the payment method form. Codes are lowercased and have to be
+// unique among the payment methods of the org, other than the one being edited (exceptID).
+func parsePaymentMethodForm(req *http.Request, form *paymentMethodForm, methods []*atlas.QBPaymentMethod, exceptID int) (FormState, error) {
+	fs, _, err := parseForm(req, form)
+	if err != nil {
+		return fs, err
+	}
+	form.Code = strings.ToLower(form.Code)
+	if _, invalid := fs.Errors["code"]; !invalid {
+		fs.Values["code"] = form.Code
+		if !atlas.IsValidPaymentMethodCode(form.Code) {
+			fs.Errors["code"] = "Code can only contain up to 20 lowercase letters, digits and underscores"
+		}
+		for _, m := range methods {
+			if m.ID != exceptID && strings.ToLower(m.Code) == form.Code {
+				fs.Errors["code"] = fmt.Sprintf("%s already uses this code", m.Name)
+				break
+			}
+		}
+	}
+	if _, invalid := fs.Errors["type"]; !invalid && !atlas.IsValidPaymentMethodType(form.Type) {
+		fs.Errors["type"] = "Please pick credit card or other"
+	}
+	return fs, nil
+}
+
+func (form *paymentMethodForm) apply(pm *atlas.QBPaymentMethod) {
+	pm.Name = form.Name
+	pm.DisplayName = form.DisplayName
+	if pm.DisplayName == "" {
+		pm.DisplayName = form.Name
+	}
+	pm.Code = form.Code
+	pm.Type = form.Type
+	pm.IsDisabled = form.IsDisabled
+}
+
+func paymentMethodsOrg(req *http.Request) (int, error) {
+	orgID, _ := requestScope(req)
+	if orgID == 0 {
+		return 0, server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for payment methods page"))
+	}
+	return orgID, nil
+}
+
+// getOrgPaymentMethod returns the org and the payment method named by the "orgid" and "pmid" URL params,
+// along with all the payment methods of the org. The payment method has to belong to the org.
+func getOrgPaymentMethod(req *http.Request, db atlas.QBPaymentMethodDB) (int, *atlas.QBPaymentMethod, []*atlas.QBPaymentMethod, error) {
+	orgID, err := paymentMethodsOrg(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	var pmID int
+	if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+		pmID, _ = strconv.Atoi(ps.ByName("pmid"))
+	}
+
+	methods, err := db.GetAllQBPaymentMethodsForOrg(orgID)
+	if err != nil {
+		return 0, nil, nil, server.New500Error("error retrieving payment methods for organisation", err)
+	}
+	for _, m := range methods {
+		if m.ID == pmID {
+			return orgID, m, methods, nil
+		}
+	}
+	return 0, nil, nil, server.NewError(http.StatusNotFound, "payment method not found", fmt.Errorf("payment method %d not in org %d", pmID, orgID))
+}
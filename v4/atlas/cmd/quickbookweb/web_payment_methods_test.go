@@ -0,0 +1,233 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBPaymentMethodDB struct {
+	hasError bool
+	methods  map[int]*atlas.QBPaymentMethod
+	syncs    []atlas.QBPaymentMethodSync
+}
+
+func newMockQBPaymentMethodDB() *MockQBPaymentMethodDB {
+	db := &MockQBPaymentMethodDB{}
+	tmpl, _ := atlas.FindPaymentMethodTemplate("SG")
+	for _, pm := range tmpl.ForOrg(org1.ID) {
+		db.CreateQBPaymentMethod(pm)
+	}
+	return db
+}
+
+func (db *MockQBPaymentMethodDB) GetAllQBPaymentMethodsForOrg(orgID int) ([]*atlas.QBPaymentMethod, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var methods []*atlas.QBPaymentMethod
+	for _, pm := range db.methods {
+		if pm.OrgID == orgID {
+			copied := *pm
+			methods = append(methods, &copied)
+		}
+	}
+	sort.Slice(methods, func(i, j int) bool { return methods[i].Position < methods[j].Position })
+	return methods, nil
+}
+
+func (db *MockQBPaymentMethodDB) CreateQBPaymentMethod(pm atlas.QBPaymentMethod) (*atlas.QBPaymentMethod, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	pm.ID = len(db.methods) + 1
+	return db.save(pm)
+}
+
+func (db *MockQBPaymentMethodDB) UpdateQBPaymentMethod(pm atlas.QBPaymentMethod) (*atlas.QBPaymentMethod, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	return db.save(pm)
+}
+
+func (db *MockQBPaymentMethodDB) save(pm atlas.QBPaymentMethod) (*atlas.QBPaymentMethod, error) {
+	for _, other := range db.methods {
+		if other.ID != pm.ID && other.OrgID == pm.OrgID && other.Code == pm.Code {
+			return nil, atlas.ErrQBPaymentMethodCodeTaken
+		}
+	}
+	if db.methods == nil {
+		db.methods = map[int]*atlas.QBPaymentMethod{}
+	}
+	db.methods[pm.ID] = &pm
+	return &pm, nil
+}
+
+func (db *MockQBPaymentMethodDB) ReorderQBPaymentMethods(orgID int, ids []int) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	for i, id := range ids {
+		db.methods[id].Position = i + 1
+	}
+	return nil
+}
+
+func (db *MockQBPaymentMethodDB) SaveQBPaymentMethodSync(s atlas.QBPaymentMethodSync) (*atlas.QBPaymentMethodSync, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	s.ID = len(db.syncs) + 1
+	db.syncs = append(db.syncs, s)
+	return &s, nil
+}
+
+func (db *MockQBPaymentMethodDB) GetLatestQBPaymentMethodSync(orgID int) (*atlas.QBPaymentMethodSync, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	for i := len(db.syncs) - 1; i >= 0; i-- {
+		if db.syncs[i].OrgID == orgID {
+			s := db.syncs[i]
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func (db *MockQBPaymentMethodDB) codes() []string {
+	methods, _ := db.GetAllQBPaymentMethodsForOrg(org1.ID)
+	codes := make([]string, len(methods))
+	for i, pm := range methods {
+		codes[i] = pm.Code
+	}
+	return codes
+}
+
+func TestWebStart3PostHandlerRegion(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOrgDB{}
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.WebStart3PostHandler(mockDB)), user1, nil)
+
+	w := test("POST", url.Values{"name": {"Floating Cube"}, "region": {"XX"}})
+	equals(t, "/start/3", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.methods))
+
+	tmpl, _ := atlas.FindPaymentMethodTemplate("AU")
+	test("POST", url.Values{"name": {"Floating Cube"}, "region": {"AU"}})
+	equals(t, len(tmpl.Methods), len(mockDB.methods))
+}
+
+func TestPaymentMethodCreatePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := newMockQBPaymentMethodDB()
+	changes := &MockQBOrgChangeDB{}
+	stream := main.NewOrgChangeStream(changes, 10, 2)
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.PaymentMethodCreatePostHandler(mockDB, stream)), true, params)
+	listURL := fmt.Sprintf("/orgs/%d/payment-methods", org1.ID)
+	count := len(mockDB.methods)
+
+	for _, form := range []url.Values{
+		{"name": {"Visa Debit"}, "code": {"VISA"}, "type": {atlas.PaymentMethodCreditCard}},
+		{"name": {"PayNow"}, "code": {"pay now"}, "type": {atlas.PaymentMethodNonCreditCard}},
+		{"name": {"PayNow"}, "code": {"paynow"}, "type": {"CHEQUE"}},
+		{"name": {""}, "code": {"paynow"}, "type": {atlas.PaymentMethodNonCreditCard}},
+	} {
+		w := test("POST", form)
+		equals(t, listURL, w.HeaderMap.Get("Location"))
+		equals(t, count, len(mockDB.methods))
+	}
+
+	w := test("POST", url.Values{"name": {"PayNow"}, "code": {"PayNow"}, "type": {atlas.PaymentMethodNonCreditCard}})
+	equals(t, listURL, w.HeaderMap.Get("Location"))
+	equals(t, count+1, len(mockDB.methods))
+	pm := mockDB.methods[count+1]
+	equals(t, "paynow", pm.Code)
+	equals(t, "PayNow", pm.DisplayName)
+	equals(t, count+1, pm.Position)
+	// devices are told about it, and only about it
+	equals(t, []atlas.QBOrgChange{{ID: 1, OrgID: org1.ID, Kind: atlas.OrgChangePaymentMethod, EntityID: fmt.Sprint(pm.ID), Operation: "Create"}}, withoutDates(changes.changes))
+
+	mockDB.hasError = true
+	w = test("POST", url.Values{"name": {"GrabPay"}, "code": {"grabpay"}, "type": {atlas.PaymentMethodNonCreditCard}})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestPaymentMethodEditPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := newMockQBPaymentMethodDB()
+	changes := &MockQBOrgChangeDB{}
+	stream := main.NewOrgChangeStream(changes, 10, 2)
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}, {Key: "pmid", Value: "1"}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.PaymentMethodEditPostHandler(mockDB, stream)), true, params)
+
+	// the code of another payment method is taken, its own code is not
+	w := test("POST", url.Values{"name": {"Cash"}, "code": {"nets"}, "type": {atlas.PaymentMethodNonCreditCard}})
+	equals(t, fmt.Sprintf("/orgs/%d/payment-methods/1", org1.ID), w.HeaderMap.Get("Location"))
+	equals(t, "cash", mockDB.methods[1].Code)
+
+	w = test("POST", url.Values{"name": {"Cash"}, "display_name": {"Cash (SGD)"}, "code": {"cash"}, "type": {atlas.PaymentMethodNonCreditCard}, "disabled": {"on"}})
+	equals(t, fmt.Sprintf("/orgs/%d/payment-methods", org1.ID), w.HeaderMap.Get("Location"))
+	equals(t, "Cash", mockDB.methods[1].Name)
+	equals(t, "Cash (SGD)", mockDB.methods[1].DisplayName)
+	assert(t, mockDB.methods[1].IsDisabled, "expected payment method to be disabled")
+	equals(t, []atlas.QBOrgChange{{ID: 1, OrgID: org1.ID, Kind: atlas.OrgChangePaymentMethod, EntityID: "1", Operation: "Update"}}, withoutDates(changes.changes))
+
+	// payment methods of other orgs cannot be edited
+	other := GenerateHandleTesterWithURLParams(t, app.Wrap(app.PaymentMethodEditPostHandler(mockDB, stream)), true,
+		httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID + 1)}, {Key: "pmid", Value: "1"}})
+	w = other("POST", url.Values{"name": {"Stolen"}, "code": {"stolen"}, "type": {atlas.PaymentMethodNonCreditCard}})
+	equals(t, http.StatusNotFound, w.Code)
+	equals(t, "Cash", mockDB.methods[1].Name)
+	equals(t, 1, len(changes.changes))
+}
+
+func TestPaymentMethodMovePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := newMockQBPaymentMethodDB()
+	changes := &MockQBOrgChangeDB{}
+	stream := main.NewOrgChangeStream(changes, 10, 2)
+	move := func(pmID int, direction string) {
+		params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}, {Key: "pmid", Value: fmt.Sprint(pmID)}}
+		test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.PaymentMethodMovePostHandler(mockDB, stream)), true, params)
+		w := test("POST", url.Values{"direction": {direction}})
+		equals(t, fmt.Sprintf("/orgs/%d/payment-methods", org1.ID), w.HeaderMap.Get("Location"))
+	}
+
+	move(2, "up")
+	move(9, "up")
+	// already at the top
+	move(2, "up")
+	equals(t, []string{"ccard", "cash", "crc", "ezlin", "nets", "vcher", "visa", "amex", "master"}, mockDB.codes())
+	// both payment methods that changed place are published, moves that change nothing are not
+	equals(t, 4, len(changes.changes))
+	move(1, "down")
+	equals(t, []string{"ccard", "crc", "cash", "ezlin", "nets", "vcher", "visa", "amex", "master"}, mockDB.codes())
+	equals(t, 6, len(changes.changes))
+	for _, c := range changes.changes[4:] {
+		equals(t, atlas.OrgChangePaymentMethod, c.Kind)
+		equals(t, "Update", c.Operation)
+	}
+	equals(t, "1", changes.changes[4].EntityID)
+	equals(t, "3", changes.changes[5].EntityID)
+}
+
+// withoutDates returns the changes with their DateCreated zeroed, to be compared.
+func withoutDates(changes []atlas.QBOrgChange) []atlas.QBOrgChange {
+	var undated []atlas.QBOrgChange
+	for _, c := range changes {
+		c.DateCreated = time.Time{}
+		undated = append(undated, c)
+	}
+	return undated
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type posTaxRateForm struct {
+	Name string `form:"name" label:"Name" validate:"required,max=100"`
+	Rate string `form:"rate" label:"Rate" validate:"required"`
+}
+
+// POSTaxRatesPageHandler lists the tax rates the POS of an org charges, with a form to add one. A rate cannot
+// be changed once added, since past sales were charged with it: a new rate is added instead and the old one
+// deactivated.
+func (a *App) POSTaxRatesPageHandler(db atlas.POSTaxRateDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, err := posTaxRatesOrg(req)
+		if err != nil {
+			return err
+		}
+		rates, err := db.GetAllPOSTaxRatesForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving tax rates", err)
+		}
+
+		p := struct {
+			Rates []*atlas.POSTaxRate
+			OrgID int
+			*localPresenter
+		}{
+			Rates: rates,
+			OrgID: orgID,
+			localPresenter: &localPresenter{
+				PageTitle:       "Tax rates",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "pos_tax_rates", p)
+		return nil
+	}
+}
+
+// POSTaxRateCreatePostHandler adds an active tax rate to an org. Its sales are not synced to Quickbooks until
+// the rate is mapped to a tax code.
+func (a *App) POSTaxRateCreatePostHandler(db atlas.POSTaxRateDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, err := posTaxRatesOrg(req)
+		if err != nil {
+			return err
+		}
+		listURL := fmt.Sprintf("/orgs/%d/tax-rates", orgID)
+
+		var form posTaxRateForm
+		fs, _, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSuffix(form.Rate, "%"), 64)
+		if _, invalid := fs.Errors["rate"]; !invalid && (err != nil || rate < 0 || rate > 100) {
+			fs.Errors["rate"] = "Rate has to be a percentage between 0 and 100"
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, listURL)
+			return nil
+		}
+
+		_, err = db.CreatePOSTaxRate(atlas.POSTaxRate{OrgID: orgID, Name: form.Name, Rate: rate, IsActive: true})
+		if err != nil {
+			return server.New500Error("error creating tax rate", err)
+		}
+
+		a.saveFlash(w, req, FlashWarning, form.Name+" added. Sales are not synced to Quickbooks until it has a Quickbooks tax code")
+		http.Redirect(w, req, listURL, http.StatusFound)
+		return nil
+	}
+}
+
+// POSTaxRateActivePostHandler activates or deactivates a tax rate of an org, as given by the "active" form
+// value. Inactive rates are kept, so that past sales still refer to them, but no longer need a tax code.
+func (a *App) POSTaxRateActivePostHandler(db atlas.POSTaxRateDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, err := posTaxRatesOrg(req)
+		if err != nil {
+			return err
+		}
+		var rateID int
+		if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+			rateID, _ = strconv.Atoi(ps.ByName("rateid"))
+		}
+		rates, err := db.GetAllPOSTaxRatesForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving tax rates", err)
+		}
+		var r *atlas.POSTaxRate
+		for _, rate := range rates {
+			if rate.ID == rateID {
+				r = rate
+			}
+		}
+		if r == nil {
+			return server.NewError(http.StatusNotFound, "tax rate not found", fmt.Errorf("tax rate %d not in org %d", rateID, orgID))
+		}
+
+		r.IsActive = req.FormValue("active") == "on"
+		_, err = db.UpdatePOSTaxRate(*r)
+		if err != nil {
+			return server.New500Error("error saving tax rate", err)
+		}
+
+		a.saveFlash(w, req, FlashSuccess, r.Name+" saved")
+		http.Redirect(w, req, fmt.Sprintf("/orgs/%d/tax-rates", orgID), http.StatusFound)
+		return nil
+	}
+}
+
+func posTaxRatesOrg(req *http.Request) (int, error) {
+	orgID, _ := requestScope(req)
+	if orgID == 0 {
+		return 0, server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for tax rates page"))
+	}
+	return orgID, nil
+}
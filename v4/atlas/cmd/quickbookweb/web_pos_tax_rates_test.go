@@ -0,0 +1,64 @@
+package main_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestPOSTaxRateCreatePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := newMockQBTaxDB()
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.POSTaxRateCreatePostHandler(mockDB)), true, params)
+	listURL := fmt.Sprintf("/orgs/%d/tax-rates", org1.ID)
+	count := len(mockDB.rates)
+
+	for _, form := range []url.Values{
+		{"name": {""}, "rate": {"9"}},
+		{"name": {"GST"}, "rate": {""}},
+		{"name": {"GST"}, "rate": {"nine"}},
+		{"name": {"GST"}, "rate": {"109"}},
+		{"name": {"GST"}, "rate": {"-1"}},
+	} {
+		w := test("POST", form)
+		equals(t, listURL, w.HeaderMap.Get("Location"))
+		equals(t, count, len(mockDB.rates))
+	}
+
+	w := test("POST", url.Values{"name": {"GST"}, "rate": {"9%"}})
+	equals(t, listURL, w.HeaderMap.Get("Location"))
+	equals(t, count+1, len(mockDB.rates))
+	r := mockDB.rates[count]
+	equals(t, org1.ID, r.OrgID)
+	equals(t, 9.0, r.Rate)
+	assert(t, r.IsActive, "expected new tax rates to be active")
+
+	mockDB.hasError = true
+	w = test("POST", url.Values{"name": {"GST"}, "rate": {"9"}})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestPOSTaxRateActivePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := newMockQBTaxDB()
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}, {Key: "rateid", Value: "1"}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.POSTaxRateActivePostHandler(mockDB)), true, params)
+
+	w := test("POST", url.Values{})
+	equals(t, fmt.Sprintf("/orgs/%d/tax-rates", org1.ID), w.HeaderMap.Get("Location"))
+	assert(t, !mockDB.rates[0].IsActive, "expected tax rate to be deactivated")
+
+	test("POST", url.Values{"active": {"on"}})
+	assert(t, mockDB.rates[0].IsActive, "expected tax rate to be activated")
+
+	// tax rates of other orgs cannot be changed
+	other := GenerateHandleTesterWithURLParams(t, app.Wrap(app.POSTaxRateActivePostHandler(mockDB)), true,
+		httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID + 1)}, {Key: "rateid", Value: "1"}})
+	w = other("POST", url.Values{})
+	equals(t, http.StatusNotFound, w.Code)
+	assert(t, mockDB.rates[0].IsActive, "expected tax rate to stay active")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var qbAccountsSetupPath = atlas.OnboardingPath(atlas.BackendQuickbooks, atlas.OnboardingAccounts)
+
+// qbAccountRoleOption is an account role of the mapping page with the accounts it can be mapped to.
+type qbAccountRoleOption struct {
+	Role     atlas.QBAccountRole
+	Accounts []atlas.QBRemoteAccount
+}
+
+// QBAccountsPageHandler displays the Quickbooks accounts an org posts deposits, undeposited funds, discounts,
+// rounding and tips to, with overrides per shop and payment method. It serves both the accounts step of the
+// setup wizard, for the org being set up, and /orgs/:orgid/quickbooks/accounts.
+func (a *App) QBAccountsPageHandler(db atlas.QBAccountMappingPageDB, qb QBClientSource) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		org, pageURL, err := a.qbAccountsOrg(w, req, db)
+		if err != nil || org == nil {
+			return err
+		}
+		accounts, err := qb(req.Context(), org).Accounts()
+		if err != nil {
+			return server.NewError(http.StatusBadGateway, "could not retrieve your chart of accounts from Quickbooks, please try again", err)
+		}
+		mappings, err := db.GetQBAccountMappings(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving account mappings", err)
+		}
+		shops, err := db.GetAllQBShopsForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving shops", err)
+		}
+		methods, err := db.GetAllQBPaymentMethodsForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving payment methods", err)
+		}
+
+		roles := make([]qbAccountRoleOption, len(atlas.AccountRoles))
+		for i, r := range atlas.AccountRoles {
+			roles[i].Role = r
+			for _, acct := range accounts {
+				if r.Allows(acct) {
+					roles[i].Accounts = append(roles[i].Accounts, acct)
+				}
+			}
+		}
+		var overrides []*atlas.QBAccountMapping
+		form := a.getFormState(w, req)
+		prefill := form.Values == nil
+		if prefill {
+			form.Values = map[string]string{}
+		}
+		for _, m := range mappings {
+			if m.ShopID != 0 || m.PaymentMethodID != 0 {
+				overrides = append(overrides, m)
+			} else if prefill {
+				form.Values["account_"+string(m.Role)] = m.QBAccountID
+			}
+		}
+		// an empty row to add an override
+		overrides = append(overrides, &atlas.QBAccountMapping{Role: atlas.AccountRoleDeposit})
+		if prefill && form.Values["account_"+string(atlas.AccountRoleDeposit)] == "" {
+			form.Values["account_"+string(atlas.AccountRoleDeposit)] = org.QBDepositAccountID
+		}
+
+		p := struct {
+			Org            *atlas.QBOrg
+			ActionURL      string
+			InSetup        bool
+			Roles          []qbAccountRoleOption
+			Accounts       []atlas.QBRemoteAccount
+			Overrides      []*atlas.QBAccountMapping
+			Shops          []*atlas.QBShop
+			PaymentMethods []*atlas.QBPaymentMethod
+			*localPresenter
+		}{
+			Org:            org,
+			ActionURL:      pageURL,
+			InSetup:        pageURL == qbAccountsSetupPath,
+			Roles:          roles,
+			Accounts:       accounts,
+			Overrides:      overrides,
+			Shops:          shops,
+			PaymentMethods: methods,
+			localPresenter: &localPresenter{
+				PageTitle:       "Quickbooks accounts",
+				PageURL:         pageURL,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "qb_accounts", p)
+		return nil
+	}
+}
+
+// QBAccountsPostHandler checks the picked accounts against the current chart of accounts of Quickbooks and
+// saves them. The org-wide deposit account is also kept in QBOrg.QBDepositAccountID. In the setup wizard it
+// moves on to the shop step.
+//
+// Overrides come as the parallel "override_role", "override_shop", "override_pm" and "override_account" form
+// values; rows without an account are dropped.
+func (a *App) QBAccountsPostHandler(db atlas.QBAccountMappingPageDB, qb QBClientSource) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		org, pageURL, err := a.qbAccountsOrg(w, req, db)
+		if err != nil || org == nil {
+			return err
+		}
+		err = req.ParseForm()
+		if err != nil {
+			return server.NewError(http.StatusBadRequest, "error parsing form", err)
+		}
+		accounts, err := qb(req.Context(), org).Accounts()
+		if err != nil {
+			return server.NewError(http.StatusBadGateway, "could not retrieve your chart of accounts from Quickbooks, please try again", err)
+		}
+		shops, err := db.GetAllQBShopsForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving shops", err)
+		}
+		methods, err := db.GetAllQBPaymentMethodsForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving payment methods", err)
+		}
+
+		mappings, fs := parseQBAccountMappings(req, org.ID, accounts, shops, methods)
+		if fs.HasErrors() {
+			a.formError(w, req, fs, pageURL)
+			return nil
+		}
+
+		err = db.ReplaceQBAccountMappings(org.ID, mappings)
+		if err != nil {
+			return server.New500Error("error saving account mappings", err)
+		}
+		org.QBDepositAccountID = atlas.ResolveQBAccount(mappingPointers(mappings), atlas.AccountRoleDeposit, 0, 0)
+		_, err = db.UpdateQBOrg(*org)
+		if err != nil {
+			return server.New500Error("error saving org", err)
+		}
+
+		if pageURL == qbAccountsSetupPath {
+			err = advanceOnboarding(req, db, atlas.OnboardingShop, nil)
+			if err != nil {
+				return server.New500Error("error saving setup progress", err)
+			}
+			http.Redirect(w, req, atlas.OnboardingPath(atlas.BackendQuickbooks, atlas.OnboardingShop), http.StatusFound)
+			return nil
+		}
+		a.saveFlash(w, req, FlashSuccess, "Quickbooks accounts saved")
+		http.Redirect(w, req, pageURL, http.StatusFound)
+		return nil
+	}
+}
+
+// qbAccountsOrg returns the org of the account mapping page and the URL of the page: the org named by the
+// "orgid" URL param, or else the org being set up in the setup wizard. It returns a nil org after sending
+// the user to connect, or reconnect, the org if it is not connected to Quickbooks.
+func (a *App) qbAccountsOrg(w http.ResponseWriter, req *http.Request, db atlas.QBAccountMappingPageDB) (*atlas.QBOrg, string, error) {
+	orgID, _ := requestScope(req)
+	pageURL := fmt.Sprintf("/orgs/%d/quickbooks/accounts", orgID)
+	if orgID == 0 {
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return nil, "", server.New500Error("error retrieving setup progress", err)
+		}
+		if o == nil || o.OrgID == 0 {
+			return nil, "", server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for quickbooks accounts page"))
+		}
+		orgID, pageURL = o.OrgID, qbAccountsSetupPath
+	}
+
+	org, err := db.GetQBOrg(orgID)
+	if err != nil {
+		return nil, "", server.NewError(http.StatusNotFound, "organisation not found", err)
+	}
+	if org.QBCompanyID == "" || org.QBNeedsReconnect {
+		if pageURL != qbAccountsSetupPath {
+			a.redirectToQBReconnect(w, req, org)
+			return nil, "", nil
+		}
+		a.saveFlash(w, req, FlashWarning, "Please connect "+org.Name+" to Quickbooks first")
+		http.Redirect(w, req, atlas.OnboardingPath(atlas.BackendQuickbooks, atlas.OnboardingConnect), http.StatusFound)
+		return nil, "", nil
+	}
+	return org, pageURL, nil
+}
+
+// parseQBAccountMappings reads the mappings of the account mapping form, checking that every account exists,
+// is active and has a type the role allows, and that overrides name a shop or payment method of the org.
+func parseQBAccountMappings(req *http.Request, orgID int, accounts []atlas.QBRemoteAccount, shops []*atlas.QBShop, methods []*atlas.QBPaymentMethod) ([]atlas.QBAccountMapping, FormState) {
+	fs := FormState{Values: map[string]string{}, Errors: map[string]string{}}
+	byID := map[string]atlas.QBRemoteAccount{}
+	for _, acct := range accounts {
+		byID[acct.QBID] = acct
+	}
+	checkAccount := func(role atlas.QBAccountRole, id string) string {
+		acct, ok := byID[id]
+		if !ok || !role.Allows(acct) {
+			return fmt.Sprintf("%s has to be an active %s account", role.Label(), strings.Join(role.AllowedTypes(), " or "))
+		}
+		return ""
+	}
+
+	var mappings []atlas.QBAccountMapping
+	for _, role := range atlas.AccountRoles {
+		name := "account_" + string(role)
+		id := strings.TrimSpace(req.FormValue(name))
+		fs.Values[name] = id
+		if id == "" {
+			if role.Required() {
+				fs.Errors[name] = fmt.Sprintf("Please pick the %s", strings.ToLower(role.Label()))
+			}
+			continue
+		}
+		if msg := checkAccount(role, id); msg != "" {
+			fs.Errors[name] = msg
+			continue
+		}
+		mappings = append(mappings, atlas.QBAccountMapping{OrgID: orgID, Role: role, QBAccountID: id})
+	}
+
+	shopIDs := map[int]bool{0: true}
+	for _, s := range shops {
+		shopIDs[s.ID] = true
+	}
+	methodIDs := map[int]bool{0: true}
+	for _, pm := range methods {
+		methodIDs[pm.ID] = true
+	}
+	roles, shopValues, pmValues, accountValues := req.Form["override_role"], req.Form["override_shop"], req.Form["override_pm"], req.Form["override_account"]
+	if len(shopValues) != len(roles) || len(pmValues) != len(roles) || len(accountValues) != len(roles) {
+		fs.Errors["overrides"] = "Please fill in every override completely"
+		return mappings, fs
+	}
+	var problems []string
+	seen := map[string]bool{}
+	for i := range roles {
+		id := strings.TrimSpace(accountValues[i])
+		if id == "" {
+			continue
+		}
+		role := atlas.QBAccountRole(roles[i])
+		shopID, _ := strconv.Atoi(shopValues[i])
+		pmID, _ := strconv.Atoi(pmValues[i])
+		row := fmt.Sprintf("Override %d: ", i+1)
+		switch {
+		case !role.IsValid():
+			problems = append(problems, row+"please pick what the account is for")
+		case !shopIDs[shopID] || !methodIDs[pmID]:
+			problems = append(problems, row+"unknown shop or payment method")
+		case shopID == 0 && pmID == 0:
+			problems = append(problems, row+"please pick a shop or a payment method")
+		case seen[fmt.Sprintf("%s/%d/%d", role, shopID, pmID)]:
+			problems = append(problems, row+"the same override is given twice")
+		default:
+			if msg := checkAccount(role, id); msg != "" {
+				problems = append(problems, row+msg)
+				continue
+			}
+			seen[fmt.Sprintf("%s/%d/%d", role, shopID, pmID)] = true
+			mappings = append(mappings, atlas.QBAccountMapping{OrgID: orgID, ShopID: shopID, PaymentMethodID: pmID, Role: role, QBAccountID: id})
+		}
+	}
+	if len(problems) > 0 {
+		fs.Errors["overrides"] = strings.Join(problems, "; ")
+	}
+	return mappings, fs
+}
+
+func mappingPointers(mappings []atlas.QBAccountMapping) []*atlas.QBAccountMapping {
+	ptrs := make([]*atlas.QBAccountMapping, len(mappings))
+	for i := range mappings {
+		ptrs[i] = &mappings[i]
+	}
+	return ptrs
+}
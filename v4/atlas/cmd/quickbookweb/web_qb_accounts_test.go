@@ -0,0 +1,137 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBAccountDB struct {
+	MockQBShopDB
+	mappings []atlas.QBAccountMapping
+}
+
+func (db *MockQBAccountDB) GetQBAccountMappings(orgID int) ([]*atlas.QBAccountMapping, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var mappings []*atlas.QBAccountMapping
+	for i := range db.mappings {
+		if db.mappings[i].OrgID == orgID {
+			m := db.mappings[i]
+			mappings = append(mappings, &m)
+		}
+	}
+	return mappings, nil
+}
+
+func (db *MockQBAccountDB) ReplaceQBAccountMappings(orgID int, mappings []atlas.QBAccountMapping) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.mappings = mappings
+	return nil
+}
+
+func newAccountsQBAPI() *MockQBAPI {
+	api := newMockQBAPI(org1.QBCompanyID)
+	for _, acct := range []map[string]interface{}{
+		{"Id": "35", "Name": "Checking", "FullyQualifiedName": "Checking", "AccountType": "Bank", "Active": true},
+		{"Id": "4", "Name": "Undeposited Funds", "FullyQualifiedName": "Undeposited Funds", "AccountType": "Other Current Asset", "AccountSubType": "UndepositedFunds", "Active": true},
+		{"Id": "86", "Name": "Discounts given", "FullyQualifiedName": "Discounts given", "AccountType": "Income", "Active": true},
+		{"Id": "90", "Name": "Tips payable", "FullyQualifiedName": "Tips payable", "AccountType": "Other Current Liability", "Active": true},
+		{"Id": "91", "Name": "Old Bank", "FullyQualifiedName": "Old Bank", "AccountType": "Bank", "Active": false},
+		{"Id": "92", "Name": "Petty Cash", "FullyQualifiedName": "Petty Cash", "AccountType": "Bank", "Active": true},
+	} {
+		api.add("Account", acct)
+	}
+	return api
+}
+
+func TestQBAccountsPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := httptest.NewServer(newAccountsQBAPI())
+	defer ts.Close()
+	mockDB := &MockQBAccountDB{}
+	mockDB.org = connectedOrg1()
+	mockDB.MockQBPaymentMethodDB = *newMockQBPaymentMethodDB()
+	mockDB.CreateQBShop(atlas.QBShop{Name: "Orchard", OrgID: org1.ID})
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBAccountsPostHandler(mockDB, newTestQBClientSource(ts))), true, params)
+	pageURL := fmt.Sprintf("/orgs/%d/quickbooks/accounts", org1.ID)
+
+	for _, form := range []url.Values{
+		// the deposit account is required
+		{"account_discount": {"86"}},
+		// a liability cannot take deposits, and inactive or unknown accounts cannot be picked
+		{"account_deposit": {"90"}},
+		{"account_deposit": {"91"}},
+		{"account_deposit": {"999"}},
+		// overrides need a shop or payment method of the org
+		{"account_deposit": {"35"}, "override_role": {"deposit"}, "override_shop": {"0"}, "override_pm": {"0"}, "override_account": {"92"}},
+		{"account_deposit": {"35"}, "override_role": {"deposit"}, "override_shop": {"42"}, "override_pm": {"0"}, "override_account": {"92"}},
+		{"account_deposit": {"35"}, "override_role": {"tips"}, "override_shop": {"1"}, "override_pm": {"0"}, "override_account": {"92"}},
+		{"account_deposit": {"35"}, "override_role": {"deposit"}, "override_shop": {"1"}},
+	} {
+		w := test("POST", form)
+		equals(t, pageURL, w.HeaderMap.Get("Location"))
+		equals(t, 0, len(mockDB.mappings))
+	}
+
+	w := test("POST", url.Values{
+		"account_deposit":           {"35"},
+		"account_undeposited_funds": {"4"},
+		"account_discount":          {""},
+		"account_tips":              {"90"},
+		// cash of the Orchard shop goes to petty cash, the empty row is dropped
+		"override_role":    {"deposit", "deposit"},
+		"override_shop":    {"1", "0"},
+		"override_pm":      {"1", "0"},
+		"override_account": {"92", ""},
+	})
+	equals(t, pageURL, w.HeaderMap.Get("Location"))
+	equals(t, []atlas.QBAccountMapping{
+		{OrgID: org1.ID, Role: atlas.AccountRoleDeposit, QBAccountID: "35"},
+		{OrgID: org1.ID, Role: atlas.AccountRoleUndepositedFunds, QBAccountID: "4"},
+		{OrgID: org1.ID, Role: atlas.AccountRoleTips, QBAccountID: "90"},
+		{OrgID: org1.ID, ShopID: 1, PaymentMethodID: 1, Role: atlas.AccountRoleDeposit, QBAccountID: "92"},
+	}, mockDB.mappings)
+	equals(t, "35", mockDB.updatedOrg.QBDepositAccountID)
+
+	mappings, _ := mockDB.GetQBAccountMappings(org1.ID)
+	equals(t, "92", atlas.ResolveQBAccount(mappings, atlas.AccountRoleDeposit, 1, 1))
+	equals(t, "35", atlas.ResolveQBAccount(mappings, atlas.AccountRoleDeposit, 1, 2))
+	equals(t, "", atlas.ResolveQBAccount(mappings, atlas.AccountRoleRounding, 1, 1))
+}
+
+func TestQBAccountsPostHandlerSetup(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := httptest.NewServer(newAccountsQBAPI())
+	defer ts.Close()
+	mockDB := &MockQBAccountDB{}
+	mockDB.org = connectedOrg1()
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{
+		user1.ID: {UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingAccounts, OrgID: org1.ID},
+	}
+	test := GenerateHandleTesterAsUser(t, app.Wrap(app.QBAccountsPostHandler(mockDB, newTestQBClientSource(ts))), user1, nil)
+
+	w := test("POST", url.Values{"account_deposit": {"35"}})
+	equals(t, "/start/5", w.HeaderMap.Get("Location"))
+	equals(t, atlas.OnboardingShop, mockDB.onboardings[user1.ID].Step)
+
+	// not connected yet
+	mockDB.org.QBCompanyID = ""
+	w = test("POST", url.Values{"account_deposit": {"35"}})
+	equals(t, "/start/4", w.HeaderMap.Get("Location"))
+
+	// Quickbooks is down
+	mockDB.org = connectedOrg1()
+	ts.Close()
+	w = test("POST", url.Values{"account_deposit": {"35"}})
+	equals(t, http.StatusBadGateway, w.Code)
+}
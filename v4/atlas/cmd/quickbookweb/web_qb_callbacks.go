@@ -0,0 +1,107 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// qbCallbackRecentDeliveries is how many deliveries the callback page shows.
+const qbCallbackRecentDeliveries = 50
+
+// QBCallbacksPageHandler displays the callbacks the shops of an org registered with their recent deliveries.
+func (a *App) QBCallbacksPageHandler(db atlas.QBCallbackPageDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		org, pageURL, err := qbCallbacksOrg(req, db)
+		if err != nil {
+			return err
+		}
+		callbacks, err := db.GetQBCallbacks(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving callbacks", err)
+		}
+		deliveries, err := db.GetRecentQBCallbackDeliveries(org.ID, qbCallbackRecentDeliveries)
+		if err != nil {
+			return server.New500Error("error retrieving callback deliveries", err)
+		}
+
+		p := struct {
+			Org        *atlas.QBOrg
+			Callbacks  []*atlas.QBCallback
+			Deliveries []*atlas.QBCallbackDelivery
+			*localPresenter
+		}{
+			Org:        org,
+			Callbacks:  callbacks,
+			Deliveries: deliveries,
+			localPresenter: &localPresenter{
+				PageTitle:       "Callbacks",
+				PageURL:         pageURL,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "qb_callbacks", p)
+		return nil
+	}
+}
+
+// QBCallbackRedeliverPostHandler queues the notification of a delivery of an org again, as a new delivery to the
+// same callback.
+func (a *App) QBCallbackRedeliverPostHandler(db atlas.QBCallbackPageDB, s *QBCallbackSender) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		org, pageURL, err := qbCallbacksOrg(req, db)
+		if err != nil {
+			return err
+		}
+		var deliveryID int
+		if ps, ok := req.Context().Value(server.Params).(httprouter.Params); ok {
+			deliveryID, _ = strconv.Atoi(ps.ByName("deliveryid"))
+		}
+		d, err := db.GetQBCallbackDelivery(deliveryID)
+		if err != nil || d.OrgID != org.ID {
+			if err == nil {
+				err = fmt.Errorf("callback delivery %d is not in org %d", deliveryID, org.ID)
+			}
+			return server.NewError(http.StatusNotFound, "delivery not found", err)
+		}
+		c, err := db.GetQBCallback(d.CallbackID)
+		if err != nil || !c.IsActive {
+			a.saveFlash(w, req, FlashError, "The callback of this delivery was removed")
+			http.Redirect(w, req, pageURL, http.StatusFound)
+			return nil
+		}
+
+		redelivery, err := s.Queue(c, d.Payload)
+		if err != nil {
+			return server.New500Error("error queueing delivery", err)
+		}
+		a.Logr.Log("callback delivery %d of org %d queued again as delivery %d", d.ID, org.ID, redelivery.ID)
+		a.saveFlash(w, req, FlashSuccess, fmt.Sprintf("Delivery %d queued again to %s", d.ID, c.URL))
+		http.Redirect(w, req, pageURL, http.StatusFound)
+		return nil
+	}
+}
+
+// qbCallbacksOrg returns the org named by the "orgid" URL param and the URL of its callback page.
+func qbCallbacksOrg(req *http.Request, db atlas.QBCallbackPageDB) (*atlas.QBOrg, string, error) {
+	orgID, _ := requestScope(req)
+	if orgID == 0 {
+		return nil, "", server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for callbacks page"))
+	}
+	org, err := db.GetQBOrg(orgID)
+	if err != nil {
+		return nil, "", server.NewError(http.StatusNotFound, "organisation not found", err)
+	}
+	return org, fmt.Sprintf("/orgs/%d/quickbooks/callbacks", org.ID), nil
+}
@@ -0,0 +1,76 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestQBCallbacksPageHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBCallbackDB{}
+	c, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: "https://pos.example.com/hooks", Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	_, err = main.NewQBCallbackSender(mockDB, newTestSecretBox(t)).Queue(c, []byte(`{"eventId":1}`))
+	ok(t, err)
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBCallbacksPageHandler(mockDB)), true, params)
+
+	w := test("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	assert(t, w.Body.Len() > 0, "expected the callbacks page")
+
+	mockDB.hasError = true
+	w = test("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestQBCallbackRedeliverPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBCallbackDB{}
+	s := main.NewQBCallbackSender(mockDB, newTestSecretBox(t))
+	c, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: org1.ID, ShopID: shop1.ID, URL: "https://pos.example.com/hooks", Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	d, err := s.Queue(c, []byte(`{"eventId":1}`))
+	ok(t, err)
+	d.Status = atlas.QBCallbackDeliveryFailed
+	ok(t, mockDB.UpdateQBCallbackDelivery(*d))
+	otherCallback, err := mockDB.CreateQBCallback(atlas.QBCallback{OrgID: 42, ShopID: 3, URL: "https://pos.example.com/hooks", Secret: callbackSecret, IsActive: true})
+	ok(t, err)
+	other, err := s.Queue(otherCallback, []byte(`{"eventId":2}`))
+	ok(t, err)
+
+	redeliver := func(deliveryID int) *httptest.ResponseRecorder {
+		params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}, {Key: "deliveryid", Value: fmt.Sprint(deliveryID)}}
+		return GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBCallbackRedeliverPostHandler(mockDB, s)), true, params)("POST", url.Values{})
+	}
+	pageURL := fmt.Sprintf("/orgs/%d/quickbooks/callbacks", org1.ID)
+
+	w := redeliver(d.ID)
+	equals(t, http.StatusFound, w.Code)
+	equals(t, pageURL, w.HeaderMap.Get("Location"))
+	equals(t, 3, len(mockDB.deliveries))
+	redelivered := mockDB.delivery(3)
+	equals(t, atlas.QBCallbackDeliveryPending, redelivered.Status)
+	equals(t, c.ID, redelivered.CallbackID)
+	equals(t, d.Payload, redelivered.Payload)
+
+	// deliveries of other orgs and unknown deliveries cannot be redelivered
+	w = redeliver(other.ID)
+	equals(t, http.StatusNotFound, w.Code)
+	w = redeliver(99)
+	equals(t, http.StatusNotFound, w.Code)
+
+	// nor can deliveries of removed callbacks
+	ok(t, mockDB.DeleteQBCallback(c.ID))
+	w = redeliver(d.ID)
+	equals(t, pageURL, w.HeaderMap.Get("Location"))
+	equals(t, 3, len(mockDB.deliveries))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"net/http"
+)
+
+// QBPaymentMethodReviewPageHandler shows how the payment methods of an org line up with Quickbooks, and the
+// conflicts found by the last sync.
+func (a *App) QBPaymentMethodReviewPageHandler(db atlas.QBPaymentMethodReviewDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		orgID, err := paymentMethodsOrg(req)
+		if err != nil {
+			return err
+		}
+		org, err := db.GetQBOrg(orgID)
+		if err != nil {
+			return server.NewError(http.StatusNotFound, "organisation not found", err)
+		}
+		methods, err := db.GetAllQBPaymentMethodsForOrg(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving payment methods for organisation", err)
+		}
+		sync, err := db.GetLatestQBPaymentMethodSync(orgID)
+		if err != nil {
+			return server.New500Error("error retrieving last payment methods sync", err)
+		}
+
+		p := struct {
+			Org            *atlas.QBOrg
+			PaymentMethods []*atlas.QBPaymentMethod
+			Sync           *atlas.QBPaymentMethodSync
+			*localPresenter
+		}{
+			Org:            org,
+			PaymentMethods: methods,
+			Sync:           sync,
+			localPresenter: &localPresenter{
+				PageTitle:       "Quickbooks payment methods",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "qb_payment_methods", p)
+		return nil
+	}
+}
+
+// QBPaymentMethodSyncPostHandler syncs the payment methods of an org with Quickbooks and goes back to the
+// review page.
+func (a *App) QBPaymentMethodSyncPostHandler(db atlas.QBPaymentMethodReviewDB, qb QBClientSource) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, err := paymentMethodsOrg(req)
+		if err != nil {
+			return err
+		}
+		reviewURL := fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", orgID)
+		org, err := db.GetQBOrg(orgID)
+		if err != nil {
+			return server.NewError(http.StatusNotFound, "organisation not found", err)
+		}
+		if org.QBCompanyID == "" || org.QBNeedsReconnect {
+			a.redirectToQBReconnect(w, req, org)
+			return nil
+		}
+
+		a.syncQBPaymentMethodsWithFlash(w, req, db, qb, org)
+		http.Redirect(w, req, reviewURL, http.StatusFound)
+		return nil
+	}
+}
+
+// syncQBPaymentMethodsWithFlash runs SyncQBPaymentMethods and tells the user how it went. A failed sync is
+// logged rather than returned, since it can always be retried from the review page.
+func (a *App) syncQBPaymentMethodsWithFlash(w http.ResponseWriter, req *http.Request, db atlas.QBPaymentMethodSyncDB, qb QBClientSource, org *atlas.QBOrg) {
+	s, err := a.SyncQBPaymentMethods(db, qb(req.Context(), org), org)
+	if err != nil {
+		a.Logr.Log("error syncing payment methods of org %d (%s) with quickbooks: %s", org.ID, org.Name, err)
+		a.saveFlash(w, req, FlashError, "Could not sync payment methods with Quickbooks, please try again later")
+		return
+	}
+	if len(s.Conflicts) > 0 {
+		a.saveFlash(w, req, FlashWarning, fmt.Sprintf("%d payment methods differ from Quickbooks and need your review", len(s.Conflicts)))
+		return
+	}
+	a.saveFlash(w, req, FlashSuccess, fmt.Sprintf("Payment methods synced with Quickbooks: %d linked, %d created, %d imported", s.Linked, s.Created, s.Imported))
+}
+
+// redirectToQBReconnect sends the user to the Quickbooks payment methods of an org that is not connected to
+// Quickbooks, where they are offered to reconnect it.
+func (a *App) redirectToQBReconnect(w http.ResponseWriter, req *http.Request, org *atlas.QBOrg) {
+	a.saveFlash(w, req, FlashWarning, "Please reconnect "+org.Name+" to Quickbooks first")
+	http.Redirect(w, req, fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", org.ID), http.StatusFound)
+}
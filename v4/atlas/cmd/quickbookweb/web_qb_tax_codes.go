@@ -0,0 +1,246 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// qbTaxOption is a Quickbooks tax code, with one of its sales tax rates if it is taxable, that a POS tax rate
+// can be mapped to. Value is what the mapping form posts for it.
+type qbTaxOption struct {
+	Value     string
+	Label     string
+	CodeID    string
+	RateID    string
+	RateValue float64
+}
+
+// qbTaxOptions lists the active tax codes of a company with each of their active sales tax rates.
+func qbTaxOptions(codes []atlas.QBRemoteTaxCode, rates []atlas.QBRemoteTaxRate) []qbTaxOption {
+	byID := map[string]atlas.QBRemoteTaxRate{}
+	for _, r := range rates {
+		byID[r.QBID] = r
+	}
+	var options []qbTaxOption
+	for _, c := range codes {
+		if !c.Active {
+			continue
+		}
+		if len(c.SalesTaxRateIDs) == 0 {
+			options = append(options, qbTaxOption{Value: c.QBID + ":", Label: c.Name + " (no tax)", CodeID: c.QBID})
+			continue
+		}
+		for _, id := range c.SalesTaxRateIDs {
+			r, ok := byID[id]
+			if !ok || !r.Active {
+				continue
+			}
+			options = append(options, qbTaxOption{
+				Value:     c.QBID + ":" + r.QBID,
+				Label:     fmt.Sprintf("%s - %s (%g%%)", c.Name, r.Name, r.RateValue),
+				CodeID:    c.QBID,
+				RateID:    r.QBID,
+				RateValue: r.RateValue,
+			})
+		}
+	}
+	return options
+}
+
+// QBTaxCodesPageHandler displays the active POS tax rates of an org with the Quickbooks tax code each is
+// mapped to, picked from the tax codes the company has now. Sales of the org are not synced to Quickbooks
+// while a rate is unmapped.
+func (a *App) QBTaxCodesPageHandler(db atlas.QBTaxMappingPageDB, qb QBClientSource) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		org, pageURL, err := a.qbTaxCodesOrg(w, req, db)
+		if err != nil || org == nil {
+			return err
+		}
+		options, err := fetchQBTaxOptions(qb(req.Context(), org))
+		if err != nil {
+			return server.NewError(http.StatusBadGateway, "could not retrieve your tax codes from Quickbooks, please try again", err)
+		}
+		rates, err := db.GetAllPOSTaxRatesForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving tax rates", err)
+		}
+		mappings, err := db.GetQBTaxMappings(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving tax code mappings", err)
+		}
+
+		var active []*atlas.POSTaxRate
+		for _, r := range rates {
+			if r.IsActive {
+				active = append(active, r)
+			}
+		}
+		form := a.getFormState(w, req)
+		if form.Values == nil {
+			form.Values = map[string]string{}
+			for _, m := range mappings {
+				form.Values[fmt.Sprintf("taxcode_%d", m.POSTaxRateID)] = m.QBTaxCodeID + ":" + m.QBTaxRateID
+			}
+		}
+
+		p := struct {
+			Org       *atlas.QBOrg
+			ActionURL string
+			Rates     []*atlas.POSTaxRate
+			Options   []qbTaxOption
+			Unmapped  []*atlas.POSTaxRate
+			*localPresenter
+		}{
+			Org:       org,
+			ActionURL: pageURL,
+			Rates:     active,
+			Options:   options,
+			Unmapped:  atlas.UnmappedPOSTaxRates(rates, mappings),
+			localPresenter: &localPresenter{
+				PageTitle:       "Quickbooks tax codes",
+				PageURL:         pageURL,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "qb_tax_codes", p)
+		return nil
+	}
+}
+
+// QBTaxCodesPostHandler checks the picked tax codes against the tax codes Quickbooks has now and saves them.
+// A rate may be left unmapped, but the org is then warned that its sales are not synced.
+//
+// Each active rate comes as a "taxcode_<rate id>" form value of "<tax code id>:<tax rate id>", with an empty
+// tax rate id for codes that charge no tax.
+func (a *App) QBTaxCodesPostHandler(db atlas.QBTaxMappingPageDB, qb QBClientSource) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		org, pageURL, err := a.qbTaxCodesOrg(w, req, db)
+		if err != nil || org == nil {
+			return err
+		}
+		err = req.ParseForm()
+		if err != nil {
+			return server.NewError(http.StatusBadRequest, "error parsing form", err)
+		}
+		options, err := fetchQBTaxOptions(qb(req.Context(), org))
+		if err != nil {
+			return server.NewError(http.StatusBadGateway, "could not retrieve your tax codes from Quickbooks, please try again", err)
+		}
+		rates, err := db.GetAllPOSTaxRatesForOrg(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving tax rates", err)
+		}
+		current, err := db.GetQBTaxMappings(org.ID)
+		if err != nil {
+			return server.New500Error("error retrieving tax code mappings", err)
+		}
+
+		mappings, fs := parseQBTaxMappings(req, org.ID, rates, current, options)
+		if fs.HasErrors() {
+			a.formError(w, req, fs, pageURL)
+			return nil
+		}
+		err = db.ReplaceQBTaxMappings(org.ID, mappings)
+		if err != nil {
+			return server.New500Error("error saving tax code mappings", err)
+		}
+
+		saved := make([]*atlas.QBTaxMapping, len(mappings))
+		for i := range mappings {
+			saved[i] = &mappings[i]
+		}
+		if unmapped := atlas.UnmappedPOSTaxRates(rates, saved); len(unmapped) > 0 {
+			names := make([]string, len(unmapped))
+			for i, r := range unmapped {
+				names[i] = r.Name
+			}
+			a.saveFlash(w, req, FlashWarning, "Tax codes saved. Sales will not be synced to Quickbooks until these tax rates have a tax code: "+strings.Join(names, ", "))
+		} else {
+			a.saveFlash(w, req, FlashSuccess, "Tax codes saved")
+		}
+		http.Redirect(w, req, pageURL, http.StatusFound)
+		return nil
+	}
+}
+
+func fetchQBTaxOptions(qb *QBClient) ([]qbTaxOption, error) {
+	codes, err := qb.TaxCodes()
+	if err != nil {
+		return nil, err
+	}
+	rates, err := qb.TaxRates()
+	if err != nil {
+		return nil, err
+	}
+	return qbTaxOptions(codes, rates), nil
+}
+
+// qbTaxCodesOrg returns the org named by the "orgid" URL param and the URL of its tax code page. It returns a
+// nil org after sending the user to reconnect the org if it is not connected to Quickbooks.
+func (a *App) qbTaxCodesOrg(w http.ResponseWriter, req *http.Request, db atlas.QBTaxMappingPageDB) (*atlas.QBOrg, string, error) {
+	orgID, _ := requestScope(req)
+	if orgID == 0 {
+		return nil, "", server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for quickbooks tax codes page"))
+	}
+	org, err := db.GetQBOrg(orgID)
+	if err != nil {
+		return nil, "", server.NewError(http.StatusNotFound, "organisation not found", err)
+	}
+	if org.QBCompanyID == "" || org.QBNeedsReconnect {
+		a.redirectToQBReconnect(w, req, org)
+		return nil, "", nil
+	}
+	return org, fmt.Sprintf("/orgs/%d/quickbooks/tax-codes", org.ID), nil
+}
+
+// parseQBTaxMappings reads the mappings of the tax code form, checking that every picked tax code is still in
+// Quickbooks and charges the same rate as the POS tax rate. Mappings of inactive rates are kept as they are.
+func parseQBTaxMappings(req *http.Request, orgID int, rates []*atlas.POSTaxRate, current []*atlas.QBTaxMapping, options []qbTaxOption) ([]atlas.QBTaxMapping, FormState) {
+	fs := FormState{Values: map[string]string{}, Errors: map[string]string{}}
+	byValue := map[string]qbTaxOption{}
+	for _, o := range options {
+		byValue[o.Value] = o
+	}
+	currentByRate := map[int]*atlas.QBTaxMapping{}
+	for _, m := range current {
+		currentByRate[m.POSTaxRateID] = m
+	}
+
+	var mappings []atlas.QBTaxMapping
+	for _, r := range rates {
+		if !r.IsActive {
+			if m, ok := currentByRate[r.ID]; ok {
+				mappings = append(mappings, *m)
+			}
+			continue
+		}
+		name := fmt.Sprintf("taxcode_%d", r.ID)
+		value := strings.TrimSpace(req.FormValue(name))
+		fs.Values[name] = value
+		if value == "" {
+			continue
+		}
+		o, ok := byValue[value]
+		switch {
+		case !ok:
+			fs.Errors[name] = "Please pick an active tax code of Quickbooks"
+		case math.Abs(o.RateValue-r.Rate) > 0.0001:
+			fs.Errors[name] = fmt.Sprintf("%s charges %g%%, which does not match %s", r.Name, r.Rate, o.Label)
+		default:
+			mappings = append(mappings, atlas.QBTaxMapping{OrgID: orgID, POSTaxRateID: r.ID, QBTaxCodeID: o.CodeID, QBTaxRateID: o.RateID})
+		}
+	}
+	return mappings, fs
+}
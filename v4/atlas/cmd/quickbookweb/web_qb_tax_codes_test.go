@@ -0,0 +1,169 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type MockQBTaxDB struct {
+	MockQBOrgDB
+	rates    []*atlas.POSTaxRate
+	mappings []atlas.QBTaxMapping
+}
+
+func (db *MockQBTaxDB) GetAllPOSTaxRatesForOrg(orgID int) ([]*atlas.POSTaxRate, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var rates []*atlas.POSTaxRate
+	for _, r := range db.rates {
+		if r.OrgID == orgID {
+			copied := *r
+			rates = append(rates, &copied)
+		}
+	}
+	return rates, nil
+}
+
+func (db *MockQBTaxDB) GetQBTaxMappings(orgID int) ([]*atlas.QBTaxMapping, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	var mappings []*atlas.QBTaxMapping
+	for i := range db.mappings {
+		if db.mappings[i].OrgID == orgID {
+			m := db.mappings[i]
+			mappings = append(mappings, &m)
+		}
+	}
+	return mappings, nil
+}
+
+func (db *MockQBTaxDB) ReplaceQBTaxMappings(orgID int, mappings []atlas.QBTaxMapping) error {
+	if db.hasError {
+		return fmt.Errorf("some error")
+	}
+	db.mappings = mappings
+	return nil
+}
+
+func (db *MockQBTaxDB) CreatePOSTaxRate(r atlas.POSTaxRate) (*atlas.POSTaxRate, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	r.ID = len(db.rates) + 1
+	db.rates = append(db.rates, &r)
+	return &r, nil
+}
+
+func (db *MockQBTaxDB) UpdatePOSTaxRate(r atlas.POSTaxRate) (*atlas.POSTaxRate, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	for i := range db.rates {
+		if db.rates[i].ID == r.ID {
+			db.rates[i] = &r
+		}
+	}
+	return &r, nil
+}
+
+func newMockQBTaxDB() *MockQBTaxDB {
+	db := &MockQBTaxDB{rates: []*atlas.POSTaxRate{
+		{ID: 1, OrgID: org1.ID, Name: "GST", Rate: 7, IsActive: true},
+		{ID: 2, OrgID: org1.ID, Name: "Zero rated", Rate: 0, IsActive: true},
+		{ID: 3, OrgID: org1.ID, Name: "Old GST", Rate: 5, IsActive: false},
+	}}
+	db.org = connectedOrg1()
+	db.mappings = []atlas.QBTaxMapping{{OrgID: org1.ID, POSTaxRateID: 3, QBTaxCodeID: "9", QBTaxRateID: "19"}}
+	return db
+}
+
+func newTaxQBAPI() *MockQBAPI {
+	api := newMockQBAPI(org1.QBCompanyID)
+	sales := func(ids ...string) map[string]interface{} {
+		var details []map[string]interface{}
+		for _, id := range ids {
+			details = append(details, map[string]interface{}{"TaxRateRef": map[string]interface{}{"value": id}})
+		}
+		return map[string]interface{}{"TaxRateDetail": details}
+	}
+	for _, tc := range []map[string]interface{}{
+		{"Id": "2", "Name": "SR", "Active": true, "Taxable": true, "SalesTaxRateList": sales("3")},
+		{"Id": "5", "Name": "ZR", "Active": true, "Taxable": false},
+		{"Id": "9", "Name": "SR old", "Active": false, "Taxable": true, "SalesTaxRateList": sales("19")},
+	} {
+		api.add("TaxCode", tc)
+	}
+	for _, tr := range []map[string]interface{}{
+		{"Id": "3", "Name": "GST (sales)", "RateValue": 7, "Active": true},
+		{"Id": "19", "Name": "GST 5% (sales)", "RateValue": 5, "Active": false},
+	} {
+		api.add("TaxRate", tr)
+	}
+	return api
+}
+
+func TestQBTaxCodesPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := httptest.NewServer(newTaxQBAPI())
+	defer ts.Close()
+	mockDB := newMockQBTaxDB()
+	params := httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QBTaxCodesPostHandler(mockDB, newTestQBClientSource(ts))), true, params)
+	pageURL := fmt.Sprintf("/orgs/%d/quickbooks/tax-codes", org1.ID)
+
+	for _, form := range []url.Values{
+		// the rate of the tax code has to match
+		{"taxcode_1": {"5:"}},
+		{"taxcode_2": {"2:3"}},
+		// inactive or unknown tax codes cannot be picked
+		{"taxcode_1": {"9:19"}},
+		{"taxcode_1": {"2:19"}},
+		{"taxcode_1": {"42:3"}},
+	} {
+		w := test("POST", form)
+		equals(t, pageURL, w.HeaderMap.Get("Location"))
+		equals(t, 1, len(mockDB.mappings))
+	}
+
+	// an unmapped rate can be saved, but blocks the sales sync
+	w := test("POST", url.Values{"taxcode_1": {"2:3"}})
+	equals(t, pageURL, w.HeaderMap.Get("Location"))
+	err := atlas.CheckQBTaxMappings(mockDB, org1.ID)
+	unmapped, isUnmapped := err.(*atlas.UnmappedTaxRatesError)
+	assert(t, isUnmapped, "expected an UnmappedTaxRatesError, got %v", err)
+	equals(t, []*atlas.POSTaxRate{mockDB.rates[1]}, unmapped.Rates)
+
+	w = test("POST", url.Values{"taxcode_1": {"2:3"}, "taxcode_2": {"5:"}})
+	equals(t, pageURL, w.HeaderMap.Get("Location"))
+	equals(t, []atlas.QBTaxMapping{
+		{OrgID: org1.ID, POSTaxRateID: 1, QBTaxCodeID: "2", QBTaxRateID: "3"},
+		{OrgID: org1.ID, POSTaxRateID: 2, QBTaxCodeID: "5"},
+		// the inactive rate keeps its mapping
+		{OrgID: org1.ID, POSTaxRateID: 3, QBTaxCodeID: "9", QBTaxRateID: "19"},
+	}, mockDB.mappings)
+	ok(t, atlas.CheckQBTaxMappings(mockDB, org1.ID))
+
+	// a new rate blocks the sales sync again
+	mockDB.rates = append(mockDB.rates, &atlas.POSTaxRate{ID: 4, OrgID: org1.ID, Name: "GST 9%", Rate: 9, IsActive: true})
+	_, isUnmapped = atlas.CheckQBTaxMappings(mockDB, org1.ID).(*atlas.UnmappedTaxRatesError)
+	assert(t, isUnmapped, "expected an UnmappedTaxRatesError")
+
+	// not connected
+	mockDB.org.QBCompanyID = ""
+	w = test("POST", url.Values{"taxcode_1": {"2:3"}})
+	equals(t, fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", org1.ID), w.HeaderMap.Get("Location"))
+
+	// Quickbooks is down
+	mockDB.org = connectedOrg1()
+	ts.Close()
+	w = test("POST", url.Values{"taxcode_1": {"2:3"}})
+	equals(t, http.StatusBadGateway, w.Code)
+}
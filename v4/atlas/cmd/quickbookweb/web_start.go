@@ -3,15 +3,31 @@ package main
 import (
 	"atlas"
 	"atlas/cmd/server"
+	"crypto/subtle"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/asaskevich/govalidator"
-	"github.com/garyburd/go-oauth/oauth"
+	"golang.org/x/oauth2"
 )
 
+type signupForm struct {
+	Email    string `form:"email" label:"Email" validate:"required,email"`
+	Password string `form:"password,secret" label:"Password" validate:"required,min=8"`
+}
+
+type orgForm struct {
+	Name   string `form:"name" label:"Organisation name" validate:"required,max=100"`
+	Region string `form:"region" label:"Payment methods"`
+}
+
+type shopForm struct {
+	Name  string `form:"name" label:"Shop name" validate:"required,max=100"`
+	OrgID int    `form:"orgid" label:"Organisation" validate:"required"`
+}
+
 // WebStartPageHandler is the handler to select Quickbooks or Odoo
 func (a *App) WebStartPageHandler() server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
@@ -19,39 +35,54 @@ func (a *App) WebStartPageHandler() server.HandlerWithError {
 			PageTitle:       "Setup",
 			PageURL:         "/start",
 			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
 		}
 		switch req.Method {
 		case "GET":
+			lp.Flashes = a.getFlashes(w, req)
 			a.Rndr.HTML(w, http.StatusOK, "start1", lp)
 			return nil
 		case "POST":
-			qb := strings.TrimSpace(req.FormValue("quickbooks"))
-			if qb == "on" {
-				http.Redirect(w, req, "/start/2", http.StatusFound)
+			backend := ""
+			if strings.TrimSpace(req.FormValue("quickbooks")) == "on" {
+				backend = atlas.BackendQuickbooks
+			} else if strings.TrimSpace(req.FormValue("odoo")) == "on" {
+				backend = atlas.BackendOdoo
 			}
+			if backend == "" {
+				a.saveFlash(w, req, FlashWarning, "Please pick Quickbooks or Odoo")
+				http.Redirect(w, req, "/start", http.StatusFound)
+				return nil
+			}
+			// the backend is kept until the account is created, which starts the onboarding
+			session, err := a.Store.Get(req, sessionName)
+			if err != nil {
+				return server.New500Error("internal server error: error during getting of session", err)
+			}
+			session.Values[setupBackendKeyName] = backend
+			session.Save(req, w)
+			http.Redirect(w, req, "/start/2", http.StatusFound)
 			return nil
 		}
 		return nil
 	}
 }
 
-// WebStart2PageHandler is the handler to display after the user has selected Quickbooks. In this case we get the user to create a superadmin user
+// WebStart2PageHandler is the handler to display after the user has selected Quickbooks. In this case we get the user to create their account
 func (a *App) WebStart2PageHandler() server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		if u, _ := getUser(req); u != nil {
 			http.Redirect(w, req, "/", http.StatusFound)
 			return nil
 		}
-		fs := a.getFlashes(w, req)
-		p := &struct {
-			Flashes []interface{}
-			localPresenter
-		}{
-			Flashes:        fs,
-			localPresenter: localPresenter{
-				PageTitle: "Set up superadmin acount", 
-				PageURL: "/start/2", 
-				GlobalPresenter: a.Gp}}
+		p := &localPresenter{
+			PageTitle:       "Create your account",
+			PageURL:         "/start/2",
+			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
+			Flashes:         a.getFlashes(w, req),
+			Form:            a.getFormState(w, req),
+		}
 		err := a.Rndr.HTML(w, http.StatusOK, "start2", p)
 		if err != nil {
 			return err
@@ -60,153 +91,164 @@ func (a *App) WebStart2PageHandler() server.HandlerWithError {
 	}
 }
 
-// WebStart2PostHandler is the handler to handle the post request from WebStart2PageHandler. It creates a superadmin
-func (a *App) WebStart2PostHandler(db atlas.QBUserDB) server.HandlerWithError {
+// WebStart2PostHandler is the handler to handle the post request from WebStart2PageHandler. It creates a plain user,
+// who is made the admin of the org they create at the next step, and starts their onboarding at the first step
+// of the chosen backend. If the email address already has an account the user is sent back to sign in or reset
+// the password instead.
+func (a *App) WebStart2PostHandler(db atlas.QBSetupUserDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
-		email, pass := strings.TrimSpace(req.FormValue("email")), req.FormValue("password")
-		if email == "" || pass == "" {
-			a.saveFlash(w, req, "You cannot leave email or password empty")
-			http.Redirect(w, req, "/start/2", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "No email/password provided", nil)
+		var form signupForm
+		fs, valid, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
 		}
-		if !govalidator.IsEmail(email) {
-			a.saveFlash(w, req, "email has to be a valid email address")
-			http.Redirect(w, req, "/start/2", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "incorrect email address", nil)
+		if !valid {
+			a.formError(w, req, fs, "/start/2")
+			return nil
 		}
 
-		// TODO: handle the case where user email already exist
-		user, err := db.CreateQBUser(atlas.QBUser{Email: email, Password: pass, IsSuperAdmin: true})
+		session, err := a.Store.Get(req, sessionName)
 		if err != nil {
-			return server.New500Error("internal server error: something went wrong when creating user", err)
+			return server.New500Error("internal server error: error during getting of session", err)
+		}
+		backend, ok := session.Values[setupBackendKeyName].(string)
+		if !ok {
+			backend = atlas.BackendQuickbooks
+		}
+		user, o, err := db.CreateQBSetupUser(atlas.QBUser{Email: form.Email, Password: form.Password}, atlas.NewQBOnboarding(0, backend))
+		if atlas.IsQBUserExists(err) {
+			// no second account is created; the page offers to sign in or reset the password instead
+			a.saveFlash(w, req, FlashWarning, "An account for "+form.Email+" already exists")
+			a.saveFormState(w, req, FormState{
+				Values: map[string]string{"email": form.Email, "existing_account": "1"},
+				Errors: map[string]string{"email": "An account with this email address already exists"},
+			})
+			http.Redirect(w, req, "/start/2", http.StatusFound)
+			return nil
 		}
-		sess, err := db.CreateAtlasWebSession(user.ID)
 		if err != nil {
-			return server.New500Error("internal server error: error during create web session", err)
+			return server.New500Error("internal server error: something went wrong when creating user", err)
 		}
-
-		session, err := a.Store.Get(req, sessionName)
+		delete(session.Values, setupBackendKeyName)
+		err = a.createLoginSession(w, req, db, user.ID)
 		if err != nil {
-			return server.New500Error("internal server error: error during saving of session", err)
+			return err
 		}
-		session.Values[sessionKeyName] = sess.SessionKey
-		session.Save(req, w)
-		http.Redirect(w, req, "/start/3", http.StatusFound)
+		http.Redirect(w, req, o.Path(), http.StatusFound)
 		return nil
 	}
 }
 
-// WebStart3PageHandler is the handler to display after the user has created a superadmin. In this case we get the user to create an org.
-func (a *App) WebStart3PageHandler(db atlas.QBOrgDB) server.HandlerWithError {
+// WebStart3PageHandler is the handler to display after the user has created their account. In this case we get the user to create an org.
+// Users coming back to this step edit the org they created before.
+func (a *App) WebStart3PageHandler(db atlas.QBSetupDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		u, err := getUser(req)
 		if err != nil {
 			return server.New500Error("error retrieving user from request", err)
 		}
-		_, err = db.IncompleteGetAllQBOrgForUser(u.ID)
+		o, err := getOnboarding(req, db)
 		if err != nil {
-			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return nil
+			return server.New500Error("error retrieving setup progress", err)
+		}
+		form := a.getFormState(w, req)
+		if form.Values == nil && o != nil && o.OrgID != 0 {
+			org, err := db.GetQBOrg(o.OrgID)
+			if err != nil {
+				return server.New500Error("error retrieving org", err)
+			}
+			form.Values = map[string]string{"name": org.Name}
 		}
 
-		lp := &localPresenter{
-			PageTitle:       "Setup Organisation",
-			PageURL:         "/start/3",
-			User:            u,
-			GlobalPresenter: a.Gp,
+		p := struct {
+			PaymentMethodTemplates []atlas.PaymentMethodTemplate
+			DefaultRegion          string
+			*localPresenter
+		}{
+			PaymentMethodTemplates: atlas.PaymentMethodTemplates,
+			DefaultRegion:          atlas.DefaultPaymentMethodRegion,
+			localPresenter: &localPresenter{
+				PageTitle:       "Setup Organisation",
+				PageURL:         "/start/3",
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            form,
+			},
 		}
-		a.Rndr.HTML(w, http.StatusOK, "start3", lp)
+		a.Rndr.HTML(w, http.StatusOK, "start3", p)
 		return nil
 	}
 }
 
-// WebStart3PostHandler is the handler that creates an org and redirects to the shop setup page.
-// TODO add proper flashes and validation warnings
-func (a *App) WebStart3PostHandler(db atlas.QBWebStart3DB) server.HandlerWithError {
+// WebStart3PostHandler is the handler that creates an org, or renames the one created on an earlier visit,
+// and redirects to the Quickbooks connect page. A new org starts with the payment methods of the region
+// picked, which can be changed later on the payment methods page.
+func (a *App) WebStart3PostHandler(db atlas.QBSetupOrgDB) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
-		name := strings.TrimSpace(req.FormValue("name"))
-		if name == "" {
-			http.Redirect(w, req, "/start/3", http.StatusFound)
+		var form orgForm
+		fs, _, err := parseForm(req, &form)
+		if err != nil {
+			return server.New500Error("error parsing form", err)
+		}
+		if form.Region == "" {
+			form.Region = atlas.DefaultPaymentMethodRegion
+		}
+		tmpl, ok := atlas.FindPaymentMethodTemplate(form.Region)
+		if !ok {
+			fs.Errors["region"] = "Please pick the payment methods to start with"
+		}
+		if fs.HasErrors() {
+			a.formError(w, req, fs, "/start/3")
 			return nil
 		}
-		// Setting up org, paymentmethods
-		org := atlas.QBOrg{Name: name}
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return server.New500Error("error retrieving setup progress", err)
+		}
+		if o != nil && o.OrgID != 0 {
+			org, err := db.GetQBOrg(o.OrgID)
+			if err != nil {
+				return server.New500Error("error retrieving org", err)
+			}
+			org.Name = form.Name
+			_, err = db.UpdateQBOrg(*org)
+			if err != nil {
+				return server.New500Error("error while saving organisation", err)
+			}
+			http.Redirect(w, req, o.Path(), http.StatusFound)
+			return nil
+		}
+
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("cannot get user from context", err)
+		}
+
+		// Setting up org, its admin, and the payment methods of the picked region
+		org := atlas.QBOrg{Name: form.Name}
 		newOrg, err := db.CreateQBOrg(org)
 		if err != nil {
 			return server.New500Error("error while creating organisation", err)
 		}
-		paymentMethods := []*atlas.QBPaymentMethod{
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Cash (SGD)",
-				DisplayName: "Cash (SGD)",
-				Code:        "cash",
-				Type:        "NON_CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Cash Card",
-				DisplayName: "Cash Card",
-				Code:        "ccard",
-				Type:        "NON_CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Credit Card (SGD)",
-				DisplayName: "Credit Card (SGD)",
-				Code:        "crc",
-				Type:        "CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "EZ Link",
-				DisplayName: "EZ Link",
-				Code:        "ezlin",
-				Type:        "NON_CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Nets",
-				DisplayName: "Nets",
-				Code:        "nets",
-				Type:        "NON_CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Voucher",
-				DisplayName: "Voucher",
-				Code:        "vcher",
-				Type:        "NON_CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Visa",
-				DisplayName: "Visa",
-				Code:        "visa",
-				Type:        "CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Master",
-				DisplayName: "Master",
-				Code:        "master",
-				Type:        "CREDIT_CARD",
-			},
-			&atlas.QBPaymentMethod{
-				OrgID:       newOrg.ID,
-				Name:        "Amex",
-				DisplayName: "American Express",
-				Code:        "amex",
-				Type:        "CREDIT_CARD",
-			},
+		_, err = db.CreateQBUserRole(atlas.QBUserRole{UserID: u.ID, OrgID: newOrg.ID, Role: atlas.RoleOrgAdmin})
+		if err != nil {
+			return server.New500Error("error while granting organisation admin", err)
 		}
-		for _, pm := range paymentMethods {
-			_, err = db.CreateQBPaymentMethod(*pm)
+		for _, pm := range tmpl.ForOrg(newOrg.ID) {
+			_, err = db.CreateQBPaymentMethod(pm)
 			if err != nil {
 				return server.New500Error("error while creating payment methods for organisation", err)
 			}
 		}
 
+		err = advanceOnboarding(req, db, atlas.OnboardingConnect, func(o *atlas.QBOnboarding) {
+			o.OrgID = newOrg.ID
+		})
+		if err != nil {
+			return server.New500Error("error saving setup progress", err)
+		}
 		http.Redirect(w, req, "/start/4", http.StatusFound)
 		return nil
 	}
@@ -233,6 +275,7 @@ func (a *App) WebStart4PageHandler(db atlas.QBOrgDB) server.HandlerWithError {
 				PageTitle:       "Connect to Quickbooks",
 				PageURL:         "/start/4",
 				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
 				User:            u,
 			},
 		}
@@ -241,32 +284,101 @@ func (a *App) WebStart4PageHandler(db atlas.QBOrgDB) server.HandlerWithError {
 	}
 }
 
-// QuickbooksCallback is the callback endpoint for Quickbooks after the auth dance.
-func (a *App) QuickbooksCallback(db atlas.QBOrgDB) server.HandlerWithError {
+// QuickbooksConnectHandler starts the oauth2 authorization-code flow for the org selected on the connect page.
+func (a *App) QuickbooksConnectHandler(db atlas.QBOrgDB, conf *oauth2.Config) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("cannot get user from context", err)
+		}
+		orgID, err := strconv.Atoi(req.FormValue("orgid"))
+		if err != nil {
+			http.Redirect(w, req, "/start/4", http.StatusFound)
+			return server.NewError(http.StatusBadRequest, "error converting orgID from request", err)
+		}
+
+		// only allow connecting orgs that belong to the user
+		org, err := userOrg(db, u.ID, orgID)
+		if err != nil {
+			return server.New500Error("error retrieving orgs for user", err)
+		}
+		if org == nil {
+			return server.NewError(http.StatusForbidden, "you cannot connect this organisation", fmt.Errorf("user %d does not own org %d", u.ID, orgID))
+		}
+		return a.redirectToQuickbooks(w, req, conf, orgID)
+	}
+}
+
+// QuickbooksReconnectHandler starts the oauth2 authorization-code flow again for the org named by the "orgid"
+// URL param, once the setup is done, such as when the token refresher flagged the org with QBNeedsReconnect.
+func (a *App) QuickbooksReconnectHandler(conf *oauth2.Config) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		orgID, _ := requestScope(req)
+		if orgID == 0 {
+			return server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for quickbooks reconnect"))
+		}
+		return a.redirectToQuickbooks(w, req, conf, orgID)
+	}
+}
+
+// redirectToQuickbooks sends the user to Intuit to authorise the connection of the org, keeping the state of
+// the flow for QuickbooksCallback in the temporary session.
+func (a *App) redirectToQuickbooks(w http.ResponseWriter, req *http.Request, conf *oauth2.Config, orgID int) error {
+	state, err := newRandomToken()
+	if err != nil {
+		return server.New500Error("error generating oauth state", err)
+	}
+	sess, err := a.Store.Get(req, tempCredName)
+	if err != nil {
+		return server.New500Error("error grabbing temp credentials", err)
+	}
+	sess.Values[oauthStateKey] = state
+	sess.Values[tempOrgIDKey] = orgID
+	err = sess.Save(req, w)
+	if err != nil {
+		return server.New500Error("error saving temp credentials", err)
+	}
+
+	http.Redirect(w, req, conf.AuthCodeURL(state), http.StatusFound)
+	return nil
+}
+
+// QuickbooksCallback is the callback endpoint for Quickbooks after the auth dance. Once connected, the payment
+// methods of the org are synced with the Quickbooks company; a failed sync does not fail the connection. Only a
+// setup waiting on the connect step moves on to the accounts step; a reconnect lands on the payment methods of
+// the org, where the outcome of the sync is shown.
+func (a *App) QuickbooksCallback(db atlas.QBSetupConnectDB, conf *oauth2.Config, qb QBClientSource) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		sess, err := a.Store.Get(req, tempCredName)
 		if err != nil {
 			return server.New500Error("error grabbing temp credentials", err)
 		}
-		var tempCred = &oauth.Credentials{}
-		tempCred, ok := sess.Values[tempCredKey].(*oauth.Credentials)
-		if !ok {
-			return server.New500Error("error casting oauth.Credentials", err)
+		state, ok := sess.Values[oauthStateKey].(string)
+		if !ok || state == "" {
+			return server.NewError(http.StatusBadRequest, "no connection to Quickbooks in progress", fmt.Errorf("missing oauth state in session"))
 		}
-
-		if tempCred.Token != req.FormValue("oauth_token") {
-			return server.New500Error("unknown oauth_token", fmt.Errorf("unknown oauth_token in request"))
+		if subtle.ConstantTimeCompare([]byte(state), []byte(req.FormValue("state"))) != 1 {
+			return server.NewError(http.StatusBadRequest, "unknown oauth state", fmt.Errorf("unknown oauth state in request"))
+		}
+		if e := req.FormValue("error"); e != "" {
+			return server.NewError(http.StatusBadRequest, "Quickbooks did not authorise the connection", fmt.Errorf("oauth error: %s", e))
 		}
-		tokenCred, _, err := a.oauthClient.RequestToken(nil, tempCred, req.FormValue("oauth_verifier"))
+		code, realmID := req.FormValue("code"), req.FormValue("realmId")
+		if code == "" || realmID == "" {
+			return server.NewError(http.StatusBadRequest, "code or realmId cannot be empty", fmt.Errorf("bad callback from Quickbooks: code or realmId is empty"))
+		}
+
+		tok, err := conf.Exchange(req.Context(), code)
 		if err != nil {
-			return server.New500Error("error getting request token", err)
+			return server.New500Error("error exchanging authorization code", err)
 		}
 		val := sess.Values[tempOrgIDKey]
 		orgID, ok := val.(int)
 		if !ok {
 			return server.New500Error("unable to type cast orgID from session", fmt.Errorf("failure to typecast orgID in request session"))
 		}
-		delete(sess.Values, tempCredKey)
+		delete(sess.Values, oauthStateKey)
+		delete(sess.Values, tempOrgIDKey)
 		sess.Save(req, w)
 
 		org, err := db.GetQBOrg(orgID)
@@ -274,21 +386,37 @@ func (a *App) QuickbooksCallback(db atlas.QBOrgDB) server.HandlerWithError {
 			return server.New500Error("unable to retrieve org", err)
 		}
 
-		org.QBCompanyID = req.FormValue("realmId")
-		org.QBCredSecret = tokenCred.Secret
-		org.QBCredToken = tokenCred.Token
+		org.QBCompanyID = realmID
+		setQBOrgToken(org, tok)
 		_, err = db.UpdateQBOrg(*org)
 		if err != nil {
 			return server.New500Error("error saving org", err)
 		}
+		a.syncQBPaymentMethodsWithFlash(w, req, db, qb, org)
 
-		http.Redirect(w, req, "/start/5", http.StatusFound)
+		// a reconnect from the admin pages goes back to the org instead of into the setup
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return server.New500Error("error retrieving setup progress", err)
+		}
+		if o == nil || o.Step != atlas.OnboardingConnect {
+			http.Redirect(w, req, fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", org.ID), http.StatusFound)
+			return nil
+		}
+		err = advanceOnboarding(req, db, atlas.OnboardingAccounts, nil)
+		if err != nil {
+			return server.New500Error("error saving setup progress", err)
+		}
+
+		http.Redirect(w, req, qbAccountsSetupPath, http.StatusFound)
 		return nil
 	}
 }
 
-// WebStart5PageHandler is the handler to display orgs, for creating a shop each.
-func (a *App) WebStart5PageHandler(db atlas.QBOrgShopDB) server.HandlerWithError {
+// WebStart5PageHandler is the handler to display orgs, for creating a shop each. The departments of the
+// Quickbooks company of the org being set up that no shop is mapped to yet are offered as shops too.
+// OnboardingMiddleware makes sure the user has created and connected an org before getting here.
+func (a *App) WebStart5PageHandler(db atlas.QBSetupDepartmentDB, qb QBClientSource) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
 		u, err := getUser(req)
 		if err != nil {
@@ -298,72 +426,94 @@ func (a *App) WebStart5PageHandler(db atlas.QBOrgShopDB) server.HandlerWithError
 		if err != nil {
 			return server.New500Error("error retrieving orgs", err)
 		}
-
-		if len(orgs) == 0 {
-			http.Redirect(w, req, "/start/3", http.StatusFound)
-			return nil
+		o, err := getOnboarding(req, db)
+		if err != nil {
+			return server.New500Error("error retrieving setup progress", err)
 		}
 
-		// if any shops exist for any of the orgs, we get out of the setup flow
-		for _, o := range orgs {
-			shops, err := db.GetAllShopsForOrg(o.ID)
+		var departmentOrg *atlas.QBOrg
+		var departments []atlas.QBRemoteDepartment
+		if o != nil && o.OrgID != 0 {
+			departmentOrg, err = db.GetQBOrg(o.OrgID)
 			if err != nil {
-				a.Logr.Log("error retrieving shops for org ", o.Name, err)
-				continue
+				return server.New500Error("error retrieving org", err)
 			}
-			if len(shops) > 0 {
-				http.Redirect(w, req, "/w", http.StatusFound)
-				return nil
+			departments, err = a.availableQBDepartments(req, db, qb, departmentOrg)
+			if err != nil {
+				// the shop can still be named by hand
+				a.Logr.Log("error listing quickbooks departments of org %d (%s): %s", departmentOrg.ID, departmentOrg.Name, err)
 			}
 		}
 
 		p := struct {
-			Orgs []*atlas.QBOrg
+			Orgs          []*atlas.QBOrg
+			DepartmentOrg *atlas.QBOrg
+			Departments   []atlas.QBRemoteDepartment
 			*localPresenter
 		}{
-			Orgs: orgs,
+			Orgs:          orgs,
+			DepartmentOrg: departmentOrg,
+			Departments:   departments,
 			localPresenter: &localPresenter{
 				PageTitle:       "Setup Shop",
 				PageURL:         "/start/4",
 				User:            u,
 				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+				Form:            a.getFormState(w, req),
 			}}
 		a.Rndr.HTML(w, http.StatusOK, "start5", p)
 		return nil
 	}
 }
 
-// WebStart5PostHandler is the handler for creating a shop. It then redirects to the home page.
-func (a *App) WebStart5PostHandler(db atlas.QBOrgShopSessionDB) server.HandlerWithError {
+// WebStart5PostHandler is the handler for creating shops. Either a shop is created from the name typed in, in
+// an org of the user, or one shop is created for each Quickbooks department picked in the "department" form
+// values, mapped to it one-to-one, in the org being set up. It completes the onboarding and redirects to the
+// home page.
+func (a *App) WebStart5PostHandler(db atlas.QBSetupDepartmentDB, qb QBClientSource) server.HandlerWithError {
 	return func(w http.ResponseWriter, req *http.Request) error {
-		name, orgIDString := strings.TrimSpace(req.FormValue("name")), req.FormValue("orgid")
-		if name == "" || orgIDString == "" {
-			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "name or org id cannot be empty", fmt.Errorf("bad input for creating shop: either orgID or name is empty"))
-		}
-
-		orgID, err := strconv.Atoi(orgIDString)
-		if err != nil {
-			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return server.NewError(http.StatusBadRequest, "error converting orgID from request", err)
-		}
-
-		org, err := db.GetQBOrg(orgID)
+		u, err := getUser(req)
 		if err != nil {
 			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return server.New500Error("error retrieving org", err)
+			return server.New500Error("error getting user from request", err)
 		}
-
-		shop, err := db.CreateQBShop(atlas.QBShop{Name: name, OrgID: orgID})
+		err = req.ParseForm()
 		if err != nil {
-			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return server.New500Error("error saving shop", err)
-		}
+			return server.NewError(http.StatusBadRequest, "error parsing form", err)
+		}
+		var org *atlas.QBOrg
+		var shop *atlas.QBShop
+		if len(req.Form["department"]) > 0 {
+			org, shop, err = a.createDepartmentShops(w, req, db, qb)
+			if err != nil || shop == nil {
+				return err
+			}
+		} else {
+			var form shopForm
+			fs, valid, err := parseForm(req, &form)
+			if err != nil {
+				return server.New500Error("error parsing form", err)
+			}
+			if !valid {
+				a.formError(w, req, fs, "/start/5")
+				return nil
+			}
+			org, err = userOrg(db, u.ID, form.OrgID)
+			if err != nil {
+				http.Redirect(w, req, "/start/4", http.StatusFound)
+				return server.New500Error("error retrieving orgs for user", err)
+			}
+			if org == nil {
+				return server.NewError(http.StatusForbidden, "you cannot add shops to this organisation", fmt.Errorf("user %d does not own org %d", u.ID, form.OrgID))
+			}
 
-		u, err := getUser(req)
-		if err != nil {
-			http.Redirect(w, req, "/start/4", http.StatusFound)
-			return server.New500Error("error getting user from request", err)
+			shop, err = db.CreateQBShop(atlas.QBShop{Name: form.Name, OrgID: org.ID})
+			if err != nil {
+				http.Redirect(w, req, "/start/4", http.StatusFound)
+				return server.New500Error("error saving shop", err)
+			}
 		}
 
 		_, err = db.CreateAtlasSession(atlas.AtlasSession{
@@ -379,8 +529,112 @@ func (a *App) WebStart5PostHandler(db atlas.QBOrgShopSessionDB) server.HandlerWi
 			http.Redirect(w, req, "/start/4", http.StatusFound)
 			return server.New500Error("error creating new atlas session", err)
 		}
+		err = advanceOnboarding(req, db, atlas.OnboardingComplete, func(o *atlas.QBOnboarding) {
+			o.Complete(time.Now())
+		})
+		if err != nil {
+			return server.New500Error("error saving setup progress", err)
+		}
 
 		http.Redirect(w, req, "/w", http.StatusFound)
 		return nil
 	}
 }
+
+// createDepartmentShops creates a shop for each picked Quickbooks department of the org being set up, and
+// returns the org and the first shop. The org is never taken from the form, which the user controls. It
+// returns a nil shop after sending the user back to the form.
+func (a *App) createDepartmentShops(w http.ResponseWriter, req *http.Request, db atlas.QBSetupDepartmentDB, qb QBClientSource) (*atlas.QBOrg, *atlas.QBShop, error) {
+	fs := FormState{Values: map[string]string{}, Errors: map[string]string{}}
+	o, err := getOnboarding(req, db)
+	if err != nil {
+		return nil, nil, server.New500Error("error retrieving setup progress", err)
+	}
+	if o == nil || o.OrgID == 0 {
+		http.Redirect(w, req, "/start/4", http.StatusFound)
+		return nil, nil, nil
+	}
+	org, err := db.GetQBOrg(o.OrgID)
+	if err != nil {
+		return nil, nil, server.New500Error("error retrieving org", err)
+	}
+	available, err := a.availableQBDepartments(req, db, qb, org)
+	if err != nil {
+		a.Logr.Log("error listing quickbooks departments of org %d (%s): %s", org.ID, org.Name, err)
+		a.saveFlash(w, req, FlashError, "Could not list your Quickbooks departments, please try again")
+		http.Redirect(w, req, "/start/5", http.StatusFound)
+		return nil, nil, nil
+	}
+
+	picked := map[int]bool{}
+	for _, v := range req.Form["department"] {
+		if id, err := strconv.Atoi(v); err == nil {
+			picked[id] = true
+		}
+	}
+	var first *atlas.QBShop
+	for _, d := range available {
+		if !picked[d.QBID] {
+			continue
+		}
+		shop, err := db.CreateQBShop(atlas.QBShop{Name: d.Name, OrgID: org.ID, QBDepartmentID: d.QBID})
+		if err != nil {
+			return nil, nil, server.New500Error("error saving shop", err)
+		}
+		if first == nil {
+			first = shop
+		}
+	}
+	if first == nil {
+		fs.Errors["department"] = "Please pick at least one department"
+		a.formError(w, req, fs, "/start/5")
+		return nil, nil, nil
+	}
+	return org, first, nil
+}
+
+// userOrgsDB is the part of the setup databases listing the orgs of a user.
+type userOrgsDB interface {
+	IncompleteGetAllQBOrgForUser(userID int) ([]*atlas.QBOrg, error)
+}
+
+// userOrg returns the org of the user with the given ID, or nil if the user has no such org.
+func userOrg(db userOrgsDB, userID int, orgID int) (*atlas.QBOrg, error) {
+	orgs, err := db.IncompleteGetAllQBOrgForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range orgs {
+		if o.ID == orgID {
+			return o, nil
+		}
+	}
+	return nil, nil
+}
+
+// availableQBDepartments returns the active departments of the Quickbooks company of org that no shop of the
+// org is mapped to yet.
+func (a *App) availableQBDepartments(req *http.Request, db atlas.QBShopDepartmentDB, qb QBClientSource, org *atlas.QBOrg) ([]atlas.QBRemoteDepartment, error) {
+	if org.QBCompanyID == "" || org.QBNeedsReconnect {
+		return nil, nil
+	}
+	departments, err := qb(req.Context(), org).Departments()
+	if err != nil {
+		return nil, err
+	}
+	shops, err := db.GetAllQBShopsForOrg(org.ID)
+	if err != nil {
+		return nil, err
+	}
+	mapped := map[int]bool{}
+	for _, s := range shops {
+		mapped[s.QBDepartmentID] = true
+	}
+	var available []atlas.QBRemoteDepartment
+	for _, d := range departments {
+		if d.Active && !mapped[d.QBID] {
+			available = append(available, d)
+		}
+	}
+	return available, nil
+}
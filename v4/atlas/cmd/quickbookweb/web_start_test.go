@@ -0,0 +1,259 @@
+package main_test
+
+import (
+	"atlas"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/oauth2"
+)
+
+type MockQBOrgDB struct {
+	MockQBOnboardingDB
+	MockQBPaymentMethodDB
+	hasError   bool
+	org        *atlas.QBOrg
+	updatedOrg *atlas.QBOrg
+	granted    []atlas.QBUserRole
+}
+
+func (db *MockQBOrgDB) CreateQBUserRole(r atlas.QBUserRole) (*atlas.QBUserRole, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	r.ID = len(db.granted) + 1
+	db.granted = append(db.granted, r)
+	return &r, nil
+}
+
+func (db *MockQBOrgDB) CreateQBOrg(o atlas.QBOrg) (*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	o.ID = org1.ID
+	return &o, nil
+}
+
+func (db *MockQBOrgDB) GetQBOrg(orgID int) (*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	o := org1
+	if db.org != nil {
+		o = *db.org
+	}
+	return &o, nil
+}
+
+func (db *MockQBOrgDB) UpdateQBOrg(o atlas.QBOrg) (*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	db.updatedOrg = &o
+	return &o, nil
+}
+
+func (db *MockQBOrgDB) IncompleteGetAllQBOrgForUser(userID int) ([]*atlas.QBOrg, error) {
+	if db.hasError {
+		return nil, fmt.Errorf("some error")
+	}
+	o := org1
+	return []*atlas.QBOrg{&o}, nil
+}
+
+// newMockIntuitTokenServer stands in for the Intuit token endpoint.
+func newMockIntuitTokenServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ok(t, req.ParseForm())
+		if req.FormValue("code") != "good-code" && req.FormValue("refresh_token") != "good-refresh" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"new-access","refresh_token":"new-refresh","token_type":"bearer","expires_in":3600,"x_refresh_token_expires_in":8726400}`)
+	}))
+}
+
+func newTestOAuth2Config(tokenURL string) *oauth2.Config {
+	conf := main.NewQuickbooksOAuth2Config("client-id", "client-secret", "http://localhost/quickbooks/callback")
+	conf.Endpoint.TokenURL = tokenURL
+	return conf
+}
+
+// connectToQuickbooks runs the connect handler and returns the session cookie and oauth state it issued.
+func connectToQuickbooks(t *testing.T, conf *oauth2.Config) (string, string) {
+	test := GenerateHandleTester(t, app.Wrap(app.QuickbooksConnectHandler(&MockQBOrgDB{}, conf)), true)
+	w := test("POST", url.Values{"orgid": {"1"}})
+	assert(t, w.Code == http.StatusFound, "expected connect to redirect 302 instead got %d", w.Code)
+	loc, err := url.Parse(w.HeaderMap.Get("Location"))
+	ok(t, err)
+	state := loc.Query().Get("state")
+	assert(t, state != "", "expected state parameter on authorization url %s", loc)
+	return w.HeaderMap.Get("Set-Cookie"), state
+}
+
+func TestQuickbooksConnectHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	conf := newTestOAuth2Config("http://localhost/token")
+
+	_, state := connectToQuickbooks(t, conf)
+	_, other := connectToQuickbooks(t, conf)
+	assert(t, state != other, "expected a fresh state for every connection attempt")
+
+	// org not owned by the user
+	test := GenerateHandleTester(t, app.Wrap(app.QuickbooksConnectHandler(&MockQBOrgDB{}, conf)), true)
+	w := test("POST", url.Values{"orgid": {"42"}})
+	equals(t, http.StatusForbidden, w.Code)
+}
+
+func TestQuickbooksCallback(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	ts := newMockIntuitTokenServer(t)
+	defer ts.Close()
+	conf := newTestOAuth2Config(ts.URL)
+	api := newMockQBAPI("1234")
+	api.add("PaymentMethod", map[string]interface{}{"Name": "Cash (SGD)", "Type": "NON_CREDIT_CARD", "Active": true})
+	apiServer := httptest.NewServer(api)
+	defer apiServer.Close()
+	qb := newTestQBClientSource(apiServer)
+
+	cookie, state := connectToQuickbooks(t, conf)
+	mockDB := &MockQBOrgDB{}
+	mockDB.onboardings = map[int]*atlas.QBOnboarding{
+		user1.ID: {UserID: user1.ID, Backend: atlas.BackendQuickbooks, Step: atlas.OnboardingConnect, OrgID: org1.ID},
+	}
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.QuickbooksCallback(mockDB, conf, qb)), true, nil,
+		map[string]string{"Cookie": cookie},
+		map[string]string{"state": state, "code": "good-code", "realmId": "1234"})
+	w := test("GET", url.Values{})
+	assert(t, w.Code == http.StatusFound, "expected successful callback to redirect 302 instead got %d", w.Code)
+	equals(t, "/start/accounts", w.HeaderMap.Get("Location"))
+	equals(t, atlas.OnboardingAccounts, mockDB.onboardings[user1.ID].Step)
+	assert(t, mockDB.updatedOrg != nil, "expected org to be saved")
+	equals(t, "1234", mockDB.updatedOrg.QBCompanyID)
+	equals(t, "new-access", mockDB.updatedOrg.QBAccessToken)
+	equals(t, "new-refresh", mockDB.updatedOrg.QBRefreshToken)
+	assert(t, mockDB.updatedOrg.QBTokenExpiry.After(time.Now()), "expected token expiry to be set")
+	assert(t, !mockDB.updatedOrg.QBRefreshTokenExpiry.IsZero(), "expected refresh token expiry to be set")
+	// the payment methods of Quickbooks are synced once connected
+	equals(t, 1, len(mockDB.syncs))
+	equals(t, 1, len(mockDB.methods))
+
+	// reconnecting an org once the setup is done goes back to the org
+	mockDB.onboardings[user1.ID].Complete(time.Now())
+	reconnect := GenerateHandleTesterWithURLParams(t, app.Wrap(app.QuickbooksReconnectHandler(conf)), true,
+		httprouter.Params{httprouter.Param{Key: "orgid", Value: strconv.Itoa(org1.ID)}})
+	w = reconnect("POST", url.Values{})
+	assert(t, w.Code == http.StatusFound, "expected reconnect to redirect 302 instead got %d", w.Code)
+	loc, err := url.Parse(w.HeaderMap.Get("Location"))
+	ok(t, err)
+	cookie, state = w.HeaderMap.Get("Set-Cookie"), loc.Query().Get("state")
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.QuickbooksCallback(mockDB, conf, qb)), true, nil,
+		map[string]string{"Cookie": cookie},
+		map[string]string{"state": state, "code": "good-code", "realmId": "1234"})
+	w = test("GET", url.Values{})
+	equals(t, fmt.Sprintf("/orgs/%d/quickbooks/payment-methods", org1.ID), w.HeaderMap.Get("Location"))
+	assert(t, mockDB.onboardings[user1.ID].IsComplete(), "expected the setup to stay complete")
+
+	// wrong state
+	cookie, _ = connectToQuickbooks(t, conf)
+	mockDB = &MockQBOrgDB{}
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.QuickbooksCallback(mockDB, conf, qb)), false, nil,
+		map[string]string{"Cookie": cookie},
+		map[string]string{"state": "forged", "code": "good-code", "realmId": "1234"})
+	w = test("GET", url.Values{})
+	equals(t, http.StatusBadRequest, w.Code)
+	assert(t, mockDB.updatedOrg == nil, "expected org not to be saved on forged state")
+
+	// code rejected by Intuit
+	cookie, state = connectToQuickbooks(t, conf)
+	mockDB = &MockQBOrgDB{}
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.QuickbooksCallback(mockDB, conf, qb)), false, nil,
+		map[string]string{"Cookie": cookie},
+		map[string]string{"state": state, "code": "bad-code", "realmId": "1234"})
+	w = test("GET", url.Values{})
+	equals(t, http.StatusInternalServerError, w.Code)
+	assert(t, mockDB.updatedOrg == nil, "expected org not to be saved when exchange fails")
+}
+
+func (db *MockQBUserDB) CreateQBSetupUser(u atlas.QBUser, o atlas.QBOnboarding) (*atlas.QBUser, *atlas.QBOnboarding, error) {
+	if db.hasError {
+		return nil, nil, fmt.Errorf("some error")
+	}
+	for _, existing := range []*atlas.QBUser{user1, user2, user3, user4} {
+		if strings.EqualFold(existing.Email, u.Email) {
+			return nil, nil, &atlas.QBUserExistsError{Email: u.Email}
+		}
+	}
+	db.setupUser = &u
+	o.UserID = user1.ID
+	saved, err := db.SaveQBOnboarding(o)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user1, saved, nil
+}
+
+func TestWebStart2PostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBUserDB{}
+	test := GenerateHandleTester(t, app.Wrap(app.WebStart2PostHandler(mockDB)), false)
+
+	w := test("POST", url.Values{"email": {"notanemail"}, "password": {"hunter2"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/start/2", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.sessionUserIDs))
+
+	// the form comes back with the errors and the email, but not the password
+	page := GenerateHandleTesterWithHeaders(t, app.Wrap(app.WebStart2PageHandler()), false, nil, map[string]string{"Cookie": lastCookie(w)}, nil)
+	w = page("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert(t, strings.Contains(body, "alert-danger"), "expected an error flash")
+	assert(t, strings.Contains(body, "Email has to be a valid email address"), "expected the email error to be shown")
+	assert(t, strings.Contains(body, "Password has to be at least 8 characters long"), "expected the password error to be shown")
+	assert(t, strings.Contains(body, `value="notanemail"`), "expected the email to be filled in again")
+	assert(t, !strings.Contains(body, "hunter2"), "expected the password not to be sent back")
+
+	// lengths count characters rather than bytes
+	w = test("POST", url.Values{"email": {"boss@floatingcube.com"}, "password": {"äöüßäöü"}})
+	equals(t, "/start/2", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.sessionUserIDs))
+
+	// an existing account is offered to sign in or reset the password instead
+	w = test("POST", url.Values{"email": {strings.ToUpper(user2.Email)}, "password": {"longenough"}})
+	equals(t, "/start/2", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.sessionUserIDs))
+	equals(t, 0, len(mockDB.onboardings))
+	page = GenerateHandleTesterWithHeaders(t, app.Wrap(app.WebStart2PageHandler()), false, nil, map[string]string{"Cookie": lastCookie(w)}, nil)
+	w = page("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	body = w.Body.String()
+	assert(t, strings.Contains(body, "An account with this email address already exists"), "expected the email error to be shown")
+	assert(t, strings.Contains(body, `href="/login"`) && strings.Contains(body, `href="/password/reset"`), "expected links to sign in and reset the password")
+
+	// a failing database creates nothing
+	mockDB.hasError = true
+	w = test("POST", url.Values{"email": {"boss@floatingcube.com"}, "password": {"longenough"}})
+	equals(t, http.StatusInternalServerError, w.Code)
+	equals(t, 0, len(mockDB.onboardings))
+	mockDB.hasError = false
+
+	w = test("POST", url.Values{"email": {"boss@floatingcube.com"}, "password": {"longenough"}})
+	equals(t, "/start/3", w.HeaderMap.Get("Location"))
+	equals(t, []int{user1.ID}, mockDB.sessionUserIDs)
+	equals(t, atlas.OnboardingOrg, mockDB.onboardings[user1.ID].Step)
+	// the org admin role comes with the org, at the next step
+	assert(t, !mockDB.setupUser.IsSuperAdmin, "expected a plain user to be created")
+}
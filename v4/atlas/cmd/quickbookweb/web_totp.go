@@ -0,0 +1,517 @@
+package main
+
+import (
+	"atlas"
+	"atlas/cmd/server"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	pendingUserKeyName    = "pending_user_id"
+	pendingAtKeyName      = "pending_at"
+	totpSecretKeyName     = "totp_secret"
+	totpSecretUserKeyName = "totp_secret_user_id"
+
+	// pendingLoginTTL is how long a user has to enter their code after entering a correct password.
+	pendingLoginTTL = 5 * time.Minute
+	// totpPeriod and totpSkew are the step length in seconds and the steps allowed on either side of now,
+	// as in totp.Validate.
+	totpPeriod = 30
+	totpSkew   = 1
+	// recoveryCodeCount is the number of recovery codes given out on enrolment.
+	recoveryCodeCount = 10
+
+	totpIssuer = "Atlas"
+)
+
+// needsSecondFactor reports whether the user has to pass the TOTP step to log in, either because they
+// enrolled or because one of their orgs makes it mandatory for admins.
+func needsSecondFactor(db atlas.QBUserTOTPDB, userID int) (bool, error) {
+	t, err := db.GetQBUserTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	if t != nil {
+		return true, nil
+	}
+	return db.IsTOTPRequiredForUser(userID)
+}
+
+// startPendingLogin remembers a user who entered a correct password but still has to pass the TOTP step.
+func (a *App) startPendingLogin(w http.ResponseWriter, req *http.Request, userID int) error {
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return err
+	}
+	clearTOTPSecret(session.Values)
+	session.Values[pendingUserKeyName] = userID
+	session.Values[pendingAtKeyName] = time.Now().Unix()
+	return session.Save(req, w)
+}
+
+// clearPendingLogin forgets the pending login.
+func (a *App) clearPendingLogin(w http.ResponseWriter, req *http.Request) {
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return
+	}
+	delete(session.Values, pendingUserKeyName)
+	delete(session.Values, pendingAtKeyName)
+	session.Save(req, w)
+}
+
+// getPendingLoginUser returns the user of a pending login that has not expired.
+func (a *App) getPendingLoginUser(req *http.Request, db atlas.QBUserDB) (*atlas.QBUser, error) {
+	session, err := a.Store.Get(req, sessionName)
+	if err != nil {
+		return nil, err
+	}
+	userID, ok := session.Values[pendingUserKeyName].(int)
+	if !ok {
+		return nil, ErrNotLoggedIn
+	}
+	at, ok := session.Values[pendingAtKeyName].(int64)
+	if !ok || time.Since(time.Unix(at, 0)) > pendingLoginTTL {
+		return nil, ErrNotLoggedIn
+	}
+	return db.GetQBUserByID(userID)
+}
+
+// TOTPLoginPageHandler displays the form asking for the TOTP code after a correct password.
+func (a *App) TOTPLoginPageHandler(db atlas.QBLoginDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := a.getPendingLoginUser(req, db)
+		if err != nil {
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return nil
+		}
+		t, err := db.GetQBUserTOTP(u.ID)
+		if err != nil {
+			return server.New500Error("error retrieving second factor", err)
+		}
+		// enrolment is mandatory for this user but they have not done it yet
+		if t == nil {
+			http.Redirect(w, req, "/login/2fa/setup", http.StatusFound)
+			return nil
+		}
+
+		p := &localPresenter{
+			PageTitle:       "Two-factor authentication",
+			PageURL:         "/login/2fa",
+			GlobalPresenter: a.Gp,
+			CSRFToken:       CSRFToken(req),
+			Flashes:         a.getFlashes(w, req),
+		}
+		a.Rndr.HTML(w, http.StatusOK, "login_2fa", p)
+		return nil
+	}
+}
+
+// TOTPLoginPostHandler checks the TOTP or recovery code and logs the user in. Wrong codes are counted by the
+// guard for the user, so that logging in again with the password does not give more tries.
+func (a *App) TOTPLoginPostHandler(db atlas.QBLoginDB, guard *LoginGuard) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := a.getPendingLoginUser(req, db)
+		if err != nil {
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return nil
+		}
+		wait, err := guard.TOTPWait(u.ID, time.Now())
+		if err != nil {
+			return server.New500Error("internal server error: unable to check totp attempts", err)
+		}
+		if wait > 0 {
+			a.Logr.Log("too many totp attempts for user %d", u.ID)
+			a.clearPendingLogin(w, req)
+			a.saveFlash(w, req, FlashError, fmt.Sprintf("Too many wrong codes, please try again in %s", wait.Round(time.Second)))
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return nil
+		}
+
+		t, err := db.GetQBUserTOTP(u.ID)
+		if err != nil || t == nil {
+			return server.New500Error("error retrieving second factor", err)
+		}
+		code := strings.TrimSpace(req.FormValue("code"))
+		if step, valid := validateTOTPCode(code, t.Secret, t.LastUsedStep, time.Now()); valid {
+			t.LastUsedStep = step
+		} else if !useRecoveryCode(t, code) {
+			if ferr := guard.FailTOTP(u.ID, remoteIP(req), time.Now()); ferr != nil {
+				a.Logr.Log("error recording wrong totp code for user %d: %s", u.ID, ferr)
+			}
+			a.saveFlash(w, req, FlashError, "The code is incorrect")
+			http.Redirect(w, req, "/login/2fa", http.StatusFound)
+			return nil
+		}
+		err = db.SaveQBUserTOTP(*t)
+		if err != nil {
+			return server.New500Error("error saving second factor", err)
+		}
+		if err = guard.SucceedTOTP(u.ID); err != nil {
+			a.Logr.Log("error clearing wrong totp codes for user %d: %s", u.ID, err)
+		}
+
+		a.clearPendingLogin(w, req)
+		err = a.createLoginSession(w, req, db, u.ID)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, req, "/w", http.StatusFound)
+		return nil
+	}
+}
+
+// TOTPSetupPageHandler displays the QR code for enrolling an authenticator app. It serves both logged-in users
+// and users whose login is pending because their org makes enrolment mandatory.
+func (a *App) TOTPSetupPageHandler(db atlas.QBLoginDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, pending, err := a.getTOTPSetupUser(req, db)
+		if err != nil {
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return nil
+		}
+		t, err := db.GetQBUserTOTP(u.ID)
+		if err != nil {
+			return server.New500Error("error retrieving second factor", err)
+		}
+		required, err := db.IsTOTPRequiredForUser(u.ID)
+		if err != nil {
+			return server.New500Error("error checking second factor", err)
+		}
+
+		p := struct {
+			Enrolled bool
+			Required bool
+			Pending  bool
+			Secret   string
+			QRCode   template.URL
+			*localPresenter
+		}{
+			Enrolled: t != nil,
+			Required: required,
+			Pending:  pending,
+			localPresenter: &localPresenter{
+				PageTitle:       "Two-factor authentication",
+				PageURL:         req.URL.Path,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+			},
+		}
+		if !pending {
+			p.User = u
+		}
+
+		if t == nil {
+			key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: u.Email})
+			if err != nil {
+				return server.New500Error("error generating totp secret", err)
+			}
+			img, err := key.Image(200, 200)
+			if err != nil {
+				return server.New500Error("error generating qr code", err)
+			}
+			var buf bytes.Buffer
+			err = png.Encode(&buf, img)
+			if err != nil {
+				return server.New500Error("error generating qr code", err)
+			}
+
+			session, err := a.Store.Get(req, sessionName)
+			if err != nil {
+				return server.New500Error("internal server error: error during getting of session", err)
+			}
+			saveTOTPSecret(session.Values, u.ID, key.Secret())
+			session.Save(req, w)
+
+			p.Secret = key.Secret()
+			p.QRCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+		}
+		a.Rndr.HTML(w, http.StatusOK, "totp_setup", p)
+		return nil
+	}
+}
+
+// TOTPSetupPostHandler confirms the enrolment with a first code and shows the recovery codes once.
+// A pending login is completed at the same time. A user who already enrolled has to turn the second factor
+// off before enrolling another authenticator.
+func (a *App) TOTPSetupPostHandler(db atlas.QBLoginDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, pending, err := a.getTOTPSetupUser(req, db)
+		if err != nil {
+			http.Redirect(w, req, "/login", http.StatusFound)
+			return nil
+		}
+		t, err := db.GetQBUserTOTP(u.ID)
+		if err != nil {
+			return server.New500Error("error retrieving second factor", err)
+		}
+		if t != nil {
+			a.saveFlash(w, req, FlashWarning, "Two-factor authentication is already set up")
+			http.Redirect(w, req, req.URL.Path, http.StatusFound)
+			return nil
+		}
+		session, err := a.Store.Get(req, sessionName)
+		if err != nil {
+			return server.New500Error("internal server error: error during getting of session", err)
+		}
+		secret := totpSecretFor(session.Values, u.ID)
+		if secret == "" {
+			http.Redirect(w, req, req.URL.Path, http.StatusFound)
+			return nil
+		}
+		step, valid := validateTOTPCode(strings.TrimSpace(req.FormValue("code")), secret, 0, time.Now())
+		if !valid {
+			a.saveFlash(w, req, FlashError, "The code is incorrect, please try again with a new one")
+			http.Redirect(w, req, req.URL.Path, http.StatusFound)
+			return nil
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err != nil {
+			return server.New500Error("error generating recovery codes", err)
+		}
+		err = db.SaveQBUserTOTP(atlas.QBUserTOTP{UserID: u.ID, Secret: secret, RecoveryCodeHashes: hashes, LastUsedStep: step})
+		if err != nil {
+			return server.New500Error("error saving second factor", err)
+		}
+		clearTOTPSecret(session.Values)
+		session.Save(req, w)
+
+		token := CSRFToken(req)
+		if pending {
+			a.clearPendingLogin(w, req)
+			err = a.createLoginSession(w, req, db, u.ID)
+			if err != nil {
+				return err
+			}
+			// the login gave the session a new CSRF token
+			token, _ = session.Values[csrfTokenKeyName].(string)
+		}
+
+		p := struct {
+			RecoveryCodes []string
+			*localPresenter
+		}{
+			RecoveryCodes: codes,
+			localPresenter: &localPresenter{
+				PageTitle:       "Recovery codes",
+				PageURL:         req.URL.Path,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       token,
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "totp_recovery_codes", p)
+		return nil
+	}
+}
+
+// TOTPDisablePostHandler removes the second factor of the logged-in user, unless their org requires it.
+func (a *App) TOTPDisablePostHandler(db atlas.QBLoginDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		required, err := db.IsTOTPRequiredForUser(u.ID)
+		if err != nil {
+			return server.New500Error("error checking second factor", err)
+		}
+		if required {
+			a.saveFlash(w, req, FlashWarning, "Your organisation requires two-factor authentication for admins")
+			http.Redirect(w, req, "/account/2fa", http.StatusFound)
+			return nil
+		}
+		t, err := db.GetQBUserTOTP(u.ID)
+		if err != nil {
+			return server.New500Error("error retrieving second factor", err)
+		}
+		if t == nil {
+			a.saveFlash(w, req, FlashError, "The code is incorrect")
+			http.Redirect(w, req, "/account/2fa", http.StatusFound)
+			return nil
+		}
+		if _, valid := validateTOTPCode(strings.TrimSpace(req.FormValue("code")), t.Secret, t.LastUsedStep, time.Now()); !valid {
+			a.saveFlash(w, req, FlashError, "The code is incorrect")
+			http.Redirect(w, req, "/account/2fa", http.StatusFound)
+			return nil
+		}
+		err = db.DeleteQBUserTOTP(u.ID)
+		if err != nil {
+			return server.New500Error("error removing second factor", err)
+		}
+		a.saveFlash(w, req, FlashSuccess, "Two-factor authentication has been turned off")
+		http.Redirect(w, req, "/account/2fa", http.StatusFound)
+		return nil
+	}
+}
+
+// saveTOTPSecret keeps the secret the setup page generated for a user in the session values, until the user
+// confirms it with a first code.
+func saveTOTPSecret(values map[interface{}]interface{}, userID int, secret string) {
+	values[totpSecretKeyName] = secret
+	values[totpSecretUserKeyName] = userID
+}
+
+// totpSecretFor returns the secret the setup page generated for the user, or "" if it generated none for
+// them, such as when it was generated for another user of the same browser.
+func totpSecretFor(values map[interface{}]interface{}, userID int) string {
+	secret, _ := values[totpSecretKeyName].(string)
+	id, ok := values[totpSecretUserKeyName].(int)
+	if !ok || id != userID {
+		return ""
+	}
+	return secret
+}
+
+// clearTOTPSecret forgets the secret of an unfinished enrolment. Logging in and out clear it, so that it does
+// not outlive the user it was generated for.
+func clearTOTPSecret(values map[interface{}]interface{}) {
+	delete(values, totpSecretKeyName)
+	delete(values, totpSecretUserKeyName)
+}
+
+// validateTOTPCode reports whether code is the code of secret for a time step around now that comes after
+// lastStep, and returns that step. A code stays valid for a few steps, so the step it was used for has to be
+// kept to refuse it the next time.
+func validateTOTPCode(code, secret string, lastStep int64, now time.Time) (int64, bool) {
+	step := now.Unix() / totpPeriod
+	for s := step - totpSkew; s <= step+totpSkew; s++ {
+		if s <= lastStep {
+			continue
+		}
+		want, err := totp.GenerateCode(secret, time.Unix(s*totpPeriod, 0))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// OrgTOTPPageHandler displays whether the admins of an org have to use two-factor authentication.
+func (a *App) OrgTOTPPageHandler(db atlas.QBOrgTOTPSettingDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		org, pageURL, err := orgTOTPOrg(req, db)
+		if err != nil {
+			return err
+		}
+
+		p := struct {
+			Org *atlas.QBOrg
+			*localPresenter
+		}{
+			Org: org,
+			localPresenter: &localPresenter{
+				PageTitle:       "Two-factor authentication",
+				PageURL:         pageURL,
+				User:            u,
+				GlobalPresenter: a.Gp,
+				CSRFToken:       CSRFToken(req),
+				Flashes:         a.getFlashes(w, req),
+			},
+		}
+		a.Rndr.HTML(w, http.StatusOK, "org_2fa", p)
+		return nil
+	}
+}
+
+// OrgTOTPPostHandler turns RequireAdminTOTP of an org on or off. Admins who have not enrolled yet are taken
+// through enrolment on their next login.
+func (a *App) OrgTOTPPostHandler(db atlas.QBOrgTOTPSettingDB) server.HandlerWithError {
+	return func(w http.ResponseWriter, req *http.Request) error {
+		u, err := getUser(req)
+		if err != nil {
+			return server.New500Error("error retrieving user from request", err)
+		}
+		org, pageURL, err := orgTOTPOrg(req, db)
+		if err != nil {
+			return err
+		}
+		org.RequireAdminTOTP = req.FormValue("require_admin_totp") == "on"
+		_, err = db.UpdateQBOrg(*org)
+		if err != nil {
+			return server.New500Error("error saving org", err)
+		}
+		a.Logr.Log("user %d set require admin totp of org %d to %t", u.ID, org.ID, org.RequireAdminTOTP)
+		if org.RequireAdminTOTP {
+			a.saveFlash(w, req, FlashSuccess, "Admins now have to use two-factor authentication")
+		} else {
+			a.saveFlash(w, req, FlashSuccess, "Two-factor authentication is now optional for admins")
+		}
+		http.Redirect(w, req, pageURL, http.StatusFound)
+		return nil
+	}
+}
+
+// orgTOTPOrg returns the org named by the "orgid" URL param and the URL of its two-factor page.
+func orgTOTPOrg(req *http.Request, db atlas.QBOrgTOTPSettingDB) (*atlas.QBOrg, string, error) {
+	orgID, _ := requestScope(req)
+	if orgID == 0 {
+		return nil, "", server.NewError(http.StatusBadRequest, "no organisation given", fmt.Errorf("missing orgid for two-factor page"))
+	}
+	org, err := db.GetQBOrg(orgID)
+	if err != nil {
+		return nil, "", server.NewError(http.StatusNotFound, "organisation not found", err)
+	}
+	return org, fmt.Sprintf("/orgs/%d/2fa", org.ID), nil
+}
+
+// getTOTPSetupUser returns the logged-in user, or else the user of a pending login, and whether it is pending.
+func (a *App) getTOTPSetupUser(req *http.Request, db atlas.QBUserDB) (*atlas.QBUser, bool, error) {
+	if u, err := getUser(req); err == nil {
+		return u, false, nil
+	}
+	u, err := a.getPendingLoginUser(req, db)
+	if err != nil {
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+// newRecoveryCodes returns fresh recovery codes along with the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		hashes[i] = hashToken(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// useRecoveryCode removes code from the unused recovery codes, reporting whether it was one of them.
+func useRecoveryCode(t *atlas.QBUserTOTP, code string) bool {
+	hash := hashToken(strings.ToLower(code))
+	for i, h := range t.RecoveryCodeHashes {
+		if h == hash {
+			t.RecoveryCodeHashes = append(t.RecoveryCodeHashes[:i], t.RecoveryCodeHashes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
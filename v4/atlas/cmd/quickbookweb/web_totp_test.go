@@ -0,0 +1,226 @@
+package main_test
+
+import (
+	"atlas"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	main "atlas/cmd/quickbookweb"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pquerna/otp/totp"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// lastCookie returns the cookie set last by a response, which is the most recent state of the session.
+func lastCookie(w *httptest.ResponseRecorder) string {
+	cookies := w.HeaderMap["Set-Cookie"]
+	if len(cookies) == 0 {
+		return ""
+	}
+	return cookies[len(cookies)-1]
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// passwordLogin logs user1 in with the right password and returns the session cookie of the pending login.
+func passwordLogin(t *testing.T, mockDB *MockQBUserDB) string {
+	test := GenerateHandleTester(t, app.Wrap(app.LoginPostHandler(mockDB, newTestLoginGuard())), false)
+	w := test("POST", url.Values{"email": {user1.Email}, "password": {user1.Password}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/login/2fa", w.HeaderMap.Get("Location"))
+	return lastCookie(w)
+}
+
+func TestTOTPLogin(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBUserDB{totps: map[int]*atlas.QBUserTOTP{
+		user1.ID: {UserID: user1.ID, Secret: testTOTPSecret, RecoveryCodeHashes: []string{hashRecoveryCode("abcde-12345")}},
+	}}
+	guard := newTestLoginGuard()
+	cookie := passwordLogin(t, mockDB)
+
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPageHandler(mockDB)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w := test("GET", url.Values{})
+	assert(t, w.Code == http.StatusOK, "expected code page to return 200 instead got %d", w.Code)
+
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{"code": {"000000"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/login/2fa", w.HeaderMap.Get("Location"))
+
+	code, err := totp.GenerateCode(testTOTPSecret, time.Now())
+	ok(t, err)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+
+	// a code is only accepted once
+	cookie = passwordLogin(t, mockDB)
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, "/login/2fa", w.HeaderMap.Get("Location"))
+
+	// recovery codes work once
+	cookie = passwordLogin(t, mockDB)
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{"code": {"abcde-12345"}})
+	equals(t, "/w", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.totps[user1.ID].RecoveryCodeHashes))
+	cookie = passwordLogin(t, mockDB)
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{"code": {"abcde-12345"}})
+	equals(t, "/login/2fa", w.HeaderMap.Get("Location"))
+
+	// no pending login
+	test = GenerateHandleTester(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+}
+
+func TestTOTPLoginTooManyAttempts(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBUserDB{totps: map[int]*atlas.QBUserTOTP{
+		user1.ID: {UserID: user1.ID, Secret: testTOTPSecret},
+	}}
+	guard := newTestLoginGuard()
+	cookie := passwordLogin(t, mockDB)
+	for i := 0; i < guard.MaxTOTPFailures; i++ {
+		test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+		w := test("POST", url.Values{"code": {"000000"}})
+		equals(t, "/login/2fa", w.HeaderMap.Get("Location"))
+		cookie = lastCookie(w)
+	}
+
+	code, err := totp.GenerateCode(testTOTPSecret, time.Now())
+	ok(t, err)
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w := test("POST", url.Values{"code": {code}})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.sessionUserIDs))
+
+	// entering the password again does not give more tries
+	cookie = passwordLogin(t, mockDB)
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPostHandler(mockDB, guard)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, "/login", w.HeaderMap.Get("Location"))
+	equals(t, 0, len(mockDB.sessionUserIDs))
+}
+
+func TestTOTPMandatoryEnrolment(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBUserDB{totpRequired: true}
+	cookie := passwordLogin(t, mockDB)
+
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPLoginPageHandler(mockDB)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w := test("GET", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, "/login/2fa/setup", w.HeaderMap.Get("Location"))
+
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPSetupPageHandler(mockDB)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("GET", url.Values{})
+	assert(t, w.Code == http.StatusOK, "expected setup page to return 200 instead got %d", w.Code)
+	assert(t, len(w.HeaderMap["Set-Cookie"]) > 0, "expected the secret to be kept in the session")
+}
+
+var totpSecretRe = regexp.MustCompile(`<code>(\w+)</code>`)
+
+// totpSetupPage opens the setup page and returns the secret it generated with the session cookie keeping it.
+func totpSetupPage(t *testing.T, mockDB *MockQBUserDB, loggedIn bool, cookie string) (string, string) {
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPSetupPageHandler(mockDB)), loggedIn, nil, map[string]string{"Cookie": cookie}, nil)
+	w := test("GET", url.Values{})
+	equals(t, http.StatusOK, w.Code)
+	m := totpSecretRe.FindStringSubmatch(w.Body.String())
+	assert(t, m != nil, "expected the setup page to show the secret")
+	return m[1], lastCookie(w)
+}
+
+func TestTOTPSetupPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBUserDB{totpRequired: true}
+	secret, cookie := totpSetupPage(t, mockDB, false, passwordLogin(t, mockDB))
+	code, err := totp.GenerateCode(secret, time.Now())
+	ok(t, err)
+
+	// enrolled in another tab meanwhile
+	mockDB.totps = map[int]*atlas.QBUserTOTP{user1.ID: {UserID: user1.ID, Secret: testTOTPSecret}}
+	test := GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPSetupPostHandler(mockDB)), false, nil, map[string]string{"Cookie": cookie}, nil)
+	w := test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, testTOTPSecret, mockDB.totps[user1.ID].Secret)
+	equals(t, 0, len(mockDB.sessionUserIDs))
+
+	mockDB.totps = nil
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusOK, w.Code)
+	equals(t, secret, mockDB.totps[user1.ID].Secret)
+	equals(t, []int{user1.ID}, mockDB.sessionUserIDs)
+
+	// logging out drops the secret of an unfinished enrolment
+	mockDB = &MockQBUserDB{}
+	secret, cookie = totpSetupPage(t, mockDB, true, "")
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.LogoutHandler(mockDB)), true, nil, map[string]string{"Cookie": cookie}, nil)
+	w = test("POST", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+	code, err = totp.GenerateCode(secret, time.Now())
+	ok(t, err)
+	test = GenerateHandleTesterWithHeaders(t, app.Wrap(app.TOTPSetupPostHandler(mockDB)), true, nil, map[string]string{"Cookie": lastCookie(w)}, nil)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusFound, w.Code)
+	assert(t, mockDB.totps[user1.ID] == nil, "expected no second factor to be saved after logout")
+
+	// the secret is only used for the user it was generated for
+	values := map[interface{}]interface{}{}
+	main.SaveTOTPSecret(values, user1.ID, secret)
+	equals(t, secret, main.TOTPSecretFor(values, user1.ID))
+	equals(t, "", main.TOTPSecretFor(values, user2.ID))
+}
+
+func TestTOTPDisablePostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	code, err := totp.GenerateCode(testTOTPSecret, time.Now())
+	ok(t, err)
+
+	// mandatory for the org
+	mockDB := &MockQBUserDB{totpRequired: true, totps: map[int]*atlas.QBUserTOTP{user1.ID: {UserID: user1.ID, Secret: testTOTPSecret}}}
+	test := GenerateHandleTester(t, app.Wrap(app.TOTPDisablePostHandler(mockDB)), true)
+	w := test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusFound, w.Code)
+	assert(t, mockDB.totps[user1.ID] != nil, "expected mandatory second factor to stay")
+
+	mockDB = &MockQBUserDB{totps: map[int]*atlas.QBUserTOTP{user1.ID: {UserID: user1.ID, Secret: testTOTPSecret}}}
+	test = GenerateHandleTester(t, app.Wrap(app.TOTPDisablePostHandler(mockDB)), true)
+	w = test("POST", url.Values{"code": {code}})
+	equals(t, http.StatusFound, w.Code)
+	assert(t, mockDB.totps[user1.ID] == nil, "expected second factor to be removed")
+}
+
+func TestOrgTOTPPostHandler(t *testing.T) {
+	skip(t, skipProjectFlag, "quickbook")
+	mockDB := &MockQBOrgDB{}
+	test := GenerateHandleTesterWithURLParams(t, app.Wrap(app.OrgTOTPPostHandler(mockDB)), true, httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}})
+	w := test("POST", url.Values{"require_admin_totp": {"on"}})
+	equals(t, http.StatusFound, w.Code)
+	equals(t, fmt.Sprintf("/orgs/%d/2fa", org1.ID), w.HeaderMap.Get("Location"))
+	assert(t, mockDB.updatedOrg != nil && mockDB.updatedOrg.RequireAdminTOTP, "expected admin totp to be required")
+
+	w = test("POST", url.Values{})
+	equals(t, http.StatusFound, w.Code)
+	assert(t, !mockDB.updatedOrg.RequireAdminTOTP, "expected admin totp to be optional")
+
+	mockDB = &MockQBOrgDB{hasError: true}
+	test = GenerateHandleTesterWithURLParams(t, app.Wrap(app.OrgTOTPPostHandler(mockDB)), true, httprouter.Params{{Key: "orgid", Value: fmt.Sprint(org1.ID)}})
+	w = test("POST", url.Values{"require_admin_totp": {"on"}})
+	equals(t, http.StatusNotFound, w.Code)
+}
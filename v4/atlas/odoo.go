@@ -0,0 +1,37 @@
+package atlas
+
+import "time"
+
+// OdooConnection holds the credentials of an Odoo server whose POS configs are linked to orgs and shops.
+// Password may be an Odoo API key; it is saved sealed, and has to be opened before calling Odoo.
+type OdooConnection struct {
+	ID          int
+	UserID      int
+	URL         string
+	Database    string
+	Username    string
+	Password    string
+	OdooUID     int
+	DateCreated time.Time
+}
+
+// OdooPOSConfig is a pos.config record of an Odoo server, i.e. one point of sale of one of its companies.
+type OdooPOSConfig struct {
+	ID          int
+	Name        string
+	CompanyID   int
+	CompanyName string
+}
+
+// OdooSetupDB is the interface for the Odoo steps of the setup wizard.
+type OdooSetupDB interface {
+	QBOnboardingDB
+	GetOdooConnection(id int) (*OdooConnection, error)
+	SaveOdooConnection(c OdooConnection) (*OdooConnection, error)
+	// ImportOdooPOSConfigs creates an org for each company and a shop for each POS config of the connection
+	// in one transaction, reusing the orgs and shops linked by an earlier import. QBOrg.OdooConnectionID and
+	// QBOrg.OdooCompanyID link the orgs, QBShop.OdooPOSConfigID the shops. The shops are returned in the order
+	// of configs.
+	ImportOdooPOSConfigs(connectionID int, configs []OdooPOSConfig) ([]*QBShop, error)
+	CreateAtlasSession(s AtlasSession) (*AtlasSession, error)
+}
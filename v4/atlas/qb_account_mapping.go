@@ -0,0 +1,138 @@
+package atlas
+
+// QBRemoteAccount is an Account entity of the chart of accounts of a Quickbooks company.
+type QBRemoteAccount struct {
+	QBID               string
+	Name               string
+	FullyQualifiedName string
+	AccountType        string
+	AccountSubType     string
+	Active             bool
+}
+
+// QBAccountRole is what an org posts to a mapped Quickbooks account.
+type QBAccountRole string
+
+// Account roles, in the order the mapping page shows them.
+const (
+	AccountRoleDeposit          QBAccountRole = "deposit"
+	AccountRoleUndepositedFunds QBAccountRole = "undeposited_funds"
+	AccountRoleDiscount         QBAccountRole = "discount"
+	AccountRoleRounding         QBAccountRole = "rounding"
+	AccountRoleTips             QBAccountRole = "tips"
+)
+
+// AccountRoles lists every account role.
+var AccountRoles = []QBAccountRole{
+	AccountRoleDeposit,
+	AccountRoleUndepositedFunds,
+	AccountRoleDiscount,
+	AccountRoleRounding,
+	AccountRoleTips,
+}
+
+var accountRoleLabels = map[QBAccountRole]string{
+	AccountRoleDeposit:          "Deposit account",
+	AccountRoleUndepositedFunds: "Undeposited funds",
+	AccountRoleDiscount:         "Discounts",
+	AccountRoleRounding:         "Rounding",
+	AccountRoleTips:             "Tips",
+}
+
+// accountRoleTypes lists the Quickbooks AccountType values each role can be mapped to.
+var accountRoleTypes = map[QBAccountRole][]string{
+	AccountRoleDeposit:          {"Bank", "Other Current Asset"},
+	AccountRoleUndepositedFunds: {"Other Current Asset"},
+	AccountRoleDiscount:         {"Income", "Expense", "Other Income", "Other Expense"},
+	AccountRoleRounding:         {"Income", "Expense", "Other Income", "Other Expense"},
+	AccountRoleTips:             {"Other Current Liability", "Income", "Other Income"},
+}
+
+// Label returns the name of the role shown to users.
+func (r QBAccountRole) Label() string {
+	return accountRoleLabels[r]
+}
+
+// IsValid reports whether r is a known role.
+func (r QBAccountRole) IsValid() bool {
+	_, ok := accountRoleTypes[r]
+	return ok
+}
+
+// Required reports whether an org has to map the role before payments can be posted to Quickbooks.
+func (r QBAccountRole) Required() bool {
+	return r == AccountRoleDeposit
+}
+
+// Allows reports whether an account can be mapped to the role.
+func (r QBAccountRole) Allows(a QBRemoteAccount) bool {
+	if !a.Active {
+		return false
+	}
+	for _, t := range accountRoleTypes[r] {
+		if a.AccountType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedTypes returns the Quickbooks account types the role can be mapped to.
+func (r QBAccountRole) AllowedTypes() []string {
+	return accountRoleTypes[r]
+}
+
+// QBAccountMapping maps an account role of an org to a Quickbooks account. A ShopID or PaymentMethodID of 0
+// means the mapping applies to every shop or payment method; more specific mappings override it.
+type QBAccountMapping struct {
+	ID              int
+	OrgID           int
+	ShopID          int
+	PaymentMethodID int
+	Role            QBAccountRole
+	QBAccountID     string
+}
+
+// ResolveQBAccount returns the Quickbooks account to post a role to for a shop and payment method, or "" if
+// none is mapped. A mapping for both the shop and the payment method wins over one for the payment method,
+// which wins over one for the shop, which wins over the org-wide one.
+func ResolveQBAccount(mappings []*QBAccountMapping, role QBAccountRole, shopID, paymentMethodID int) string {
+	best, bestRank := "", 0
+	for _, m := range mappings {
+		if m.Role != role {
+			continue
+		}
+		if (m.ShopID != 0 && m.ShopID != shopID) || (m.PaymentMethodID != 0 && m.PaymentMethodID != paymentMethodID) {
+			continue
+		}
+		rank := 1
+		if m.ShopID != 0 {
+			rank++
+		}
+		if m.PaymentMethodID != 0 {
+			rank += 2
+		}
+		if rank > bestRank {
+			best, bestRank = m.QBAccountID, rank
+		}
+	}
+	return best
+}
+
+// QBAccountMappingDB is the interface for reading and saving the account mappings of an org.
+type QBAccountMappingDB interface {
+	GetQBAccountMappings(orgID int) ([]*QBAccountMapping, error)
+	// ReplaceQBAccountMappings replaces every mapping of the org in one transaction.
+	ReplaceQBAccountMappings(orgID int, mappings []QBAccountMapping) error
+}
+
+// QBAccountMappingPageDB is the interface for the account mapping page, both as a step of the setup wizard
+// and for changing the mappings later.
+type QBAccountMappingPageDB interface {
+	QBAccountMappingDB
+	QBOnboardingDB
+	GetQBOrg(orgID int) (*QBOrg, error)
+	UpdateQBOrg(o QBOrg) (*QBOrg, error)
+	GetAllQBShopsForOrg(orgID int) ([]*QBShop, error)
+	GetAllQBPaymentMethodsForOrg(orgID int) ([]*QBPaymentMethod, error)
+}
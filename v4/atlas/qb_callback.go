@@ -0,0 +1,69 @@
+package atlas
+
+import "time"
+
+// QBCallback is a URL a shop registered to be notified of the changes of the Quickbooks company of its org.
+// Notifications are signed with Secret, which the shop shares with the server; it is saved sealed, and has to be
+// opened before signing.
+type QBCallback struct {
+	ID          int
+	OrgID       int
+	ShopID      int
+	URL         string
+	Secret      string
+	IsActive    bool
+	DateCreated time.Time
+}
+
+// QBCallbackDeliveryStatus is where a callback delivery is in the queue.
+type QBCallbackDeliveryStatus string
+
+// Callback delivery statuses. A pending delivery is sent once NextAttemptAt has passed; a sending delivery is
+// leased to a worker until NextAttemptAt, after which it is pending again in case the worker died.
+const (
+	QBCallbackDeliveryPending   QBCallbackDeliveryStatus = "pending"
+	QBCallbackDeliverySending   QBCallbackDeliveryStatus = "sending"
+	QBCallbackDeliveryDelivered QBCallbackDeliveryStatus = "delivered"
+	QBCallbackDeliveryFailed    QBCallbackDeliveryStatus = "failed"
+)
+
+// QBCallbackDelivery is a notification to be posted to a callback, kept as a log once it was sent.
+// ResponseCode is the status the callback answered the last attempt with, 0 if it could not be reached.
+type QBCallbackDelivery struct {
+	ID            int
+	CallbackID    int
+	OrgID         int
+	URL           string
+	Payload       []byte
+	Status        QBCallbackDeliveryStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	ResponseCode  int
+	LastError     string
+	DateCreated   time.Time
+	DeliveredAt   *time.Time
+}
+
+// QBCallbackDB is the interface for callbacks and their deliveries. Implementations must make
+// ClaimQBCallbackDeliveries atomic so that several nodes can share the queue.
+type QBCallbackDB interface {
+	GetQBCallbacks(orgID int) ([]*QBCallback, error)
+	GetQBCallback(callbackID int) (*QBCallback, error)
+	CreateQBCallback(c QBCallback) (*QBCallback, error)
+	DeleteQBCallback(callbackID int) error
+
+	CreateQBCallbackDelivery(d QBCallbackDelivery) (*QBCallbackDelivery, error)
+	GetQBCallbackDelivery(deliveryID int) (*QBCallbackDelivery, error)
+	// GetRecentQBCallbackDeliveries returns up to limit deliveries of an org, the newest first.
+	GetRecentQBCallbackDeliveries(orgID int, limit int) ([]*QBCallbackDelivery, error)
+	// ClaimQBCallbackDeliveries leases up to limit deliveries that are due at now, the oldest first, by marking
+	// them sending until now+lease, and returns them.
+	ClaimQBCallbackDeliveries(now time.Time, lease time.Duration, limit int) ([]*QBCallbackDelivery, error)
+	UpdateQBCallbackDelivery(d QBCallbackDelivery) error
+}
+
+// QBCallbackPageDB is the interface for the callback management pages.
+type QBCallbackPageDB interface {
+	QBCallbackDB
+	GetQBOrg(orgID int) (*QBOrg, error)
+}
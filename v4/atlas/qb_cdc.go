@@ -0,0 +1,14 @@
+package atlas
+
+import "time"
+
+// QBCDCDB is the interface for polling Quickbooks for the changes the webhook missed. The checkpoint of an org
+// is the time of its company up to which changes were queued, the zero time before the first poll.
+type QBCDCDB interface {
+	GetAllQBOrgs() ([]*QBOrg, error)
+	GetQBCDCCheckpoint(orgID int) (time.Time, error)
+	SaveQBCDCCheckpoint(orgID int, checkpoint time.Time) error
+	// MarkQBOrgForFullResync flags the org so that its data is synced from Quickbooks in full, since some of
+	// its changes could not be polled.
+	MarkQBOrgForFullResync(orgID int) error
+}
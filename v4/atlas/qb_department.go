@@ -0,0 +1,31 @@
+package atlas
+
+// QBRemoteDepartment is a Department entity of a Quickbooks company, called a Location in some regions.
+// Shops map one-to-one to departments through QBShop.QBDepartmentID.
+type QBRemoteDepartment struct {
+	QBID   int
+	Name   string
+	Active bool
+}
+
+// QBShopDepartmentDB is the interface for creating shops from Quickbooks departments and keeping their names
+// in sync.
+type QBShopDepartmentDB interface {
+	GetAllQBShopsForOrg(orgID int) ([]*QBShop, error)
+	CreateQBShop(s QBShop) (*QBShop, error)
+	UpdateQBShop(s QBShop) (*QBShop, error)
+}
+
+// QBSetupDepartmentDB is the interface for the shop step of the setup wizard, which offers the departments of
+// the Quickbooks company as shops.
+type QBSetupDepartmentDB interface {
+	QBSetupShopDB
+	QBOrgShopDB
+	QBShopDepartmentDB
+}
+
+// QBDepartmentSyncDB is the interface for keeping shop names in sync with renamed Quickbooks departments.
+type QBDepartmentSyncDB interface {
+	GetAllQBOrgs() ([]*QBOrg, error)
+	QBShopDepartmentDB
+}
@@ -0,0 +1,66 @@
+package atlas
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Names of the Quickbooks entities whose changes are handled.
+const (
+	QBEntityCustomer     = "Customer"
+	QBEntityItem         = "Item"
+	QBEntityInvoice      = "Invoice"
+	QBEntityPayment      = "Payment"
+	QBEntitySalesReceipt = "SalesReceipt"
+)
+
+// QBChangeEntities lists the entities whose changes are handled.
+var QBChangeEntities = []string{QBEntityCustomer, QBEntityItem, QBEntityInvoice, QBEntityPayment, QBEntitySalesReceipt}
+
+// QBEntityChange is a change of one entity of a Quickbooks company, as sent in the dataChangeEvent of a
+// webhook notification. Operation is Create, Update, Delete, Merge, Void or Emailed.
+type QBEntityChange struct {
+	Name        string `json:"name"`
+	ID          string `json:"id"`
+	Operation   string `json:"operation"`
+	LastUpdated string `json:"lastUpdated"`
+	DeletedID   string `json:"deletedId,omitempty"`
+}
+
+// Fingerprint identifies the change within the Quickbooks company realmID. Intuit sends the same change again
+// with the same fingerprint. LastUpdated is compared as an instant, since webhooks and change data capture
+// format it differently.
+func (c QBEntityChange) Fingerprint(realmID string) string {
+	updated := c.LastUpdated
+	if t, err := c.LastUpdatedTime(); err == nil {
+		updated = t.UTC().Format(time.RFC3339Nano)
+	}
+	return strings.Join([]string{realmID, c.Name, c.ID, c.Operation, updated}, "|")
+}
+
+// qbChangeTimeLayouts are the formats Intuit sends lastUpdated in.
+var qbChangeTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05.000-0700"}
+
+// LastUpdatedTime parses LastUpdated.
+func (c QBEntityChange) LastUpdatedTime() (time.Time, error) {
+	for _, layout := range qbChangeTimeLayouts {
+		if t, err := time.Parse(layout, c.LastUpdated); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unexpected lastUpdated %q of %s %s", c.LastUpdated, c.Name, c.ID)
+}
+
+// QBEventNotification holds the changes of one Quickbooks company in a webhook payload.
+type QBEventNotification struct {
+	RealmID         string `json:"realmId"`
+	DataChangeEvent struct {
+		Entities []QBEntityChange `json:"entities"`
+	} `json:"dataChangeEvent"`
+}
+
+// QBWebhookPayload is the body of an Intuit webhook request, which can hold notifications of several companies.
+type QBWebhookPayload struct {
+	EventNotifications []QBEventNotification `json:"eventNotifications"`
+}
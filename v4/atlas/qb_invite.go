@@ -0,0 +1,28 @@
+package atlas
+
+import "time"
+
+// QBInvite is an invitation for someone to join an org, or one of its shops, with a role.
+type QBInvite struct {
+	ID          int
+	Email       string
+	OrgID       int
+	ShopID      int
+	Role        QBRole
+	InvitedByID int
+	ExpiresAt   time.Time
+	AcceptedAt  *time.Time
+	DateCreated time.Time
+}
+
+// QBInviteDB is the interface for inviting users and accepting invitations.
+type QBInviteDB interface {
+	QBUserRoleDB
+	GetQBUserByEmail(email string) (*QBUser, error)
+	GetAllShopsForOrg(orgID int) ([]*QBShop, error)
+	CreateQBInvite(inv QBInvite) (*QBInvite, error)
+	GetQBInvite(inviteID int) (*QBInvite, error)
+	// AcceptQBInvite creates the user, grants the invited role and marks the invite accepted in one transaction.
+	AcceptQBInvite(inviteID int, u QBUser) (*QBUser, error)
+	CreateAtlasWebSession(userID int) (*WebSession, error)
+}
@@ -0,0 +1,38 @@
+package atlas
+
+import "time"
+
+// QBLoginAttempt tracks the recent failed logins for an account or IP address.
+type QBLoginAttempt struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// QBLoginAttemptDB stores failed login attempts. Implementations must make RecordQBLoginFailure atomic so
+// that several nodes can share the counts.
+type QBLoginAttemptDB interface {
+	// GetQBLoginAttempt returns an empty QBLoginAttempt when nothing is recorded for key.
+	GetQBLoginAttempt(key string) (*QBLoginAttempt, error)
+	// RecordQBLoginFailure counts a failure for key, restarting the count if the last failure was
+	// longer than window ago, and returns the updated attempt.
+	RecordQBLoginFailure(key string, at time.Time, window time.Duration) (*QBLoginAttempt, error)
+	LockQBLoginAttempt(key string, until time.Time) error
+	DeleteQBLoginAttempt(key string) error
+}
+
+// QBAuditEntry records a security relevant action. UserID is the user who acted, 0 for the system.
+type QBAuditEntry struct {
+	ID          int
+	UserID      int
+	Action      string
+	Target      string
+	IP          string
+	DateCreated time.Time
+}
+
+// QBAuditDB is the interface for writing audit entries.
+type QBAuditDB interface {
+	CreateQBAuditEntry(e QBAuditEntry) error
+}
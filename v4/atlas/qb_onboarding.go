@@ -0,0 +1,185 @@
+package atlas
+
+import (
+	"strings"
+	"time"
+)
+
+// Backends an org can be set up against.
+const (
+	BackendQuickbooks = "quickbooks"
+	BackendOdoo       = "odoo"
+)
+
+// OnboardingStep is a step of the /start setup wizard.
+type OnboardingStep int
+
+// Steps of the setup wizard. The values are stored with the onboarding of a user, so they must never change;
+// new steps get the next free value and are placed in the wizard by onboardingOrder.
+const (
+	OnboardingBackend    OnboardingStep = 1
+	OnboardingSuperadmin OnboardingStep = 2
+	OnboardingOrg        OnboardingStep = 3
+	OnboardingConnect    OnboardingStep = 4
+	OnboardingShop       OnboardingStep = 5
+	OnboardingComplete   OnboardingStep = 6
+	OnboardingAccounts   OnboardingStep = 7
+)
+
+// onboardingOrder lists the steps of the setup wizard in the order they are gone through. Backends skip the
+// steps they have no page for.
+var onboardingOrder = []OnboardingStep{
+	OnboardingBackend,
+	OnboardingSuperadmin,
+	OnboardingOrg,
+	OnboardingConnect,
+	OnboardingAccounts,
+	OnboardingShop,
+	OnboardingComplete,
+}
+
+// position returns where the step comes in the setup wizard, or 0 for an unknown step.
+func (s OnboardingStep) position() int {
+	for i, step := range onboardingOrder {
+		if step == s {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Before reports whether the step comes before t in the setup wizard.
+func (s OnboardingStep) Before(t OnboardingStep) bool {
+	return s.position() < t.position()
+}
+
+// onboardingPages lists the page of every step after the superadmin is created, per backend.
+// Odoo has no org step because orgs are created from the companies of the Odoo server, and no accounts step
+// because nothing is posted to Quickbooks.
+var onboardingPages = map[string]map[OnboardingStep]string{
+	BackendQuickbooks: {
+		OnboardingOrg:      "/start/3",
+		OnboardingConnect:  "/start/4",
+		OnboardingAccounts: "/start/accounts",
+		OnboardingShop:     "/start/5",
+	},
+	BackendOdoo: {
+		OnboardingConnect: "/start/odoo/connect",
+		OnboardingShop:    "/start/odoo/pos",
+	},
+}
+
+// OnboardingPath returns the page of a step of the setup wizard for a backend.
+func OnboardingPath(backend string, s OnboardingStep) string {
+	switch {
+	case !OnboardingBackend.Before(s):
+		return "/start"
+	case s == OnboardingSuperadmin:
+		return "/start/2"
+	case !s.Before(OnboardingComplete):
+		return "/w"
+	}
+	return onboardingPages[backend][s]
+}
+
+// OnboardingStepForPath returns the step and backend of a page of the setup wizard. The backend is "" for the
+// steps every backend shares, and the step 0 for pages that are not part of the wizard.
+func OnboardingStepForPath(path string) (OnboardingStep, string) {
+	path = strings.TrimSuffix(path, "/")
+	switch path {
+	case "/start":
+		return OnboardingBackend, ""
+	case "/start/2":
+		return OnboardingSuperadmin, ""
+	}
+	for backend, pages := range onboardingPages {
+		for s, p := range pages {
+			if p == path {
+				return s, backend
+			}
+		}
+	}
+	return 0, ""
+}
+
+// QBOnboarding is how far a superadmin has got with the setup wizard, so that a half-finished setup can be
+// resumed. Users who never went through the wizard (e.g. invited users) have none. OrgID is the org being set
+// up with Quickbooks, OdooConnectionID the Odoo server being set up with Odoo.
+type QBOnboarding struct {
+	UserID           int
+	Backend          string
+	Step             OnboardingStep
+	OrgID            int
+	OdooConnectionID int
+	CompletedAt      *time.Time
+	DateUpdated      time.Time
+}
+
+// NewQBOnboarding starts the onboarding of a superadmin who just got created, at the first step of the backend.
+func NewQBOnboarding(userID int, backend string) QBOnboarding {
+	o := QBOnboarding{UserID: userID, Backend: backend, Step: OnboardingOrg}
+	if _, ok := onboardingPages[backend][OnboardingOrg]; !ok {
+		o.Step = OnboardingConnect
+	}
+	return o
+}
+
+// Path returns the page of the step the user is at.
+func (o *QBOnboarding) Path() string {
+	return OnboardingPath(o.Backend, o.Step)
+}
+
+// Advance moves the onboarding on to step. Going back to edit an earlier step does not lose the progress made.
+func (o *QBOnboarding) Advance(step OnboardingStep) {
+	if o.Step.Before(step) {
+		o.Step = step
+	}
+}
+
+// Complete marks the setup as done.
+func (o *QBOnboarding) Complete(at time.Time) {
+	o.Step = OnboardingComplete
+	o.CompletedAt = &at
+}
+
+// IsComplete reports whether the setup is done.
+func (o *QBOnboarding) IsComplete() bool {
+	return !o.Step.Before(OnboardingComplete)
+}
+
+// QBOnboardingDB is the interface for persisting the state of the setup wizard.
+type QBOnboardingDB interface {
+	// GetQBOnboarding returns nil and no error if the user has no onboarding.
+	GetQBOnboarding(userID int) (*QBOnboarding, error)
+	SaveQBOnboarding(o QBOnboarding) (*QBOnboarding, error)
+}
+
+// QBSetupUserDB is the interface for the superadmin step of the setup wizard.
+type QBSetupUserDB interface {
+	QBUserDB
+	QBOnboardingDB
+	// CreateQBSetupUser creates the user and saves its onboarding in one transaction, so that a failed step
+	// leaves no user behind without a way to finish setting up. o.UserID is set to the ID of the new user.
+	// It returns a *QBUserExistsError if the email address is taken, like CreateQBUser.
+	CreateQBSetupUser(u QBUser, o QBOnboarding) (*QBUser, *QBOnboarding, error)
+}
+
+// QBSetupDB is the interface for the org and Quickbooks connect steps of the setup wizard.
+type QBSetupDB interface {
+	QBOrgDB
+	QBOnboardingDB
+}
+
+// QBSetupOrgDB is the interface for creating or editing the org of the setup wizard. The user creating the
+// org is granted RoleOrgAdmin on it.
+type QBSetupOrgDB interface {
+	QBWebStart3DB
+	QBSetupDB
+	QBUserRoleGrantDB
+}
+
+// QBSetupShopDB is the interface for the shop step of the setup wizard.
+type QBSetupShopDB interface {
+	QBOrgShopSessionDB
+	QBOnboardingDB
+}
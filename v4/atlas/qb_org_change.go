@@ -0,0 +1,34 @@
+package atlas
+
+import "time"
+
+// Kinds of org changes that V4 devices are told about.
+const (
+	OrgChangeItem          = "item"
+	OrgChangePrice         = "price"
+	OrgChangeCustomer      = "customer"
+	OrgChangePaymentMethod = "payment_method"
+)
+
+// QBOrgChange is a change of an entity of an org, kept so that V4 devices can be streamed the changes they
+// missed. A ShopID of 0 means the change is for every shop of the org.
+type QBOrgChange struct {
+	ID          int
+	OrgID       int
+	ShopID      int
+	Kind        string
+	EntityID    string
+	Operation   string
+	DateCreated time.Time
+}
+
+// QBOrgChangeDB is the interface for org changes. IDs must increase in the order changes are created, across
+// every org, since devices resume their stream from the last ID they got.
+type QBOrgChangeDB interface {
+	// CreateQBOrgChanges saves changes in the order given, all of them or none.
+	CreateQBOrgChanges(changes []QBOrgChange) ([]*QBOrgChange, error)
+	// GetQBOrgChangesSince returns up to limit changes of an org with an ID above afterID, the oldest first.
+	GetQBOrgChangesSince(orgID int, afterID int, limit int) ([]*QBOrgChange, error)
+	// GetLatestQBOrgChangeID returns the ID of the latest change of an org, 0 if it has none.
+	GetLatestQBOrgChangeID(orgID int) (int, error)
+}
@@ -0,0 +1,12 @@
+package atlas
+
+// QBOrgTokenDB is the interface needed to keep the Quickbooks credentials of every org fresh.
+type QBOrgTokenDB interface {
+	GetAllQBOrgs() ([]*QBOrg, error)
+	QBOrgTokenSaver
+}
+
+// QBOrgTokenSaver is the interface for saving the Quickbooks tokens of an org refreshed while calling the API.
+type QBOrgTokenSaver interface {
+	UpdateQBOrg(QBOrg) (*QBOrg, error)
+}
@@ -0,0 +1,24 @@
+package atlas
+
+import "time"
+
+// QBPasswordReset is a single-use request to reset the password of a user. Only a hash of the
+// token sent to the user is kept.
+type QBPasswordReset struct {
+	ID          int
+	UserID      int
+	TokenHash   string
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	DateCreated time.Time
+}
+
+// QBPasswordResetDB is the interface for the password reset pages.
+type QBPasswordResetDB interface {
+	GetQBUserByEmail(email string) (*QBUser, error)
+	CreateQBPasswordReset(r QBPasswordReset) (*QBPasswordReset, error)
+	GetQBPasswordResetByTokenHash(tokenHash string) (*QBPasswordReset, error)
+	// ResetQBUserPassword sets the new password, marks the reset used and deletes every web session
+	// of the user in one transaction.
+	ResetQBUserPassword(resetID int, userID int, password string) error
+}
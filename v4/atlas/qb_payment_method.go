@@ -0,0 +1,128 @@
+package atlas
+
+import (
+	"errors"
+	"regexp"
+)
+
+// Quickbooks payment method types.
+const (
+	PaymentMethodCreditCard    = "CREDIT_CARD"
+	PaymentMethodNonCreditCard = "NON_CREDIT_CARD"
+)
+
+// DefaultPaymentMethodRegion is the template used when none is picked during setup.
+const DefaultPaymentMethodRegion = "SG"
+
+// ErrQBPaymentMethodCodeTaken is returned when saving a payment method whose code another payment method of
+// the same org already uses.
+var ErrQBPaymentMethodCodeTaken = errors.New("payment method code already used in this org")
+
+var paymentMethodCodeRe = regexp.MustCompile(`^[a-z0-9_]{1,20}$`)
+
+// IsValidPaymentMethodCode reports whether code is 1 to 20 lowercase letters, digits or underscores.
+// Codes are what the POS sends with every payment, so they are kept simple.
+func IsValidPaymentMethodCode(code string) bool {
+	return paymentMethodCodeRe.MatchString(code)
+}
+
+// IsValidPaymentMethodType reports whether t is a Quickbooks payment method type.
+func IsValidPaymentMethodType(t string) bool {
+	return t == PaymentMethodCreditCard || t == PaymentMethodNonCreditCard
+}
+
+// PaymentMethodTemplate is the set of payment methods a new org of a region starts with.
+type PaymentMethodTemplate struct {
+	Region  string
+	Name    string
+	Methods []QBPaymentMethod
+}
+
+// PaymentMethodTemplates lists the templates offered during setup, in the order they are shown.
+var PaymentMethodTemplates = []PaymentMethodTemplate{
+	{
+		Region: "SG",
+		Name:   "Singapore",
+		Methods: []QBPaymentMethod{
+			{Name: "Cash (SGD)", DisplayName: "Cash (SGD)", Code: "cash", Type: PaymentMethodNonCreditCard},
+			{Name: "Cash Card", DisplayName: "Cash Card", Code: "ccard", Type: PaymentMethodNonCreditCard},
+			{Name: "Credit Card (SGD)", DisplayName: "Credit Card (SGD)", Code: "crc", Type: PaymentMethodCreditCard},
+			{Name: "EZ Link", DisplayName: "EZ Link", Code: "ezlin", Type: PaymentMethodNonCreditCard},
+			{Name: "Nets", DisplayName: "Nets", Code: "nets", Type: PaymentMethodNonCreditCard},
+			{Name: "Voucher", DisplayName: "Voucher", Code: "vcher", Type: PaymentMethodNonCreditCard},
+			{Name: "Visa", DisplayName: "Visa", Code: "visa", Type: PaymentMethodCreditCard},
+			{Name: "Master", DisplayName: "Master", Code: "master", Type: PaymentMethodCreditCard},
+			{Name: "Amex", DisplayName: "American Express", Code: "amex", Type: PaymentMethodCreditCard},
+		},
+	},
+	{
+		Region: "MY",
+		Name:   "Malaysia",
+		Methods: []QBPaymentMethod{
+			{Name: "Cash (MYR)", DisplayName: "Cash (MYR)", Code: "cash", Type: PaymentMethodNonCreditCard},
+			{Name: "Touch 'n Go", DisplayName: "Touch 'n Go", Code: "tng", Type: PaymentMethodNonCreditCard},
+			{Name: "GrabPay", DisplayName: "GrabPay", Code: "grabpay", Type: PaymentMethodNonCreditCard},
+			{Name: "Boost", DisplayName: "Boost", Code: "boost", Type: PaymentMethodNonCreditCard},
+			{Name: "MyDebit", DisplayName: "MyDebit", Code: "mydebit", Type: PaymentMethodNonCreditCard},
+			{Name: "Voucher", DisplayName: "Voucher", Code: "vcher", Type: PaymentMethodNonCreditCard},
+			{Name: "Visa", DisplayName: "Visa", Code: "visa", Type: PaymentMethodCreditCard},
+			{Name: "Master", DisplayName: "Master", Code: "master", Type: PaymentMethodCreditCard},
+			{Name: "Amex", DisplayName: "American Express", Code: "amex", Type: PaymentMethodCreditCard},
+		},
+	},
+	{
+		Region: "AU",
+		Name:   "Australia",
+		Methods: []QBPaymentMethod{
+			{Name: "Cash (AUD)", DisplayName: "Cash (AUD)", Code: "cash", Type: PaymentMethodNonCreditCard},
+			{Name: "EFTPOS", DisplayName: "EFTPOS", Code: "eftpos", Type: PaymentMethodNonCreditCard},
+			{Name: "Gift Card", DisplayName: "Gift Card", Code: "gift", Type: PaymentMethodNonCreditCard},
+			{Name: "Visa", DisplayName: "Visa", Code: "visa", Type: PaymentMethodCreditCard},
+			{Name: "Master", DisplayName: "Master", Code: "master", Type: PaymentMethodCreditCard},
+			{Name: "Amex", DisplayName: "American Express", Code: "amex", Type: PaymentMethodCreditCard},
+		},
+	},
+	{
+		Region: "OTHER",
+		Name:   "Other (cash and cards only)",
+		Methods: []QBPaymentMethod{
+			{Name: "Cash", DisplayName: "Cash", Code: "cash", Type: PaymentMethodNonCreditCard},
+			{Name: "Credit Card", DisplayName: "Credit Card", Code: "crc", Type: PaymentMethodCreditCard},
+			{Name: "Debit Card", DisplayName: "Debit Card", Code: "debit", Type: PaymentMethodNonCreditCard},
+		},
+	},
+}
+
+// FindPaymentMethodTemplate returns the template of a region.
+func FindPaymentMethodTemplate(region string) (*PaymentMethodTemplate, bool) {
+	for i := range PaymentMethodTemplates {
+		if PaymentMethodTemplates[i].Region == region {
+			return &PaymentMethodTemplates[i], true
+		}
+	}
+	return nil, false
+}
+
+// ForOrg returns copies of the payment methods of the template for an org, in order.
+func (t *PaymentMethodTemplate) ForOrg(orgID int) []QBPaymentMethod {
+	methods := make([]QBPaymentMethod, len(t.Methods))
+	for i, pm := range t.Methods {
+		pm.OrgID = orgID
+		pm.Position = i + 1
+		methods[i] = pm
+	}
+	return methods
+}
+
+// QBPaymentMethodDB is the interface for managing the payment methods of an org.
+type QBPaymentMethodDB interface {
+	// GetAllQBPaymentMethodsForOrg returns the payment methods of the org, disabled ones included, ordered
+	// by Position.
+	GetAllQBPaymentMethodsForOrg(orgID int) ([]*QBPaymentMethod, error)
+	// CreateQBPaymentMethod and UpdateQBPaymentMethod return ErrQBPaymentMethodCodeTaken if the code is
+	// already used in the org.
+	CreateQBPaymentMethod(pm QBPaymentMethod) (*QBPaymentMethod, error)
+	UpdateQBPaymentMethod(pm QBPaymentMethod) (*QBPaymentMethod, error)
+	// ReorderQBPaymentMethods sets the Position of the payment methods of the org to their index in ids.
+	ReorderQBPaymentMethods(orgID int, ids []int) error
+}
@@ -0,0 +1,80 @@
+package atlas
+
+import "time"
+
+// QBRemotePaymentMethod is a PaymentMethod entity of a Quickbooks company.
+type QBRemotePaymentMethod struct {
+	QBID   string
+	Name   string
+	Type   string
+	Active bool
+}
+
+// Kinds of QBPaymentMethodConflict.
+const (
+	// ConflictTypeMismatch is a payment method whose type differs from the Quickbooks one of the same name.
+	// The two are not linked until the types agree.
+	ConflictTypeMismatch = "type_mismatch"
+	// ConflictInactiveInQB is an enabled payment method linked to a Quickbooks one that was made inactive.
+	ConflictInactiveInQB = "inactive_in_qb"
+	// ConflictDeletedInQB is a payment method linked to a Quickbooks one that no longer exists.
+	ConflictDeletedInQB = "deleted_in_qb"
+)
+
+// QBPaymentMethodConflict is a difference between a payment method and Quickbooks that the sync could not
+// settle by itself.
+type QBPaymentMethodConflict struct {
+	PaymentMethodID int
+	Name            string
+	QBID            string
+	Kind            string
+	Type            string
+	QBType          string
+}
+
+// Message describes the conflict for the review page.
+func (c QBPaymentMethodConflict) Message() string {
+	switch c.Kind {
+	case ConflictTypeMismatch:
+		return "is " + c.Type + " here but " + c.QBType + " in Quickbooks"
+	case ConflictInactiveInQB:
+		return "is inactive in Quickbooks"
+	case ConflictDeletedInQB:
+		return "was deleted in Quickbooks"
+	}
+	return c.Kind
+}
+
+// QBPaymentMethodSync is the outcome of reconciling the payment methods of an org with its Quickbooks company.
+// Linked payment methods matched an existing Quickbooks one by name, Created ones were added to Quickbooks,
+// and Imported ones were added here, disabled, from Quickbooks.
+type QBPaymentMethodSync struct {
+	ID        int
+	OrgID     int
+	RanAt     time.Time
+	Linked    int
+	Created   int
+	Imported  int
+	Conflicts []QBPaymentMethodConflict
+}
+
+// QBPaymentMethodSyncDB is the interface for syncing the payment methods of an org with Quickbooks.
+type QBPaymentMethodSyncDB interface {
+	QBPaymentMethodDB
+	SaveQBPaymentMethodSync(s QBPaymentMethodSync) (*QBPaymentMethodSync, error)
+	// GetLatestQBPaymentMethodSync returns nil and no error if the org was never synced.
+	GetLatestQBPaymentMethodSync(orgID int) (*QBPaymentMethodSync, error)
+}
+
+// QBPaymentMethodReviewDB is the interface for the Quickbooks payment methods review page.
+type QBPaymentMethodReviewDB interface {
+	QBPaymentMethodSyncDB
+	GetQBOrg(orgID int) (*QBOrg, error)
+}
+
+// QBSetupConnectDB is the interface for the Quickbooks connect step of the setup wizard, which syncs the
+// payment methods of the org once connected.
+type QBSetupConnectDB interface {
+	QBSetupDB
+	QBPaymentMethodSyncDB
+}
@@ -0,0 +1,53 @@
+package atlas
+
+// QBRole is the role a QBUser holds within an org or shop.
+type QBRole string
+
+// Roles ordered from the most to the least privileged.
+const (
+	RoleSuperAdmin  QBRole = "superadmin"
+	RoleOrgAdmin    QBRole = "orgadmin"
+	RoleShopManager QBRole = "shopmanager"
+	RoleCashier     QBRole = "cashier"
+)
+
+var roleRanks = map[QBRole]int{
+	RoleSuperAdmin:  4,
+	RoleOrgAdmin:    3,
+	RoleShopManager: 2,
+	RoleCashier:     1,
+}
+
+// Includes reports whether r grants at least the rights of other.
+func (r QBRole) Includes(other QBRole) bool {
+	rank, ok := roleRanks[r]
+	if !ok {
+		return false
+	}
+	return rank >= roleRanks[other]
+}
+
+// IsValid reports whether r is a known role.
+func (r QBRole) IsValid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// QBUserRole grants a role to a user for an org. A ShopID of 0 means the role applies to every shop of the org.
+type QBUserRole struct {
+	ID     int
+	UserID int
+	OrgID  int
+	ShopID int
+	Role   QBRole
+}
+
+// QBUserRoleDB is the interface for reading the roles of a user.
+type QBUserRoleDB interface {
+	GetQBUserRoles(userID int) ([]*QBUserRole, error)
+}
+
+// QBUserRoleGrantDB is the interface for granting a role to a user.
+type QBUserRoleGrantDB interface {
+	CreateQBUserRole(r QBUserRole) (*QBUserRole, error)
+}
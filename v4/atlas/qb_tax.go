@@ -0,0 +1,113 @@
+package atlas
+
+import (
+	"fmt"
+	"strings"
+)
+
+// POSTaxRate is a tax rate the POS of an org charges on sales, e.g. GST at 7 percent.
+type POSTaxRate struct {
+	ID       int
+	OrgID    int
+	Name     string
+	Rate     float64
+	IsActive bool
+}
+
+// QBRemoteTaxRate is a TaxRate entity of a Quickbooks company. RateValue is a percentage.
+type QBRemoteTaxRate struct {
+	QBID      string
+	Name      string
+	RateValue float64
+	Active    bool
+}
+
+// QBRemoteTaxCode is a TaxCode entity of a Quickbooks company with the IDs of the tax rates it applies to
+// sales. Non-taxable codes have none.
+type QBRemoteTaxCode struct {
+	QBID            string
+	Name            string
+	Active          bool
+	Taxable         bool
+	SalesTaxRateIDs []string
+}
+
+// QBTaxMapping maps a POS tax rate of an org to the Quickbooks tax code, and the sales tax rate of that code,
+// its sales are posted with. QBTaxRateID is "" for non-taxable codes.
+type QBTaxMapping struct {
+	ID           int
+	OrgID        int
+	POSTaxRateID int
+	QBTaxCodeID  string
+	QBTaxRateID  string
+}
+
+// UnmappedTaxRatesError is returned when an org has active POS tax rates without a Quickbooks tax code, so that
+// its sales cannot be posted to Quickbooks.
+type UnmappedTaxRatesError struct {
+	OrgID int
+	Rates []*POSTaxRate
+}
+
+func (e *UnmappedTaxRatesError) Error() string {
+	names := make([]string, len(e.Rates))
+	for i, r := range e.Rates {
+		names[i] = r.Name
+	}
+	return fmt.Sprintf("org %d has tax rates without a quickbooks tax code: %s", e.OrgID, strings.Join(names, ", "))
+}
+
+// UnmappedPOSTaxRates returns the active rates that have no mapping.
+func UnmappedPOSTaxRates(rates []*POSTaxRate, mappings []*QBTaxMapping) []*POSTaxRate {
+	mapped := map[int]bool{}
+	for _, m := range mappings {
+		mapped[m.POSTaxRateID] = true
+	}
+	var unmapped []*POSTaxRate
+	for _, r := range rates {
+		if r.IsActive && !mapped[r.ID] {
+			unmapped = append(unmapped, r)
+		}
+	}
+	return unmapped
+}
+
+// CheckQBTaxMappings returns an *UnmappedTaxRatesError unless every active POS tax rate of the org is mapped
+// to a Quickbooks tax code. Syncing the sales of an org has to be blocked until it returns nil.
+func CheckQBTaxMappings(db QBTaxMappingDB, orgID int) error {
+	rates, err := db.GetAllPOSTaxRatesForOrg(orgID)
+	if err != nil {
+		return err
+	}
+	mappings, err := db.GetQBTaxMappings(orgID)
+	if err != nil {
+		return err
+	}
+	if unmapped := UnmappedPOSTaxRates(rates, mappings); len(unmapped) > 0 {
+		return &UnmappedTaxRatesError{OrgID: orgID, Rates: unmapped}
+	}
+	return nil
+}
+
+// QBTaxMappingDB is the interface for reading and saving the tax code mappings of an org.
+type QBTaxMappingDB interface {
+	// GetAllPOSTaxRatesForOrg returns the tax rates of the org, inactive ones included.
+	GetAllPOSTaxRatesForOrg(orgID int) ([]*POSTaxRate, error)
+	GetQBTaxMappings(orgID int) ([]*QBTaxMapping, error)
+	// ReplaceQBTaxMappings replaces every mapping of the org in one transaction.
+	ReplaceQBTaxMappings(orgID int, mappings []QBTaxMapping) error
+}
+
+// QBTaxMappingPageDB is the interface for the tax code mapping page.
+type QBTaxMappingPageDB interface {
+	QBTaxMappingDB
+	GetQBOrg(orgID int) (*QBOrg, error)
+}
+
+// POSTaxRateDB is the interface for the tax rate page of an org.
+type POSTaxRateDB interface {
+	// GetAllPOSTaxRatesForOrg returns the tax rates of the org, inactive ones included.
+	GetAllPOSTaxRatesForOrg(orgID int) ([]*POSTaxRate, error)
+	CreatePOSTaxRate(r POSTaxRate) (*POSTaxRate, error)
+	UpdatePOSTaxRate(r POSTaxRate) (*POSTaxRate, error)
+}
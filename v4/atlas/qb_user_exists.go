@@ -0,0 +1,17 @@
+package atlas
+
+// QBUserExistsError is returned when creating a user whose email address, compared case-insensitively, already
+// belongs to another user. Handlers can branch on it to offer signing in instead.
+type QBUserExistsError struct {
+	Email string
+}
+
+func (e *QBUserExistsError) Error() string {
+	return "a user with the email address " + e.Email + " already exists"
+}
+
+// IsQBUserExists reports whether err is a *QBUserExistsError.
+func IsQBUserExists(err error) bool {
+	_, ok := err.(*QBUserExistsError)
+	return ok
+}
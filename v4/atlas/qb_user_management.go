@@ -0,0 +1,13 @@
+package atlas
+
+// QBUserManagementDB is the interface for the user management pages.
+type QBUserManagementDB interface {
+	QBUserRoleDB
+	GetQBUserByID(userID int) (*QBUser, error)
+	GetQBUserByEmail(email string) (*QBUser, error)
+	// SearchQBUsersForOrg returns one page of the users holding a role in the org whose name or email
+	// contains query, together with the total number of matching users.
+	SearchQBUsersForOrg(orgID int, query string, limit, offset int) ([]*QBUser, int, error)
+	UpdateQBUser(u QBUser) (*QBUser, error)
+	DeleteAllAtlasWebSessionsForUser(userID int) error
+}
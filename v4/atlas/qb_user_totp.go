@@ -0,0 +1,36 @@
+package atlas
+
+import "time"
+
+// QBUserTOTP is the TOTP second factor a user has enrolled, with hashes of their unused recovery codes.
+// LastUsedStep is the time step of the last code used, so that a code is not accepted twice.
+type QBUserTOTP struct {
+	UserID             int
+	Secret             string
+	RecoveryCodeHashes []string
+	LastUsedStep       int64
+	DateCreated        time.Time
+}
+
+// QBUserTOTPDB is the interface for TOTP enrolment and verification.
+type QBUserTOTPDB interface {
+	// GetQBUserTOTP returns nil and no error when the user has not enrolled.
+	GetQBUserTOTP(userID int) (*QBUserTOTP, error)
+	SaveQBUserTOTP(t QBUserTOTP) error
+	DeleteQBUserTOTP(userID int) error
+	// IsTOTPRequiredForUser reports whether the user is a superadmin or org admin of an org with
+	// RequireAdminTOTP set.
+	IsTOTPRequiredForUser(userID int) (bool, error)
+}
+
+// QBLoginDB is the interface needed to log users in.
+type QBLoginDB interface {
+	QBUserDB
+	QBUserTOTPDB
+}
+
+// QBOrgTOTPSettingDB is the interface for the page making TOTP mandatory for the admins of an org.
+type QBOrgTOTPSettingDB interface {
+	GetQBOrg(orgID int) (*QBOrg, error)
+	UpdateQBOrg(o QBOrg) (*QBOrg, error)
+}
@@ -0,0 +1,57 @@
+package atlas
+
+import "time"
+
+// QBWebhookEventStatus is where a webhook event is in the queue.
+type QBWebhookEventStatus string
+
+// Webhook event statuses. A pending event is processed once NextAttemptAt has passed; a processing event is
+// leased to a worker until NextAttemptAt, after which it is pending again in case the worker died.
+const (
+	QBWebhookEventPending    QBWebhookEventStatus = "pending"
+	QBWebhookEventProcessing QBWebhookEventStatus = "processing"
+	QBWebhookEventDone       QBWebhookEventStatus = "done"
+	QBWebhookEventDead       QBWebhookEventStatus = "dead"
+)
+
+// QBWebhookEvent is a verified webhook payload of Intuit for an org, kept until it has been processed.
+type QBWebhookEvent struct {
+	ID            int
+	OrgID         int
+	RealmID       string
+	Payload       []byte
+	Status        QBWebhookEventStatus
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	DateCreated   time.Time
+	ProcessedAt   *time.Time
+}
+
+// QBWebhookEventDB is the storage of the webhook event queue. Implementations must make ClaimQBWebhookEvents
+// atomic so that several nodes can share the queue.
+type QBWebhookEventDB interface {
+	CreateQBWebhookEvent(e QBWebhookEvent) (*QBWebhookEvent, error)
+	GetQBWebhookEvent(eventID int) (*QBWebhookEvent, error)
+	// ClaimQBWebhookEvents leases up to limit events that are due at now, the oldest first, by marking them
+	// processing until now+lease, and returns them.
+	ClaimQBWebhookEvents(now time.Time, lease time.Duration, limit int) ([]*QBWebhookEvent, error)
+	UpdateQBWebhookEvent(e QBWebhookEvent) error
+}
+
+// QBWebhookFingerprintDB remembers the entity changes that were queued, by their QBEntityChange.Fingerprint,
+// so that changes Intuit sends again are not processed twice.
+type QBWebhookFingerprintDB interface {
+	// RecordQBWebhookFingerprints records the fingerprints that are not recorded yet and returns them. It has to
+	// insert them only if absent, in one statement, so that of two concurrent calls recording a fingerprint
+	// only one returns it.
+	RecordQBWebhookFingerprints(fingerprints []string, at time.Time) ([]string, error)
+	DeleteQBWebhookFingerprints(fingerprints []string) error
+	DeleteQBWebhookFingerprintsBefore(t time.Time) error
+}
+
+// QBWebhookQueueDB is the interface for the webhook event queue.
+type QBWebhookQueueDB interface {
+	QBWebhookEventDB
+	QBWebhookFingerprintDB
+}